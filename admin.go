@@ -0,0 +1,32 @@
+// admin.go
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// requireAdmin guards operator endpoints with a static bearer token
+// (ADMIN_TOKEN). With no token configured the admin API is disabled.
+func (a *App) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if a.Config.AdminToken == "" {
+			jsonWrite(w, http.StatusForbidden, map[string]string{"error": "Admin API disabled"})
+			return
+		}
+		if !a.isAdminRequest(r) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			jsonWrite(w, http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+			return
+		}
+		next(w, r)
+	}
+}
+
+// isAdminRequest reports whether r bears ADMIN_TOKEN.
+func (a *App) isAdminRequest(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && a.Config.AdminToken != "" &&
+		subtle.ConstantTimeCompare([]byte(token), []byte(a.Config.AdminToken)) == 1
+}
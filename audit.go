@@ -0,0 +1,175 @@
+// audit.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Audited actions, one audit_log row per user written.
+const (
+	auditUserCreated = "user.created"
+	auditUserUpdated = "user.updated"
+	auditUserDeleted = "user.deleted"
+)
+
+var auditEntriesDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "audit_entries_dropped_total",
+	Help: "Audit entries for AUDIT_DB_URL that were never written, by reason.",
+}, []string{"reason"})
+
+// auditEntry is one audit_log row. At is when the API saw the write
+// commit, which with AUDIT_DB_URL precedes the row's own insert.
+type auditEntry struct {
+	Action    string
+	UserID    int32
+	RequestID string
+	At        time.Time
+}
+
+// auditEntries describes action applied to ids by the request in ctx.
+func auditEntries(ctx context.Context, action string, ids ...int32) []auditEntry {
+	at, reqID := time.Now(), requestIDFrom(ctx)
+	entries := make([]auditEntry, len(ids))
+	for i, id := range ids {
+		entries[i] = auditEntry{Action: action, UserID: id, RequestID: reqID, At: at}
+	}
+	return entries
+}
+
+// execer is what insertAudit runs on: the user's transaction, or the
+// audit database.
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// insertAudit writes entries with a single statement, however many.
+func insertAudit(ctx context.Context, q execer, entries []auditEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	actions := make([]string, len(entries))
+	ids := make([]int32, len(entries))
+	reqIDs := make([]string, len(entries))
+	ats := make([]time.Time, len(entries))
+	for i, e := range entries {
+		actions[i], ids[i], reqIDs[i], ats[i] = e.Action, e.UserID, e.RequestID, e.At
+	}
+	_, err := q.ExecContext(ctx, `INSERT INTO audit_log (action, user_id, request_id, occurred_at)
+		SELECT a, u, NULLIF(r, ''), t FROM unnest($1::text[], $2::int[], $3::text[], $4::timestamptz[]) AS e(a, u, r, t)`,
+		actions, ids, reqIDs, ats)
+	if err != nil {
+		return fmt.Errorf("audit: %w", err)
+	}
+	return nil
+}
+
+// Retries of a failed audit insert start at auditBackoffBase and double up
+// to auditBackoffMax; after auditRetries the entries are dropped.
+const (
+	auditBackoffBase = time.Second
+	auditBackoffMax  = 30 * time.Second
+	auditRetries     = 5
+	// auditBuffer is how many writes' entries wait for their insert before
+	// record starts dropping them.
+	auditBuffer = 1000
+)
+
+// auditWriter writes audit entries to the AUDIT_DB_URL database in the
+// background, so audit inserts neither compete with user traffic on the
+// primary nor hold up the request. The price is consistency: a write
+// commits before its entries are stored, and entries dropped when the
+// buffer is full, or whose insert keeps failing, are lost (logged and
+// counted in audit_entries_dropped_total). Without AUDIT_DB_URL pgStore
+// writes them in the write's own transaction instead.
+type auditWriter struct {
+	db      *sql.DB
+	timeout time.Duration // of each insert
+	backoff time.Duration
+	pending chan []auditEntry
+}
+
+func newAuditWriter(db *sql.DB, timeout time.Duration) *auditWriter {
+	return &auditWriter{
+		db:      db,
+		timeout: timeout,
+		backoff: auditBackoffBase,
+		pending: make(chan []auditEntry, auditBuffer),
+	}
+}
+
+// record queues entries for run without waiting.
+func (w *auditWriter) record(entries []auditEntry) {
+	if len(entries) == 0 {
+		return
+	}
+	select {
+	case w.pending <- entries:
+	default:
+		slog.Error("audit: buffer full, dropping entries", "action", entries[0].Action, "entries", len(entries))
+		auditEntriesDropped.WithLabelValues("buffer_full").Add(float64(len(entries)))
+	}
+}
+
+// run writes queued entries until ctx is done, then makes one attempt at
+// each batch still queued, which were recorded before shutdown.
+func (w *auditWriter) run(ctx context.Context) {
+	for {
+		select {
+		case entries := <-w.pending:
+			w.write(ctx, entries)
+		case <-ctx.Done():
+			for {
+				select {
+				case entries := <-w.pending:
+					if err := w.insert(context.WithoutCancel(ctx), entries); err != nil {
+						w.drop(entries, 1, err)
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// write inserts entries, retrying with backoff until the retries run out
+// or shutdown begins.
+func (w *auditWriter) write(ctx context.Context, entries []auditEntry) {
+	wait := w.backoff
+	for attempt := 1; ; attempt++ {
+		err := w.insert(context.WithoutCancel(ctx), entries)
+		if err == nil {
+			return
+		}
+		if attempt > auditRetries {
+			w.drop(entries, attempt, err)
+			return
+		}
+		slog.Warn("audit: insert failed, retrying", "entries", len(entries), "attempt", attempt, "retry_in", wait, "err", err)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			w.drop(entries, attempt, err)
+			return
+		}
+		wait = min(wait*2, auditBackoffMax)
+	}
+}
+
+func (w *auditWriter) insert(ctx context.Context, entries []auditEntry) error {
+	ctx, cancel := context.WithTimeout(ctx, w.timeout)
+	defer cancel()
+	return insertAudit(ctx, w.db, entries)
+}
+
+func (w *auditWriter) drop(entries []auditEntry, attempts int, err error) {
+	slog.Error("audit: giving up", "action", entries[0].Action, "entries", len(entries), "attempts", attempts, "err", err)
+	auditEntriesDropped.WithLabelValues("insert_failed").Add(float64(len(entries)))
+}
@@ -0,0 +1,243 @@
+// audit_test.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// auditConnector's connections record the entries of every audit insert,
+// failing the first fail of them.
+type auditConnector struct {
+	mu      sync.Mutex
+	fail    int
+	tries   int
+	actions []string
+	userIDs []int32
+	reqIDs  []string
+}
+
+func (c *auditConnector) Connect(context.Context) (driver.Conn, error) { return auditConn{c}, nil }
+func (*auditConnector) Driver() driver.Driver                          { return nil }
+
+func (c *auditConnector) recorded() (actions []string, ids []int32, reqIDs []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return slices.Clone(c.actions), slices.Clone(c.userIDs), slices.Clone(c.reqIDs)
+}
+
+type auditConn struct{ c *auditConnector }
+
+func (auditConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("stub: no statements") }
+func (auditConn) Close() error                        { return nil }
+func (auditConn) Begin() (driver.Tx, error)           { return nil, errors.New("stub: no transactions") }
+
+// CheckNamedValue passes insertAudit's slices through as they are.
+func (auditConn) CheckNamedValue(*driver.NamedValue) error { return nil }
+
+func (a auditConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	a.c.mu.Lock()
+	defer a.c.mu.Unlock()
+	if !strings.Contains(query, "INSERT INTO audit_log") {
+		return nil, errors.New("stub: unexpected " + query)
+	}
+	if a.c.tries++; a.c.tries <= a.c.fail {
+		return nil, errors.New("stub: audit database down")
+	}
+	a.c.actions = append(a.c.actions, args[0].Value.([]string)...)
+	a.c.userIDs = append(a.c.userIDs, args[1].Value.([]int32)...)
+	a.c.reqIDs = append(a.c.reqIDs, args[2].Value.([]string)...)
+	return driver.RowsAffected(int64(len(args[0].Value.([]string)))), nil
+}
+
+func TestAuditWriterRecordsAPIWrites(t *testing.T) {
+	c := &auditConnector{}
+	db := sql.OpenDB(c)
+	defer db.Close()
+	ta := newTestApp(t, map[string]string{
+		"ADMIN_TOKEN":           "secret",
+		"AUDIT_LOG":             "true",
+		"AUDIT_DB_URL":          "postgres://audit@localhost/audit",
+		"IMPORT_COPY_THRESHOLD": "1",
+	})
+	ta.Users.audit = newAuditWriter(db, time.Second)
+
+	rec := ta.do(t, http.MethodPost, "/users", `{"username":"ann","email":"ann@example.com"}`, "X-Request-ID", "req-create")
+	wantStatus(t, rec, http.StatusCreated)
+	wantStatus(t, ta.do(t, http.MethodPut, "/users/1", `{"username":"anne","email":"ann@example.com"}`), http.StatusOK)
+	wantStatus(t, ta.do(t, http.MethodPut, "/users/99", `{"username":"nobody","email":"nobody@example.com"}`), http.StatusNotFound)
+	wantStatus(t, ta.do(t, http.MethodDelete, "/users/1", ""), http.StatusOK)
+	// Auditing takes imports off COPY, which can't return the ids.
+	rec = ta.do(t, http.MethodPost, "/users/import", importCSV("bulk", 2), adminAuth...)
+	wantStatus(t, rec, http.StatusCreated)
+	if body := jsonBody(t, rec); body["method"] != "insert" {
+		t.Fatalf("audited import = %v", body)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ta.Users.audit.run(ctx)
+
+	actions, ids, reqIDs := c.recorded()
+	wantActions := []string{auditUserCreated, auditUserUpdated, auditUserDeleted, auditUserCreated, auditUserCreated}
+	if !slices.Equal(actions, wantActions) || !slices.Equal(ids, []int32{1, 1, 1, 2, 3}) {
+		t.Fatalf("audited %v %v, want %v [1 1 1 2 3]", actions, ids, wantActions)
+	}
+	if reqIDs[0] != "req-create" || reqIDs[1] == "" {
+		t.Fatalf("request ids = %q", reqIDs)
+	}
+}
+
+func TestAuditWriterRetries(t *testing.T) {
+	c := &auditConnector{fail: 2}
+	db := sql.OpenDB(c)
+	defer db.Close()
+	w := newAuditWriter(db, time.Second)
+	w.backoff = time.Millisecond
+
+	w.write(context.Background(), auditEntries(context.Background(), auditUserDeleted, 7))
+	if actions, ids, _ := c.recorded(); len(actions) != 1 || ids[0] != 7 || c.tries != 3 {
+		t.Fatalf("after %d tries audited %v %v", c.tries, actions, ids)
+	}
+
+	out := captureDefaultLog(t)
+	c.fail, c.tries = auditRetries+1, 0
+	w.write(context.Background(), auditEntries(context.Background(), auditUserDeleted, 8))
+	if actions, _, _ := c.recorded(); len(actions) != 1 || c.tries != auditRetries+1 {
+		t.Fatalf("after %d tries audited %v", c.tries, actions)
+	}
+	if !strings.Contains(out.String(), "audit: giving up") {
+		t.Fatalf("log = %s", out)
+	}
+}
+
+// A full buffer drops entries rather than holding up the write, and what
+// was buffered is still written at shutdown.
+func TestAuditWriterBufferFull(t *testing.T) {
+	c := &auditConnector{}
+	db := sql.OpenDB(c)
+	defer db.Close()
+	w := newAuditWriter(db, time.Second)
+	out := captureDefaultLog(t)
+
+	for id := range int32(auditBuffer + 1) {
+		w.record(auditEntries(context.Background(), auditUserCreated, id))
+	}
+	if !strings.Contains(out.String(), "audit: buffer full") {
+		t.Fatalf("log = %s", out)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	w.run(ctx)
+	if _, ids, _ := c.recorded(); len(ids) != auditBuffer || ids[auditBuffer-1] != auditBuffer-1 {
+		t.Fatalf("shutdown wrote %d entries", len(ids))
+	}
+}
+
+func TestAuditConfig(t *testing.T) {
+	for name, tt := range map[string]struct {
+		env  map[string]string
+		want string
+	}{
+		"url without audit": {map[string]string{"STORAGE": "memory", "AUDIT_DB_URL": "postgres://localhost/audit"}, "AUDIT_DB_URL"},
+		"bad url":           {map[string]string{"STORAGE": "memory", "AUDIT_LOG": "true", "AUDIT_DB_URL": "postgres://%zz"}, "AUDIT_DB_URL"},
+		"memory store":      {map[string]string{"STORAGE": "memory", "AUDIT_LOG": "true"}, "AUDIT_LOG"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if err := loadConfigErr(t, tt.env); !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("err = %v, want %s", err, tt.want)
+			}
+		})
+	}
+	cfg := testConfig(t, map[string]string{"AUDIT_LOG": "true", "AUDIT_DB_URL": "postgres://localhost/audit"})
+	if !cfg.AuditLog || cfg.AuditDBURL == "" {
+		t.Fatalf("config = %+v", cfg)
+	}
+}
+
+// TestAuditSameTransactionPostgres writes through session-local copies of
+// users and audit_log, which the store's unqualified names resolve to.
+func TestAuditSameTransactionPostgres(t *testing.T) {
+	db := testDB(t)
+	db.SetMaxOpenConns(1)
+	ctx := context.Background()
+	if _, err := db.ExecContext(ctx, `CREATE TEMP TABLE users (LIKE public.users INCLUDING ALL);
+		CREATE TEMP TABLE audit_log (LIKE public.audit_log INCLUDING ALL)`); err != nil {
+		t.Fatal(err)
+	}
+	s := &pgStore{db: db, audit: true}
+
+	id, err := s.CreateUser(ctx, "ann", "ann@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A failed write leaves no audit row behind.
+	if _, err := s.CreateUser(ctx, "ann2", "ANN@example.com"); !errors.Is(err, errDuplicateEmail) {
+		t.Fatalf("duplicate create: %v", err)
+	}
+	name := "anne"
+	if _, _, err := s.UpdateUsers(ctx, []userUpdate{{ID: id, Username: &name}, {ID: id + 100, Username: &name}}, false); err != nil {
+		t.Fatal(err)
+	}
+	ids, err := s.InsertUsers(ctx, []createUserReq{{Username: "bo", Email: "bo@example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteUser(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.CopyUsers(ctx, []createUserReq{{Username: "cy", Email: "cy@example.com"}}); err == nil {
+		t.Fatal("COPY succeeded while auditing")
+	}
+
+	rows, err := db.QueryContext(ctx, "SELECT action, user_id FROM audit_log ORDER BY id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var got []string
+	for rows.Next() {
+		var action string
+		var uid int32
+		if err := rows.Scan(&action, &uid); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, fmt.Sprintf("%s %d", action, uid))
+	}
+	want := []string{
+		fmt.Sprintf("user.created %d", id),
+		fmt.Sprintf("user.updated %d", id),
+		fmt.Sprintf("user.created %d", ids[0]),
+		fmt.Sprintf("user.deleted %d", id),
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("audit_log = %q, want %q", got, want)
+	}
+}
+
+func TestAuditWriterPostgres(t *testing.T) {
+	db := testDB(t)
+	db.SetMaxOpenConns(1)
+	ctx := context.Background()
+	if _, err := db.ExecContext(ctx, "CREATE TEMP TABLE audit_log (LIKE public.audit_log INCLUDING ALL)"); err != nil {
+		t.Fatal(err)
+	}
+	w := newAuditWriter(db, 5*time.Second)
+	w.write(ctx, auditEntries(ctx, auditUserCreated, 4, 5))
+
+	var n int
+	var reqID sql.NullString
+	if err := db.QueryRowContext(ctx, "SELECT count(*), max(request_id) FROM audit_log WHERE action = 'user.created'").Scan(&n, &reqID); err != nil || n != 2 || reqID.Valid {
+		t.Fatalf("audit_log = %d rows, request id %v, %v", n, reqID, err)
+	}
+}
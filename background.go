@@ -0,0 +1,27 @@
+// background.go
+package main
+
+import "context"
+
+// backgroundSlots caps how many background tasks (pool health checks,
+// webhook deliveries, ...) run at once, so together they can't crowd out
+// request traffic (MAX_BACKGROUND_CONCURRENCY). Foreground requests never
+// take a slot.
+type backgroundSlots chan struct{}
+
+func newBackgroundSlots(n int) backgroundSlots {
+	return make(backgroundSlots, n)
+}
+
+// acquire waits for a free slot; it fails only when ctx ends first, e.g. on
+// shutdown.
+func (s backgroundSlots) acquire(ctx context.Context) error {
+	select {
+	case s <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s backgroundSlots) release() { <-s }
@@ -0,0 +1,62 @@
+// background_test.go
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBackgroundSlotsAcquire(t *testing.T) {
+	s := newBackgroundSlots(1)
+	if err := s.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := s.acquire(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("acquire on a full set = %v", err)
+	}
+	s.release()
+	if err := s.acquire(context.Background()); err != nil {
+		t.Fatalf("acquire after release: %v", err)
+	}
+}
+
+func TestBackgroundTasksQueueBehindLimit(t *testing.T) {
+	var received atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) { received.Add(1) }))
+	defer srv.Close()
+
+	ta, n := webhookApp(t, srv.URL, 0)
+	slots := newBackgroundSlots(1)
+	n.slots = slots
+	// Another background task holds the only slot.
+	if err := slots.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Foreground requests don't wait for it.
+	start := time.Now()
+	ta.createUser(t, "ann", "ann@example.com")
+	wantStatus(t, ta.do(t, http.MethodGet, "/users/1", ""), http.StatusOK)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("requests took %v behind a busy background slot", elapsed)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if pending, _ := n.queue(); pending != 1 || n.posting.Load() != 0 || received.Load() != 0 {
+		t.Fatalf("pending %d, posting %d, received %d; want the delivery queued", pending, n.posting.Load(), received.Load())
+	}
+
+	slots.release()
+	if err := n.wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if received.Load() != 1 {
+		t.Fatal("queued delivery not sent once the slot freed")
+	}
+}
@@ -0,0 +1,104 @@
+// batchupdate.go
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+type updateUserReq struct {
+	UserID   int32   `json:"user_id"`
+	Username *string `json:"username"`
+	Email    *string `json:"email"`
+}
+
+// updateUsers handles PATCH /users: a JSON array of partial updates applied
+// in one transaction. BATCH_UPDATE_POLICY decides whether an item error
+// rolls back the whole batch or only that item.
+func (a *App) updateUsers(w http.ResponseWriter, r *http.Request) {
+	var reqs []updateUserReq
+	if err := a.decodeBatchBody(r, &reqs); err != nil {
+		writeDecodeError(w, err, "invalid JSON, expected an array of updates")
+		return
+	}
+	if len(reqs) == 0 {
+		jsonWrite(w, http.StatusBadRequest, map[string]string{"error": "at least one update is required"})
+		return
+	}
+	if len(reqs) > a.Config.MaxBatchSize {
+		jsonWrite(w, http.StatusBadRequest, map[string]string{
+			"error": fmt.Sprintf("at most %d updates per request", a.Config.MaxBatchSize),
+		})
+		return
+	}
+
+	items := make([]userUpdate, len(reqs))
+	for i, req := range reqs {
+		if req.UserID < 1 {
+			jsonWrite(w, http.StatusBadRequest, map[string]any{
+				"error": "user_id must be a positive integer",
+				"index": i,
+			})
+			return
+		}
+		if req.Username == nil && req.Email == nil {
+			jsonWrite(w, http.StatusBadRequest, map[string]any{
+				"error": "at least one of username or email is required",
+				"index": i,
+			})
+			return
+		}
+		items[i] = userUpdate{ID: req.UserID, Username: req.Username, Email: req.Email}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), a.Config.QueryTimeout)
+	defer cancel()
+
+	results, committed, err := a.Users.UpdateBatch(ctx, items)
+	if bve := (*batchValidationError)(nil); errors.As(err, &bve) {
+		jsonWrite(w, http.StatusBadRequest, map[string]any{
+			"error":  "Validation failed",
+			"index":  bve.index,
+			"fields": bve.fields,
+		})
+		return
+	}
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	for i := range results {
+		if results[i].err != nil {
+			results[i].Error = updateErrorMessage(results[i].err)
+		}
+	}
+
+	status := http.StatusOK
+	if !committed {
+		status = http.StatusConflict
+	}
+	jsonWrite(w, status, map[string]any{
+		"results":   results,
+		"committed": committed,
+	})
+}
+
+func updateErrorMessage(err error) string {
+	var cv *checkViolationError
+	switch {
+	case errors.Is(err, errDuplicateEmail):
+		return "Email already exists"
+	case errors.Is(err, errDuplicateUsername):
+		return "Username already exists"
+	case errors.Is(err, errValueTooLong):
+		return "username or email is too long"
+	case errors.As(err, &cv):
+		if code, ok := constraintCodes[cv.Constraint]; ok {
+			return code
+		}
+		return "CONSTRAINT_VIOLATION"
+	}
+	return err.Error()
+}
@@ -0,0 +1,67 @@
+// batchupdate_test.go
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"testing"
+)
+
+func TestUpdateUsersPolicies(t *testing.T) {
+	tests := []struct {
+		policy    string
+		status    int
+		committed bool
+		results   []string
+		username  string
+	}{
+		{"all_or_nothing", http.StatusConflict, false, []string{updateRolledBack, updateNotFound, updateError}, "ann"},
+		{"best_effort", http.StatusOK, true, []string{updateUpdated, updateNotFound, updateError}, "ann2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			ta := newTestApp(t, map[string]string{"BATCH_UPDATE_POLICY": tt.policy})
+			ann := ta.createUser(t, "ann", "ann@example.com")
+			bob := ta.createUser(t, "bob", "bob@example.com")
+
+			rec := ta.do(t, http.MethodPatch, "/users", fmt.Sprintf(
+				`[{"user_id":%d,"username":"ann2"},{"user_id":999,"username":"x"},{"user_id":%d,"email":"ann@example.com"}]`, ann, bob))
+			wantStatus(t, rec, tt.status)
+			body := jsonBody(t, rec)
+			if body["committed"] != tt.committed {
+				t.Errorf("committed = %v", body["committed"])
+			}
+			var got []string
+			for _, r := range body["results"].([]any) {
+				got = append(got, r.(map[string]any)["status"].(string))
+			}
+			if !slices.Equal(got, tt.results) {
+				t.Errorf("results = %v, want %v", got, tt.results)
+			}
+			if msg := body["results"].([]any)[2].(map[string]any)["error"]; msg != "Email already exists" {
+				t.Errorf("error = %v", msg)
+			}
+
+			user := jsonBody(t, ta.do(t, http.MethodGet, fmt.Sprintf("/users/%d", ann), ""))
+			if user["username"] != tt.username {
+				t.Errorf("username after batch = %v, want %s", user["username"], tt.username)
+			}
+		})
+	}
+}
+
+func TestUpdateUsersRejectsBadBatch(t *testing.T) {
+	ta := newTestApp(t, map[string]string{"MAX_BATCH_SIZE": "1"})
+	for name, body := range map[string]string{
+		"empty":     `[]`,
+		"too many":  `[{"user_id":1,"username":"a"},{"user_id":2,"username":"b"}]`,
+		"bad id":    `[{"user_id":0,"username":"a"}]`,
+		"no fields": `[{"user_id":1}]`,
+		"invalid":   `[{"user_id":1,"email":"nope"}]`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			wantStatus(t, ta.do(t, http.MethodPatch, "/users", body), http.StatusBadRequest)
+		})
+	}
+}
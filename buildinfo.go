@@ -0,0 +1,50 @@
+// buildinfo.go
+package main
+
+import "runtime/debug"
+
+// Set at build time, e.g.
+//
+//	go build -ldflags "-X main.buildVersion=v1.4.0 -X main.buildCommit=$(git rev-parse HEAD)"
+//
+// When unset, buildInfo falls back to what the toolchain recorded.
+var (
+	buildVersion string
+	buildCommit  string
+)
+
+// buildInfo reports the version and commit of this binary. Without ldflags
+// the commit is the vcs.revision go build stamps when run in a git
+// checkout, marked "-dirty" for uncommitted changes.
+func buildInfo() (version, commit string) {
+	version, commit = buildVersion, buildCommit
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return or(version, "unknown"), or(commit, "unknown")
+	}
+	if version == "" {
+		version = info.Main.Version
+	}
+	if commit == "" {
+		var dirty bool
+		for _, s := range info.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				commit = s.Value
+			case "vcs.modified":
+				dirty = s.Value == "true"
+			}
+		}
+		if commit != "" && dirty {
+			commit += "-dirty"
+		}
+	}
+	return or(version, "unknown"), or(commit, "unknown")
+}
+
+func or(s, fallback string) string {
+	if s == "" {
+		return fallback
+	}
+	return s
+}
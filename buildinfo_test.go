@@ -0,0 +1,29 @@
+// buildinfo_test.go
+package main
+
+import "testing"
+
+func TestBuildInfo(t *testing.T) {
+	prevVersion, prevCommit := buildVersion, buildCommit
+	t.Cleanup(func() { buildVersion, buildCommit = prevVersion, prevCommit })
+
+	buildVersion, buildCommit = "v1.4.0", "5e1f2a9"
+	if version, commit := buildInfo(); version != "v1.4.0" || commit != "5e1f2a9" {
+		t.Fatalf("ldflags: got %q, %q", version, commit)
+	}
+
+	// Test binaries carry no VCS stamp, so the fallback is never empty.
+	buildVersion, buildCommit = "", ""
+	if version, commit := buildInfo(); version == "" || commit == "" {
+		t.Fatalf("fallback: got %q, %q", version, commit)
+	}
+}
+
+func TestOr(t *testing.T) {
+	if got := or("", "unknown"); got != "unknown" {
+		t.Errorf("or(\"\") = %q", got)
+	}
+	if got := or("v1", "unknown"); got != "v1" {
+		t.Errorf("or(\"v1\") = %q", got)
+	}
+}
@@ -0,0 +1,35 @@
+// cachecontrol.go
+package main
+
+import "net/http"
+
+// defaultCacheControl is the Cache-Control policy by route; CACHE_CONTROL
+// overrides entries. "default" covers every response without its own
+// entry, errors included, so no intermediary keeps mutable data around.
+// A single user may be kept privately but must be revalidated, which its
+// ETag makes cheap.
+var defaultCacheControl = map[string]string{
+	"default":    "no-store",
+	"get_user":   "private, no-cache",
+	"list_users": "no-store",
+}
+
+// cacheControl sets the default policy before the handler runs; handlers
+// with an entry of their own replace it on success (setCacheControl).
+func cacheControl(policy map[string]string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if v := policy["default"]; v != "" {
+			w.Header().Set("Cache-Control", v)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// setCacheControl applies route's policy; an empty one sends no header.
+func (a *App) setCacheControl(w http.ResponseWriter, route string) {
+	if v := a.Config.CacheControl[route]; v != "" {
+		w.Header().Set("Cache-Control", v)
+	} else {
+		w.Header().Del("Cache-Control")
+	}
+}
@@ -0,0 +1,64 @@
+// cachecontrol_test.go
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCacheControlPerRoute(t *testing.T) {
+	ta := newTestApp(t, map[string]string{"USER_ETAGS": "true"})
+	ta.createUser(t, "ann", "ann@example.com")
+	tests := []struct {
+		name, method, target, body string
+		want                       string
+	}{
+		{"get user", http.MethodGet, "/users/1", "", "private, no-cache"},
+		{"head user", http.MethodHead, "/users/1", "", "private, no-cache"},
+		{"lookup", http.MethodGet, "/users/lookup?id=1", "", "private, no-cache"},
+		{"list", http.MethodGet, "/users", "", "no-store"},
+		{"missing user", http.MethodGet, "/users/999", "", "no-store"},
+		{"create", http.MethodPost, "/users", `{"username":"bob","email":"bob@example.com"}`, "no-store"},
+		{"by emails", http.MethodPost, "/users/by-emails", `["ann@example.com"]`, "no-store"},
+		{"health", http.MethodGet, "/healthz", "", "no-store"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ta.do(t, tt.method, tt.target, tt.body).Header().Get("Cache-Control"); got != tt.want {
+				t.Fatalf("Cache-Control = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCacheControlOverrides(t *testing.T) {
+	ta := newTestApp(t, map[string]string{"CACHE_CONTROL": "get_user=private, max-age=30; default=no-cache;list_users="})
+	ta.createUser(t, "ann", "ann@example.com")
+	if got := ta.do(t, http.MethodGet, "/users/1", "").Header().Get("Cache-Control"); got != "private, max-age=30" {
+		t.Errorf("get user: %q", got)
+	}
+	if got := ta.do(t, http.MethodGet, "/users/999", "").Header().Get("Cache-Control"); got != "no-cache" {
+		t.Errorf("missing user: %q", got)
+	}
+	// An empty value sends no header, even over the default.
+	if h := ta.do(t, http.MethodGet, "/users", "").Header(); h.Get("Cache-Control") != "" || len(h.Values("Cache-Control")) != 0 {
+		t.Errorf("list: %q", h.Values("Cache-Control"))
+	}
+}
+
+func TestCacheControlConfig(t *testing.T) {
+	cfg := testConfig(t, map[string]string{"CACHE_CONTROL": " get_user = private, max-age=30 ;;"})
+	if cfg.CacheControl["get_user"] != "private, max-age=30" || cfg.CacheControl["default"] != "no-store" {
+		t.Fatalf("policy = %v", cfg.CacheControl)
+	}
+	if defaultCacheControl["get_user"] != "private, no-cache" {
+		t.Fatal("override changed the defaults")
+	}
+	for _, v := range []string{"users=no-store", "get_user"} {
+		err := loadConfigErr(t, map[string]string{"CACHE_CONTROL": v})
+		if err == nil || !strings.Contains(err.Error(), "CACHE_CONTROL") {
+			t.Errorf("%q: err = %v", v, err)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+// capture.go
+package main
+
+import (
+	"bytes"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/netip"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// captureRedactedHeaders never leave the process in a capture.
+var captureRedactedHeaders = []string{"Authorization", "Cookie", "Proxy-Authorization", "X-Api-Key"}
+
+var emailRe = regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+`)
+
+type capturedRequest struct {
+	Time      time.Time         `json:"time"`
+	RequestID string            `json:"request_id"`
+	ClientIP  string            `json:"client_ip,omitempty"`
+	Method    string            `json:"method"`
+	Path      string            `json:"path"`
+	Query     string            `json:"query,omitempty"`
+	Headers   map[string]string `json:"headers"`
+	Body      string            `json:"body,omitempty"`
+	Truncated bool              `json:"truncated,omitempty"`
+}
+
+// captureRing keeps the most recent sampled requests (CAPTURE_SAMPLE_RATE)
+// for GET /admin/captures.
+type captureRing struct {
+	mu      sync.Mutex
+	entries []capturedRequest
+	next    int
+	full    bool
+}
+
+func newCaptureRing(size int) *captureRing {
+	return &captureRing{entries: make([]capturedRequest, size)}
+}
+
+func (c *captureRing) add(e capturedRequest) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[c.next] = e
+	c.next = (c.next + 1) % len(c.entries)
+	c.full = c.full || c.next == 0
+}
+
+// snapshot returns the captures oldest first.
+func (c *captureRing) snapshot() []capturedRequest {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.full {
+		return append([]capturedRequest(nil), c.entries[:c.next]...)
+	}
+	return append(append([]capturedRequest(nil), c.entries[c.next:]...), c.entries[:c.next]...)
+}
+
+// captureRequests records a rate fraction of requests, with bodies cut at
+// maxBytes and emails and credentials redacted, then passes them on intact.
+func captureRequests(ring *captureRing, rate float64, maxBytes int, clientIP func(*http.Request) (netip.Addr, bool), next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if opsPaths[r.URL.Path] || strings.HasPrefix(r.URL.Path, "/admin/") || rand.Float64() >= rate {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		e := capturedRequest{
+			Time:      time.Now().UTC(),
+			RequestID: requestIDFrom(r.Context()),
+			Method:    r.Method,
+			Path:      r.URL.Path,
+			Query:     emailRe.ReplaceAllString(r.URL.RawQuery, "[redacted]"),
+			Headers:   make(map[string]string, len(r.Header)),
+		}
+		if ip, ok := clientIP(r); ok {
+			e.ClientIP = ip.String()
+		}
+		for k := range r.Header {
+			e.Headers[k] = r.Header.Get(k)
+		}
+		for _, k := range captureRedactedHeaders {
+			if _, ok := e.Headers[k]; ok {
+				e.Headers[k] = "[redacted]"
+			}
+		}
+
+		if r.Body != nil {
+			buf, err := io.ReadAll(io.LimitReader(r.Body, int64(maxBytes)+1))
+			// Hand the handler the full body: what was read, then the rest.
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(buf), r.Body), r.Body}
+			if err == nil {
+				if len(buf) > maxBytes {
+					buf, e.Truncated = buf[:maxBytes], true
+				}
+				e.Body = emailRe.ReplaceAllString(string(buf), "[redacted]")
+			}
+		}
+
+		ring.add(e)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (a *App) listCaptures(w http.ResponseWriter, r *http.Request) {
+	if a.Captures == nil {
+		jsonWrite(w, http.StatusOK, map[string]any{"captures": []capturedRequest{}, "enabled": false})
+		return
+	}
+	jsonWrite(w, http.StatusOK, map[string]any{"captures": a.Captures.snapshot(), "enabled": true})
+}
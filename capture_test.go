@@ -0,0 +1,63 @@
+// capture_test.go
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCapturedRequestIsRedacted(t *testing.T) {
+	ta := newTestApp(t, map[string]string{"CAPTURE_SAMPLE_RATE": "1", "ADMIN_TOKEN": "secret"})
+	ta.do(t, http.MethodPost, "/users", `{"username":"ann","email":"ann@example.com"}`,
+		"Cookie", "session=abc", "X-Request-ID", "req-1")
+	ta.do(t, http.MethodGet, "/users/lookup?email=bob@example.com", "")
+
+	rec := ta.do(t, http.MethodGet, "/admin/captures", "", adminAuth...)
+	wantStatus(t, rec, http.StatusOK)
+	var body struct {
+		Captures []capturedRequest `json:"captures"`
+		Enabled  bool              `json:"enabled"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	// Admin requests, including this one, are never captured.
+	if !body.Enabled || len(body.Captures) != 2 {
+		t.Fatalf("captures = %+v", body)
+	}
+	c := body.Captures[0]
+	if c.Method != http.MethodPost || c.Path != "/users" || c.RequestID != "req-1" {
+		t.Fatalf("capture = %+v", c)
+	}
+	if c.Body != `{"username":"ann","email":"[redacted]"}` || c.Headers["Cookie"] != "[redacted]" {
+		t.Fatalf("not redacted: body %s, headers %v", c.Body, c.Headers)
+	}
+	if q := body.Captures[1].Query; q != "email=[redacted]" {
+		t.Fatalf("query = %q", q)
+	}
+	if strings.Contains(rec.Body.String(), "example.com") || strings.Contains(rec.Body.String(), "secret") {
+		t.Fatalf("PII or credentials in %s", rec.Body)
+	}
+}
+
+func TestCaptureKeepsBodyForHandler(t *testing.T) {
+	ta := newTestApp(t, map[string]string{"CAPTURE_SAMPLE_RATE": "1", "CAPTURE_MAX_BODY_BYTES": "10"})
+	ta.createUser(t, "ann", "ann@example.com")
+	c := ta.Captures.snapshot()
+	if len(c) != 1 || !c[0].Truncated || len(c[0].Body) != 10 {
+		t.Fatalf("capture = %+v", c)
+	}
+}
+
+func TestCaptureRingKeepsNewest(t *testing.T) {
+	ring := newCaptureRing(2)
+	for _, id := range []string{"a", "b", "c"} {
+		ring.add(capturedRequest{RequestID: id})
+	}
+	got := ring.snapshot()
+	if len(got) != 2 || got[0].RequestID != "b" || got[1].RequestID != "c" {
+		t.Fatalf("snapshot = %+v", got)
+	}
+}
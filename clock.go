@@ -0,0 +1,45 @@
+// clock.go
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// handleTime serves GET /time (ENABLE_TIME_ENDPOINT): the clocks of this
+// server and of the database, to spot skew between their hosts before it
+// shows up as early-expiring tokens or idempotency keys. The database is
+// read with clock_timestamp(), as now() is the transaction's start; the
+// server time is taken halfway through the round trip, so delta_ms is off
+// by at most rtt_ms/2.
+func (a *App) handleTime(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+	if a.DB == nil {
+		jsonWrite(w, http.StatusOK, map[string]any{"server_time": time.Now().UTC(), "db_time": nil})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), a.Config.QueryTimeout)
+	defer cancel()
+
+	var dbTime time.Time
+	start := time.Now()
+	if err := a.DB.QueryRowContext(ctx, "SELECT clock_timestamp()").Scan(&dbTime); err != nil {
+		writeDBError(w, err)
+		return
+	}
+	rtt := time.Since(start)
+	serverTime := start.Add(rtt / 2)
+
+	ms := func(d time.Duration) float64 { return float64(d.Microseconds()) / 1000 }
+	jsonWrite(w, http.StatusOK, map[string]any{
+		"server_time": serverTime.UTC(),
+		"db_time":     dbTime.UTC(),
+		"delta_ms":    ms(dbTime.Sub(serverTime)),
+		"rtt_ms":      ms(rtt),
+	})
+}
@@ -0,0 +1,81 @@
+// clock_test.go
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"math"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// clockRows answers SELECT clock_timestamp() with at.
+type clockRows struct {
+	at   time.Time
+	done bool
+}
+
+func (*clockRows) Columns() []string { return []string{"clock_timestamp"} }
+func (*clockRows) Close() error      { return nil }
+
+func (r *clockRows) Next(dest []driver.Value) error {
+	if r.done {
+		return io.EOF
+	}
+	dest[0], r.done = r.at, true
+	return nil
+}
+
+func TestTimeEndpoint(t *testing.T) {
+	wantStatus(t, newTestApp(t, nil).do(t, http.MethodGet, "/time", ""), http.StatusNotFound)
+
+	ta := newTestApp(t, map[string]string{"ENABLE_TIME_ENDPOINT": "true"})
+	rec := ta.do(t, http.MethodGet, "/time", "")
+	wantStatus(t, rec, http.StatusOK)
+	body := jsonBody(t, rec)
+	if _, ok := body["db_time"]; !ok || body["db_time"] != nil || body["server_time"] == nil {
+		t.Fatalf("memory store body = %v", body)
+	}
+	wantStatus(t, ta.do(t, http.MethodPost, "/time", ""), http.StatusMethodNotAllowed)
+
+	// A database an hour ahead shows as a delta of about +3600s.
+	ahead := time.Now().Add(time.Hour)
+	ta.DB = sql.OpenDB(rowsConnector{func() driver.Rows { return &clockRows{at: ahead} }})
+	defer ta.DB.Close()
+	rec = ta.do(t, http.MethodGet, "/time", "")
+	wantStatus(t, rec, http.StatusOK)
+	body = jsonBody(t, rec)
+	delta, _ := body["delta_ms"].(float64)
+	if math.Abs(delta-3_600_000) > 1000 {
+		t.Fatalf("delta_ms = %v, want about 3600000", body["delta_ms"])
+	}
+	if got, err := time.Parse(time.RFC3339Nano, body["db_time"].(string)); err != nil || !got.Equal(ahead) {
+		t.Fatalf("db_time = %v, want %v", body["db_time"], ahead.UTC())
+	}
+	if rtt, ok := body["rtt_ms"].(float64); !ok || rtt < 0 {
+		t.Fatalf("rtt_ms = %v", body["rtt_ms"])
+	}
+
+	ta.DB = sql.OpenDB(textConnector{})
+	wantStatus(t, ta.do(t, http.MethodGet, "/time", ""), http.StatusInternalServerError)
+}
+
+func TestTimeEndpointPostgres(t *testing.T) {
+	db := testDB(t)
+	ta := newTestApp(t, map[string]string{"ENABLE_TIME_ENDPOINT": "true"})
+	ta.DB = db
+	rec := ta.do(t, http.MethodGet, "/time", "")
+	wantStatus(t, rec, http.StatusOK)
+	body := jsonBody(t, rec)
+	for _, k := range []string{"server_time", "db_time", "delta_ms", "rtt_ms"} {
+		if body[k] == nil {
+			t.Fatalf("%s missing from %v", k, body)
+		}
+	}
+	// A test database has no real skew from the test host.
+	if delta := body["delta_ms"].(float64); math.Abs(delta) > 1000 {
+		t.Fatalf("delta_ms = %v against a local database", delta)
+	}
+}
@@ -0,0 +1,135 @@
+// compress.go
+package main
+
+import (
+	"compress/gzip"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// streamingTypes are delivered as they are written; buffering them in a
+// compressor would defeat Flush.
+var streamingTypes = map[string]bool{
+	"text/event-stream":    true,
+	"application/x-ndjson": true,
+}
+
+// gzipWriter compresses a response once it has seen minBytes of it, so
+// small bodies go out as-is. A streaming content type, or a Flush before the
+// decision, keeps the response uncompressed for good.
+type gzipWriter struct {
+	http.ResponseWriter
+	minBytes int
+
+	status  int
+	buf     []byte
+	decided bool
+	gz      *gzip.Writer
+}
+
+func (g *gzipWriter) WriteHeader(status int) {
+	if g.status == 0 {
+		g.status = status
+	}
+}
+
+func (g *gzipWriter) Write(b []byte) (int, error) {
+	if g.status == 0 {
+		g.status = http.StatusOK
+	}
+	if !g.decided {
+		g.buf = append(g.buf, b...)
+		if len(g.buf) < g.minBytes && !g.streaming() {
+			return len(b), nil
+		}
+		if err := g.decide(!g.streaming()); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	if g.gz != nil {
+		return g.gz.Write(b)
+	}
+	return g.ResponseWriter.Write(b)
+}
+
+func (g *gzipWriter) streaming() bool {
+	mt, _, _ := mime.ParseMediaType(g.Header().Get("Content-Type"))
+	return streamingTypes[mt]
+}
+
+// decide sends the header, compressed or not, and any buffered body.
+func (g *gzipWriter) decide(compress bool) error {
+	g.decided = true
+	h := g.Header()
+	if compress && h.Get("Content-Encoding") == "" && g.status != http.StatusNoContent && g.status != http.StatusNotModified {
+		h.Set("Content-Encoding", "gzip")
+		h.Del("Content-Length")
+		g.gz = gzip.NewWriter(g.ResponseWriter)
+	}
+	if g.status != 0 {
+		g.ResponseWriter.WriteHeader(g.status)
+	}
+	if len(g.buf) == 0 {
+		return nil
+	}
+	var err error
+	if g.gz != nil {
+		_, err = g.gz.Write(g.buf)
+	} else {
+		_, err = g.ResponseWriter.Write(g.buf)
+	}
+	g.buf = nil
+	return err
+}
+
+func (g *gzipWriter) Flush() {
+	if !g.decided {
+		// Flushing mid-response means the client wants bytes now.
+		_ = g.decide(false)
+	}
+	if g.gz != nil {
+		_ = g.gz.Flush()
+	}
+	if f, ok := g.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// finish sends a short, still-buffered response and ends the gzip stream.
+func (g *gzipWriter) finish() {
+	if !g.decided {
+		_ = g.decide(false)
+	}
+	if g.gz != nil {
+		_ = g.gz.Close()
+	}
+}
+
+func (g *gzipWriter) Unwrap() http.ResponseWriter { return g.ResponseWriter }
+
+// compressResponses gzips responses for clients sending Accept-Encoding:
+// gzip (COMPRESS_RESPONSES).
+func compressResponses(minBytes int, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if r.Method == http.MethodHead || !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		gw := &gzipWriter{ResponseWriter: w, minBytes: minBytes}
+		defer gw.finish()
+		next.ServeHTTP(gw, r)
+	})
+}
+
+func acceptsGzip(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if strings.EqualFold(strings.TrimSpace(coding), "gzip") {
+			return strings.ReplaceAll(params, " ", "") != "q=0"
+		}
+	}
+	return false
+}
@@ -0,0 +1,112 @@
+// compress_test.go
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompressResponses(t *testing.T) {
+	ta := newTestApp(t, map[string]string{"COMPRESS_RESPONSES": "true", "COMPRESS_MIN_BYTES": "200"})
+	createUsers(t, ta, 10)
+
+	rec := ta.do(t, http.MethodGet, "/users", "", "Accept-Encoding", "gzip")
+	wantStatus(t, rec, http.StatusOK)
+	if rec.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("large list not compressed: %v", rec.Header())
+	}
+	zr, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body struct{ Users []any }
+	if err := json.NewDecoder(zr).Decode(&body); err != nil || len(body.Users) != 10 {
+		t.Fatalf("decoded %d users: %v", len(body.Users), err)
+	}
+
+	// Small bodies, and clients not asking for gzip, get plain JSON.
+	for _, rec := range []*httptest.ResponseRecorder{
+		ta.do(t, http.MethodGet, "/users/1", "", "Accept-Encoding", "gzip"),
+		ta.do(t, http.MethodGet, "/users", ""),
+		ta.do(t, http.MethodGet, "/users", "", "Accept-Encoding", "gzip;q=0"),
+	} {
+		if rec.Header().Get("Content-Encoding") != "" || !json.Valid(rec.Body.Bytes()) {
+			t.Fatalf("compressed: %v", rec.Header())
+		}
+	}
+}
+
+func TestSSENotCompressed(t *testing.T) {
+	ta := newTestApp(t, map[string]string{"COMPRESS_RESPONSES": "true", "COMPRESS_MIN_BYTES": "0"})
+	srv := httptest.NewServer(ta.handler)
+	defer srv.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/events", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ce := resp.Header.Get("Content-Encoding"); ce != "" || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("stream headers = %v", resp.Header)
+	}
+
+	waitFor(t, "subscriber", func() bool {
+		ta.Events.mu.Lock()
+		defer ta.Events.mu.Unlock()
+		return len(ta.Events.subs) == 1
+	})
+	ta.createUser(t, "ann", "ann@example.com")
+
+	line := make(chan string, 1)
+	go func() {
+		s, _ := bufio.NewReader(resp.Body).ReadString('\n')
+		line <- s
+	}()
+	select {
+	case s := <-line:
+		if !strings.HasPrefix(s, "data: {") {
+			t.Fatalf("first line = %q", s)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("event not flushed")
+	}
+}
+
+func TestFlushDisablesCompression(t *testing.T) {
+	h := compressResponses(1024, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "partial")
+		w.(http.Flusher).Flush()
+		io.WriteString(w, strings.Repeat(" rest", 100))
+	}))
+	rec := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	h.ServeHTTP(rec, r)
+	if rec.Header().Get("Content-Encoding") != "" || !strings.HasPrefix(rec.Body.String(), "partial rest") {
+		t.Fatalf("flushed response = %v %q", rec.Header(), rec.Body.String()[:20])
+	}
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	for header, want := range map[string]bool{
+		"gzip":              true,
+		"br, GZIP;q=0.5":    true,
+		"gzip; q=0":         false,
+		"deflate, identity": false,
+		"":                  false,
+	} {
+		if got := acceptsGzip(header); got != want {
+			t.Errorf("acceptsGzip(%q) = %v", header, got)
+		}
+	}
+}
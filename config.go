@@ -0,0 +1,879 @@
+// config.go
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+type Config struct {
+	DBHost     string
+	DBUser     string
+	DBPassword string
+	DBName     string
+	DBPort     string
+	DBParams   url.Values
+	Port       string
+	AdminPort  string
+	AdminBind  string
+	Storage    string
+
+	// RunMigrations applies the embedded migrations before serving.
+	RunMigrations    bool
+	MigrationTimeout time.Duration
+	// SeedUsername and SeedEmail (SEED_USER=username:email) are inserted at
+	// startup while the users table is empty.
+	SeedUsername string
+	SeedEmail    string
+
+	Debug      bool
+	AdminToken string
+	// AccessLog writes one summary line per request, including fields
+	// handlers attach with withField.
+	AccessLog bool
+	// RouteTimingMetrics exports per-route histograms of database and
+	// other request time.
+	RouteTimingMetrics bool
+	// MetricsExemplars attaches the trace id of sampled requests to the
+	// route timing histograms.
+	MetricsExemplars bool
+	// LogBuildInfo adds the binary's version and commit to every log line.
+	LogBuildInfo bool
+	// LogFile, when set, receives a copy of the log output, rotated at
+	// LogFileMaxBytes or LogFileMaxAge, keeping LogFileMaxBackups old files.
+	LogFile           string
+	LogFileMaxBytes   int64
+	LogFileMaxAge     time.Duration
+	LogFileMaxBackups int
+
+	// Pool settings; a zero duration means no limit, as in database/sql.
+	DBMaxOpenConns    int
+	DBMaxIdleConns    int
+	DBConnMaxLifetime time.Duration
+	DBConnMaxIdleTime time.Duration
+	// DBIsolation is the isolation level of the store's write transactions.
+	DBIsolation sql.IsolationLevel
+
+	// DBPingTimeout bounds each startup ping; failed pings are retried
+	// DBConnectMaxRetries times, waiting DBConnectBackoff (doubling) between.
+	DBPingTimeout       time.Duration
+	DBConnectMaxRetries int
+	DBConnectBackoff    time.Duration
+
+	// PingBenchMax caps n for /admin/db/ping-bench; a run stops after
+	// PingBenchTimeout in total.
+	PingBenchMax     int
+	PingBenchTimeout time.Duration
+	// DomainsMaxLimit caps limit for /users/domains.
+	DomainsMaxLimit int
+
+	DBAcquireTimeout time.Duration
+	QueryTimeout     time.Duration
+	PartialResults   bool
+	CoalesceReads    bool
+	// DBReadRetry runs a read once more when its connection is lost.
+	DBReadRetry      bool
+	StartupGrace     time.Duration
+	SQLCommentReqID  bool
+	PrepareWarmup    bool
+	LogQueries       bool
+	LogQueriesRedact []string
+
+	PoolHealthInterval time.Duration
+	PoolHealthFailures int
+	ShutdownTimeout    time.Duration
+	// ShutdownStepTimeout bounds each post-drain shutdown step.
+	ShutdownStepTimeout time.Duration
+	// MaxBackgroundConcurrency bounds concurrently running background tasks.
+	MaxBackgroundConcurrency int
+	// ReadinessHistorySize is how many readiness flips are kept.
+	ReadinessHistorySize int
+
+	// LoadShedWait sheds user-facing writes while pool acquires over the
+	// last LoadShedWindow waited this long on average, once at least
+	// LoadShedMinWaits of them waited; 0 disables.
+	LoadShedWait     time.Duration
+	LoadShedWindow   time.Duration
+	LoadShedMinWaits int
+
+	SSEMaxSubscribers int
+	SSEBufferSize     int
+	EventHubBuffer    int
+	EventHubOverflow  string
+
+	ForceHTTPS     bool
+	TrustedProxies trustedProxies
+	ClientIPHeader string
+
+	RateLimitRPS     float64
+	RateLimitBurst   int
+	RateLimitHeaders bool
+	// RateLimitFailOpen lets requests through when the limiter fails
+	// (RATE_LIMIT_FAIL_POLICY=open) instead of answering 503.
+	RateLimitFailOpen bool
+	// RetryAfterFormat renders Retry-After on 429 and 503 responses.
+	RetryAfterFormat retryAfterFormat
+
+	UsernameMinLen int
+	UsernameMaxLen int
+	EmailMaxLen    int
+	// DisallowUsernameEqualsEmail rejects a username equal to the email or
+	// its local part, ignoring case.
+	DisallowUsernameEqualsEmail bool
+
+	MaxBatchSize         int
+	MaxJSONTokens        int
+	BatchUpdateAtomic    bool
+	MaxQueryParams       int
+	MaxBodyBytes         int64
+	MaxImportBodyBytes   int64
+	MaxDecompressedBytes int64
+	MaxResponseBytes     int
+	ResponseLimitMode    string
+
+	// MaxImportRows caps one POST /users/import; batches of at least
+	// ImportCopyThreshold rows (0: never) are loaded with COPY unless ids
+	// are requested. ImportTimeout replaces QueryTimeout for imports.
+	// ImportDuplicates is what to do with rows repeating an earlier row's
+	// email, or username with UNIQUE_USERNAMES: "off" (leave it to the
+	// database), "reject" or "dedupe" (keep the first).
+	MaxImportRows       int
+	ImportCopyThreshold int
+	ImportTimeout       time.Duration
+	ImportDuplicates    string
+
+	// LargeNumbersAsString renders user counts as JSON strings.
+	LargeNumbersAsString bool
+
+	// EmptyListAsNull encodes an empty users list as null instead of [].
+	EmptyListAsNull bool
+
+	// StrictJSON rejects request bodies with data after the JSON document
+	// and keeps untyped numbers as json.Number.
+	StrictJSON bool
+
+	// RejectGetBody answers 400 to GET, HEAD and DELETE requests that
+	// carry a body.
+	RejectGetBody bool
+
+	// DuplicateSlashes is how paths like //users are handled: "redirect"
+	// (the mux redirects to the cleaned path), "collapse" or "reject".
+	DuplicateSlashes string
+
+	// CompressResponses gzips responses of at least CompressMinBytes for
+	// clients accepting it; streams are never compressed.
+	CompressResponses bool
+	CompressMinBytes  int
+
+	// MalformedIDStatus is returned for ids that can't name a user.
+	MalformedIDStatus int
+	// IdenticalCreateOK answers 200 instead of 409 when a create exactly
+	// matches an existing user.
+	IdenticalCreateOK bool
+	// UniqueUsernames rejects a username already taken in any casing; the
+	// stored casing is kept.
+	UniqueUsernames bool
+	// CreateReturnsBody is false to answer a create with 201 and only its
+	// Location header.
+	CreateReturnsBody bool
+	// UserETags adds an ETag to GET /users/{id}, honours If-None-Match and
+	// answers HEAD /users/{id}.
+	UserETags bool
+	// NullFields renders NULL username/email as "null", "empty" or "omit".
+	NullFields string
+	// JSONFieldOrder is "canonical" (declared order) or "sorted" for user
+	// objects.
+	JSONFieldOrder string
+	// JSONAPI serves JSON:API documents to clients accepting them.
+	JSONAPI bool
+	// ProblemJSON formats error responses as RFC 7807 documents: "off",
+	// "negotiate" (when Accept lists application/problem+json) or "always".
+	ProblemJSON string
+	// EnableGraphQL serves the users API at /graphql as well.
+	EnableGraphQL bool
+	// EnableTimeEndpoint serves GET /time, the server and database clocks.
+	EnableTimeEndpoint bool
+	// PutProtectedFields can't be cleared (sent empty) in PUT /users/{id}.
+	PutProtectedFields []string
+
+	// ValidateEmailMX rejects emails whose domain has neither MX nor address
+	// records; EmailMXAllowlist domains skip the lookup.
+	ValidateEmailMX  bool
+	EmailMXTimeout   time.Duration
+	EmailMXCacheTTL  time.Duration
+	EmailMXAllowlist []string
+
+	IdempotencyTTL   time.Duration
+	IdempotencyStore string
+	StatsCacheTTL    time.Duration
+	// RequireIdempotencyKey rejects writes without an Idempotency-Key.
+	RequireIdempotencyKey bool
+
+	// IdempotencyRetention is how long idempotency_keys rows are kept, and
+	// WebhookRetention delivered and dead webhook_deliveries rows (0 keeps
+	// them). Purgers delete older ones every PurgeInterval (0 disables),
+	// PurgeBatchSize rows per statement.
+	IdempotencyRetention time.Duration
+	WebhookRetention     time.Duration
+	PurgeInterval        time.Duration
+	PurgeBatchSize       int
+
+	UserCreatedWebhook string
+	WebhookTimeout     time.Duration
+	WebhookRetries     int
+	// WebhookQueue is "memory" (retries held in process) or "db" (the
+	// webhook_deliveries table, polled every WebhookPollInterval).
+	WebhookQueue        string
+	WebhookPollInterval time.Duration
+
+	// AuditLog records user writes in audit_log: in each write's own
+	// transaction on the primary or, with AuditDBURL, in that database
+	// through auditWriter.
+	AuditLog   bool
+	AuditDBURL string
+
+	CaptureSampleRate float64
+	CaptureBufferSize int
+	CaptureMaxBytes   int
+
+	// RootBehavior is "hello", "notfound" or "redirect"; RootRedirectURL is
+	// set for the latter.
+	RootBehavior    string
+	RootRedirectURL string
+
+	// CacheControl maps routes ("default", "get_user", "list_users") to
+	// their Cache-Control value; empty sends none.
+	CacheControl map[string]string
+	// FieldScopes maps user fields to the scope a caller needs to see
+	// them; see fieldauth.go.
+	FieldScopes map[string]string
+
+	Maintenance           bool
+	MaintenanceMessage    string
+	MaintenanceRetryAfter time.Duration
+}
+
+// LoadConfig reads the runtime configuration through getenv (usually
+// os.Getenv) and reports every invalid value at once.
+func LoadConfig(getenv func(string) string) (Config, error) {
+	env := &envReader{getenv: getenv}
+
+	cfg := Config{
+		DBHost:     env.str("DB_HOST", "container_postgresql"),
+		DBUser:     env.str("DB_USER", "testuser"),
+		DBPassword: env.str("DB_PASSWORD", "testpass"),
+		DBName:     env.str("DB_NAME", "testdb"),
+		DBPort:     env.str("DB_PORT", "5432"),
+		DBParams:   env.query("DB_PARAMS"),
+		Port:       env.str("PORT", "3000"),
+		AdminPort:  env.str("ADMIN_PORT", ""),
+		AdminBind:  env.str("ADMIN_BIND", "127.0.0.1"),
+		Storage:    env.oneOf("STORAGE", "postgres", "postgres", "memory"),
+
+		RunMigrations:    env.bool("RUN_MIGRATIONS", false),
+		MigrationTimeout: env.duration("MIGRATION_TIMEOUT", 5*time.Minute),
+
+		Debug:      env.bool("DEBUG", false),
+		AdminToken: env.str("ADMIN_TOKEN", ""),
+		AccessLog:  env.bool("ACCESS_LOG", false),
+
+		RouteTimingMetrics: env.bool("ROUTE_TIMING_METRICS", false),
+		MetricsExemplars:   env.bool("METRICS_EXEMPLARS", false),
+		LogBuildInfo:       env.bool("LOG_BUILD_INFO", true),
+
+		LogFile:           env.str("LOG_FILE", ""),
+		LogFileMaxBytes:   int64(env.int("LOG_FILE_MAX_SIZE_MB", 100)) << 20,
+		LogFileMaxAge:     env.duration("LOG_FILE_MAX_AGE", 0),
+		LogFileMaxBackups: env.int("LOG_FILE_MAX_BACKUPS", 5),
+
+		DBMaxOpenConns:    env.int("DB_MAX_OPEN_CONNS", 10),
+		DBMaxIdleConns:    env.int("DB_MAX_IDLE_CONNS", 10),
+		DBConnMaxLifetime: env.duration("DB_CONN_MAX_LIFETIME", 30*time.Minute),
+		DBConnMaxIdleTime: env.duration("DB_CONN_MAX_IDLE_TIME", 10*time.Minute),
+
+		DBPingTimeout:       env.duration("DB_PING_TIMEOUT", 10*time.Second),
+		DBConnectMaxRetries: env.int("DB_CONNECT_MAX_RETRIES", 0),
+		DBConnectBackoff:    env.duration("DB_CONNECT_BACKOFF", time.Second),
+
+		PingBenchMax:     env.int("PING_BENCH_MAX", 1000),
+		PingBenchTimeout: env.duration("PING_BENCH_TIMEOUT", 10*time.Second),
+		DomainsMaxLimit:  env.int("DOMAINS_MAX_LIMIT", 100),
+
+		DBAcquireTimeout: env.duration("DB_ACQUIRE_TIMEOUT", 0),
+		QueryTimeout:     env.duration("QUERY_TIMEOUT", 60*time.Second),
+		PartialResults:   env.bool("PARTIAL_RESULTS", false),
+		CoalesceReads:    env.bool("COALESCE_READS", false),
+		DBReadRetry:      env.bool("DB_READ_RETRY", false),
+		StartupGrace:     env.duration("STARTUP_GRACE", 0),
+		SQLCommentReqID:  env.bool("SQL_COMMENT_REQUEST_ID", false),
+		PrepareWarmup:    env.bool("PREPARE_WARMUP", false),
+		LogQueries:       env.bool("LOG_QUERIES", false),
+		LogQueriesRedact: env.list("LOG_QUERIES_REDACT", "email"),
+
+		PoolHealthInterval:       env.duration("POOL_HEALTH_INTERVAL", 0),
+		PoolHealthFailures:       env.int("POOL_HEALTH_FAILURES", 3),
+		ShutdownTimeout:          env.duration("SHUTDOWN_TIMEOUT", 10*time.Second),
+		ShutdownStepTimeout:      env.duration("SHUTDOWN_STEP_TIMEOUT", 5*time.Second),
+		MaxBackgroundConcurrency: env.int("MAX_BACKGROUND_CONCURRENCY", 2),
+
+		LoadShedWait:     env.duration("LOAD_SHED_WAIT", 0),
+		LoadShedWindow:   env.duration("LOAD_SHED_WINDOW", 10*time.Second),
+		LoadShedMinWaits: env.int("LOAD_SHED_MIN_WAITS", 10),
+
+		SSEMaxSubscribers: env.int("SSE_MAX_SUBSCRIBERS", 100),
+		SSEBufferSize:     env.int("SSE_BUFFER_SIZE", 16),
+		EventHubBuffer:    env.int("EVENT_HUB_BUFFER", 256),
+		EventHubOverflow:  env.oneOf("EVENT_HUB_OVERFLOW", overflowDropOldest, overflowDropOldest, overflowDropNew, overflowBlock),
+
+		ForceHTTPS:     env.bool("FORCE_HTTPS", false),
+		TrustedProxies: env.prefixes("TRUSTED_PROXIES"),
+		ClientIPHeader: env.str("CLIENT_IP_HEADER", "X-Forwarded-For"),
+
+		RateLimitRPS:     env.float("RATE_LIMIT_RPS", 0),
+		RateLimitBurst:   env.int("RATE_LIMIT_BURST", 20),
+		RateLimitHeaders: env.bool("RATE_LIMIT_HEADERS", true),
+
+		// Defaults mirror the VARCHAR(50)/VARCHAR(100) columns.
+		UsernameMinLen: env.int("USERNAME_MIN_LEN", 1),
+		UsernameMaxLen: env.int("USERNAME_MAX_LEN", 50),
+		EmailMaxLen:    env.int("EMAIL_MAX_LEN", 100),
+
+		MaxBatchSize:         env.int("MAX_BATCH_SIZE", 100),
+		MaxJSONTokens:        env.int("MAX_JSON_TOKENS", 10000),
+		MaxImportRows:        env.int("MAX_IMPORT_ROWS", 100000),
+		ImportCopyThreshold:  env.int("IMPORT_COPY_THRESHOLD", 1000),
+		ImportTimeout:        env.duration("IMPORT_TIMEOUT", 5*time.Minute),
+		ImportDuplicates:     env.oneOf("IMPORT_DUPLICATES", "off", "off", "reject", "dedupe"),
+		MaxQueryParams:       env.int("MAX_QUERY_PARAMS", 50),
+		MaxBodyBytes:         int64(env.int("MAX_BODY_BYTES", 1<<20)),
+		MaxImportBodyBytes:   int64(env.int("MAX_IMPORT_BODY_BYTES", 32<<20)),
+		LargeNumbersAsString: env.bool("LARGE_NUMBERS_AS_STRING", false),
+		EmptyListAsNull:      env.bool("EMPTY_LIST_AS_NULL", false),
+		StrictJSON:           env.bool("STRICT_JSON", false),
+		RejectGetBody:        env.bool("REJECT_GET_BODY", false),
+		DuplicateSlashes:     env.oneOf("DUPLICATE_SLASHES", "redirect", "redirect", "collapse", "reject"),
+		IdenticalCreateOK:    env.bool("IDENTICAL_CREATE_RETURNS_OK", false),
+		UniqueUsernames:      env.bool("UNIQUE_USERNAMES", false),
+		CreateReturnsBody:    env.bool("CREATE_RETURNS_BODY", true),
+		UserETags:            env.bool("USER_ETAGS", false),
+		NullFields:           env.oneOf("NULL_FIELDS", "null", "null", "empty", "omit"),
+		JSONFieldOrder:       env.oneOf("JSON_FIELD_ORDER", "canonical", "canonical", "sorted"),
+		JSONAPI:              env.bool("JSON_API", false),
+		ProblemJSON:          env.oneOf("PROBLEM_JSON", "off", "off", "negotiate", "always"),
+		EnableGraphQL:        env.bool("ENABLE_GRAPHQL", false),
+		EnableTimeEndpoint:   env.bool("ENABLE_TIME_ENDPOINT", false),
+		PutProtectedFields:   env.list("PUT_PROTECTED_FIELDS", "email"),
+		IdempotencyTTL:       env.duration("IDEMPOTENCY_TTL", 24*time.Hour),
+		IdempotencyStore:     env.oneOf("IDEMPOTENCY_STORE", "memory", "memory", "db"),
+		StatsCacheTTL:        env.duration("STATS_CACHE_TTL", 10*time.Second),
+		IdempotencyRetention: env.duration("IDEMPOTENCY_RETENTION", 7*24*time.Hour),
+		WebhookRetention:     env.duration("WEBHOOK_RETENTION", 7*24*time.Hour),
+		PurgeInterval:        env.duration("PURGE_INTERVAL", 10*time.Minute),
+		PurgeBatchSize:       env.int("PURGE_BATCH_SIZE", 1000),
+		UserCreatedWebhook:   env.url("USER_CREATED_WEBHOOK"),
+		WebhookTimeout:       env.duration("WEBHOOK_TIMEOUT", 5*time.Second),
+		WebhookRetries:       env.int("WEBHOOK_RETRIES", 3),
+		WebhookQueue:         env.oneOf("WEBHOOK_QUEUE", "memory", "memory", "db"),
+		WebhookPollInterval:  env.duration("WEBHOOK_POLL_INTERVAL", 5*time.Second),
+		AuditLog:             env.bool("AUDIT_LOG", false),
+		AuditDBURL:           env.str("AUDIT_DB_URL", ""),
+		CaptureSampleRate:    env.float("CAPTURE_SAMPLE_RATE", 0),
+		CaptureBufferSize:    env.int("CAPTURE_BUFFER_SIZE", 100),
+		CaptureMaxBytes:      env.int("CAPTURE_MAX_BODY_BYTES", 4096),
+		MaxDecompressedBytes: int64(env.int("MAX_DECOMPRESSED_BODY_BYTES", 1<<20)),
+		MaxResponseBytes:     env.int("MAX_RESPONSE_BYTES", 0),
+		ResponseLimitMode:    env.oneOf("RESPONSE_LIMIT_MODE", "error", "error", "truncate"),
+
+		ValidateEmailMX:  env.bool("VALIDATE_EMAIL_MX", false),
+		EmailMXTimeout:   env.duration("EMAIL_MX_TIMEOUT", 2*time.Second),
+		EmailMXCacheTTL:  env.duration("EMAIL_MX_CACHE_TTL", time.Hour),
+		EmailMXAllowlist: env.list("EMAIL_MX_ALLOWLIST", "gmail.com,googlemail.com,outlook.com,hotmail.com,yahoo.com,icloud.com,proton.me"),
+
+		CompressResponses: env.bool("COMPRESS_RESPONSES", false),
+		CompressMinBytes:  env.int("COMPRESS_MIN_BYTES", 1024),
+	}
+	cfg.DBIsolation = isolationLevels[env.oneOf("DB_ISOLATION_LEVEL", "read committed", "read committed", "repeatable read", "serializable")]
+	cfg.RetryAfterFormat = retryAfterFormat(env.oneOf("RETRY_AFTER_FORMAT", string(retryAfterSeconds), string(retryAfterSeconds), string(retryAfterHTTPDate)))
+	cfg.RateLimitFailOpen = env.oneOf("RATE_LIMIT_FAIL_POLICY", "open", "open", "closed") == "open"
+	cfg.BatchUpdateAtomic = env.oneOf("BATCH_UPDATE_POLICY", "all_or_nothing", "all_or_nothing", "best_effort") == "all_or_nothing"
+	cfg.Maintenance = env.bool("MAINTENANCE_MODE", false)
+	cfg.MaintenanceMessage = env.str("MAINTENANCE_MESSAGE", "The service is undergoing planned maintenance.")
+	cfg.MaintenanceRetryAfter = env.duration("MAINTENANCE_RETRY_AFTER", 5*time.Minute)
+	cfg.MalformedIDStatus, _ = strconv.Atoi(env.oneOf("MALFORMED_ID_STATUS", "400", "400", "404"))
+	cfg.RootBehavior, cfg.RootRedirectURL = env.rootBehavior("ROOT_BEHAVIOR")
+	cfg.SeedUsername, cfg.SeedEmail = env.seedUser("SEED_USER")
+	cfg.CacheControl = env.cacheControl("CACHE_CONTROL")
+	cfg.RequireIdempotencyKey = env.bool("REQUIRE_IDEMPOTENCY_KEY", false)
+	cfg.ReadinessHistorySize = env.int("READINESS_HISTORY_SIZE", 100)
+	cfg.DisallowUsernameEqualsEmail = env.bool("DISALLOW_USERNAME_EQUALS_EMAIL", false)
+	cfg.FieldScopes = env.fieldScopes("FIELD_SCOPES")
+
+	if cfg.AdminPort != "" && cfg.AdminPort == cfg.Port {
+		env.fail("ADMIN_PORT", "must differ from PORT")
+	}
+	if cfg.RunMigrations && cfg.Storage != "postgres" {
+		env.fail("RUN_MIGRATIONS", "requires STORAGE=postgres")
+	}
+	if cfg.MigrationTimeout <= 0 {
+		env.fail("MIGRATION_TIMEOUT", "must be positive")
+	}
+	if cfg.LogFileMaxBytes < 1 {
+		env.fail("LOG_FILE_MAX_SIZE_MB", "must be at least 1")
+	}
+	if cfg.LogFileMaxAge < 0 {
+		env.fail("LOG_FILE_MAX_AGE", "must not be negative")
+	}
+	if cfg.LogFileMaxBackups < 0 {
+		env.fail("LOG_FILE_MAX_BACKUPS", "must not be negative")
+	}
+	if cfg.LogQueries && !cfg.Debug {
+		env.fail("LOG_QUERIES", "requires DEBUG=true")
+	}
+	if cfg.DBMaxOpenConns < 1 {
+		env.fail("DB_MAX_OPEN_CONNS", "must be at least 1")
+	}
+	if cfg.DBMaxIdleConns < 0 || cfg.DBMaxIdleConns > cfg.DBMaxOpenConns {
+		env.fail("DB_MAX_IDLE_CONNS", "must be between 0 and DB_MAX_OPEN_CONNS")
+	}
+	if cfg.DBConnMaxLifetime < 0 {
+		env.fail("DB_CONN_MAX_LIFETIME", "must not be negative")
+	}
+	if cfg.DBConnMaxIdleTime < 0 {
+		env.fail("DB_CONN_MAX_IDLE_TIME", "must not be negative")
+	}
+	if cfg.DBConnMaxLifetime > 0 && cfg.DBConnMaxIdleTime > cfg.DBConnMaxLifetime {
+		env.fail("DB_CONN_MAX_IDLE_TIME", fmt.Sprintf("%s exceeds DB_CONN_MAX_LIFETIME %s; a connection is recycled before it can idle that long",
+			cfg.DBConnMaxIdleTime, cfg.DBConnMaxLifetime))
+	}
+	if cfg.DBAcquireTimeout < 0 {
+		env.fail("DB_ACQUIRE_TIMEOUT", "must not be negative")
+	}
+	if cfg.QueryTimeout <= 0 {
+		env.fail("QUERY_TIMEOUT", "must be positive")
+	}
+	if cfg.StartupGrace < 0 {
+		env.fail("STARTUP_GRACE", "must not be negative")
+	}
+	if cfg.MetricsExemplars && !cfg.RouteTimingMetrics {
+		env.fail("METRICS_EXEMPLARS", "requires ROUTE_TIMING_METRICS, whose histograms carry them")
+	}
+	if len(cfg.FieldScopes) > 0 && cfg.AdminToken == "" {
+		env.fail("FIELD_SCOPES", "requires ADMIN_TOKEN, or no one could see the fields")
+	}
+	if cfg.ReadinessHistorySize < 0 {
+		env.fail("READINESS_HISTORY_SIZE", "must not be negative")
+	}
+	if cfg.PoolHealthInterval < 0 {
+		env.fail("POOL_HEALTH_INTERVAL", "must not be negative")
+	}
+	if cfg.MaxBackgroundConcurrency < 1 {
+		env.fail("MAX_BACKGROUND_CONCURRENCY", "must be at least 1")
+	}
+	if cfg.PoolHealthFailures < 1 {
+		env.fail("POOL_HEALTH_FAILURES", "must be at least 1")
+	}
+	if cfg.ShutdownTimeout <= 0 {
+		env.fail("SHUTDOWN_TIMEOUT", "must be positive")
+	}
+	if cfg.ShutdownStepTimeout <= 0 {
+		env.fail("SHUTDOWN_STEP_TIMEOUT", "must be positive")
+	}
+	if cfg.SSEMaxSubscribers < 1 {
+		env.fail("SSE_MAX_SUBSCRIBERS", "must be at least 1")
+	}
+	if cfg.SSEBufferSize < 1 {
+		env.fail("SSE_BUFFER_SIZE", "must be at least 1")
+	}
+	if cfg.EventHubBuffer < 1 {
+		env.fail("EVENT_HUB_BUFFER", "must be at least 1")
+	}
+	if cfg.RateLimitRPS < 0 {
+		env.fail("RATE_LIMIT_RPS", "must not be negative")
+	}
+	if cfg.RateLimitBurst < 1 {
+		env.fail("RATE_LIMIT_BURST", "must be at least 1")
+	}
+	if cfg.UsernameMinLen < 1 {
+		env.fail("USERNAME_MIN_LEN", "must be at least 1")
+	}
+	if cfg.UsernameMaxLen < cfg.UsernameMinLen {
+		env.fail("USERNAME_MAX_LEN", "must not be less than USERNAME_MIN_LEN")
+	}
+	if cfg.EmailMaxLen < 1 {
+		env.fail("EMAIL_MAX_LEN", "must be at least 1")
+	}
+	if cfg.MaxBatchSize < 1 {
+		env.fail("MAX_BATCH_SIZE", "must be at least 1")
+	}
+	if cfg.MaxJSONTokens < 0 {
+		env.fail("MAX_JSON_TOKENS", "must not be negative")
+	}
+	if cfg.IdempotencyTTL <= 0 {
+		env.fail("IDEMPOTENCY_TTL", "must be positive")
+	}
+	if cfg.IdempotencyStore == "db" && cfg.Storage != "postgres" {
+		env.fail("IDEMPOTENCY_STORE", "db requires STORAGE=postgres")
+	}
+	if cfg.LoadShedWait < 0 {
+		env.fail("LOAD_SHED_WAIT", "must not be negative")
+	}
+	if cfg.LoadShedWait > 0 && cfg.Storage != "postgres" {
+		env.fail("LOAD_SHED_WAIT", "requires STORAGE=postgres")
+	}
+	if cfg.LoadShedWindow < time.Second {
+		env.fail("LOAD_SHED_WINDOW", "must be at least 1s")
+	}
+	if cfg.LoadShedMinWaits < 1 {
+		env.fail("LOAD_SHED_MIN_WAITS", "must be at least 1")
+	}
+	if cfg.WebhookQueue == "db" && cfg.Storage != "postgres" {
+		env.fail("WEBHOOK_QUEUE", "db requires STORAGE=postgres")
+	}
+	if cfg.AuditDBURL != "" {
+		if !cfg.AuditLog {
+			env.fail("AUDIT_DB_URL", "requires AUDIT_LOG=true")
+		}
+		if _, err := pgx.ParseConfig(cfg.AuditDBURL); err != nil {
+			env.fail("AUDIT_DB_URL", fmt.Sprintf("invalid connection string %q", cfg.AuditDBURL))
+		}
+	} else if cfg.AuditLog && cfg.Storage != "postgres" {
+		env.fail("AUDIT_LOG", "requires STORAGE=postgres or AUDIT_DB_URL")
+	}
+	if cfg.WebhookPollInterval <= 0 {
+		env.fail("WEBHOOK_POLL_INTERVAL", "must be positive")
+	}
+	if cfg.IdempotencyRetention < cfg.IdempotencyTTL {
+		env.fail("IDEMPOTENCY_RETENTION", "must be at least IDEMPOTENCY_TTL")
+	}
+	if cfg.WebhookRetention < 0 {
+		env.fail("WEBHOOK_RETENTION", "must not be negative")
+	}
+	if cfg.PurgeInterval < 0 {
+		env.fail("PURGE_INTERVAL", "must not be negative")
+	}
+	if cfg.PurgeBatchSize < 1 {
+		env.fail("PURGE_BATCH_SIZE", "must be at least 1")
+	}
+	if cfg.StatsCacheTTL < 0 {
+		env.fail("STATS_CACHE_TTL", "must not be negative")
+	}
+	if cfg.WebhookTimeout <= 0 {
+		env.fail("WEBHOOK_TIMEOUT", "must be positive")
+	}
+	if cfg.WebhookRetries < 0 {
+		env.fail("WEBHOOK_RETRIES", "must not be negative")
+	}
+	if cfg.CaptureSampleRate < 0 || cfg.CaptureSampleRate > 1 {
+		env.fail("CAPTURE_SAMPLE_RATE", "must be between 0 and 1")
+	}
+	if cfg.CaptureBufferSize < 1 {
+		env.fail("CAPTURE_BUFFER_SIZE", "must be at least 1")
+	}
+	if cfg.CaptureMaxBytes < 0 {
+		env.fail("CAPTURE_MAX_BODY_BYTES", "must not be negative")
+	}
+	if cfg.MaxQueryParams < 0 {
+		env.fail("MAX_QUERY_PARAMS", "must not be negative")
+	}
+	if cfg.MaxBodyBytes < 1 {
+		env.fail("MAX_BODY_BYTES", "must be at least 1")
+	}
+	if cfg.MaxImportBodyBytes < 1 {
+		env.fail("MAX_IMPORT_BODY_BYTES", "must be at least 1")
+	}
+	if cfg.MaxDecompressedBytes < 1 {
+		env.fail("MAX_DECOMPRESSED_BODY_BYTES", "must be at least 1")
+	}
+	if cfg.MaintenanceRetryAfter < time.Second {
+		env.fail("MAINTENANCE_RETRY_AFTER", "must be at least 1s")
+	}
+	for _, f := range cfg.PutProtectedFields {
+		if f != "username" && f != "email" {
+			env.fail("PUT_PROTECTED_FIELDS", fmt.Sprintf("unknown field %q", f))
+		}
+	}
+	if cfg.MaxResponseBytes != 0 && cfg.MaxResponseBytes <= envelopeReserve {
+		env.fail("MAX_RESPONSE_BYTES", fmt.Sprintf("must be 0 (off) or more than %d", envelopeReserve))
+	}
+	if cfg.DBPingTimeout <= 0 {
+		env.fail("DB_PING_TIMEOUT", "must be positive")
+	}
+	if cfg.DBConnectMaxRetries < 0 {
+		env.fail("DB_CONNECT_MAX_RETRIES", "must not be negative")
+	}
+	if cfg.DBConnectBackoff <= 0 {
+		env.fail("DB_CONNECT_BACKOFF", "must be positive")
+	}
+	if cfg.MaxImportRows < 1 {
+		env.fail("MAX_IMPORT_ROWS", "must be at least 1")
+	}
+	if cfg.ImportCopyThreshold < 0 {
+		env.fail("IMPORT_COPY_THRESHOLD", "must not be negative")
+	}
+	if cfg.ImportTimeout <= 0 {
+		env.fail("IMPORT_TIMEOUT", "must be positive")
+	}
+	if cfg.PingBenchMax < 1 {
+		env.fail("PING_BENCH_MAX", "must be at least 1")
+	}
+	if cfg.PingBenchTimeout <= 0 {
+		env.fail("PING_BENCH_TIMEOUT", "must be positive")
+	}
+	if cfg.DomainsMaxLimit < 1 {
+		env.fail("DOMAINS_MAX_LIMIT", "must be at least 1")
+	}
+	if cfg.EmailMXTimeout <= 0 {
+		env.fail("EMAIL_MX_TIMEOUT", "must be positive")
+	}
+	if cfg.EmailMXCacheTTL < 0 {
+		env.fail("EMAIL_MX_CACHE_TTL", "must not be negative")
+	}
+	if cfg.CompressMinBytes < 0 {
+		env.fail("COMPRESS_MIN_BYTES", "must not be negative")
+	}
+
+	return cfg, errors.Join(env.errs...)
+}
+
+var isolationLevels = map[string]sql.IsolationLevel{
+	"read committed":  sql.LevelReadCommitted,
+	"repeatable read": sql.LevelRepeatableRead,
+	"serializable":    sql.LevelSerializable,
+}
+
+// secretEnvKeys set the fields GET /admin/config masks. Their values are
+// masked the same way in LoadConfig errors, which reach the startup log
+// and POST /admin/config/validate responses.
+var secretEnvKeys = map[string]bool{
+	"DB_PASSWORD":          true,
+	"ADMIN_TOKEN":          true,
+	"USER_CREATED_WEBHOOK": true,
+	"AUDIT_DB_URL":         true,
+}
+
+type envReader struct {
+	getenv func(string) string
+	errs   []error
+}
+
+func (e *envReader) fail(key, msg string) {
+	if v := e.getenv(key); secretEnvKeys[key] && v != "" {
+		msg = strings.ReplaceAll(msg, strconv.Quote(v), "[redacted]")
+		msg = strings.ReplaceAll(msg, v, "[redacted]")
+	}
+	e.errs = append(e.errs, fmt.Errorf("%s: %s", key, msg))
+}
+
+func (e *envReader) str(key, def string) string {
+	if v := e.getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+func (e *envReader) int(key string, def int) int {
+	v := e.getenv(key)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		e.fail(key, fmt.Sprintf("invalid integer %q", v))
+		return def
+	}
+	return n
+}
+
+func (e *envReader) float(key string, def float64) float64 {
+	v := e.getenv(key)
+	if v == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		e.fail(key, fmt.Sprintf("invalid number %q", v))
+		return def
+	}
+	return f
+}
+
+func (e *envReader) oneOf(key, def string, allowed ...string) string {
+	v := e.str(key, def)
+	if !slices.Contains(allowed, v) {
+		e.fail(key, fmt.Sprintf("must be one of %s, got %q", strings.Join(allowed, ", "), v))
+		return def
+	}
+	return v
+}
+
+func (e *envReader) duration(key string, def time.Duration) time.Duration {
+	v := e.getenv(key)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		e.fail(key, fmt.Sprintf("invalid duration %q", v))
+		return def
+	}
+	return d
+}
+
+// rootBehavior parses "hello", "notfound" or "redirect:<absolute http(s) URL>".
+func (e *envReader) rootBehavior(key string) (string, string) {
+	v := e.str(key, "hello")
+	if target, ok := strings.CutPrefix(v, "redirect:"); ok {
+		u, err := url.Parse(target)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			e.fail(key, fmt.Sprintf("invalid redirect URL %q", target))
+			return "hello", ""
+		}
+		return "redirect", target
+	}
+	if v != "hello" && v != "notfound" {
+		e.fail(key, fmt.Sprintf("must be hello, notfound or redirect:<url>, got %q", v))
+		return "hello", ""
+	}
+	return v, ""
+}
+
+// seedUser parses an optional "username:email". The username may not
+// contain a colon; the email is checked for shape only, the length rules
+// apply when the user is inserted.
+func (e *envReader) seedUser(key string) (string, string) {
+	v := e.getenv(key)
+	if v == "" {
+		return "", ""
+	}
+	username, email, ok := strings.Cut(v, ":")
+	if !ok || strings.TrimSpace(username) == "" || !isValidEmail(email) {
+		e.fail(key, fmt.Sprintf("must be username:email, got %q", v))
+		return "", ""
+	}
+	return username, email
+}
+
+// cacheControl overlays route=value entries, separated by ";" since values
+// contain commas, on defaultCacheControl.
+func (e *envReader) cacheControl(key string) map[string]string {
+	policy := maps.Clone(defaultCacheControl)
+	for _, entry := range strings.Split(e.getenv(key), ";") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		route, value, ok := strings.Cut(entry, "=")
+		route = strings.TrimSpace(route)
+		if _, known := defaultCacheControl[route]; !ok || !known {
+			e.fail(key, fmt.Sprintf("entries must be route=value with route %s, got %q",
+				strings.Join(slices.Sorted(maps.Keys(defaultCacheControl)), ", "), entry))
+			continue
+		}
+		policy[route] = strings.TrimSpace(value)
+	}
+	return policy
+}
+
+// fieldScopes parses comma-separated field=scope entries. Fields are the
+// user's own (user_id excepted) and its ?expand= fields.
+func (e *envReader) fieldScopes(key string) map[string]string {
+	fields := append([]string{"username", "email"}, slices.Sorted(maps.Keys(expanders))...)
+	scopes := make(map[string]string)
+	for _, entry := range e.list(key, "") {
+		field, scope, ok := strings.Cut(entry, "=")
+		field, scope = strings.TrimSpace(field), strings.TrimSpace(scope)
+		if !ok || !slices.Contains(fields, field) || !slices.Contains(knownScopes, scope) {
+			e.fail(key, fmt.Sprintf("entries must be field=scope with field %s and scope %s, got %q",
+				strings.Join(fields, ", "), strings.Join(knownScopes, ", "), entry))
+			continue
+		}
+		scopes[field] = scope
+	}
+	return scopes
+}
+
+// url parses an optional absolute http(s) URL.
+func (e *envReader) url(key string) string {
+	v := e.getenv(key)
+	if v == "" {
+		return ""
+	}
+	u, err := url.Parse(v)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		e.fail(key, fmt.Sprintf("invalid URL %q", v))
+		return ""
+	}
+	return v
+}
+
+func (e *envReader) query(key string) url.Values {
+	v, err := url.ParseQuery(e.getenv(key))
+	if err != nil {
+		e.fail(key, fmt.Sprintf("invalid query string: %v", err))
+		return nil
+	}
+	return v
+}
+
+// list parses a comma-separated list, dropping empty items. An unset
+// variable yields def; set it to "," for an empty list.
+func (e *envReader) list(key, def string) []string {
+	var out []string
+	for _, item := range strings.Split(e.str(key, def), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+func (e *envReader) bool(key string, def bool) bool {
+	v := e.getenv(key)
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		e.fail(key, fmt.Sprintf("invalid boolean %q", v))
+		return def
+	}
+	return b
+}
+
+// prefixes parses a comma-separated list of CIDRs; bare IPs are treated as
+// single-host prefixes.
+func (e *envReader) prefixes(key string) []netip.Prefix {
+	var out []netip.Prefix
+	for _, item := range strings.Split(e.getenv(key), ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			addr, err := netip.ParseAddr(item)
+			if err != nil {
+				e.fail(key, fmt.Sprintf("invalid address %q", item))
+				continue
+			}
+			out = append(out, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(item)
+		if err != nil {
+			e.fail(key, fmt.Sprintf("invalid CIDR %q", item))
+			continue
+		}
+		out = append(out, p.Masked())
+	}
+	return out
+}
@@ -0,0 +1,130 @@
+// config_test.go
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// loadConfigErr loads a Config from env and returns the validation error,
+// failing t if there is none.
+func loadConfigErr(t *testing.T, env map[string]string) error {
+	t.Helper()
+	_, err := LoadConfig(func(key string) string { return env[key] })
+	if err == nil {
+		t.Fatalf("LoadConfig(%v) succeeded", env)
+	}
+	return err
+}
+
+func TestRootBehaviorValidated(t *testing.T) {
+	for _, v := range []string{"redirect:/docs", "redirect:ftp://example.com", "redirect:https://", "goodbye"} {
+		if err := loadConfigErr(t, map[string]string{"ROOT_BEHAVIOR": v}); !strings.Contains(err.Error(), "ROOT_BEHAVIOR") {
+			t.Errorf("%q: %v", v, err)
+		}
+	}
+}
+
+// TestBehaviourTogglesDefaultOff checks that settings changing how the
+// baseline API answers are opt-in.
+func TestBehaviourTogglesDefaultOff(t *testing.T) {
+	cfg := testConfig(t, nil)
+	if cfg.DBAcquireTimeout != 0 {
+		t.Errorf("DBAcquireTimeout = %v, want 0", cfg.DBAcquireTimeout)
+	}
+	if cfg.UserETags {
+		t.Error("UserETags on by default")
+	}
+	if cfg.DBReadRetry {
+		t.Error("DBReadRetry on by default")
+	}
+}
+
+func TestDBParamsInDSN(t *testing.T) {
+	cfg := testConfig(t, map[string]string{"DB_PARAMS": "connect_timeout=5&sslmode=require&options=-c%20statement_timeout%3D1000"})
+	u, err := url.Parse(buildDSN(cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	if q.Get("connect_timeout") != "5" || q.Get("options") != "-c statement_timeout=1000" {
+		t.Fatalf("params missing from %s", u)
+	}
+	if q.Get("sslmode") != "disable" {
+		t.Fatalf("DB_PARAMS overrode sslmode: %s", u)
+	}
+}
+
+func TestDBParamsValidated(t *testing.T) {
+	if err := loadConfigErr(t, map[string]string{"DB_PARAMS": "a=%zz"}); !strings.Contains(err.Error(), "DB_PARAMS") {
+		t.Fatal(err)
+	}
+}
+
+func TestPoolTimesValidated(t *testing.T) {
+	for _, env := range []map[string]string{
+		{"DB_CONN_MAX_LIFETIME": "30m", "DB_CONN_MAX_IDLE_TIME": "10m"},
+		{"DB_CONN_MAX_LIFETIME": "10m", "DB_CONN_MAX_IDLE_TIME": "10m"},
+		{"DB_CONN_MAX_LIFETIME": "0", "DB_CONN_MAX_IDLE_TIME": "2h"},
+		{"DB_CONN_MAX_LIFETIME": "1h", "DB_CONN_MAX_IDLE_TIME": "0"},
+	} {
+		testConfig(t, env)
+	}
+
+	for _, tt := range []struct {
+		env  map[string]string
+		want string
+	}{
+		{map[string]string{"DB_CONN_MAX_LIFETIME": "5m", "DB_CONN_MAX_IDLE_TIME": "10m"}, "DB_CONN_MAX_IDLE_TIME"},
+		{map[string]string{"DB_CONN_MAX_LIFETIME": "-1s"}, "DB_CONN_MAX_LIFETIME"},
+		{map[string]string{"DB_CONN_MAX_IDLE_TIME": "-1s"}, "DB_CONN_MAX_IDLE_TIME"},
+		{map[string]string{"DB_MAX_OPEN_CONNS": "2", "DB_MAX_IDLE_CONNS": "3"}, "DB_MAX_IDLE_CONNS"},
+		{map[string]string{"DB_MAX_OPEN_CONNS": "0"}, "DB_MAX_OPEN_CONNS"},
+	} {
+		if err := loadConfigErr(t, tt.env); !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%v: %v", tt.env, err)
+		}
+	}
+}
+
+func TestSeedUserValidated(t *testing.T) {
+	cfg := testConfig(t, map[string]string{"SEED_USER": "admin:admin@example.com"})
+	if cfg.SeedUsername != "admin" || cfg.SeedEmail != "admin@example.com" {
+		t.Fatalf("seed = %q, %q", cfg.SeedUsername, cfg.SeedEmail)
+	}
+	for _, v := range []string{"admin", ":admin@example.com", "admin:not-an-email", "admin:"} {
+		if err := loadConfigErr(t, map[string]string{"SEED_USER": v}); !strings.Contains(err.Error(), "SEED_USER") {
+			t.Errorf("%q: %v", v, err)
+		}
+	}
+}
+
+func TestLoadConfigErrorsMaskSecrets(t *testing.T) {
+	for key, v := range map[string]string{
+		"USER_CREATED_WEBHOOK": "hooks.example.com/T0KEN",
+		"ADMIN_TOKEN":          "T0KEN",
+		"DB_PASSWORD":          "T0KEN",
+	} {
+		e := &envReader{getenv: func(k string) string {
+			if k == key {
+				return v
+			}
+			return ""
+		}}
+		e.fail(key, fmt.Sprintf("invalid value %q (raw %s)", v, v))
+		if msg := e.errs[0].Error(); strings.Contains(msg, "T0KEN") || msg != key+": invalid value [redacted] (raw [redacted])" {
+			t.Errorf("%s error = %q", key, msg)
+		}
+	}
+
+	err := loadConfigErr(t, map[string]string{"USER_CREATED_WEBHOOK": "ftp://hooks.example.com/T0KEN"})
+	if strings.Contains(err.Error(), "T0KEN") || !strings.Contains(err.Error(), "USER_CREATED_WEBHOOK") {
+		t.Fatalf("LoadConfig error = %v", err)
+	}
+	// Other values are still quoted, which is what makes errors useful.
+	if err := loadConfigErr(t, map[string]string{"QUERY_TIMEOUT": "soon"}); !strings.Contains(err.Error(), `"soon"`) {
+		t.Fatalf("LoadConfig error = %v", err)
+	}
+}
@@ -0,0 +1,102 @@
+// configadmin.go
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// secretConfigFields are masked by GET /admin/config. The webhook URL is
+// included because receivers commonly take a token in the path or query,
+// and AUDIT_DB_URL because it carries a password.
+var secretConfigFields = map[string]bool{
+	"DBPassword":         true,
+	"AdminToken":         true,
+	"UserCreatedWebhook": true,
+	"AuditDBURL":         true,
+}
+
+// showConfig returns the effective configuration, keyed by Config field
+// name, with secrets masked and durations in Go syntax.
+func (a *App) showConfig(w http.ResponseWriter, r *http.Request) {
+	jsonWrite(w, http.StatusOK, configView(a.Config))
+}
+
+func configView(cfg Config) map[string]any {
+	v := reflect.ValueOf(cfg)
+	t := v.Type()
+	out := make(map[string]any, t.NumField())
+	for i := range t.NumField() {
+		name, f := t.Field(i).Name, v.Field(i)
+		if secretConfigFields[name] && !f.IsZero() {
+			out[name] = "[redacted]"
+			continue
+		}
+		switch x := f.Interface().(type) {
+		case time.Duration:
+			out[name] = x.String()
+		case sql.IsolationLevel:
+			out[name] = x.String()
+		case url.Values:
+			out[name] = redactedParams(x)
+		default:
+			out[name] = x
+		}
+	}
+	return out
+}
+
+// redactedParams masks DB_PARAMS values that look like credentials, such
+// as sslpassword.
+func redactedParams(params url.Values) map[string]string {
+	out := make(map[string]string, len(params))
+	for k := range params {
+		if strings.Contains(strings.ToLower(k), "pass") {
+			out[k] = "[redacted]"
+			continue
+		}
+		out[k] = params.Get(k)
+	}
+	return out
+}
+
+// validateConfig handles POST /admin/config/validate: the body is a JSON
+// object of environment variables, overlaid on the process environment,
+// and the response says whether LoadConfig would accept the result.
+// Nothing is applied.
+func (a *App) validateConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, http.MethodPost)
+		return
+	}
+	var proposed map[string]string
+	if err := a.decodeBody(r, &proposed); err != nil {
+		writeDecodeError(w, err, "invalid JSON, expected an object of environment variables")
+		return
+	}
+
+	_, err := LoadConfig(func(key string) string {
+		if v, ok := proposed[key]; ok {
+			return v
+		}
+		return os.Getenv(key)
+	})
+	if err == nil {
+		jsonWrite(w, http.StatusOK, map[string]any{"valid": true})
+		return
+	}
+	errs := []error{err}
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		errs = joined.Unwrap()
+	}
+	msgs := make([]string, len(errs))
+	for i, e := range errs {
+		msgs[i] = e.Error()
+	}
+	jsonWrite(w, http.StatusOK, map[string]any{"valid": false, "errors": msgs})
+}
@@ -0,0 +1,79 @@
+// configadmin_test.go
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestShowConfigMasksSecrets(t *testing.T) {
+	ta := newTestApp(t, map[string]string{
+		"ADMIN_TOKEN":          "secret",
+		"DB_PASSWORD":          "hunter2",
+		"USER_CREATED_WEBHOOK": "https://hooks.example.com/T0KEN",
+		"DB_PARAMS":            "sslmode=require&sslpassword=keypass",
+		"QUERY_TIMEOUT":        "7s",
+	})
+	wantStatus(t, ta.do(t, http.MethodGet, "/admin/config", ""), http.StatusUnauthorized)
+	rec := ta.do(t, http.MethodGet, "/admin/config", "", adminAuth...)
+	wantStatus(t, rec, http.StatusOK)
+	for _, secret := range []string{"hunter2", `"secret"`, "T0KEN", "keypass"} {
+		if strings.Contains(rec.Body.String(), secret) {
+			t.Errorf("config shows %s: %s", secret, rec.Body)
+		}
+	}
+	body := jsonBody(t, rec)
+	for _, field := range []string{"DBPassword", "AdminToken", "UserCreatedWebhook"} {
+		if body[field] != "[redacted]" {
+			t.Errorf("%s = %v", field, body[field])
+		}
+	}
+	if params := body["DBParams"].(map[string]any); params["sslmode"] != "require" || params["sslpassword"] != "[redacted]" {
+		t.Errorf("DBParams = %v", params)
+	}
+	if body["QueryTimeout"] != "7s" {
+		t.Errorf("QueryTimeout = %v", body["QueryTimeout"])
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	ta := newTestApp(t, map[string]string{"ADMIN_TOKEN": "secret"})
+	validate := func(body string) map[string]any {
+		t.Helper()
+		rec := ta.do(t, http.MethodPost, "/admin/config/validate", body, adminAuth...)
+		wantStatus(t, rec, http.StatusOK)
+		return jsonBody(t, rec)
+	}
+
+	if got := validate(`{"RATE_LIMIT_RPS":"50","QUERY_TIMEOUT":"5s"}`); got["valid"] != true {
+		t.Fatalf("valid config = %v", got)
+	}
+	got := validate(`{"QUERY_TIMEOUT":"soon","RATE_LIMIT_RPS":"fast"}`)
+	errs, _ := got["errors"].([]any)
+	if got["valid"] != false || len(errs) != 2 {
+		t.Fatalf("invalid config = %v", got)
+	}
+	for i, key := range []string{"QUERY_TIMEOUT", "RATE_LIMIT_RPS"} {
+		if !strings.HasPrefix(errs[i].(string), key+": ") {
+			t.Errorf("errors[%d] = %v, want one for %s", i, errs[i], key)
+		}
+	}
+
+	wantStatus(t, ta.do(t, http.MethodPost, "/admin/config/validate", `{"QUERY_TIMEOUT":"5s"}`), http.StatusUnauthorized)
+	wantStatus(t, ta.do(t, http.MethodGet, "/admin/config/validate", "", adminAuth...), http.StatusMethodNotAllowed)
+	wantStatus(t, ta.do(t, http.MethodPost, "/admin/config/validate", `["QUERY_TIMEOUT"]`, adminAuth...), http.StatusBadRequest)
+}
+
+func TestValidateConfigMasksSecrets(t *testing.T) {
+	ta := newTestApp(t, map[string]string{"ADMIN_TOKEN": "secret"})
+	rec := ta.do(t, http.MethodPost, "/admin/config/validate",
+		`{"USER_CREATED_WEBHOOK":"ftp://hooks.example.com/T0KEN"}`, adminAuth...)
+	wantStatus(t, rec, http.StatusOK)
+	if strings.Contains(rec.Body.String(), "T0KEN") {
+		t.Fatalf("validate echoes the webhook URL: %s", rec.Body)
+	}
+	if errs, _ := jsonBody(t, rec)["errors"].([]any); len(errs) != 1 || !strings.Contains(errs[0].(string), "USER_CREATED_WEBHOOK: invalid URL [redacted]") {
+		t.Fatalf("errors = %v", errs)
+	}
+}
@@ -0,0 +1,17 @@
+// contextkey.go
+package main
+
+// contextKey namespaces the values this service stores in a
+// context.Context. Being unexported, it cannot collide with keys from other
+// packages; each value gets its own constant and typed accessors next to
+// the code that owns it.
+type contextKey int
+
+const (
+	requestIDKey contextKey = iota
+	queryLogKey
+	logFieldsKey
+	dbTimeKey
+	queryTimerKey
+	principalKey
+)
@@ -0,0 +1,40 @@
+// contextkey_test.go
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestContextKeysDoNotCollide(t *testing.T) {
+	p := &principal{scopes: []string{scopeAdmin}}
+	ctx := withPrincipal(withRequestID(context.Background(), "req-1"), p)
+	if got := requestIDFrom(ctx); got != "req-1" {
+		t.Fatalf("request id = %q", got)
+	}
+	if principalFrom(ctx) != p {
+		t.Fatal("principal lost")
+	}
+
+	// Neither a foreign key of the same underlying value nor a plain string
+	// reads this package's values.
+	type otherKey int
+	ctx = context.WithValue(ctx, otherKey(requestIDKey), "foreign")
+	ctx = context.WithValue(ctx, "requestIDKey", "string")
+	if got := requestIDFrom(ctx); got != "req-1" {
+		t.Fatalf("request id overwritten by a foreign key: %q", got)
+	}
+	if requestIDFrom(context.Background()) != "" || principalFrom(context.Background()) != nil {
+		t.Fatal("empty context yields values")
+	}
+}
+
+func TestRequestIDInHandlerContext(t *testing.T) {
+	ta := newTestApp(t, nil)
+	rec := ta.do(t, http.MethodGet, "/users", "", "X-Request-ID", "abc123")
+	wantStatus(t, rec, http.StatusOK)
+	if got := rec.Header().Get("X-Request-ID"); got != "abc123" {
+		t.Fatalf("X-Request-ID = %q", got)
+	}
+}
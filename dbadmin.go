@@ -0,0 +1,152 @@
+// dbadmin.go
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// reconnectMu serializes reconnects so one can't restore the idle limit in
+// the middle of another.
+var reconnectMu sync.Mutex
+
+// dbReconnect discards the pool's idle connections, so that after a failover
+// new queries dial the promoted primary instead of reusing dead sockets.
+// Connections busy at the time are kept until their query finishes.
+func (a *App) dbReconnect(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, http.MethodPost)
+		return
+	}
+	if a.DB == nil {
+		jsonWrite(w, http.StatusConflict, map[string]string{"error": "No database in use"})
+		return
+	}
+
+	reconnectMu.Lock()
+	before := a.DB.Stats()
+	a.DB.SetMaxIdleConns(0)
+	a.DB.SetMaxIdleConns(a.Config.DBMaxIdleConns)
+	closed := a.DB.Stats().MaxIdleClosed - before.MaxIdleClosed
+	reconnectMu.Unlock()
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	if err := a.DB.PingContext(ctx); err != nil {
+		writeDBError(w, err)
+		return
+	}
+	jsonWrite(w, http.StatusOK, map[string]int64{
+		"closed_idle": closed,
+		"in_use":      int64(before.InUse),
+	})
+}
+
+// dbInfo reports the server version and installed extensions, to confirm
+// the service talks to the expected Postgres build.
+func (a *App) dbInfo(w http.ResponseWriter, r *http.Request) {
+	if a.DB == nil {
+		jsonWrite(w, http.StatusConflict, map[string]string{"error": "No database in use"})
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	var version string
+	if err := a.DB.QueryRowContext(ctx, "SELECT version()").Scan(&version); err != nil {
+		writeDBError(w, err)
+		return
+	}
+	extensions, err := a.listExtensions(ctx)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	jsonWrite(w, http.StatusOK, map[string]any{"version": version, "extensions": extensions})
+}
+
+func (a *App) listExtensions(ctx context.Context) (names []string, err error) {
+	rows, err := a.DB.QueryContext(ctx, "SELECT extname FROM pg_extension ORDER BY extname")
+	if err != nil {
+		return nil, err
+	}
+	defer closeRows(rows, &err)
+
+	names = []string{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// dbPingBench times n sequential SELECT 1 round trips on one connection, so
+// pool waits don't skew the numbers, and reports their distribution.
+func (a *App) dbPingBench(w http.ResponseWriter, r *http.Request) {
+	if a.DB == nil {
+		jsonWrite(w, http.StatusConflict, map[string]string{"error": "No database in use"})
+		return
+	}
+	n := 100
+	if v := r.URL.Query().Get("n"); v != "" {
+		var err error
+		if n, err = strconv.Atoi(v); err != nil || n < 1 {
+			jsonWrite(w, http.StatusBadRequest, map[string]string{"error": "n must be a positive integer"})
+			return
+		}
+	}
+	n = min(n, a.Config.PingBenchMax)
+
+	ctx, cancel := context.WithTimeout(r.Context(), a.Config.PingBenchTimeout)
+	defer cancel()
+	c, err := a.DB.Conn(ctx)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	defer c.Close()
+
+	samples := make([]time.Duration, 0, n)
+	timedOut := false
+	for range n {
+		start := time.Now()
+		var one int
+		if err := c.QueryRowContext(ctx, "SELECT 1").Scan(&one); err != nil {
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) && len(samples) > 0 {
+				timedOut = true
+				break
+			}
+			writeDBError(w, err)
+			return
+		}
+		samples = append(samples, time.Since(start))
+	}
+
+	slices.Sort(samples)
+	var total time.Duration
+	for _, d := range samples {
+		total += d
+	}
+	ms := func(d time.Duration) float64 { return float64(d.Microseconds()) / 1000 }
+	quantile := func(q float64) time.Duration { return samples[int(q*float64(len(samples)-1))] }
+	resp := map[string]any{
+		"n":      len(samples),
+		"min_ms": ms(samples[0]),
+		"avg_ms": ms(total / time.Duration(len(samples))),
+		"p50_ms": ms(quantile(0.50)),
+		"p95_ms": ms(quantile(0.95)),
+		"max_ms": ms(samples[len(samples)-1]),
+	}
+	if timedOut {
+		resp["timed_out"] = true
+	}
+	jsonWrite(w, http.StatusOK, resp)
+}
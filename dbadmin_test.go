@@ -0,0 +1,231 @@
+// dbadmin_test.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// dialCounter is a pingConnector that counts the connections it opens.
+type dialCounter struct {
+	pingConnector
+	dials atomic.Int32
+}
+
+func (c *dialCounter) Connect(ctx context.Context) (driver.Conn, error) {
+	c.dials.Add(1)
+	return c.pingConnector.Connect(ctx)
+}
+
+func TestDBReconnectDialsFreshConnections(t *testing.T) {
+	ta := newTestApp(t, map[string]string{"ADMIN_TOKEN": "secret"})
+	dialer := &dialCounter{pingConnector: pingConnector{new(atomic.Bool)}}
+	ta.DB = sql.OpenDB(dialer)
+	t.Cleanup(func() { ta.DB.Close() })
+	ta.DB.SetMaxIdleConns(ta.Config.DBMaxIdleConns)
+
+	query := func() {
+		t.Helper()
+		var one int
+		if err := ta.DB.QueryRow("SELECT 1").Scan(&one); err != nil {
+			t.Fatal(err)
+		}
+	}
+	query()
+	query()
+	if n := dialer.dials.Load(); n != 1 {
+		t.Fatalf("dials = %d, want the idle connection reused", n)
+	}
+
+	rec := ta.do(t, http.MethodPost, "/admin/db/reconnect", "", adminAuth...)
+	wantStatus(t, rec, http.StatusOK)
+	if got := jsonBody(t, rec)["closed_idle"]; got != 1.0 {
+		t.Fatalf("closed_idle = %v", got)
+	}
+	// The ping after the reset dialed one fresh connection, which stays idle
+	// for the next query.
+	query()
+	if n := dialer.dials.Load(); n != 2 {
+		t.Fatalf("dials = %d, want one fresh connection after reconnect", n)
+	}
+	if got := ta.DB.Stats().MaxIdleClosed; got != 1 {
+		t.Fatalf("MaxIdleClosed = %d", got)
+	}
+}
+
+func TestDBReconnectRequiresAdminAndDatabase(t *testing.T) {
+	ta := newTestApp(t, map[string]string{"ADMIN_TOKEN": "secret"})
+	wantStatus(t, ta.do(t, http.MethodPost, "/admin/db/reconnect", ""), http.StatusUnauthorized)
+	wantStatus(t, ta.do(t, http.MethodGet, "/admin/db/reconnect", "", adminAuth...), http.StatusMethodNotAllowed)
+	wantStatus(t, ta.do(t, http.MethodPost, "/admin/db/reconnect", "", adminAuth...), http.StatusConflict)
+}
+
+// textConnector's connections answer a query with the rows listed for the
+// first key it contains, one text column each, and fail any other query.
+type textConnector map[string][]string
+
+func (c textConnector) Connect(context.Context) (driver.Conn, error) { return textConn(c), nil }
+func (textConnector) Driver() driver.Driver                          { return nil }
+
+type textConn map[string][]string
+
+func (textConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("stub: no statements") }
+func (textConn) Close() error                        { return nil }
+func (textConn) Begin() (driver.Tx, error)           { return nil, errors.New("stub: no transactions") }
+
+func (c textConn) QueryContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Rows, error) {
+	for key, vals := range c {
+		if strings.Contains(query, key) {
+			return &textRows{vals: vals}, nil
+		}
+	}
+	return nil, errors.New("stub: relation does not exist")
+}
+
+type textRows struct{ vals []string }
+
+func (*textRows) Columns() []string { return []string{"text"} }
+func (*textRows) Close() error      { return nil }
+
+func (r *textRows) Next(dest []driver.Value) error {
+	if len(r.vals) == 0 {
+		return io.EOF
+	}
+	dest[0], r.vals = r.vals[0], r.vals[1:]
+	return nil
+}
+
+func TestDBInfo(t *testing.T) {
+	ta := newTestApp(t, map[string]string{"ADMIN_TOKEN": "secret"})
+	wantStatus(t, ta.do(t, http.MethodGet, "/admin/db/info", "", adminAuth...), http.StatusConflict)
+
+	open := func(c textConnector) *sql.DB {
+		db := sql.OpenDB(c)
+		t.Cleanup(func() { db.Close() })
+		return db
+	}
+	ta.DB = open(textConnector{
+		"version()":    {"PostgreSQL 17.2 on x86_64-pc-linux-gnu"},
+		"pg_extension": {"citext", "plpgsql"},
+	})
+	wantStatus(t, ta.do(t, http.MethodGet, "/admin/db/info", ""), http.StatusUnauthorized)
+	rec := ta.do(t, http.MethodGet, "/admin/db/info", "", adminAuth...)
+	wantStatus(t, rec, http.StatusOK)
+	body := jsonBody(t, rec)
+	if body["version"] != "PostgreSQL 17.2 on x86_64-pc-linux-gnu" {
+		t.Fatalf("version = %v", body["version"])
+	}
+	if ext, _ := body["extensions"].([]any); !slices.Equal(ext, []any{"citext", "plpgsql"}) {
+		t.Fatalf("extensions = %v", body["extensions"])
+	}
+
+	// A failing catalog query is a server error, not a crash or a 200.
+	ta.DB = open(textConnector{"version()": {"PostgreSQL 17.2"}})
+	wantStatus(t, ta.do(t, http.MethodGet, "/admin/db/info", "", adminAuth...), http.StatusInternalServerError)
+}
+
+func TestDBInfoWithDatabase(t *testing.T) {
+	db := testDB(t)
+	ta := newTestApp(t, map[string]string{"ADMIN_TOKEN": "secret"})
+	ta.DB = db
+	rec := ta.do(t, http.MethodGet, "/admin/db/info", "", adminAuth...)
+	wantStatus(t, rec, http.StatusOK)
+	body := jsonBody(t, rec)
+	if v, _ := body["version"].(string); !strings.HasPrefix(v, "PostgreSQL ") {
+		t.Fatalf("version = %v", body["version"])
+	}
+	if ext, _ := body["extensions"].([]any); !slices.Contains(ext, any("plpgsql")) {
+		t.Fatalf("extensions = %v", body["extensions"])
+	}
+}
+
+func TestDBPingBench(t *testing.T) {
+	ta := newTestApp(t, map[string]string{"ADMIN_TOKEN": "secret", "PING_BENCH_MAX": "50"})
+	wantStatus(t, ta.do(t, http.MethodGet, "/admin/db/ping-bench", "", adminAuth...), http.StatusConflict)
+
+	var queries atomic.Int32
+	db := sql.OpenDB(rowsConnector{func() driver.Rows {
+		queries.Add(1)
+		return &textRows{vals: []string{"1"}}
+	}})
+	t.Cleanup(func() { db.Close() })
+	ta.DB = db
+
+	wantStatus(t, ta.do(t, http.MethodGet, "/admin/db/ping-bench", ""), http.StatusUnauthorized)
+	for _, n := range []string{"0", "-3", "ten"} {
+		wantStatus(t, ta.do(t, http.MethodGet, "/admin/db/ping-bench?n="+n, "", adminAuth...), http.StatusBadRequest)
+	}
+
+	rec := ta.do(t, http.MethodGet, "/admin/db/ping-bench?n=10", "", adminAuth...)
+	wantStatus(t, rec, http.StatusOK)
+	body := jsonBody(t, rec)
+	if body["n"] != float64(10) || queries.Load() != 10 {
+		t.Fatalf("n = %v after %d queries", body["n"], queries.Load())
+	}
+	for _, key := range []string{"min_ms", "avg_ms", "p50_ms", "p95_ms", "max_ms"} {
+		if _, ok := body[key].(float64); !ok {
+			t.Fatalf("%s missing: %v", key, body)
+		}
+	}
+	if !(body["min_ms"].(float64) <= body["p50_ms"].(float64) && body["p50_ms"].(float64) <= body["max_ms"].(float64)) {
+		t.Fatalf("stats out of order: %v", body)
+	}
+	if _, ok := body["timed_out"]; ok {
+		t.Fatalf("timed_out set on a complete run: %v", body)
+	}
+
+	queries.Store(0)
+	rec = ta.do(t, http.MethodGet, "/admin/db/ping-bench?n=100000", "", adminAuth...)
+	wantStatus(t, rec, http.StatusOK)
+	if body := jsonBody(t, rec); body["n"] != float64(50) || queries.Load() != 50 {
+		t.Fatalf("n = %v after %d queries, want capped at 50", body["n"], queries.Load())
+	}
+}
+
+// slowConnector's connections answer every query with one row of "1"
+// after the delay, or fail with the context's error if it ends first.
+type slowConnector time.Duration
+
+func (c slowConnector) Connect(context.Context) (driver.Conn, error) { return slowConn(c), nil }
+func (slowConnector) Driver() driver.Driver                          { return nil }
+
+type slowConn time.Duration
+
+func (slowConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("stub: no statements") }
+func (slowConn) Close() error                        { return nil }
+func (slowConn) Begin() (driver.Tx, error)           { return nil, errors.New("stub: no transactions") }
+
+func (c slowConn) QueryContext(ctx context.Context, _ string, _ []driver.NamedValue) (driver.Rows, error) {
+	select {
+	case <-time.After(time.Duration(c)):
+		return &textRows{vals: []string{"1"}}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func TestDBPingBenchTimeout(t *testing.T) {
+	ta := newTestApp(t, map[string]string{"ADMIN_TOKEN": "secret", "PING_BENCH_TIMEOUT": "100ms"})
+	db := sql.OpenDB(slowConnector(20 * time.Millisecond))
+	t.Cleanup(func() { db.Close() })
+	ta.DB = db
+
+	rec := ta.do(t, http.MethodGet, "/admin/db/ping-bench?n=1000", "", adminAuth...)
+	wantStatus(t, rec, http.StatusOK)
+	body := jsonBody(t, rec)
+	if body["timed_out"] != true {
+		t.Fatalf("timed_out = %v", body["timed_out"])
+	}
+	if n := body["n"].(float64); n < 1 || n >= 1000 {
+		t.Fatalf("n = %v, want the round trips done before the timeout", n)
+	}
+}
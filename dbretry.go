@@ -0,0 +1,89 @@
+// dbretry.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var dbReadRetries = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "db_read_retries_total",
+	Help: "Reads run again on a fresh connection after theirs was lost (DB_READ_RETRY).",
+})
+
+// isConnectionLost reports whether err means the database connection went
+// away, as on a failover, rather than the statement failing: the same
+// statement may well succeed on another connection. Expiry of the caller's
+// own context is not a lost connection.
+func isConnectionLost(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, sql.ErrConnDone) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, net.ErrClosed) {
+		return true
+	}
+	// Class 08 is connection_exception; 57P01-03 are sent to the sessions a
+	// server shutting down or restarting terminates.
+	switch code := pgErrorCode(err); {
+	case strings.HasPrefix(code, "08"), code == "57P01", code == "57P02", code == "57P03":
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr)
+}
+
+// readRetryStore runs each read of the wrapped store once more when its
+// connection is lost mid-query (DB_READ_RETRY). database/sql already
+// retries a connection found dead before a query is sent; this covers one
+// dying while the query runs. Reads are safe to repeat; writes pass
+// through untouched, since a lost write may still have committed.
+type readRetryStore struct {
+	userStore
+}
+
+func retryRead[T any](ctx context.Context, what string, read func() (T, error)) (T, error) {
+	v, err := read()
+	if !isConnectionLost(err) || ctx.Err() != nil {
+		return v, err
+	}
+	dbReadRetries.Inc()
+	logger(ctx).Warn("database connection lost, retrying read", "read", what, "err", err)
+	return read()
+}
+
+func (s readRetryStore) GetUser(ctx context.Context, id int32) (User, error) {
+	return retryRead(ctx, "get_user", func() (User, error) { return s.userStore.GetUser(ctx, id) })
+}
+
+func (s readRetryStore) GetUserByEmail(ctx context.Context, email string) (User, error) {
+	return retryRead(ctx, "get_user_by_email", func() (User, error) { return s.userStore.GetUserByEmail(ctx, email) })
+}
+
+func (s readRetryStore) ListUsers(ctx context.Context, p pageParams) ([]User, error) {
+	return retryRead(ctx, "list_users", func() ([]User, error) { return s.userStore.ListUsers(ctx, p) })
+}
+
+func (s readRetryStore) ListUsersByEmails(ctx context.Context, emails []string) ([]User, error) {
+	return retryRead(ctx, "list_users_by_emails", func() ([]User, error) { return s.userStore.ListUsersByEmails(ctx, emails) })
+}
+
+func (s readRetryStore) UserStats(ctx context.Context) (userStats, error) {
+	return retryRead(ctx, "user_stats", func() (userStats, error) { return s.userStore.UserStats(ctx) })
+}
+
+func (s readRetryStore) EmailDomains(ctx context.Context, limit int) ([]domainCount, error) {
+	return retryRead(ctx, "email_domains", func() ([]domainCount, error) { return s.userStore.EmailDomains(ctx, limit) })
+}
+
+func (s readRetryStore) RandomUser(ctx context.Context) (User, error) {
+	return retryRead(ctx, "random_user", func() (User, error) { return s.userStore.RandomUser(ctx) })
+}
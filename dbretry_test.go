@@ -0,0 +1,159 @@
+// dbretry_test.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// droppingStore loses the connection on the first drops calls of each
+// read and of CreateUser, as a failover would, then defers to userStore.
+type droppingStore struct {
+	userStore
+	drops int32
+	calls atomic.Int32
+}
+
+func (s *droppingStore) drop() error {
+	if s.calls.Add(1) <= s.drops {
+		return fmt.Errorf("get user: %w", driver.ErrBadConn)
+	}
+	return nil
+}
+
+func (s *droppingStore) GetUser(ctx context.Context, id int32) (User, error) {
+	if err := s.drop(); err != nil {
+		return User{}, err
+	}
+	return s.userStore.GetUser(ctx, id)
+}
+
+func (s *droppingStore) ListUsers(ctx context.Context, p pageParams) ([]User, error) {
+	if err := s.drop(); err != nil {
+		return nil, err
+	}
+	return s.userStore.ListUsers(ctx, p)
+}
+
+func (s *droppingStore) CreateUser(ctx context.Context, username, email string) (int32, error) {
+	if err := s.drop(); err != nil {
+		return 0, err
+	}
+	return s.userStore.CreateUser(ctx, username, email)
+}
+
+func TestReadRetryStoreRetriesOnce(t *testing.T) {
+	mem := newMemoryStore(false)
+	id, err := mem.CreateUser(context.Background(), "ann", "ann@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := testutil.ToFloat64(dbReadRetries)
+
+	flaky := &droppingStore{userStore: mem, drops: 1}
+	u, err := readRetryStore{flaky}.GetUser(context.Background(), id)
+	if err != nil || u.Username != "ann" {
+		t.Fatalf("GetUser = %+v, %v", u, err)
+	}
+	if n := flaky.calls.Load(); n != 2 {
+		t.Fatalf("store called %d times, want 2", n)
+	}
+	if got := testutil.ToFloat64(dbReadRetries) - before; got != 1 {
+		t.Fatalf("retries counted %v, want 1", got)
+	}
+
+	// Only once: a second loss is returned.
+	flaky = &droppingStore{userStore: mem, drops: 2}
+	if _, err := (readRetryStore{flaky}).GetUser(context.Background(), id); !errors.Is(err, driver.ErrBadConn) {
+		t.Fatalf("err = %v, want ErrBadConn", err)
+	}
+
+	// Nor after the caller has given up.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	flaky = &droppingStore{userStore: mem, drops: 1}
+	if _, err := (readRetryStore{flaky}).GetUser(ctx, id); !errors.Is(err, driver.ErrBadConn) || flaky.calls.Load() != 1 {
+		t.Fatalf("retried for a canceled caller: %v after %d calls", err, flaky.calls.Load())
+	}
+
+	// Writes are never repeated.
+	flaky = &droppingStore{userStore: mem, drops: 1}
+	if _, err := (readRetryStore{flaky}).CreateUser(context.Background(), "bob", "bob@example.com"); !errors.Is(err, driver.ErrBadConn) || flaky.calls.Load() != 1 {
+		t.Fatalf("write retried: %v after %d calls", err, flaky.calls.Load())
+	}
+}
+
+func TestDroppedConnectionThroughHandlers(t *testing.T) {
+	ta := newTestApp(t, nil)
+	ta.createUser(t, "ann", "ann@example.com")
+	flaky := &droppingStore{userStore: ta.Users.store, drops: 1}
+	ta.Users.store = readRetryStore{flaky}
+	rec := ta.do(t, http.MethodGet, "/users/1", "")
+	wantStatus(t, rec, http.StatusOK)
+	if jsonBody(t, rec)["username"] != "ann" {
+		t.Fatalf("body = %s", rec.Body)
+	}
+
+	flaky.calls.Store(0)
+	wantStatus(t, ta.do(t, http.MethodGet, "/users", ""), http.StatusOK)
+
+	// A lost write is 503, for the client to retry.
+	flaky.calls.Store(0)
+	rec = ta.do(t, http.MethodPost, "/users", `{"username":"bob","email":"bob@example.com"}`)
+	wantStatus(t, rec, http.StatusServiceUnavailable)
+	if got := jsonBody(t, rec)["code"]; got != "DB_CONNECTION_LOST" {
+		t.Fatalf("code = %v", got)
+	}
+}
+
+func TestIsConnectionLost(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"bad conn", fmt.Errorf("query: %w", driver.ErrBadConn), true},
+		{"conn done", sql.ErrConnDone, true},
+		{"eof", io.ErrUnexpectedEOF, true},
+		{"closed", net.ErrClosed, true},
+		{"op error", &net.OpError{Op: "read", Err: errors.New("connection reset by peer")}, true},
+		{"admin shutdown", &pgconn.PgError{Code: "57P01"}, true},
+		{"connection exception", &pgconn.PgError{Code: "08006"}, true},
+		{"unique violation", &pgconn.PgError{Code: "23505"}, false},
+		{"deadline", fmt.Errorf("%w: %w", context.DeadlineExceeded, io.EOF), false},
+		{"canceled", context.Canceled, false},
+		{"other", errors.New("boom"), false},
+	}
+	for _, tt := range tests {
+		if got := isConnectionLost(tt.err); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDBErrorDetailIsLoggedNotSent(t *testing.T) {
+	out := captureDefaultLog(t)
+	rec := httptest.NewRecorder()
+	writeDBError(rec, errors.New(`insert: relation "users_secret" does not exist`))
+	wantStatus(t, rec, http.StatusInternalServerError)
+	if body := jsonBody(t, rec); len(body) != 1 || body["error"] != "Database error" {
+		t.Fatalf("body = %v", body)
+	}
+	if !strings.Contains(out.String(), "users_secret") {
+		t.Fatalf("detail not logged: %s", out)
+	}
+}
@@ -0,0 +1,85 @@
+// dbtiming.go
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	routeDBSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_route_db_seconds",
+		Help:    "Time spent in database queries per request, by route pattern.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route"})
+	routeHandlerSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_route_handler_seconds",
+		Help:    "Time spent outside database queries per request, by route pattern.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route"})
+)
+
+// dbTime sums the query time of one request, atomically since database/sql
+// may still be finishing a query when a timed-out handler moves on.
+type dbTime struct {
+	ns atomic.Int64
+}
+
+func dbTimeFrom(ctx context.Context) *dbTime {
+	t, _ := ctx.Value(dbTimeKey).(*dbTime)
+	return t
+}
+
+// timeRoutes splits each request's duration into database and other time
+// (ROUTE_TIMING_METRICS) and observes both under the mux pattern it
+// matches. Middleware time, such as idempotency lookups, is included.
+func timeRoutes(mux *http.ServeMux, exemplars bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := "unmatched"
+		if _, pattern := mux.Handler(r); pattern != "" {
+			route = pattern
+		}
+		var traceID string
+		if exemplars {
+			traceID, _ = sampledTraceID(r)
+		}
+		t := &dbTime{}
+		start := time.Now()
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), dbTimeKey, t)))
+
+		total := time.Since(start)
+		db := time.Duration(t.ns.Load())
+		observe(routeDBSeconds.WithLabelValues(route), db.Seconds(), traceID)
+		observe(routeHandlerSeconds.WithLabelValues(route), max(total-db, 0).Seconds(), traceID)
+	})
+}
+
+// queryTimer is a pgx tracer adding each statement's duration to the
+// request's dbTime. It forwards to next, the query logger when LOG_QUERIES
+// is on, since a connection takes a single tracer.
+type queryTimer struct {
+	next pgx.QueryTracer
+}
+
+func (q *queryTimer) TraceQueryStart(ctx context.Context, conn *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+	if q.next != nil {
+		ctx = q.next.TraceQueryStart(ctx, conn, data)
+	}
+	return context.WithValue(ctx, queryTimerKey, time.Now())
+}
+
+func (q *queryTimer) TraceQueryEnd(ctx context.Context, conn *pgx.Conn, data pgx.TraceQueryEndData) {
+	if q.next != nil {
+		q.next.TraceQueryEnd(ctx, conn, data)
+	}
+	start, ok := ctx.Value(queryTimerKey).(time.Time)
+	if t := dbTimeFrom(ctx); ok && t != nil {
+		t.ns.Add(int64(time.Since(start)))
+	}
+}
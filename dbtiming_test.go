@@ -0,0 +1,105 @@
+// dbtiming_test.go
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// tracedStore reports every GetUser to tracer as a query taking delay, the
+// way pgx calls its tracer around each statement.
+type tracedStore struct {
+	userStore
+	tracer pgx.QueryTracer
+	delay  time.Duration
+}
+
+func (s tracedStore) GetUser(ctx context.Context, id int32) (User, error) {
+	ctx = s.tracer.TraceQueryStart(ctx, nil, pgx.TraceQueryStartData{SQL: sqlGetUser})
+	time.Sleep(s.delay)
+	defer s.tracer.TraceQueryEnd(ctx, nil, pgx.TraceQueryEndData{})
+	return s.userStore.GetUser(ctx, id)
+}
+
+// scrapeHistogram reads the count and sum of histogram name for route
+// from /metrics.
+func scrapeHistogram(t *testing.T, ta *testApp, name, route string) (count, sum float64) {
+	t.Helper()
+	rec := ta.do(t, http.MethodGet, "/metrics", "")
+	wantStatus(t, rec, http.StatusOK)
+	label := fmt.Sprintf("{route=%q}", route)
+	sc := bufio.NewScanner(rec.Body)
+	for sc.Scan() {
+		series, value, ok := strings.Cut(sc.Text(), " ")
+		if !ok {
+			continue
+		}
+		v, _ := strconv.ParseFloat(value, 64)
+		switch series {
+		case name + "_count" + label:
+			count = v
+		case name + "_sum" + label:
+			sum = v
+		}
+	}
+	return count, sum
+}
+
+func TestRouteTimingMetrics(t *testing.T) {
+	ta := newTestApp(t, map[string]string{"ROUTE_TIMING_METRICS": "true"})
+	id := ta.createUser(t, "ann", "ann@example.com")
+	const delay = 30 * time.Millisecond
+	ta.Users.store = tracedStore{ta.Users.store, &queryTimer{}, delay}
+
+	dbCount, dbSum := scrapeHistogram(t, ta, "http_route_db_seconds", "/users/")
+	handlerCount, _ := scrapeHistogram(t, ta, "http_route_handler_seconds", "/users/")
+	wantStatus(t, ta.do(t, http.MethodGet, "/users/"+strconv.Itoa(int(id)), ""), http.StatusOK)
+
+	count, sum := scrapeHistogram(t, ta, "http_route_db_seconds", "/users/")
+	if count != dbCount+1 || sum-dbSum < delay.Seconds() {
+		t.Fatalf("db histogram rose by %v observations totalling %vs, want 1 of at least %v", count-dbCount, sum-dbSum, delay)
+	}
+	if count, _ := scrapeHistogram(t, ta, "http_route_handler_seconds", "/users/"); count != handlerCount+1 {
+		t.Fatalf("handler histogram rose by %v observations, want 1", count-handlerCount)
+	}
+}
+
+func TestRouteTimingUnmatched(t *testing.T) {
+	ta := newTestApp(t, map[string]string{"ROUTE_TIMING_METRICS": "true"})
+	before, _ := scrapeHistogram(t, ta, "http_route_handler_seconds", "unmatched")
+	ta.do(t, http.MethodGet, "/no/such/path", "")
+	ta.do(t, http.MethodGet, "/another", "")
+	if after, _ := scrapeHistogram(t, ta, "http_route_handler_seconds", "unmatched"); after != before+2 {
+		t.Fatalf("unmatched rose by %v, want 2", after-before)
+	}
+}
+
+func TestQueryTimerChainsAndSums(t *testing.T) {
+	out := captureDefaultLog(t)
+	q := &queryTimer{next: newQueryLogger(nil)}
+	acc := &dbTime{}
+	ctx := context.WithValue(context.Background(), dbTimeKey, acc)
+	for range 2 {
+		qctx := q.TraceQueryStart(ctx, nil, pgx.TraceQueryStartData{SQL: sqlGetUser, Args: []any{int32(1)}})
+		time.Sleep(5 * time.Millisecond)
+		q.TraceQueryEnd(qctx, nil, pgx.TraceQueryEndData{})
+	}
+	if got := time.Duration(acc.ns.Load()); got < 10*time.Millisecond {
+		t.Fatalf("summed %v, want at least 10ms", got)
+	}
+	if lines := logLines(t, out); len(lines) != 2 {
+		t.Fatalf("query logger saw %d queries, want 2", len(lines))
+	}
+
+	// Queries made outside a timed request are ignored.
+	qctx := q.TraceQueryStart(context.Background(), nil, pgx.TraceQueryStartData{SQL: sqlGetUser})
+	q.TraceQueryEnd(qctx, nil, pgx.TraceQueryEndData{})
+}
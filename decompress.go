@@ -0,0 +1,307 @@
+// decompress.go
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+var errBodyTooLarge = errors.New("request body too large")
+
+// errTrailingData rejects a body with more after its JSON document, such as
+// two concatenated objects (STRICT_JSON).
+var errTrailingData = errors.New("unexpected data after the JSON document")
+
+// errTooManyTokens rejects a body of more than MAX_JSON_TOKENS tokens.
+var errTooManyTokens = errors.New("too many JSON tokens")
+
+// gzipBody inflates a gzip request body, failing once more than max
+// decompressed bytes have been produced (zip-bomb guard). The failure is
+// sticky and nothing past the limit is inflated, so a reader that retries
+// after an error still can't pull the rest of the stream.
+type gzipBody struct {
+	zr   *gzip.Reader
+	body io.ReadCloser
+	n    int64
+	max  int64
+}
+
+func (b *gzipBody) Read(p []byte) (int, error) {
+	if b.n > b.max {
+		return 0, errBodyTooLarge
+	}
+	if room := b.max - b.n + 1; int64(len(p)) > room {
+		p = p[:room]
+	}
+	n, err := b.zr.Read(p)
+	b.n += int64(n)
+	if b.n > b.max {
+		return n, errBodyTooLarge
+	}
+	return n, err
+}
+
+func (b *gzipBody) Close() error {
+	b.zr.Close()
+	return b.body.Close()
+}
+
+// limitBodies caps every request body at maxBytes as sent, or importMax
+// for POST /users/import, whose CSV bodies are legitimately larger. A body
+// declaring more is refused outright; reading past the limit of one that
+// doesn't fails with *http.MaxBytesError.
+func limitBodies(maxBytes, importMax int64, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit := bodyLimit(r, maxBytes, importMax)
+		if r.ContentLength > limit {
+			writeDecodeError(w, errBodyTooLarge, "")
+			return
+		}
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// bodyLimit is importMax for POST /users/import and maxBytes otherwise.
+func bodyLimit(r *http.Request, maxBytes, importMax int64) int64 {
+	if r.URL.Path == "/users/import" {
+		return importMax
+	}
+	return maxBytes
+}
+
+// isBodyTooLarge reports whether err is a body size limit being hit, either
+// the one on the sent body or the one on its inflated size.
+func isBodyTooLarge(err error) bool {
+	var mbe *http.MaxBytesError
+	return errors.Is(err, errBodyTooLarge) || errors.As(err, &mbe)
+}
+
+// decompressRequest transparently inflates bodies sent with
+// Content-Encoding: gzip, up to maxBytes inflated or, like limitBodies,
+// importMax for imports. Other encodings are rejected with 415.
+func decompressRequest(maxBytes, importMax int64, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		enc := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+		switch enc {
+		case "", "identity":
+			next.ServeHTTP(w, r)
+			return
+		case "gzip", "x-gzip":
+		default:
+			jsonWrite(w, http.StatusUnsupportedMediaType, map[string]string{"error": "unsupported Content-Encoding"})
+			return
+		}
+
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			recordValidationFailure("corrupt_body")
+			jsonWrite(w, http.StatusBadRequest, map[string]string{"error": "corrupt compressed body"})
+			return
+		}
+		r.Body = &gzipBody{zr: zr, body: r.Body, max: bodyLimit(r, maxBytes, importMax)}
+		r.Header.Del("Content-Encoding")
+		r.Header.Del("Content-Length")
+		r.ContentLength = -1
+		next.ServeHTTP(w, r)
+	})
+}
+
+// decodeBody decodes the request's JSON body into v. With STRICT_JSON,
+// numbers bound for any stay json.Number and anything but whitespace after
+// the document is an error.
+func (a *App) decodeBody(r *http.Request, v any) error {
+	dec := json.NewDecoder(r.Body)
+	if !a.Config.StrictJSON {
+		return dec.Decode(v)
+	}
+	dec.UseNumber()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		if err != nil && !isSyntaxError(err) {
+			// A read failure, e.g. the body limit, not trailing data.
+			return err
+		}
+		return errTrailingData
+	}
+	return nil
+}
+
+// decodeBatchBody is decodeBody for the batch endpoints, whose array bodies
+// can hold many small values within the size limit: with MAX_JSON_TOKENS
+// set it first counts the body's tokens, so a pathological one is rejected
+// before any decoding work is spent on it.
+func (a *App) decodeBatchBody(r *http.Request, v any) error {
+	if a.Config.MaxJSONTokens > 0 {
+		if err := limitTokens(r, a.Config.MaxJSONTokens); err != nil {
+			return err
+		}
+	}
+	return a.decodeBody(r, v)
+}
+
+// limitTokens streams the first JSON value of r's body through a token
+// counter, failing with errTooManyTokens as soon as there are more than
+// max. The bytes read are put back in front of the body for the real
+// decode; malformed JSON is left for it to report.
+func limitTokens(r *http.Request, max int) error {
+	var buf bytes.Buffer
+	body := r.Body
+	defer func() {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(&buf, body), body}
+	}()
+
+	dec := json.NewDecoder(io.TeeReader(body, &buf))
+	depth := 0
+	for n := 1; ; n++ {
+		if n > max {
+			return errTooManyTokens
+		}
+		t, err := dec.Token()
+		if err != nil {
+			return nil
+		}
+		switch t {
+		case json.Delim('['), json.Delim('{'):
+			depth++
+		case json.Delim(']'), json.Delim('}'):
+			depth--
+		}
+		if depth == 0 {
+			return nil
+		}
+	}
+}
+
+func isSyntaxError(err error) bool {
+	var se *json.SyntaxError
+	return errors.As(err, &se)
+}
+
+// integerFieldError names the integer field err failed to decode a number
+// into, and whether the number was integral but out of range rather than
+// fractional (1.5, 1e3).
+func integerFieldError(err error) (field string, outOfRange, ok bool) {
+	var te *json.UnmarshalTypeError
+	if !errors.As(err, &te) || te.Field == "" || !strings.HasPrefix(te.Value, "number ") {
+		return "", false, false
+	}
+	switch te.Type.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+	default:
+		return "", false, false
+	}
+	_, err = strconv.ParseInt(strings.TrimPrefix(te.Value, "number "), 10, 64)
+	return te.Field, err == nil || errors.Is(err, strconv.ErrRange), true
+}
+
+// writeDecodeError maps a request-body decode failure to a response; msg is
+// used for plain malformed JSON.
+func writeDecodeError(w http.ResponseWriter, err error, msg string) {
+	var corrupt flate.CorruptInputError
+	var mismatch *json.UnmarshalTypeError
+	field, outOfRange, badInteger := integerFieldError(err)
+	switch {
+	case isBodyTooLarge(err):
+		recordValidationFailure("body_too_large")
+		jsonWrite(w, http.StatusRequestEntityTooLarge, map[string]string{"error": "request body too large"})
+	case errors.Is(err, gzip.ErrChecksum), errors.Is(err, gzip.ErrHeader), errors.As(err, &corrupt):
+		recordValidationFailure("corrupt_body")
+		jsonWrite(w, http.StatusBadRequest, map[string]string{"error": "corrupt compressed body"})
+	case errors.Is(err, errTooManyTokens):
+		recordValidationFailure("too_many_tokens")
+		jsonWrite(w, http.StatusBadRequest, map[string]string{
+			"error": "request body has too many JSON tokens",
+			"code":  "TOO_MANY_TOKENS",
+		})
+	case errors.Is(err, errTrailingData):
+		recordValidationFailure("invalid_json")
+		jsonWrite(w, http.StatusBadRequest, map[string]string{
+			"error": "unexpected data after the JSON document",
+			"code":  "TRAILING_DATA",
+		})
+	case badInteger:
+		body := fieldErrorBody(field)
+		field = body["field"].(string)
+		if outOfRange {
+			recordValidationFailure("value_out_of_range")
+			body["error"], body["code"] = field+" is out of range", "VALUE_OUT_OF_RANGE"
+		} else {
+			recordValidationFailure("invalid_json")
+			body["error"], body["code"] = field+" must be an integer", "NOT_AN_INTEGER"
+		}
+		jsonWrite(w, http.StatusBadRequest, body)
+	case errors.As(err, &mismatch) && mismatch.Field != "":
+		recordValidationFailure("type_mismatch")
+		body := fieldErrorBody(mismatch.Field)
+		expected := jsonTypeName(mismatch.Type)
+		body["error"] = body["field"].(string) + " must be " + article(expected) + " " + expected
+		body["code"], body["expected"] = "TYPE_MISMATCH", expected
+		// Value is the JSON kind sent, with the literal for numbers.
+		body["received"], _, _ = strings.Cut(mismatch.Value, " ")
+		if body["received"] == "bool" {
+			body["received"] = "boolean"
+		}
+		jsonWrite(w, http.StatusBadRequest, body)
+	default:
+		recordValidationFailure("invalid_json")
+		jsonWrite(w, http.StatusBadRequest, map[string]string{"error": msg})
+	}
+}
+
+// fieldErrorBody starts an error body naming the JSON field at path. In an
+// array body the path starts with the element index, reported separately.
+func fieldErrorBody(path string) map[string]any {
+	body := map[string]any{}
+	if i, rest, ok := strings.Cut(path, "."); ok {
+		if n, err := strconv.Atoi(i); err == nil {
+			body["index"], path = n, rest
+		}
+	}
+	body["field"] = path
+	return body
+}
+
+// jsonTypeName names the JSON type a Go value of type t decodes from.
+func jsonTypeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Pointer:
+		return jsonTypeName(t.Elem())
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "integer"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+func article(noun string) string {
+	if strings.ContainsRune("aeiou", rune(noun[0])) {
+		return "an"
+	}
+	return "a"
+}
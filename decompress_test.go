@@ -0,0 +1,349 @@
+// decompress_test.go
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func gzipString(t *testing.T, s string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write([]byte(s)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestGzipRequestBody(t *testing.T) {
+	ta := newTestApp(t, nil)
+	body := gzipString(t, `{"username":"ann","email":"ann@example.com"}`)
+	wantStatus(t, ta.do(t, http.MethodPost, "/users", body, "Content-Encoding", "gzip"), http.StatusCreated)
+}
+
+func TestCorruptGzipRequestBody(t *testing.T) {
+	ta := newTestApp(t, nil)
+	body := gzipString(t, `{"username":"ann","email":"ann@example.com"}`)
+	for name, b := range map[string]string{
+		"not gzip":  "definitely not gzip",
+		"truncated": body[:len(body)/2],
+	} {
+		t.Run(name, func(t *testing.T) {
+			wantStatus(t, ta.do(t, http.MethodPost, "/users", b, "Content-Encoding", "gzip"), http.StatusBadRequest)
+		})
+	}
+	wantStatus(t, ta.do(t, http.MethodPost, "/users", body, "Content-Encoding", "br"), http.StatusUnsupportedMediaType)
+}
+
+func TestGzipBombRejected(t *testing.T) {
+	ta := newTestApp(t, map[string]string{"MAX_DECOMPRESSED_BODY_BYTES": "1024"})
+	body := gzipString(t, `{"username":"`+strings.Repeat("a", 1<<20)+`","email":"ann@example.com"}`)
+	wantStatus(t, ta.do(t, http.MethodPost, "/users", body, "Content-Encoding", "gzip"), http.StatusRequestEntityTooLarge)
+}
+
+func TestGzipImportGetsImportLimit(t *testing.T) {
+	ta := newTestApp(t, map[string]string{"MAX_DECOMPRESSED_BODY_BYTES": "64", "MAX_IMPORT_BODY_BYTES": "4096", "ADMIN_TOKEN": "secret"})
+	csv := importCSV("ann", 20)
+	if len(csv) <= 64 || len(csv) > 4096 {
+		t.Fatalf("csv is %d bytes", len(csv))
+	}
+	body := gzipString(t, csv)
+	wantStatus(t, ta.do(t, http.MethodPost, "/users/import", body, append([]string{"Content-Encoding", "gzip"}, adminAuth...)...), http.StatusCreated)
+
+	big := gzipString(t, importCSV("bob", 200))
+	wantStatus(t, ta.do(t, http.MethodPost, "/users/import", big, append([]string{"Content-Encoding", "gzip"}, adminAuth...)...), http.StatusRequestEntityTooLarge)
+}
+
+func TestBodyLimitAppliesToEveryBody(t *testing.T) {
+	ta := newTestApp(t, map[string]string{"MAX_BODY_BYTES": "64", "MAX_IMPORT_BODY_BYTES": "128", "ADMIN_TOKEN": "secret"})
+	big := `{"username":"ann","email":"` + strings.Repeat("a", 64) + `@example.com"}`
+	wantStatus(t, ta.do(t, http.MethodPost, "/users", big), http.StatusRequestEntityTooLarge)
+
+	// A body of unknown length is cut off while it is read.
+	r := httptest.NewRequest(http.MethodPost, "/users", strings.NewReader(big))
+	r.ContentLength = -1
+	r.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	ta.handler.ServeHTTP(rec, r)
+	wantStatus(t, rec, http.StatusRequestEntityTooLarge)
+
+	csv := "username,email\nann,ann@example.com\nbob,bob@example.com\ncy,cy@example.com\n"
+	wantStatus(t, ta.do(t, http.MethodPost, "/users/import", csv, adminAuth...), http.StatusCreated)
+	r = httptest.NewRequest(http.MethodPost, "/users/import", strings.NewReader(csv+csv))
+	r.ContentLength = -1
+	r.Header.Set(adminAuth[0], adminAuth[1])
+	rec = httptest.NewRecorder()
+	ta.handler.ServeHTTP(rec, r)
+	wantStatus(t, rec, http.StatusRequestEntityTooLarge)
+}
+
+func TestIntegerOverflowIsOutOfRange(t *testing.T) {
+	ta := newTestApp(t, nil)
+	ta.createUser(t, "ann", "ann@example.com")
+	counter := validationFailures.WithLabelValues("value_out_of_range")
+	before := testutil.ToFloat64(counter)
+
+	rec := ta.do(t, http.MethodPatch, "/users", `[{"user_id":1,"username":"ann2"},{"user_id":3000000000,"username":"x"}]`)
+	wantStatus(t, rec, http.StatusBadRequest)
+	body := jsonBody(t, rec)
+	if body["code"] != "VALUE_OUT_OF_RANGE" || body["field"] != "user_id" || body["index"] != float64(1) {
+		t.Fatalf("body = %v", body)
+	}
+	if got := testutil.ToFloat64(counter) - before; got != 1 {
+		t.Fatalf("value_out_of_range counted %v times", got)
+	}
+
+	// A number of the wrong shape keeps the generic message.
+	rec = ta.do(t, http.MethodPatch, "/users", `[{"user_id":1.5,"username":"x"}]`)
+	wantStatus(t, rec, http.StatusBadRequest)
+	if got := jsonBody(t, rec)["code"]; got == "VALUE_OUT_OF_RANGE" {
+		t.Fatalf("1.5 reported as out of range")
+	}
+}
+
+func TestIntegerFieldError(t *testing.T) {
+	decode := func(body string) error {
+		var v []struct {
+			ID    int32   `json:"user_id"`
+			Score float64 `json:"score"`
+			Name  string  `json:"name"`
+		}
+		return json.Unmarshal([]byte(body), &v)
+	}
+	tests := []struct {
+		body       string
+		field      string
+		outOfRange bool
+		ok         bool
+	}{
+		{`[{"user_id":2147483648}]`, "0.user_id", true, true},
+		{`[{"user_id":-2147483649}]`, "0.user_id", true, true},
+		{`[{"user_id":99999999999999999999999}]`, "0.user_id", true, true},
+		{`[{"user_id":1.5}]`, "0.user_id", false, true},
+		{`[{"name":12}]`, "", false, false},
+		{`[{"user_id":"7"}]`, "", false, false},
+	}
+	for _, tt := range tests {
+		field, outOfRange, ok := integerFieldError(decode(tt.body))
+		if field != tt.field || outOfRange != tt.outOfRange || ok != tt.ok {
+			t.Errorf("%s: got %q, %v, %v; want %q, %v, %v", tt.body, field, outOfRange, ok, tt.field, tt.outOfRange, tt.ok)
+		}
+	}
+	if _, _, ok := integerFieldError(errors.New("boom")); ok {
+		t.Error("unrelated error reported as an integer field error")
+	}
+}
+
+func TestStrictJSON(t *testing.T) {
+	ta := newTestApp(t, map[string]string{"STRICT_JSON": "true"})
+	wantStatus(t, ta.do(t, http.MethodPost, "/users", "{\"username\":\"ann\",\"email\":\"ann@example.com\"}\n\t "), http.StatusCreated)
+	for name, tt := range map[string]struct{ method, target, body string }{
+		"second document": {http.MethodPost, "/users", `{"username":"bob","email":"bob@example.com"}{"username":"cy","email":"cy@example.com"}`},
+		"garbage":         {http.MethodPost, "/users", `{"username":"bob","email":"bob@example.com"} trailing`},
+		"batch":           {http.MethodPatch, "/users", `[{"user_id":1,"username":"ann2"}],`},
+		"by emails":       {http.MethodPost, "/users/by-emails", `["ann@example.com"]["bob@example.com"]`},
+	} {
+		t.Run(name, func(t *testing.T) {
+			rec := ta.do(t, tt.method, tt.target, tt.body)
+			wantStatus(t, rec, http.StatusBadRequest)
+			if got := jsonBody(t, rec)["code"]; got != "TRAILING_DATA" {
+				t.Fatalf("code = %v", got)
+			}
+		})
+	}
+	if _, err := ta.Users.GetByEmail(context.Background(), "bob@example.com"); !errors.Is(err, errUserNotFound) {
+		t.Fatalf("body with trailing data was applied: %v", err)
+	}
+
+	rec := ta.do(t, http.MethodPatch, "/users", `[{"user_id":1,"username":"ann2"},{"user_id":1.5,"username":"x"}]`)
+	wantStatus(t, rec, http.StatusBadRequest)
+	if body := jsonBody(t, rec); body["code"] != "NOT_AN_INTEGER" || body["field"] != "user_id" || body["index"] != float64(1) {
+		t.Fatalf("body = %v", body)
+	}
+
+	// Lenient by default: the first document is used.
+	ta = newTestApp(t, nil)
+	wantStatus(t, ta.do(t, http.MethodPost, "/users", `{"username":"bob","email":"bob@example.com"} trailing`), http.StatusCreated)
+}
+
+func TestStrictJSONUsesNumber(t *testing.T) {
+	decode := func(strict bool) any {
+		ta := newTestApp(t, map[string]string{"STRICT_JSON": strconv.FormatBool(strict)})
+		var v map[string]any
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"n":12345678901234567890}`))
+		if err := ta.decodeBody(r, &v); err != nil {
+			t.Fatal(err)
+		}
+		return v["n"]
+	}
+	if n, ok := decode(true).(json.Number); !ok || n.String() != "12345678901234567890" {
+		t.Fatalf("strict n = %#v, want the exact json.Number", n)
+	}
+	if _, ok := decode(false).(float64); !ok {
+		t.Fatal("lenient decoding changed number type")
+	}
+}
+
+func TestTypeMismatch(t *testing.T) {
+	ta := newTestApp(t, nil)
+	ta.createUser(t, "ann", "ann@example.com")
+	counter := validationFailures.WithLabelValues("type_mismatch")
+	before := testutil.ToFloat64(counter)
+	tests := []struct {
+		name, method, target, body string
+		want                       map[string]any
+	}{
+		{"number for string", http.MethodPost, "/users", `{"username":123,"email":"bob@example.com"}`,
+			map[string]any{"field": "username", "expected": "string", "received": "number", "error": "username must be a string"}},
+		{"string for integer", http.MethodPatch, "/users", `[{"user_id":1,"username":"ann2"},{"user_id":"7","username":"x"}]`,
+			map[string]any{"field": "user_id", "index": float64(1), "expected": "integer", "received": "string", "error": "user_id must be an integer"}},
+		{"object for string", http.MethodPost, "/users", `{"username":{},"email":"bob@example.com"}`,
+			map[string]any{"field": "username", "expected": "string", "received": "object"}},
+		{"boolean for string", http.MethodPost, "/users", `{"username":"bob","email":true}`,
+			map[string]any{"field": "email", "expected": "string", "received": "boolean"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := ta.do(t, tt.method, tt.target, tt.body)
+			wantStatus(t, rec, http.StatusBadRequest)
+			body := jsonBody(t, rec)
+			if body["code"] != "TYPE_MISMATCH" {
+				t.Fatalf("body = %v", body)
+			}
+			for k, v := range tt.want {
+				if body[k] != v {
+					t.Errorf("%s = %v, want %v", k, body[k], v)
+				}
+			}
+		})
+	}
+	if got := testutil.ToFloat64(counter) - before; got != float64(len(tests)) {
+		t.Fatalf("type_mismatch counted %v times, want %d", got, len(tests))
+	}
+
+	// A top-level mismatch keeps the endpoint's own message.
+	rec := ta.do(t, http.MethodPatch, "/users", `{"user_id":1}`)
+	wantStatus(t, rec, http.StatusBadRequest)
+	if got := jsonBody(t, rec)["code"]; got == "TYPE_MISMATCH" {
+		t.Fatal("top-level mismatch reported as TYPE_MISMATCH")
+	}
+}
+
+func TestJSONTypeName(t *testing.T) {
+	tests := []struct {
+		v    any
+		want string
+	}{
+		{"", "string"},
+		{new(string), "string"},
+		{false, "boolean"},
+		{int32(0), "integer"},
+		{uint8(0), "integer"},
+		{0.5, "number"},
+		{[]string{}, "array"},
+		{map[string]any{}, "object"},
+		{struct{}{}, "object"},
+	}
+	for _, tt := range tests {
+		if got := jsonTypeName(reflect.TypeOf(tt.v)); got != tt.want {
+			t.Errorf("%T: got %q, want %q", tt.v, got, tt.want)
+		}
+	}
+}
+
+func TestFieldErrorBody(t *testing.T) {
+	tests := []struct {
+		path string
+		want map[string]any
+	}{
+		{"username", map[string]any{"field": "username"}},
+		{"2.user_id", map[string]any{"field": "user_id", "index": 2}},
+		{"address.city", map[string]any{"field": "address.city"}},
+	}
+	for _, tt := range tests {
+		got := fieldErrorBody(tt.path)
+		if len(got) != len(tt.want) || got["field"] != tt.want["field"] || got["index"] != tt.want["index"] {
+			t.Errorf("%q: got %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestMaxJSONTokens(t *testing.T) {
+	ta := newTestApp(t, map[string]string{"MAX_JSON_TOKENS": "50"})
+	ta.createUser(t, "ann", "ann@example.com")
+	counter := validationFailures.WithLabelValues("too_many_tokens")
+	before := testutil.ToFloat64(counter)
+
+	// 30 empty objects: 62 tokens in 92 bytes.
+	heavy := "[" + strings.Repeat("{},", 29) + "{}]"
+	for _, tt := range []struct{ method, target, body string }{
+		{http.MethodPatch, "/users", heavy},
+		{http.MethodPost, "/users/by-emails", "[" + strings.Repeat(`"a@b.co",`, 50) + `"a@b.co"]`},
+	} {
+		rec := ta.do(t, tt.method, tt.target, tt.body)
+		wantStatus(t, rec, http.StatusBadRequest)
+		if got := jsonBody(t, rec)["code"]; got != "TOO_MANY_TOKENS" {
+			t.Fatalf("%s %s: code = %v", tt.method, tt.target, got)
+		}
+	}
+	if got := testutil.ToFloat64(counter) - before; got != 2 {
+		t.Fatalf("too_many_tokens counted %v times", got)
+	}
+
+	// Small bodies keep their usual responses.
+	wantStatus(t, ta.do(t, http.MethodPatch, "/users", `[{"user_id":1,"username":"ann2"}]`), http.StatusOK)
+	wantStatus(t, ta.do(t, http.MethodPatch, "/users", `[{"user_id":1`), http.StatusBadRequest)
+	wantStatus(t, ta.do(t, http.MethodPost, "/users/by-emails", `["ann@example.com"]`), http.StatusOK)
+	// Only the batch endpoints count tokens.
+	wantStatus(t, ta.do(t, http.MethodPost, "/users", `{"username":"bob","email":"bob@example.com","x":`+heavy+`}`), http.StatusCreated)
+
+	ta = newTestApp(t, map[string]string{"MAX_JSON_TOKENS": "0"})
+	if got := jsonBody(t, ta.do(t, http.MethodPatch, "/users", heavy))["code"]; got == "TOO_MANY_TOKENS" {
+		t.Fatal("tokens counted with MAX_JSON_TOKENS=0")
+	}
+	if err := loadConfigErr(t, map[string]string{"MAX_JSON_TOKENS": "-1"}); err == nil {
+		t.Fatal("negative MAX_JSON_TOKENS accepted")
+	}
+}
+
+func TestLimitTokens(t *testing.T) {
+	tests := []struct {
+		body string
+		max  int
+		err  error
+	}{
+		{`[1,2]`, 4, nil},
+		{`[1,2]`, 3, errTooManyTokens},
+		{`{"a":[true,null]}`, 7, nil},
+		{`{"a":[true,null]}`, 6, errTooManyTokens},
+		{`"x"`, 1, nil},
+		{`[1,2] [3,4,5,6]`, 4, nil}, // only the first value is counted
+		{`[1,2,`, 10, nil},          // malformed: left for the decoder
+		{`[1,2,`, 2, errTooManyTokens},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/users", strings.NewReader(tt.body))
+		if err := limitTokens(r, tt.max); err != tt.err {
+			t.Errorf("%s, max %d: err = %v, want %v", tt.body, tt.max, err, tt.err)
+		}
+		var rest bytes.Buffer
+		if _, err := rest.ReadFrom(r.Body); err != nil || rest.String() != tt.body {
+			t.Errorf("%s: body after counting = %q, %v", tt.body, rest.String(), err)
+		}
+	}
+}
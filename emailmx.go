@@ -0,0 +1,110 @@
+// emailmx.go
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxDomainCacheEntries bounds the lookup cache; it is reset when full.
+const maxDomainCacheEntries = 10000
+
+// domainResolver is the subset of *net.Resolver the MX check uses.
+type domainResolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+type domainResult struct {
+	ok      bool
+	expires time.Time
+}
+
+// emailDomainChecker verifies that an email's domain can receive mail: it
+// has MX records or, failing that, an address (VALIDATE_EMAIL_MX).
+// Definitive answers are cached for ttl; transient DNS failures are not.
+type emailDomainChecker struct {
+	resolver domainResolver
+	timeout  time.Duration
+	ttl      time.Duration
+	allow    map[string]bool
+
+	mu    sync.Mutex
+	cache map[string]domainResult
+}
+
+func newEmailDomainChecker(resolver domainResolver, timeout, ttl time.Duration, allow []string) *emailDomainChecker {
+	c := &emailDomainChecker{
+		resolver: resolver,
+		timeout:  timeout,
+		ttl:      ttl,
+		allow:    make(map[string]bool, len(allow)),
+		cache:    make(map[string]domainResult),
+	}
+	for _, d := range allow {
+		c.allow[strings.ToLower(d)] = true
+	}
+	return c
+}
+
+// resolvable reports whether email's domain accepts mail. Allowlisted
+// domains are never looked up.
+func (c *emailDomainChecker) resolvable(ctx context.Context, email string) bool {
+	domain := email[strings.LastIndex(email, "@")+1:]
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	if c.allow[domain] {
+		return true
+	}
+
+	now := time.Now()
+	c.mu.Lock()
+	if r, ok := c.cache[domain]; ok && now.Before(r.expires) {
+		c.mu.Unlock()
+		return r.ok
+	}
+	c.mu.Unlock()
+
+	ok, definitive := c.lookup(ctx, domain)
+	if definitive {
+		c.mu.Lock()
+		if len(c.cache) >= maxDomainCacheEntries {
+			clear(c.cache)
+		}
+		c.cache[domain] = domainResult{ok: ok, expires: now.Add(c.ttl)}
+		c.mu.Unlock()
+	}
+	return ok
+}
+
+// lookup resolves domain for mail. definitive is false for timeouts and
+// other failures that say nothing about the domain itself.
+func (c *emailDomainChecker) lookup(ctx context.Context, domain string) (ok, definitive bool) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	mx, err := c.resolver.LookupMX(ctx, domain)
+	if err == nil && len(mx) > 0 {
+		// A null MX (RFC 7505) explicitly refuses mail.
+		return !(len(mx) == 1 && mx[0].Host == "."), true
+	}
+	if err != nil && !isNotFound(err) {
+		slog.Warn("email domain MX lookup failed", "domain", domain, "err", err)
+		return false, false
+	}
+	addrs, err := c.resolver.LookupHost(ctx, domain)
+	if err != nil && !isNotFound(err) {
+		slog.Warn("email domain address lookup failed", "domain", domain, "err", err)
+		return false, false
+	}
+	return len(addrs) > 0, true
+}
+
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
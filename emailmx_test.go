@@ -0,0 +1,101 @@
+// emailmx_test.go
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeResolver answers from fixed records; domains it doesn't know are
+// NXDOMAIN, and those in fail time out.
+type fakeResolver struct {
+	mx    map[string][]*net.MX
+	hosts map[string][]string
+	fail  map[string]bool
+
+	mu      sync.Mutex
+	lookups int
+}
+
+func (f *fakeResolver) LookupMX(_ context.Context, name string) ([]*net.MX, error) {
+	f.mu.Lock()
+	f.lookups++
+	f.mu.Unlock()
+	if f.fail[name] {
+		return nil, &net.DNSError{Err: "i/o timeout", Name: name, IsTimeout: true}
+	}
+	if mx, ok := f.mx[name]; ok {
+		return mx, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (f *fakeResolver) LookupHost(_ context.Context, host string) ([]string, error) {
+	if addrs, ok := f.hosts[host]; ok {
+		return addrs, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func newFakeResolver() *fakeResolver {
+	return &fakeResolver{
+		mx: map[string][]*net.MX{
+			"example.com": {{Host: "mail.example.com.", Pref: 10}},
+			"nomail.com":  {{Host: ".", Pref: 0}},
+		},
+		hosts: map[string][]string{"a-only.com": {"192.0.2.10"}},
+		fail:  map[string]bool{"flaky.com": true},
+	}
+}
+
+func TestEmailDomainChecker(t *testing.T) {
+	res := newFakeResolver()
+	c := newEmailDomainChecker(res, time.Second, time.Hour, []string{"Gmail.com"})
+	ctx := context.Background()
+	for email, want := range map[string]bool{
+		"ann@example.com":  true,
+		"ann@EXAMPLE.com.": true,
+		"ann@a-only.com":   true,
+		"ann@nomail.com":   false,
+		"ann@exmaple.com":  false,
+		"ann@flaky.com":    false,
+		"ann@gmail.com":    true,
+	} {
+		if got := c.resolvable(ctx, email); got != want {
+			t.Errorf("%s: %v, want %v", email, got, want)
+		}
+	}
+
+	// Definitive answers are cached; timeouts and allowlisted domains not.
+	before := res.lookups
+	c.resolvable(ctx, "bob@example.com")
+	c.resolvable(ctx, "bob@exmaple.com")
+	c.resolvable(ctx, "bob@gmail.com")
+	if res.lookups != before {
+		t.Fatalf("lookups rose by %d for cached and allowlisted domains", res.lookups-before)
+	}
+	c.resolvable(ctx, "bob@flaky.com")
+	if res.lookups != before+1 {
+		t.Fatal("transient failure was cached")
+	}
+}
+
+func TestCreateRejectsUnresolvableDomain(t *testing.T) {
+	ta := newTestApp(t, nil)
+	ta.Users.domains = newEmailDomainChecker(newFakeResolver(), time.Second, time.Hour, nil)
+
+	ta.createUser(t, "ann", "ann@example.com")
+	rec := ta.do(t, http.MethodPost, "/users", `{"username":"bob","email":"bob@exmaple.com"}`)
+	wantStatus(t, rec, http.StatusBadRequest)
+	if got := jsonBody(t, rec)["code"]; got != "EMAIL_DOMAIN_UNRESOLVABLE" {
+		t.Fatalf("code = %v", got)
+	}
+	if _, err := ta.Store.GetUserByEmail(context.Background(), "bob@exmaple.com"); !errors.Is(err, errUserNotFound) {
+		t.Fatalf("rejected user stored: %v", err)
+	}
+}
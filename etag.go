@@ -0,0 +1,78 @@
+// etag.go
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// userETag is a weak validator over body, the user as this caller sees it.
+// The users table has no version or updated_at column, so the rendered
+// fields are the version. Hashing only what FIELD_SCOPES lets through means
+// the tag reveals nothing the body doesn't; weak because gzip changes the
+// bytes on the wire.
+func userETag(body *object) (string, error) {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return `W/"` + hex.EncodeToString(sum[:8]) + `"`, nil
+}
+
+// etagMatches reports whether an If-None-Match header lists etag, using the
+// weak comparison RFC 9110 prescribes for it.
+func etagMatches(header, etag string) bool {
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || strings.TrimPrefix(t, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified sets the ETag of body and, when the request's If-None-Match
+// already has it, answers 304 and returns true.
+func notModified(w http.ResponseWriter, r *http.Request, body *object) bool {
+	etag, err := userETag(body)
+	if err != nil {
+		// jsonWrite reports the encoding failure when it renders body.
+		return false
+	}
+	w.Header().Set("ETag", etag)
+	if inm := r.Header.Get("If-None-Match"); inm != "" && etagMatches(inm, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	return false
+}
+
+// headUser handles HEAD /users/{id}: the ETag of GET without the body, so a
+// client can check whether its copy is current.
+func (a *App) headUser(w http.ResponseWriter, r *http.Request) {
+	id, err := parseUserID(r)
+	if err != nil {
+		a.writeInvalidID(w, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), a.Config.QueryTimeout)
+	defer cancel()
+
+	u, err := a.Users.Get(ctx, id)
+	if err != nil {
+		writeUserError(w, err)
+		return
+	}
+	a.setCacheControl(w, "get_user")
+	if notModified(w, r, a.userBody(r.Context(), u)) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+}
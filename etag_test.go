@@ -0,0 +1,81 @@
+// etag_test.go
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func TestHeadUserCarriesETag(t *testing.T) {
+	ta := newTestApp(t, map[string]string{"USER_ETAGS": "true"})
+	id := strconv.Itoa(int(ta.createUser(t, "ann", "ann@example.com")))
+
+	get := ta.do(t, http.MethodGet, "/users/"+id, "")
+	wantStatus(t, get, http.StatusOK)
+	etag := get.Header().Get("ETag")
+	if etag == "" || etag[:3] != `W/"` {
+		t.Fatalf("GET ETag = %q, want a weak tag", etag)
+	}
+
+	head := ta.do(t, http.MethodHead, "/users/"+id, "")
+	wantStatus(t, head, http.StatusOK)
+	if head.Header().Get("ETag") != etag {
+		t.Fatalf("HEAD ETag = %q, GET ETag = %q", head.Header().Get("ETag"), etag)
+	}
+	if head.Body.Len() != 0 {
+		t.Fatalf("HEAD body = %q, want empty", head.Body)
+	}
+
+	wantStatus(t, ta.do(t, http.MethodHead, "/users/999", ""), http.StatusNotFound)
+}
+
+func TestIfNoneMatch(t *testing.T) {
+	ta := newTestApp(t, map[string]string{"USER_ETAGS": "true"})
+	id := strconv.Itoa(int(ta.createUser(t, "ann", "ann@example.com")))
+	etag := ta.do(t, http.MethodGet, "/users/"+id, "").Header().Get("ETag")
+
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		rec := ta.do(t, method, "/users/"+id, "", "If-None-Match", etag)
+		wantStatus(t, rec, http.StatusNotModified)
+		if rec.Body.Len() != 0 {
+			t.Fatalf("%s 304 body = %q", method, rec.Body)
+		}
+	}
+	wantStatus(t, ta.do(t, http.MethodGet, "/users/"+id, "", "If-None-Match", `"other", `+etag[2:]), http.StatusNotModified)
+
+	// A change makes the cached copy stale.
+	wantStatus(t, ta.do(t, http.MethodPut, "/users/"+id, `{"username":"annie","email":"ann@example.com"}`), http.StatusOK)
+	rec := ta.do(t, http.MethodGet, "/users/"+id, "", "If-None-Match", etag)
+	wantStatus(t, rec, http.StatusOK)
+	if rec.Header().Get("ETag") == etag {
+		t.Fatal("ETag unchanged after the user changed")
+	}
+}
+
+func TestUserETagsDisabled(t *testing.T) {
+	ta := newTestApp(t, nil)
+	id := strconv.Itoa(int(ta.createUser(t, "ann", "ann@example.com")))
+	rec := ta.do(t, http.MethodGet, "/users/"+id, "", "If-None-Match", "*")
+	wantStatus(t, rec, http.StatusOK)
+	if rec.Header().Get("ETag") != "" {
+		t.Fatalf("ETag = %q without USER_ETAGS", rec.Header().Get("ETag"))
+	}
+	wantStatus(t, ta.do(t, http.MethodHead, "/users/"+id, ""), http.StatusMethodNotAllowed)
+}
+
+func TestETagMatches(t *testing.T) {
+	const etag = `W/"abc"`
+	for header, want := range map[string]bool{
+		`W/"abc"`:          true,
+		`"abc"`:            true,
+		`"x", W/"abc"`:     true,
+		`*`:                true,
+		`"abcd"`:           false,
+		`W/"ab", W/"abcd"`: false,
+	} {
+		if got := etagMatches(header, etag); got != want {
+			t.Errorf("etagMatches(%q) = %v, want %v", header, got, want)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+// exemplars.go
+package main
+
+import (
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// sampledTraceID returns the trace id of r's W3C traceparent header when
+// the caller sampled the trace. There is no tracer in this service, so the
+// trace is the one a proxy or client started and propagated to us.
+func sampledTraceID(r *http.Request) (string, bool) {
+	// version-traceid-parentid-flags, e.g.
+	// 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+	parts := strings.Split(strings.TrimSpace(r.Header.Get("traceparent")), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" ||
+		(parts[0] == "00" && len(parts) != 4) ||
+		len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return "", false
+	}
+	if _, err := hex.DecodeString(parts[0]); err != nil {
+		return "", false
+	}
+	id, err := hex.DecodeString(parts[1])
+	if err != nil || parts[1] == strings.Repeat("0", 32) || strings.ToLower(parts[1]) != parts[1] {
+		return "", false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil || flags[0]&0x01 == 0 {
+		return "", false
+	}
+	return hex.EncodeToString(id), true
+}
+
+// observe records v, with the trace id as exemplar when there is one.
+func observe(o prometheus.Observer, v float64, traceID string) {
+	if eo, ok := o.(prometheus.ExemplarObserver); ok && traceID != "" {
+		eo.ObserveWithExemplar(v, prometheus.Labels{"trace_id": traceID})
+		return
+	}
+	o.Observe(v)
+}
@@ -0,0 +1,94 @@
+// exemplars_test.go
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// openMetrics asks /metrics for the exposition format that carries exemplars.
+var openMetrics = []string{"Accept", "application/openmetrics-text; version=1.0.0"}
+
+func TestSampledTraceID(t *testing.T) {
+	const id = "4bf92f3577b34da6a3ce929d0e0e4736"
+	tests := []struct {
+		header string
+		ok     bool
+	}{
+		{"00-" + id + "-00f067aa0ba902b7-01", true},
+		{" 00-" + id + "-00f067aa0ba902b7-03 ", true},
+		{"01-" + id + "-00f067aa0ba902b7-01-future", true}, // later versions may append fields
+		{"00-" + id + "-00f067aa0ba902b7-00", false},       // not sampled
+		{"00-" + id + "-00f067aa0ba902b7-01-extra", false},
+		{"ff-" + id + "-00f067aa0ba902b7-01", false},
+		{"00-" + strings.Repeat("0", 32) + "-00f067aa0ba902b7-01", false},
+		{"00-" + strings.ToUpper(id) + "-00f067aa0ba902b7-01", false},
+		{"00-" + id[:30] + "-00f067aa0ba902b7-01", false},
+		{"00-" + id + "-00f067aa0ba902b7-zz", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/users", nil)
+		r.Header.Set("traceparent", tt.header)
+		got, ok := sampledTraceID(r)
+		if ok != tt.ok || (ok && got != id) {
+			t.Errorf("%q: got %q, %v; want %v", tt.header, got, ok, tt.ok)
+		}
+	}
+}
+
+func TestObserveExemplar(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	h := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "test_seconds", Help: "Test."})
+	reg.MustRegister(h)
+	observe(h, 0.2, "4bf92f3577b34da6a3ce929d0e0e4736")
+	observe(h, 0.3, "")
+
+	rec := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	r.Header.Set(openMetrics[0], openMetrics[1])
+	promhttp.HandlerFor(reg, promhttp.HandlerOpts{EnableOpenMetrics: true}).ServeHTTP(rec, r)
+	body := rec.Body.String()
+	if strings.Count(body, `trace_id="4bf92f3577b34da6a3ce929d0e0e4736"`) != 1 || !strings.Contains(body, "test_seconds_count 2") {
+		t.Fatalf("scrape = %s", body)
+	}
+}
+
+func TestExemplarsOnRouteTiming(t *testing.T) {
+	ta := newTestApp(t, map[string]string{"ROUTE_TIMING_METRICS": "true", "METRICS_EXEMPLARS": "true"})
+	const sampled, unsampled = "1c1d0a2b3e4f50617283940a5b6c7d8e", "9e8d7c6b5a4f3e2d1c0b0a9f8e7d6c5b"
+	ta.do(t, http.MethodGet, "/users", "", "traceparent", "00-"+sampled+"-00f067aa0ba902b7-01")
+	ta.do(t, http.MethodGet, "/users", "", "traceparent", "00-"+unsampled+"-00f067aa0ba902b7-00")
+
+	body := ta.do(t, http.MethodGet, "/metrics", "", openMetrics...).Body.String()
+	if !strings.Contains(body, `trace_id="`+sampled+`"`) {
+		t.Fatal("no exemplar for the sampled request")
+	}
+	if strings.Contains(body, unsampled) {
+		t.Fatal("exemplar for an unsampled request")
+	}
+	if plain := ta.do(t, http.MethodGet, "/metrics", "").Body.String(); strings.Contains(plain, sampled) {
+		t.Fatal("exemplar in the text format")
+	}
+
+	// Without METRICS_EXEMPLARS the traceparent is ignored.
+	const other = "2a2b2c2d2e2f30313233343536373839"
+	ta = newTestApp(t, map[string]string{"ROUTE_TIMING_METRICS": "true"})
+	ta.do(t, http.MethodGet, "/users", "", "traceparent", "00-"+other+"-00f067aa0ba902b7-01")
+	r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	r.Header.Set(openMetrics[0], openMetrics[1])
+	rec := httptest.NewRecorder()
+	promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{EnableOpenMetrics: true}).ServeHTTP(rec, r)
+	if strings.Contains(rec.Body.String(), other) {
+		t.Fatal("exemplar recorded while disabled")
+	}
+
+	if err := loadConfigErr(t, map[string]string{"METRICS_EXEMPLARS": "true"}); err == nil || !strings.Contains(err.Error(), "ROUTE_TIMING_METRICS") {
+		t.Fatalf("err = %v", err)
+	}
+}
@@ -0,0 +1,48 @@
+// expand.go
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// expanders are the computed fields a client may opt into via ?expand=.
+// They derive from the stored row only; none costs a DB round trip.
+var expanders = map[string]func(User) any{
+	"gravatar": func(u User) any {
+		sum := md5.Sum([]byte(strings.ToLower(strings.TrimSpace(u.Email))))
+		return "https://www.gravatar.com/avatar/" + hex.EncodeToString(sum[:])
+	},
+	"initials": func(u User) any {
+		var b strings.Builder
+		for _, part := range strings.FieldsFunc(u.Username, func(r rune) bool {
+			return unicode.IsSpace(r) || r == '.' || r == '_' || r == '-'
+		}) {
+			r, _ := utf8.DecodeRuneInString(part)
+			b.WriteRune(unicode.ToUpper(r))
+		}
+		return b.String()
+	},
+}
+
+// parseExpand validates a comma-separated ?expand= against expanders.
+func parseExpand(r *http.Request) ([]string, error) {
+	raw := r.URL.Query().Get("expand")
+	if raw == "" {
+		return nil, nil
+	}
+	var fields []string
+	for _, f := range strings.Split(raw, ",") {
+		f = strings.TrimSpace(f)
+		if _, ok := expanders[f]; !ok {
+			return nil, fmt.Errorf("Invalid expand %q", f)
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
@@ -0,0 +1,32 @@
+// expand_test.go
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestGetUserExpand(t *testing.T) {
+	ta := newTestApp(t, nil)
+	id := ta.createUser(t, "ann.lee", "Ann@Example.com")
+	path := fmt.Sprintf("/users/%d", id)
+
+	body := jsonBody(t, ta.do(t, http.MethodGet, path, ""))
+	if _, ok := body["gravatar"]; ok {
+		t.Fatal("gravatar present without expand")
+	}
+
+	rec := ta.do(t, http.MethodGet, path+"?expand=gravatar,initials", "")
+	wantStatus(t, rec, http.StatusOK)
+	body = jsonBody(t, rec)
+	// md5("ann@example.com")
+	if got := body["gravatar"]; got != "https://www.gravatar.com/avatar/257c57037d384ae37ea27a07e8a01665" {
+		t.Errorf("gravatar = %v", got)
+	}
+	if got := body["initials"]; got != "AL" {
+		t.Errorf("initials = %v", got)
+	}
+
+	wantStatus(t, ta.do(t, http.MethodGet, path+"?expand=password", ""), http.StatusBadRequest)
+}
@@ -0,0 +1,55 @@
+// fieldauth.go
+package main
+
+import (
+	"context"
+	"net/http"
+	"slices"
+)
+
+// scopeAdmin is held by requests bearing ADMIN_TOKEN, the only credential
+// the API knows; anonymous requests hold no scopes.
+const scopeAdmin = "admin"
+
+// knownScopes are the scopes FIELD_SCOPES may require.
+var knownScopes = []string{scopeAdmin}
+
+// principal is who a request acts as, for field authorization.
+type principal struct {
+	scopes []string
+}
+
+func (p *principal) has(scope string) bool {
+	return p != nil && slices.Contains(p.scopes, scope)
+}
+
+func withPrincipal(ctx context.Context, p *principal) context.Context {
+	return context.WithValue(ctx, principalKey, p)
+}
+
+func principalFrom(ctx context.Context) *principal {
+	p, _ := ctx.Value(principalKey).(*principal)
+	return p
+}
+
+// identify records the request's principal for fieldAllowed. A missing or
+// wrong token is not an error here: the request proceeds without scopes.
+// Responses then depend on the credentials, which Vary tells caches.
+func (a *App) identify(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Authorization")
+		p := &principal{}
+		if a.isAdminRequest(r) {
+			p.scopes = append(p.scopes, scopeAdmin)
+		}
+		next.ServeHTTP(w, r.WithContext(withPrincipal(r.Context(), p)))
+	})
+}
+
+// fieldAllowed reports whether the principal in ctx may see a user field
+// under FIELD_SCOPES. Fields it may not see are left out of the response
+// and so of its ETag; events need no check, carrying only user_id.
+func (a *App) fieldAllowed(ctx context.Context, field string) bool {
+	scope, ok := a.Config.FieldScopes[field]
+	return !ok || principalFrom(ctx).has(scope)
+}
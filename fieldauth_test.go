@@ -0,0 +1,147 @@
+// fieldauth_test.go
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestFieldScopesHideEmailFromNonAdmins(t *testing.T) {
+	ta := newTestApp(t, map[string]string{"FIELD_SCOPES": "email=admin, gravatar=admin", "ADMIN_TOKEN": "secret", "ENABLE_GRAPHQL": "true"})
+	ta.createUser(t, "ann", "ann@example.com")
+	for _, tt := range []struct {
+		name, method, target, body string
+		expand                     bool
+	}{
+		{"get", http.MethodGet, "/users/1?expand=gravatar,initials", "", true},
+		{"lookup", http.MethodGet, "/users/lookup?id=1&expand=gravatar,initials", "", true},
+		{"list", http.MethodGet, "/users", "", false},
+		{"by emails", http.MethodPost, "/users/by-emails", `["ann@example.com"]`, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			user := func(header ...string) map[string]any {
+				rec := ta.do(t, tt.method, tt.target, tt.body, header...)
+				wantStatus(t, rec, http.StatusOK)
+				if !strings.Contains(rec.Header().Get("Vary"), "Authorization") {
+					t.Fatalf("Vary = %q", rec.Header().Get("Vary"))
+				}
+				body := jsonBody(t, rec)
+				if users, ok := body["users"].([]any); ok {
+					return users[0].(map[string]any)
+				}
+				return body
+			}
+			admin := user(adminAuth...)
+			if admin["email"] != "ann@example.com" || (admin["gravatar"] == nil) == tt.expand || admin["username"] != "ann" {
+				t.Fatalf("admin sees %v", admin)
+			}
+			for name, header := range map[string][]string{
+				"anonymous":   nil,
+				"wrong token": {"Authorization", "Bearer nope"},
+			} {
+				u := user(header...)
+				_, email := u["email"]
+				_, gravatar := u["gravatar"]
+				if email || gravatar || u["username"] != "ann" || (u["initials"] == nil) == tt.expand {
+					t.Fatalf("%s sees %v", name, u)
+				}
+			}
+		})
+	}
+
+	// GraphQL resolves hidden fields to null instead.
+	body := ta.gql(t, `{ user(id: "1") { username email } }`, nil)
+	if user := body["data"].(map[string]any)["user"].(map[string]any); user["username"] != "ann" || user["email"] != nil {
+		t.Fatalf("graphql = %v", body)
+	}
+	b, _ := json.Marshal(gqlRequest{Query: `{ user(id: "1") { email } }`})
+	rec := ta.do(t, http.MethodPost, "/graphql", string(b), adminAuth...)
+	if !strings.Contains(rec.Body.String(), `"email":"ann@example.com"`) {
+		t.Fatalf("admin graphql = %s", rec.Body)
+	}
+}
+
+func TestFieldScopesOffByDefault(t *testing.T) {
+	ta := newTestApp(t, nil)
+	ta.createUser(t, "ann", "ann@example.com")
+	rec := ta.do(t, http.MethodGet, "/users/1", "")
+	if jsonBody(t, rec)["email"] != "ann@example.com" || strings.Contains(rec.Header().Get("Vary"), "Authorization") {
+		t.Fatalf("response = %v %s", rec.Header(), rec.Body)
+	}
+}
+
+func TestFieldScopesConfig(t *testing.T) {
+	cfg := testConfig(t, map[string]string{"FIELD_SCOPES": "email=admin,initials=admin", "ADMIN_TOKEN": "secret"})
+	if len(cfg.FieldScopes) != 2 || cfg.FieldScopes["email"] != scopeAdmin || cfg.FieldScopes["initials"] != scopeAdmin {
+		t.Fatalf("scopes = %v", cfg.FieldScopes)
+	}
+	for _, env := range []map[string]string{
+		{"FIELD_SCOPES": "user_id=admin", "ADMIN_TOKEN": "secret"},
+		{"FIELD_SCOPES": "email=staff", "ADMIN_TOKEN": "secret"},
+		{"FIELD_SCOPES": "email", "ADMIN_TOKEN": "secret"},
+		{"FIELD_SCOPES": "email=admin"},
+	} {
+		if err := loadConfigErr(t, env); err == nil || !strings.Contains(err.Error(), "FIELD_SCOPES") {
+			t.Errorf("%v: err = %v", env, err)
+		}
+	}
+}
+
+func TestPrincipalScopes(t *testing.T) {
+	var none *principal
+	if none.has(scopeAdmin) || (&principal{}).has(scopeAdmin) {
+		t.Fatal("principal without scopes has admin")
+	}
+	if !(&principal{scopes: []string{scopeAdmin}}).has(scopeAdmin) {
+		t.Fatal("admin scope not held")
+	}
+}
+
+func TestETagCoversOnlyVisibleFields(t *testing.T) {
+	ta := newTestApp(t, map[string]string{"FIELD_SCOPES": "email=admin", "ADMIN_TOKEN": "secret", "USER_ETAGS": "true"})
+	ta.createUser(t, "ann", "ann@example.com")
+	etag := func(header ...string) string {
+		rec := ta.do(t, http.MethodGet, "/users/1", "", header...)
+		wantStatus(t, rec, http.StatusOK)
+		return rec.Header().Get("ETag")
+	}
+	anon, admin := etag(), etag(adminAuth...)
+	if anon == admin {
+		t.Fatal("anonymous and admin share an ETag over different bodies")
+	}
+
+	// A change to the hidden email moves only the admin's tag: anonymous
+	// callers can't test a guessed email against theirs.
+	wantStatus(t, ta.do(t, http.MethodPut, "/users/1", `{"username":"ann","email":"other@example.com"}`), http.StatusOK)
+	if got := etag(); got != anon {
+		t.Fatalf("anonymous ETag changed with the hidden email: %s -> %s", anon, got)
+	}
+	if got := etag(adminAuth...); got == admin {
+		t.Fatal("admin ETag unchanged after the email changed")
+	}
+	head := ta.do(t, http.MethodHead, "/users/1", "")
+	if head.Header().Get("ETag") != anon {
+		t.Fatalf("HEAD ETag = %q, GET ETag = %q", head.Header().Get("ETag"), anon)
+	}
+}
+
+func TestEventsCarryNoScopedFields(t *testing.T) {
+	ta := newTestApp(t, map[string]string{"FIELD_SCOPES": "username=admin", "ADMIN_TOKEN": "secret"})
+	sub, err := ta.Events.subscribe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ta.createUser(t, "ann", "ann@example.com")
+	payload, _ := receive(t, sub)
+	var ev struct {
+		Data map[string]any `json:"data"`
+	}
+	if err := json.Unmarshal(payload, &ev); err != nil {
+		t.Fatal(err)
+	}
+	if len(ev.Data) != 1 || ev.Data["user_id"] == nil {
+		t.Fatalf("event data = %v, want only user_id", ev.Data)
+	}
+}
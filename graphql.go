@@ -0,0 +1,769 @@
+// graphql.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Type kinds, as reported by introspection.
+const (
+	kindScalar  = "SCALAR"
+	kindObject  = "OBJECT"
+	kindEnum    = "ENUM"
+	kindList    = "LIST"
+	kindNonNull = "NON_NULL"
+)
+
+type gqlType struct {
+	kind        string
+	name        string
+	description string
+	fields      []*gqlField // objects
+	enumValues  []string    // enums
+	ofType      *gqlType    // lists and non-null wrappers
+	// coerce converts an input value for scalars; nil for output-only types.
+	coerce func(any) (any, error)
+}
+
+func gqlList(t *gqlType) *gqlType    { return &gqlType{kind: kindList, ofType: t} }
+func gqlNonNull(t *gqlType) *gqlType { return &gqlType{kind: kindNonNull, ofType: t} }
+
+func (t *gqlType) String() string {
+	switch t.kind {
+	case kindList:
+		return "[" + t.ofType.String() + "]"
+	case kindNonNull:
+		return t.ofType.String() + "!"
+	}
+	return t.name
+}
+
+func (t *gqlType) named() *gqlType {
+	for t.ofType != nil {
+		t = t.ofType
+	}
+	return t
+}
+
+func (t *gqlType) field(name string) *gqlField {
+	for _, f := range t.fields {
+		if f.name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+type gqlResolver func(ctx context.Context, source any, args map[string]any) (any, error)
+
+type gqlField struct {
+	name        string
+	description string
+	args        []*gqlArgDef
+	typ         *gqlType
+	resolve     gqlResolver
+}
+
+type gqlArgDef struct {
+	name        string
+	description string
+	typ         *gqlType
+	def         any
+	defLiteral  string // the default as GraphQL source; empty when none
+}
+
+type gqlDirectiveDef struct {
+	name        string
+	description string
+	locations   []string
+	args        []*gqlArgDef
+}
+
+type gqlSchema struct {
+	query    *gqlType
+	mutation *gqlType
+	types    []*gqlType // every named type, for introspection
+	// Meta-fields available on the query root.
+	schemaField, typeField *gqlField
+	directives             []*gqlDirectiveDef
+}
+
+func (s *gqlSchema) typeNamed(name string) *gqlType {
+	for _, t := range s.types {
+		if t.name == name {
+			return t
+		}
+	}
+	return nil
+}
+
+// lookupField finds a field on t, including the introspection meta-fields.
+func (s *gqlSchema) lookupField(t *gqlType, name string) *gqlField {
+	if t == s.query {
+		switch name {
+		case "__schema":
+			return s.schemaField
+		case "__type":
+			return s.typeField
+		}
+	}
+	return t.field(name)
+}
+
+func (s *gqlSchema) directive(name string) *gqlDirectiveDef {
+	for _, d := range s.directives {
+		if d.name == name {
+			return d
+		}
+	}
+	return nil
+}
+
+// gqlError is an entry of a response's "errors" list.
+type gqlError struct {
+	Message    string         `json:"message"`
+	Locations  []gqlLocation  `json:"locations,omitempty"`
+	Path       []any          `json:"path,omitempty"`
+	Extensions map[string]any `json:"extensions,omitempty"`
+}
+
+type gqlLocation struct {
+	Line   int `json:"line"`
+	Column int `json:"column"`
+}
+
+// gqlCodedError is returned by resolvers to give an error a machine-readable
+// extensions.code (and optional other extensions).
+type gqlCodedError struct {
+	msg        string
+	extensions map[string]any
+}
+
+func (e *gqlCodedError) Error() string { return e.msg }
+
+func newGQLError(code, msg string) *gqlCodedError {
+	return &gqlCodedError{msg: msg, extensions: map[string]any{"code": code}}
+}
+
+// Built-in scalars.
+var (
+	gqlInt = &gqlType{kind: kindScalar, name: "Int",
+		description: "The `Int` scalar type represents non-fractional signed whole numeric values between -(2^31) and 2^31 - 1.",
+		coerce:      coerceInt}
+	gqlFloat = &gqlType{kind: kindScalar, name: "Float",
+		description: "The `Float` scalar type represents signed double-precision fractional values.",
+		coerce:      coerceFloat}
+	gqlString = &gqlType{kind: kindScalar, name: "String",
+		description: "The `String` scalar type represents textual data as UTF-8 character sequences.",
+		coerce:      coerceString}
+	gqlBoolean = &gqlType{kind: kindScalar, name: "Boolean",
+		description: "The `Boolean` scalar type represents `true` or `false`.",
+		coerce:      coerceBoolean}
+	gqlID = &gqlType{kind: kindScalar, name: "ID",
+		description: "The `ID` scalar type represents a unique identifier, serialized as a string; integer input is accepted.",
+		coerce:      coerceID}
+)
+
+func coerceInt(v any) (any, error) {
+	var n int64
+	switch v := v.(type) {
+	case int:
+		return v, nil
+	case int64:
+		n = v
+	case json.Number:
+		i, err := v.Int64()
+		if err != nil {
+			return nil, fmt.Errorf("Int cannot represent non-integer value: %s", v)
+		}
+		n = i
+	default:
+		return nil, fmt.Errorf("Int cannot represent non-integer value: %s", describeValue(v))
+	}
+	if n < math.MinInt32 || n > math.MaxInt32 {
+		return nil, fmt.Errorf("Int cannot represent non 32-bit signed integer value: %d", n)
+	}
+	return int(n), nil
+}
+
+func coerceFloat(v any) (any, error) {
+	switch v := v.(type) {
+	case float64:
+		return v, nil
+	case int:
+		return float64(v), nil
+	case int64:
+		return float64(v), nil
+	case json.Number:
+		f, err := v.Float64()
+		if err == nil {
+			return f, nil
+		}
+	}
+	return nil, fmt.Errorf("Float cannot represent non numeric value: %s", describeValue(v))
+}
+
+func coerceString(v any) (any, error) {
+	if s, ok := v.(string); ok {
+		return s, nil
+	}
+	return nil, fmt.Errorf("String cannot represent a non string value: %s", describeValue(v))
+}
+
+func coerceBoolean(v any) (any, error) {
+	if b, ok := v.(bool); ok {
+		return b, nil
+	}
+	return nil, fmt.Errorf("Boolean cannot represent a non boolean value: %s", describeValue(v))
+}
+
+func coerceID(v any) (any, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case int:
+		return strconv.Itoa(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case json.Number:
+		if _, err := v.Int64(); err == nil {
+			return v.String(), nil
+		}
+	}
+	return nil, fmt.Errorf("ID cannot represent value: %s", describeValue(v))
+}
+
+func describeValue(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return strconv.Quote(v)
+	case gqlEnum:
+		return string(v)
+	case gqlVariable:
+		return "$" + string(v)
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(b)
+}
+
+// coerceInput converts a literal or variable value to typ. Variables inside
+// literals are looked up in vars, which hold already-coerced values.
+func coerceInput(typ *gqlType, v any, vars map[string]any) (any, error) {
+	if name, ok := v.(gqlVariable); ok {
+		v = vars[string(name)]
+	}
+	if typ.kind == kindNonNull {
+		if v == nil {
+			return nil, fmt.Errorf("Expected value of type %q, found null.", typ)
+		}
+		return coerceInput(typ.ofType, v, vars)
+	}
+	if v == nil {
+		return nil, nil
+	}
+	switch typ.kind {
+	case kindList:
+		items, ok := v.([]any)
+		if !ok {
+			// A single value is accepted where a list is expected.
+			items = []any{v}
+		}
+		out := make([]any, len(items))
+		for i, it := range items {
+			c, err := coerceInput(typ.ofType, it, vars)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = c
+		}
+		return out, nil
+	case kindScalar:
+		return typ.coerce(v)
+	}
+	return nil, fmt.Errorf("Type %q cannot be used as input.", typ)
+}
+
+// gqlRequest is a GraphQL request as it arrives over HTTP.
+type gqlRequest struct {
+	Query         string         `json:"query"`
+	OperationName string         `json:"operationName"`
+	Variables     map[string]any `json:"variables"`
+}
+
+type gqlExecutor struct {
+	schema *gqlSchema
+	src    string
+	doc    *gqlDocument
+	vars   map[string]any
+	errs   []gqlError
+
+	tooDeep bool // the depth error is reported once
+}
+
+// errGQLNull marks a null that must bubble up to the nearest nullable
+// position; the error causing it has already been recorded.
+var errGQLNull = errors.New("null in non-null position")
+
+// execute runs req and returns the response body. Requests that fail to
+// parse or validate get a body with only "errors". A mutation when
+// allowMutation is false (GET requests) returns errGQLMutationNotAllowed.
+func (s *gqlSchema) execute(ctx context.Context, req gqlRequest, allowMutation bool) (*object, error) {
+	x := &gqlExecutor{schema: s, src: req.Query, vars: map[string]any{}}
+	body := newObject(false)
+
+	doc, err := parseGraphQL(req.Query)
+	if err != nil {
+		var se *gqlSyntaxError
+		if errors.As(err, &se) {
+			x.failAt(se.pos, nil, err)
+		} else {
+			x.failAt(-1, nil, err)
+		}
+		body.set("errors", x.errs)
+		return body, nil
+	}
+	x.doc = doc
+
+	op, err := doc.operation(req.OperationName)
+	if err == nil {
+		x.validate()
+	} else {
+		x.failAt(-1, nil, err)
+	}
+	if len(x.errs) == 0 {
+		x.coerceVariables(op, req.Variables)
+	}
+	if len(x.errs) > 0 {
+		body.set("errors", x.errs)
+		return body, nil
+	}
+	if op.kind == "mutation" && !allowMutation {
+		return nil, errGQLMutationNotAllowed
+	}
+
+	root := s.query
+	if op.kind == "mutation" {
+		root = s.mutation
+	}
+	data, err := x.selectionSet(ctx, root, nil, op.sel, nil)
+	if len(x.errs) > 0 {
+		body.set("errors", x.errs)
+	}
+	if err != nil {
+		body.set("data", nil)
+	} else {
+		body.set("data", data)
+	}
+	return body, nil
+}
+
+var errGQLMutationNotAllowed = errors.New("mutations are only allowed over POST")
+
+func (d *gqlDocument) operation(name string) (*gqlOperation, error) {
+	if name == "" {
+		if len(d.operations) > 1 {
+			return nil, errors.New("Must provide operation name if query contains multiple operations.")
+		}
+		return d.operations[0], nil
+	}
+	for _, op := range d.operations {
+		if op.name == name {
+			return op, nil
+		}
+	}
+	return nil, fmt.Errorf("Unknown operation named %q.", name)
+}
+
+func (x *gqlExecutor) failAt(pos int, path []any, err error) {
+	e := gqlError{Message: err.Error(), Path: path}
+	if pos >= 0 {
+		line, col := lineCol(x.src, pos)
+		e.Locations = []gqlLocation{{line, col}}
+	}
+	var coded *gqlCodedError
+	if errors.As(err, &coded) {
+		e.Extensions = coded.extensions
+	}
+	x.errs = append(x.errs, e)
+}
+
+func (x *gqlExecutor) failf(pos int, format string, args ...any) {
+	x.failAt(pos, nil, fmt.Errorf(format, args...))
+}
+
+// validate applies the checks that stop a request from running at all:
+// unknown fields, arguments, fragments and directives, missing required
+// arguments, undefined variables, fragment cycles and misplaced selections.
+func (x *gqlExecutor) validate() {
+	for _, op := range x.doc.operations {
+		root := x.schema.query
+		if op.kind == "mutation" {
+			root = x.schema.mutation
+		}
+		for _, d := range op.directives {
+			x.failf(d.pos, "Directive %q may not be used on %s.", "@"+d.name, strings.ToUpper(op.kind))
+		}
+		defined := make(map[string]bool, len(op.vars))
+		for _, v := range op.vars {
+			defined[v.name] = true
+		}
+		x.validateSelections(root, op.sel, defined, map[string]bool{}, 1)
+	}
+}
+
+// validateSelections checks sel, whose fields are depth levels deep once
+// fragments are expanded.
+func (x *gqlExecutor) validateSelections(t *gqlType, sel []*gqlSelection, vars, visiting map[string]bool, depth int) {
+	if depth > gqlMaxDepth {
+		if !x.tooDeep {
+			x.failf(sel[0].pos, "Query nesting exceeds the maximum depth of %d.", gqlMaxDepth)
+			x.tooDeep = true
+		}
+		return
+	}
+	for _, s := range sel {
+		x.validateDirectives(s.directives, vars)
+		switch s.kind {
+		case selSpread:
+			f, ok := x.doc.fragments[s.name]
+			switch {
+			case !ok:
+				x.failf(s.pos, "Unknown fragment %q.", s.name)
+			case visiting[s.name]:
+				x.failf(s.pos, "Cannot spread fragment %q within itself.", s.name)
+			case x.checkTypeCond(s.pos, f.typeCond, t):
+				visiting[s.name] = true
+				x.validateSelections(t, f.sel, vars, visiting, depth)
+				delete(visiting, s.name)
+			}
+		case selInline:
+			if s.typeCond == "" || x.checkTypeCond(s.pos, s.typeCond, t) {
+				x.validateSelections(t, s.sel, vars, visiting, depth)
+			}
+		case selField:
+			x.validateField(t, s, vars, visiting, depth)
+		}
+	}
+}
+
+// checkTypeCond reports whether a fragment on cond applies to t. There are
+// no interfaces or unions, so only t itself matches.
+func (x *gqlExecutor) checkTypeCond(pos int, cond string, t *gqlType) bool {
+	switch {
+	case x.schema.typeNamed(cond) == nil:
+		x.failf(pos, "Unknown type %q.", cond)
+	case cond != t.name:
+		x.failf(pos, "Fragment cannot be spread here as objects of type %q can never be of type %q.", t.name, cond)
+	default:
+		return true
+	}
+	return false
+}
+
+func (x *gqlExecutor) validateField(t *gqlType, s *gqlSelection, vars, visiting map[string]bool, depth int) {
+	if s.name == "__typename" {
+		if len(s.sel) > 0 {
+			x.failf(s.pos, "Field %q must not have a selection since type \"String!\" has no subfields.", s.name)
+		}
+		return
+	}
+	def := x.schema.lookupField(t, s.name)
+	if def == nil {
+		x.failf(s.pos, "Cannot query field %q on type %q.", s.name, t.name)
+		return
+	}
+	x.validateArgs(s.pos, fmt.Sprintf("Field %q", s.name), def.args, s.args, vars)
+
+	named := def.typ.named()
+	switch {
+	case named.kind == kindObject && len(s.sel) == 0:
+		x.failf(s.pos, "Field %q of type %q must have a selection of subfields.", s.name, def.typ)
+	case named.kind != kindObject && len(s.sel) > 0:
+		x.failf(s.pos, "Field %q must not have a selection since type %q has no subfields.", s.name, def.typ)
+	case named.kind == kindObject:
+		x.validateSelections(named, s.sel, vars, visiting, depth+1)
+	}
+}
+
+func (x *gqlExecutor) validateArgs(pos int, owner string, defs []*gqlArgDef, given []gqlArg, vars map[string]bool) {
+	seen := make(map[string]bool, len(given))
+	for _, a := range given {
+		if seen[a.name] {
+			x.failf(pos, "There can be only one argument named %q.", a.name)
+		}
+		seen[a.name] = true
+		if !slicesContainsArg(defs, a.name) {
+			x.failf(pos, "Unknown argument %q on %s.", a.name, strings.ToLower(owner[:1])+owner[1:])
+		}
+		x.validateVarRefs(pos, a.val, vars)
+	}
+	for _, d := range defs {
+		if d.typ.kind == kindNonNull && d.defLiteral == "" && !seen[d.name] {
+			x.failf(pos, "%s argument %q of type %q is required, but it was not provided.", owner, d.name, d.typ)
+		}
+	}
+}
+
+func slicesContainsArg(defs []*gqlArgDef, name string) bool {
+	for _, d := range defs {
+		if d.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (x *gqlExecutor) validateVarRefs(pos int, v any, vars map[string]bool) {
+	switch v := v.(type) {
+	case gqlVariable:
+		if !vars[string(v)] {
+			x.failf(pos, "Variable %q is not defined.", "$"+string(v))
+		}
+	case []any:
+		for _, it := range v {
+			x.validateVarRefs(pos, it, vars)
+		}
+	case map[string]any:
+		for _, it := range v {
+			x.validateVarRefs(pos, it, vars)
+		}
+	}
+}
+
+func (x *gqlExecutor) validateDirectives(dirs []gqlDirective, vars map[string]bool) {
+	for _, d := range dirs {
+		def := x.schema.directive(d.name)
+		if def == nil {
+			x.failf(d.pos, "Unknown directive %q.", "@"+d.name)
+			continue
+		}
+		x.validateArgs(d.pos, fmt.Sprintf("Directive %q", "@"+d.name), def.args, d.args, vars)
+	}
+}
+
+func (x *gqlExecutor) coerceVariables(op *gqlOperation, raw map[string]any) {
+	for _, d := range op.vars {
+		typ, err := x.inputType(d.typ)
+		if err != nil {
+			x.failAt(op.pos, nil, fmt.Errorf("Variable %q: %w", "$"+d.name, err))
+			continue
+		}
+		v, given := raw[d.name]
+		switch {
+		case !given && d.hasDef:
+			v = d.def
+		case !given && typ.kind == kindNonNull:
+			x.failf(op.pos, "Variable %q of required type %q was not provided.", "$"+d.name, typ)
+			continue
+		case !given:
+			continue
+		}
+		c, err := coerceInput(typ, v, nil)
+		if err != nil {
+			x.failf(op.pos, "Variable %q got invalid value %s; %v", "$"+d.name, describeValue(v), err)
+			continue
+		}
+		x.vars[d.name] = c
+	}
+}
+
+func (x *gqlExecutor) inputType(ref *gqlTypeRef) (*gqlType, error) {
+	var t *gqlType
+	if ref.elem != nil {
+		elem, err := x.inputType(ref.elem)
+		if err != nil {
+			return nil, err
+		}
+		t = gqlList(elem)
+	} else {
+		t = x.schema.typeNamed(ref.name)
+		if t == nil {
+			return nil, fmt.Errorf("Unknown type %q.", ref.name)
+		}
+		if t.coerce == nil {
+			return nil, fmt.Errorf("Type %q cannot be used as input.", ref.name)
+		}
+	}
+	if ref.nonNull {
+		t = gqlNonNull(t)
+	}
+	return t, nil
+}
+
+// collectFields flattens fragments and applies @skip/@include, grouping
+// selections by response key in first-seen order.
+func (x *gqlExecutor) collectFields(t *gqlType, sel []*gqlSelection, keys []string, groups map[string][]*gqlSelection) []string {
+	for _, s := range sel {
+		if !x.included(s.directives) {
+			continue
+		}
+		switch s.kind {
+		case selField:
+			k := s.responseKey()
+			if _, ok := groups[k]; !ok {
+				keys = append(keys, k)
+			}
+			groups[k] = append(groups[k], s)
+		case selSpread:
+			if f := x.doc.fragments[s.name]; f.typeCond == t.name {
+				keys = x.collectFields(t, f.sel, keys, groups)
+			}
+		case selInline:
+			if s.typeCond == "" || s.typeCond == t.name {
+				keys = x.collectFields(t, s.sel, keys, groups)
+			}
+		}
+	}
+	return keys
+}
+
+func (x *gqlExecutor) included(dirs []gqlDirective) bool {
+	for _, d := range dirs {
+		for _, a := range d.args {
+			if a.name != "if" {
+				continue
+			}
+			v, err := coerceInput(gqlNonNull(gqlBoolean), a.val, x.vars)
+			if err != nil {
+				x.failAt(d.pos, nil, err)
+				return false
+			}
+			if v.(bool) == (d.name == "skip") {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (x *gqlExecutor) selectionSet(ctx context.Context, t *gqlType, source any, sel []*gqlSelection, path []any) (*object, error) {
+	groups := make(map[string][]*gqlSelection)
+	keys := x.collectFields(t, sel, nil, groups)
+	out := newObject(false)
+	for _, k := range keys {
+		v, err := x.field(ctx, t, source, groups[k], appendPath(path, k))
+		if err != nil {
+			return nil, err
+		}
+		out.set(k, v)
+	}
+	return out, nil
+}
+
+func appendPath(path []any, elem any) []any {
+	return append(path[:len(path):len(path)], elem)
+}
+
+func (x *gqlExecutor) field(ctx context.Context, t *gqlType, source any, fields []*gqlSelection, path []any) (any, error) {
+	f := fields[0]
+	if f.name == "__typename" {
+		return t.name, nil
+	}
+	def := x.schema.lookupField(t, f.name)
+
+	args, err := x.coerceArgs(def.args, f.args)
+	if err == nil {
+		var v any
+		if v, err = def.resolve(ctx, source, args); err == nil {
+			var sub []*gqlSelection
+			for _, s := range fields {
+				sub = append(sub, s.sel...)
+			}
+			v, err = x.complete(ctx, def.typ, v, sub, path)
+			if err == nil {
+				return v, nil
+			}
+		}
+	}
+	if !errors.Is(err, errGQLNull) {
+		x.failAt(f.pos, path, err)
+	}
+	if def.typ.kind == kindNonNull {
+		return nil, errGQLNull
+	}
+	return nil, nil
+}
+
+func (x *gqlExecutor) coerceArgs(defs []*gqlArgDef, given []gqlArg) (map[string]any, error) {
+	out := make(map[string]any, len(defs))
+	for _, d := range defs {
+		var v any
+		found := false
+		for _, a := range given {
+			if a.name == d.name {
+				v, found = a.val, true
+			}
+		}
+		if name, ok := v.(gqlVariable); ok && found {
+			v, found = x.vars[string(name)]
+		}
+		if !found {
+			if d.defLiteral != "" {
+				out[d.name] = d.def
+			} else if d.typ.kind == kindNonNull {
+				return nil, fmt.Errorf("Argument %q of required type %q was not provided.", d.name, d.typ)
+			}
+			continue
+		}
+		c, err := coerceInput(d.typ, v, x.vars)
+		if err != nil {
+			return nil, fmt.Errorf("Argument %q has invalid value %s: %v", d.name, describeValue(v), err)
+		}
+		out[d.name] = c
+	}
+	return out, nil
+}
+
+// complete shapes a resolved value per the field's type, turning a null in a
+// non-null position into errGQLNull for the caller to propagate.
+func (x *gqlExecutor) complete(ctx context.Context, typ *gqlType, v any, sel []*gqlSelection, path []any) (any, error) {
+	if typ.kind == kindNonNull {
+		r, err := x.complete(ctx, typ.ofType, v, sel, path)
+		if err != nil {
+			return nil, err
+		}
+		if r == nil {
+			return nil, errors.New("Cannot return null for non-nullable field.")
+		}
+		return r, nil
+	}
+	if v == nil {
+		return nil, nil
+	}
+	switch typ.kind {
+	case kindList:
+		items, ok := v.([]any)
+		if !ok {
+			return nil, fmt.Errorf("Expected a list for field of type %q.", typ)
+		}
+		out := make([]any, len(items))
+		for i, it := range items {
+			r, err := x.complete(ctx, typ.ofType, it, sel, appendPath(path, i))
+			if err != nil {
+				if !errors.Is(err, errGQLNull) {
+					x.failAt(-1, appendPath(path, i), err)
+				}
+				if typ.ofType.kind == kindNonNull {
+					return nil, errGQLNull
+				}
+				r = nil
+			}
+			out[i] = r
+		}
+		return out, nil
+	case kindObject:
+		return x.selectionSet(ctx, typ, v, sel, path)
+	}
+	return v, nil
+}
@@ -0,0 +1,217 @@
+// graphql_introspection.go
+package main
+
+import "context"
+
+type gqlEnumValue string
+
+// newGQLSchema assembles a schema from its root types and the named types
+// they reach, adding the built-in scalars, directives and the introspection
+// types behind __schema and __type.
+func newGQLSchema(query, mutation *gqlType, types ...*gqlType) *gqlSchema {
+	s := &gqlSchema{query: query, mutation: mutation}
+
+	ifArg := func(desc string) []*gqlArgDef {
+		return []*gqlArgDef{{name: "if", description: desc, typ: gqlNonNull(gqlBoolean)}}
+	}
+	s.directives = []*gqlDirectiveDef{
+		{name: "include", description: "Directs the executor to include this field or fragment only when the `if` argument is true.",
+			locations: []string{"FIELD", "FRAGMENT_SPREAD", "INLINE_FRAGMENT"}, args: ifArg("Included when true.")},
+		{name: "skip", description: "Directs the executor to skip this field or fragment when the `if` argument is true.",
+			locations: []string{"FIELD", "FRAGMENT_SPREAD", "INLINE_FRAGMENT"}, args: ifArg("Skipped when true.")},
+	}
+
+	typeKind := &gqlType{kind: kindEnum, name: "__TypeKind",
+		description: "An enum describing what kind of type a given `__Type` is.",
+		enumValues:  []string{"SCALAR", "OBJECT", "INTERFACE", "UNION", "ENUM", "INPUT_OBJECT", "LIST", "NON_NULL"}}
+	directiveLocation := &gqlType{kind: kindEnum, name: "__DirectiveLocation",
+		description: "A Directive can be adjacent to many parts of the GraphQL language, a __DirectiveLocation describes one such possible adjacencies.",
+		enumValues: []string{"QUERY", "MUTATION", "SUBSCRIPTION", "FIELD", "FRAGMENT_DEFINITION", "FRAGMENT_SPREAD",
+			"INLINE_FRAGMENT", "VARIABLE_DEFINITION", "SCHEMA", "SCALAR", "OBJECT", "FIELD_DEFINITION", "ARGUMENT_DEFINITION",
+			"INTERFACE", "UNION", "ENUM", "ENUM_VALUE", "INPUT_OBJECT", "INPUT_FIELD_DEFINITION"}}
+
+	schemaT := &gqlType{kind: kindObject, name: "__Schema",
+		description: "A GraphQL Schema defines the capabilities of a GraphQL server."}
+	typeT := &gqlType{kind: kindObject, name: "__Type",
+		description: "The fundamental unit of any GraphQL Schema is the type."}
+	fieldT := &gqlType{kind: kindObject, name: "__Field",
+		description: "Object and Interface types are described by a list of Fields, each of which has a name, potentially a list of arguments, and a return type."}
+	inputValueT := &gqlType{kind: kindObject, name: "__InputValue",
+		description: "Arguments provided to Fields or Directives and the input fields of an InputObject are represented as Input Values which describe their type and optionally a default value."}
+	enumValueT := &gqlType{kind: kindObject, name: "__EnumValue",
+		description: "One possible value for a given Enum."}
+	directiveT := &gqlType{kind: kindObject, name: "__Directive",
+		description: "A Directive provides a way to describe alternate runtime execution and type validation behavior in a GraphQL document."}
+
+	includeDeprecated := []*gqlArgDef{{name: "includeDeprecated", typ: gqlBoolean, def: false, defLiteral: "false"}}
+	notDeprecated := []*gqlField{
+		{name: "isDeprecated", typ: gqlNonNull(gqlBoolean), resolve: constant(false)},
+		{name: "deprecationReason", typ: gqlString, resolve: constant(nil)},
+	}
+
+	schemaT.fields = []*gqlField{
+		{name: "description", typ: gqlString, resolve: constant(nil)},
+		{name: "types", typ: gqlNonNull(gqlList(gqlNonNull(typeT))), resolve: func(context.Context, any, map[string]any) (any, error) {
+			out := make([]any, len(s.types))
+			for i, t := range s.types {
+				out[i] = t
+			}
+			return out, nil
+		}},
+		{name: "queryType", typ: gqlNonNull(typeT), resolve: constant(s.query)},
+		{name: "mutationType", typ: typeT, resolve: optionalType(s.mutation)},
+		{name: "subscriptionType", typ: typeT, resolve: constant(nil)},
+		{name: "directives", typ: gqlNonNull(gqlList(gqlNonNull(directiveT))), resolve: func(context.Context, any, map[string]any) (any, error) {
+			out := make([]any, len(s.directives))
+			for i, d := range s.directives {
+				out[i] = d
+			}
+			return out, nil
+		}},
+	}
+
+	typeT.fields = []*gqlField{
+		{name: "kind", typ: gqlNonNull(typeKind), resolve: typeAttr(func(t *gqlType) any { return t.kind })},
+		{name: "name", typ: gqlString, resolve: typeAttr(func(t *gqlType) any { return nonEmpty(t.name) })},
+		{name: "description", typ: gqlString, resolve: typeAttr(func(t *gqlType) any { return nonEmpty(t.description) })},
+		{name: "specifiedByURL", typ: gqlString, resolve: constant(nil)},
+		{name: "fields", typ: gqlList(gqlNonNull(fieldT)), args: includeDeprecated, resolve: typeAttr(func(t *gqlType) any {
+			if t.kind != kindObject {
+				return nil
+			}
+			out := make([]any, len(t.fields))
+			for i, f := range t.fields {
+				out[i] = f
+			}
+			return out
+		})},
+		{name: "interfaces", typ: gqlList(gqlNonNull(typeT)), resolve: typeAttr(func(t *gqlType) any {
+			if t.kind != kindObject {
+				return nil
+			}
+			return []any{}
+		})},
+		{name: "possibleTypes", typ: gqlList(gqlNonNull(typeT)), resolve: constant(nil)},
+		{name: "enumValues", typ: gqlList(gqlNonNull(enumValueT)), args: includeDeprecated, resolve: typeAttr(func(t *gqlType) any {
+			if t.kind != kindEnum {
+				return nil
+			}
+			out := make([]any, len(t.enumValues))
+			for i, v := range t.enumValues {
+				out[i] = gqlEnumValue(v)
+			}
+			return out
+		})},
+		{name: "inputFields", typ: gqlList(gqlNonNull(inputValueT)), args: includeDeprecated, resolve: constant(nil)},
+		{name: "ofType", typ: typeT, resolve: typeAttr(func(t *gqlType) any {
+			if t.ofType == nil {
+				return nil
+			}
+			return t.ofType
+		})},
+		{name: "isOneOf", typ: gqlBoolean, resolve: constant(nil)},
+	}
+
+	fieldT.fields = append([]*gqlField{
+		{name: "name", typ: gqlNonNull(gqlString), resolve: fieldAttr(func(f *gqlField) any { return f.name })},
+		{name: "description", typ: gqlString, resolve: fieldAttr(func(f *gqlField) any { return nonEmpty(f.description) })},
+		{name: "args", typ: gqlNonNull(gqlList(gqlNonNull(inputValueT))), args: includeDeprecated, resolve: fieldAttr(func(f *gqlField) any {
+			return argList(f.args)
+		})},
+		{name: "type", typ: gqlNonNull(typeT), resolve: fieldAttr(func(f *gqlField) any { return f.typ })},
+	}, notDeprecated...)
+
+	inputValueT.fields = append([]*gqlField{
+		{name: "name", typ: gqlNonNull(gqlString), resolve: argAttr(func(a *gqlArgDef) any { return a.name })},
+		{name: "description", typ: gqlString, resolve: argAttr(func(a *gqlArgDef) any { return nonEmpty(a.description) })},
+		{name: "type", typ: gqlNonNull(typeT), resolve: argAttr(func(a *gqlArgDef) any { return a.typ })},
+		{name: "defaultValue", typ: gqlString, resolve: argAttr(func(a *gqlArgDef) any { return nonEmpty(a.defLiteral) })},
+	}, notDeprecated...)
+
+	enumValueT.fields = append([]*gqlField{
+		{name: "name", typ: gqlNonNull(gqlString), resolve: func(_ context.Context, src any, _ map[string]any) (any, error) {
+			return string(src.(gqlEnumValue)), nil
+		}},
+		{name: "description", typ: gqlString, resolve: constant(nil)},
+	}, notDeprecated...)
+
+	directiveT.fields = []*gqlField{
+		{name: "name", typ: gqlNonNull(gqlString), resolve: directiveAttr(func(d *gqlDirectiveDef) any { return d.name })},
+		{name: "description", typ: gqlString, resolve: directiveAttr(func(d *gqlDirectiveDef) any { return nonEmpty(d.description) })},
+		{name: "isRepeatable", typ: gqlNonNull(gqlBoolean), resolve: constant(false)},
+		{name: "locations", typ: gqlNonNull(gqlList(gqlNonNull(directiveLocation))), resolve: directiveAttr(func(d *gqlDirectiveDef) any {
+			out := make([]any, len(d.locations))
+			for i, l := range d.locations {
+				out[i] = l
+			}
+			return out
+		})},
+		{name: "args", typ: gqlNonNull(gqlList(gqlNonNull(inputValueT))), args: includeDeprecated, resolve: directiveAttr(func(d *gqlDirectiveDef) any {
+			return argList(d.args)
+		})},
+	}
+
+	s.schemaField = &gqlField{name: "__schema", description: "Access the current type schema of this server.",
+		typ: gqlNonNull(schemaT), resolve: constant(s)}
+	s.typeField = &gqlField{name: "__type", description: "Request the type information of a single type.",
+		args: []*gqlArgDef{{name: "name", typ: gqlNonNull(gqlString)}},
+		typ:  typeT,
+		resolve: func(_ context.Context, _ any, args map[string]any) (any, error) {
+			if t := s.typeNamed(args["name"].(string)); t != nil {
+				return t, nil
+			}
+			return nil, nil
+		}}
+
+	s.types = append([]*gqlType{query}, types...)
+	if mutation != nil {
+		s.types = append(s.types, mutation)
+	}
+	s.types = append(s.types, gqlID, gqlInt, gqlFloat, gqlString, gqlBoolean,
+		schemaT, typeT, typeKind, fieldT, inputValueT, enumValueT, directiveT, directiveLocation)
+	return s
+}
+
+func constant(v any) gqlResolver {
+	return func(context.Context, any, map[string]any) (any, error) { return v, nil }
+}
+
+// optionalType avoids handing the executor a typed nil, which it would
+// treat as a value.
+func optionalType(t *gqlType) gqlResolver {
+	if t == nil {
+		return constant(nil)
+	}
+	return constant(t)
+}
+
+func nonEmpty(s string) any {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+func argList(args []*gqlArgDef) []any {
+	out := make([]any, len(args))
+	for i, a := range args {
+		out[i] = a
+	}
+	return out
+}
+
+func typeAttr(f func(*gqlType) any) gqlResolver {
+	return func(_ context.Context, src any, _ map[string]any) (any, error) { return f(src.(*gqlType)), nil }
+}
+
+func fieldAttr(f func(*gqlField) any) gqlResolver {
+	return func(_ context.Context, src any, _ map[string]any) (any, error) { return f(src.(*gqlField)), nil }
+}
+
+func argAttr(f func(*gqlArgDef) any) gqlResolver {
+	return func(_ context.Context, src any, _ map[string]any) (any, error) { return f(src.(*gqlArgDef)), nil }
+}
+
+func directiveAttr(f func(*gqlDirectiveDef) any) gqlResolver {
+	return func(_ context.Context, src any, _ map[string]any) (any, error) { return f(src.(*gqlDirectiveDef)), nil }
+}
@@ -0,0 +1,749 @@
+// graphql_parse.go
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// The executable GraphQL subset served at /graphql: queries, mutations,
+// fragments, variables and @skip/@include. Subscriptions and block strings
+// are not supported.
+
+// gqlMaxDepth bounds how deeply selection sets, list and object values and
+// list types may nest in a document, and how deeply fields may nest once
+// fragments are expanded. The parser and validator recurse per level, so
+// without it a body of ten megabytes of "[" overflows the stack.
+const gqlMaxDepth = 32
+
+type gqlDocument struct {
+	operations []*gqlOperation
+	fragments  map[string]*gqlFragment
+}
+
+type gqlOperation struct {
+	kind       string // "query" or "mutation"
+	name       string
+	vars       []*gqlVarDef
+	directives []gqlDirective
+	sel        []*gqlSelection
+	pos        int
+}
+
+type gqlVarDef struct {
+	name   string
+	typ    *gqlTypeRef
+	def    any
+	hasDef bool
+}
+
+// gqlTypeRef is a type as written in a variable definition.
+type gqlTypeRef struct {
+	name    string      // named type; empty for a list
+	elem    *gqlTypeRef // list element
+	nonNull bool
+}
+
+func (t *gqlTypeRef) String() string {
+	s := t.name
+	if t.elem != nil {
+		s = "[" + t.elem.String() + "]"
+	}
+	if t.nonNull {
+		s += "!"
+	}
+	return s
+}
+
+type gqlFragment struct {
+	name     string
+	typeCond string
+	sel      []*gqlSelection
+	pos      int
+}
+
+type selectionKind int
+
+const (
+	selField selectionKind = iota
+	selSpread
+	selInline
+)
+
+type gqlSelection struct {
+	kind       selectionKind
+	alias      string // fields: response key when set
+	name       string // field name, or fragment name for a spread
+	args       []gqlArg
+	typeCond   string // inline fragments; empty applies to any type
+	directives []gqlDirective
+	sel        []*gqlSelection
+	pos        int
+}
+
+func (s *gqlSelection) responseKey() string {
+	if s.alias != "" {
+		return s.alias
+	}
+	return s.name
+}
+
+type gqlArg struct {
+	name string
+	val  any
+}
+
+type gqlDirective struct {
+	name string
+	args []gqlArg
+	pos  int
+}
+
+// Literal values parse to nil, bool, int64, float64, string, []any and
+// map[string]any, plus these two.
+type (
+	gqlVariable string
+	gqlEnum     string
+)
+
+type gqlSyntaxError struct {
+	msg string
+	pos int
+}
+
+func (e *gqlSyntaxError) Error() string { return "Syntax Error: " + e.msg }
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokPunct
+	tokName
+	tokInt
+	tokFloat
+	tokString
+)
+
+type gqlToken struct {
+	kind tokenKind
+	val  string
+	pos  int
+}
+
+func (t gqlToken) String() string {
+	switch t.kind {
+	case tokEOF:
+		return "<EOF>"
+	case tokString:
+		return strconv.Quote(t.val)
+	}
+	return fmt.Sprintf("%q", t.val)
+}
+
+type gqlLexer struct {
+	src string
+	pos int
+}
+
+func (l *gqlLexer) skipIgnored() {
+	for l.pos < len(l.src) {
+		switch c := l.src[l.pos]; {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',':
+			l.pos++
+		case c == '#':
+			for l.pos < len(l.src) && l.src[l.pos] != '\n' && l.src[l.pos] != '\r' {
+				l.pos++
+			}
+		case strings.HasPrefix(l.src[l.pos:], "\uFEFF"): // byte order mark
+			l.pos += len("\uFEFF")
+		default:
+			return
+		}
+	}
+}
+
+func (l *gqlLexer) next() (gqlToken, error) {
+	l.skipIgnored()
+	start := l.pos
+	if l.pos >= len(l.src) {
+		return gqlToken{kind: tokEOF, pos: start}, nil
+	}
+	switch c := l.src[l.pos]; {
+	case strings.HasPrefix(l.src[l.pos:], "..."):
+		l.pos += 3
+		return gqlToken{tokPunct, "...", start}, nil
+	case strings.IndexByte("!$&():=@[]{}|", c) >= 0:
+		l.pos++
+		return gqlToken{tokPunct, string(c), start}, nil
+	case isNameStart(c):
+		for l.pos < len(l.src) && (isNameStart(l.src[l.pos]) || isDigit(l.src[l.pos])) {
+			l.pos++
+		}
+		return gqlToken{tokName, l.src[start:l.pos], start}, nil
+	case c == '-' || isDigit(c):
+		return l.number()
+	case c == '"':
+		return l.string()
+	default:
+		r, _ := utf8.DecodeRuneInString(l.src[l.pos:])
+		return gqlToken{}, &gqlSyntaxError{fmt.Sprintf("Unexpected character %q.", r), start}
+	}
+}
+
+func (l *gqlLexer) number() (gqlToken, error) {
+	start := l.pos
+	digits := func() bool {
+		from := l.pos
+		for l.pos < len(l.src) && isDigit(l.src[l.pos]) {
+			l.pos++
+		}
+		return l.pos > from
+	}
+	if l.src[l.pos] == '-' {
+		l.pos++
+	}
+	intStart := l.pos
+	if !digits() {
+		return gqlToken{}, &gqlSyntaxError{"Invalid number, expected digit.", l.pos}
+	}
+	if l.src[intStart] == '0' && l.pos-intStart > 1 {
+		return gqlToken{}, &gqlSyntaxError{"Invalid number, unexpected digit after 0.", intStart + 1}
+	}
+	kind := tokInt
+	if l.pos < len(l.src) && l.src[l.pos] == '.' {
+		kind = tokFloat
+		l.pos++
+		if !digits() {
+			return gqlToken{}, &gqlSyntaxError{"Invalid number, expected digit.", l.pos}
+		}
+	}
+	if l.pos < len(l.src) && (l.src[l.pos] == 'e' || l.src[l.pos] == 'E') {
+		kind = tokFloat
+		l.pos++
+		if l.pos < len(l.src) && (l.src[l.pos] == '+' || l.src[l.pos] == '-') {
+			l.pos++
+		}
+		if !digits() {
+			return gqlToken{}, &gqlSyntaxError{"Invalid number, expected digit.", l.pos}
+		}
+	}
+	if l.pos < len(l.src) && (l.src[l.pos] == '.' || isNameStart(l.src[l.pos])) {
+		return gqlToken{}, &gqlSyntaxError{"Invalid number.", l.pos}
+	}
+	return gqlToken{kind, l.src[start:l.pos], start}, nil
+}
+
+func (l *gqlLexer) string() (gqlToken, error) {
+	start := l.pos
+	if strings.HasPrefix(l.src[l.pos:], `"""`) {
+		return gqlToken{}, &gqlSyntaxError{"Block strings are not supported.", start}
+	}
+	l.pos++
+	var b strings.Builder
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		switch {
+		case c == '"':
+			l.pos++
+			return gqlToken{tokString, b.String(), start}, nil
+		case c == '\n' || c == '\r':
+			return gqlToken{}, &gqlSyntaxError{"Unterminated string.", l.pos}
+		case c != '\\':
+			b.WriteByte(c)
+			l.pos++
+			continue
+		}
+		if l.pos+1 >= len(l.src) {
+			break
+		}
+		esc := l.src[l.pos+1]
+		l.pos += 2
+		switch esc {
+		case '"', '\\', '/':
+			b.WriteByte(esc)
+		case 'b':
+			b.WriteByte('\b')
+		case 'f':
+			b.WriteByte('\f')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case 'u':
+			if l.pos+4 > len(l.src) {
+				return gqlToken{}, &gqlSyntaxError{"Invalid Unicode escape sequence.", l.pos - 2}
+			}
+			n, err := strconv.ParseUint(l.src[l.pos:l.pos+4], 16, 32)
+			if err != nil {
+				return gqlToken{}, &gqlSyntaxError{"Invalid Unicode escape sequence.", l.pos - 2}
+			}
+			b.WriteRune(rune(n))
+			l.pos += 4
+		default:
+			return gqlToken{}, &gqlSyntaxError{fmt.Sprintf("Invalid character escape sequence \\%c.", esc), l.pos - 2}
+		}
+	}
+	return gqlToken{}, &gqlSyntaxError{"Unterminated string.", l.pos}
+}
+
+func isNameStart(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
+
+type gqlParser struct {
+	lex   gqlLexer
+	tok   gqlToken
+	depth int
+}
+
+func parseGraphQL(src string) (*gqlDocument, error) {
+	p := &gqlParser{lex: gqlLexer{src: src}}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	doc := &gqlDocument{fragments: make(map[string]*gqlFragment)}
+	for p.tok.kind != tokEOF {
+		switch {
+		case p.is("{"), p.tok.kind == tokName && (p.tok.val == "query" || p.tok.val == "mutation"):
+			op, err := p.operation()
+			if err != nil {
+				return nil, err
+			}
+			doc.operations = append(doc.operations, op)
+		case p.tok.kind == tokName && p.tok.val == "subscription":
+			return nil, &gqlSyntaxError{"Subscriptions are not supported.", p.tok.pos}
+		case p.tok.kind == tokName && p.tok.val == "fragment":
+			f, err := p.fragment()
+			if err != nil {
+				return nil, err
+			}
+			if _, dup := doc.fragments[f.name]; dup {
+				return nil, &gqlSyntaxError{fmt.Sprintf("There can be only one fragment named %q.", f.name), f.pos}
+			}
+			doc.fragments[f.name] = f
+		default:
+			return nil, p.unexpected()
+		}
+	}
+	if len(doc.operations) == 0 {
+		return nil, &gqlSyntaxError{"Document contains no operations.", 0}
+	}
+	return doc, nil
+}
+
+func (p *gqlParser) advance() (err error) {
+	p.tok, err = p.lex.next()
+	return err
+}
+
+// nest enters a nested construct; callers defer p.unnest() once it
+// succeeds.
+func (p *gqlParser) nest() error {
+	if p.depth >= gqlMaxDepth {
+		return &gqlSyntaxError{fmt.Sprintf("Document nesting exceeds the maximum depth of %d.", gqlMaxDepth), p.tok.pos}
+	}
+	p.depth++
+	return nil
+}
+
+func (p *gqlParser) unnest() { p.depth-- }
+
+func (p *gqlParser) is(punct string) bool {
+	return p.tok.kind == tokPunct && p.tok.val == punct
+}
+
+func (p *gqlParser) unexpected() error {
+	return &gqlSyntaxError{"Unexpected " + p.tok.String() + ".", p.tok.pos}
+}
+
+func (p *gqlParser) expect(punct string) error {
+	if !p.is(punct) {
+		return &gqlSyntaxError{fmt.Sprintf("Expected %q, found %s.", punct, p.tok), p.tok.pos}
+	}
+	return p.advance()
+}
+
+func (p *gqlParser) name() (string, error) {
+	if p.tok.kind != tokName {
+		return "", &gqlSyntaxError{"Expected Name, found " + p.tok.String() + ".", p.tok.pos}
+	}
+	n := p.tok.val
+	return n, p.advance()
+}
+
+func (p *gqlParser) operation() (*gqlOperation, error) {
+	op := &gqlOperation{kind: "query", pos: p.tok.pos}
+	if p.tok.kind == tokName {
+		op.kind = p.tok.val
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		if p.tok.kind == tokName {
+			op.name = p.tok.val
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+		}
+		if p.is("(") {
+			vars, err := p.varDefs()
+			if err != nil {
+				return nil, err
+			}
+			op.vars = vars
+		}
+		dirs, err := p.directives(true)
+		if err != nil {
+			return nil, err
+		}
+		op.directives = dirs
+	}
+	sel, err := p.selectionSet()
+	if err != nil {
+		return nil, err
+	}
+	op.sel = sel
+	return op, nil
+}
+
+func (p *gqlParser) varDefs() ([]*gqlVarDef, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	var defs []*gqlVarDef
+	for !p.is(")") {
+		if err := p.expect("$"); err != nil {
+			return nil, err
+		}
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(":"); err != nil {
+			return nil, err
+		}
+		typ, err := p.typeRef()
+		if err != nil {
+			return nil, err
+		}
+		d := &gqlVarDef{name: name, typ: typ}
+		if p.is("=") {
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+			if d.def, err = p.value(true); err != nil {
+				return nil, err
+			}
+			d.hasDef = true
+		}
+		if _, err := p.directives(true); err != nil {
+			return nil, err
+		}
+		defs = append(defs, d)
+	}
+	return defs, p.advance()
+}
+
+func (p *gqlParser) typeRef() (*gqlTypeRef, error) {
+	t := &gqlTypeRef{}
+	if p.is("[") {
+		if err := p.nest(); err != nil {
+			return nil, err
+		}
+		defer p.unnest()
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		elem, err := p.typeRef()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect("]"); err != nil {
+			return nil, err
+		}
+		t.elem = elem
+	} else {
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		t.name = name
+	}
+	if p.is("!") {
+		t.nonNull = true
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+func (p *gqlParser) fragment() (*gqlFragment, error) {
+	f := &gqlFragment{pos: p.tok.pos}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	if p.tok.kind == tokName && p.tok.val == "on" {
+		return nil, p.unexpected()
+	}
+	name, err := p.name()
+	if err != nil {
+		return nil, err
+	}
+	f.name = name
+	if p.tok.kind != tokName || p.tok.val != "on" {
+		return nil, &gqlSyntaxError{`Expected "on", found ` + p.tok.String() + ".", p.tok.pos}
+	}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	if f.typeCond, err = p.name(); err != nil {
+		return nil, err
+	}
+	if _, err := p.directives(true); err != nil {
+		return nil, err
+	}
+	if f.sel, err = p.selectionSet(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (p *gqlParser) selectionSet() ([]*gqlSelection, error) {
+	if err := p.nest(); err != nil {
+		return nil, err
+	}
+	defer p.unnest()
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	var sel []*gqlSelection
+	for !p.is("}") {
+		if p.tok.kind == tokEOF {
+			return nil, p.unexpected()
+		}
+		s, err := p.selection()
+		if err != nil {
+			return nil, err
+		}
+		sel = append(sel, s)
+	}
+	if len(sel) == 0 {
+		return nil, &gqlSyntaxError{"Expected Name, found \"}\".", p.tok.pos}
+	}
+	return sel, p.advance()
+}
+
+func (p *gqlParser) selection() (*gqlSelection, error) {
+	s := &gqlSelection{pos: p.tok.pos}
+	var err error
+	if p.is("...") {
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		switch {
+		case p.tok.kind == tokName && p.tok.val != "on":
+			s.kind, s.name = selSpread, p.tok.val
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+			s.directives, err = p.directives(false)
+			return s, err
+		case p.tok.kind == tokName:
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+			if s.typeCond, err = p.name(); err != nil {
+				return nil, err
+			}
+		}
+		s.kind = selInline
+		if s.directives, err = p.directives(false); err != nil {
+			return nil, err
+		}
+		s.sel, err = p.selectionSet()
+		return s, err
+	}
+
+	if s.name, err = p.name(); err != nil {
+		return nil, err
+	}
+	if p.is(":") {
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		s.alias = s.name
+		if s.name, err = p.name(); err != nil {
+			return nil, err
+		}
+	}
+	if p.is("(") {
+		if s.args, err = p.args(false); err != nil {
+			return nil, err
+		}
+	}
+	if s.directives, err = p.directives(false); err != nil {
+		return nil, err
+	}
+	if p.is("{") {
+		s.sel, err = p.selectionSet()
+	}
+	return s, err
+}
+
+func (p *gqlParser) args(isConst bool) ([]gqlArg, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	var args []gqlArg
+	for !p.is(")") {
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(":"); err != nil {
+			return nil, err
+		}
+		v, err := p.value(isConst)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, gqlArg{name, v})
+	}
+	if len(args) == 0 {
+		return nil, &gqlSyntaxError{"Expected Name, found \")\".", p.tok.pos}
+	}
+	return args, p.advance()
+}
+
+func (p *gqlParser) directives(isConst bool) ([]gqlDirective, error) {
+	var dirs []gqlDirective
+	for p.is("@") {
+		d := gqlDirective{pos: p.tok.pos}
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		d.name = name
+		if p.is("(") {
+			if d.args, err = p.args(isConst); err != nil {
+				return nil, err
+			}
+		}
+		dirs = append(dirs, d)
+	}
+	return dirs, nil
+}
+
+func (p *gqlParser) value(isConst bool) (any, error) {
+	tok := p.tok
+	switch tok.kind {
+	case tokInt:
+		n, err := strconv.ParseInt(tok.val, 10, 64)
+		if err != nil {
+			// Too big for int64: let coercion reject it as out of range.
+			f, _ := strconv.ParseFloat(tok.val, 64)
+			return f, p.advance()
+		}
+		return n, p.advance()
+	case tokFloat:
+		f, err := strconv.ParseFloat(tok.val, 64)
+		if err != nil {
+			return nil, &gqlSyntaxError{"Invalid number.", tok.pos}
+		}
+		return f, p.advance()
+	case tokString:
+		return tok.val, p.advance()
+	case tokName:
+		var v any
+		switch tok.val {
+		case "true":
+			v = true
+		case "false":
+			v = false
+		case "null":
+			v = nil
+		default:
+			v = gqlEnum(tok.val)
+		}
+		return v, p.advance()
+	}
+
+	switch {
+	case p.is("$") && !isConst:
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		name, err := p.name()
+		return gqlVariable(name), err
+	case p.is("["):
+		if err := p.nest(); err != nil {
+			return nil, err
+		}
+		defer p.unnest()
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		list := []any{}
+		for !p.is("]") {
+			if p.tok.kind == tokEOF {
+				return nil, p.unexpected()
+			}
+			v, err := p.value(isConst)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		return list, p.advance()
+	case p.is("{"):
+		if err := p.nest(); err != nil {
+			return nil, err
+		}
+		defer p.unnest()
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		obj := map[string]any{}
+		for !p.is("}") {
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(":"); err != nil {
+				return nil, err
+			}
+			if obj[name], err = p.value(isConst); err != nil {
+				return nil, err
+			}
+		}
+		return obj, p.advance()
+	}
+	return nil, p.unexpected()
+}
+
+// lineCol converts a byte offset to the 1-based line and column GraphQL
+// errors report.
+func lineCol(src string, pos int) (line, col int) {
+	line, col = 1, 1
+	for i := 0; i < pos && i < len(src); i++ {
+		switch {
+		case src[i] == '\n', src[i] == '\r' && (i+1 >= len(src) || src[i+1] != '\n'):
+			line, col = line+1, 1
+		case src[i] == '\r':
+		default:
+			if utf8.RuneStart(src[i]) {
+				col++
+			}
+		}
+	}
+	return line, col
+}
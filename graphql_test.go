@@ -0,0 +1,240 @@
+// graphql_test.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// gql POSTs a GraphQL request and decodes the response body.
+func (ta *testApp) gql(t *testing.T, query string, vars map[string]any) map[string]any {
+	t.Helper()
+	b, err := json.Marshal(gqlRequest{Query: query, Variables: vars})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := ta.do(t, http.MethodPost, "/graphql", string(b))
+	wantStatus(t, rec, http.StatusOK)
+	return jsonBody(t, rec)
+}
+
+// gqlErrorMessages lists the messages of a response's errors.
+func gqlErrorMessages(body map[string]any) []string {
+	var out []string
+	errs, _ := body["errors"].([]any)
+	for _, e := range errs {
+		out = append(out, e.(map[string]any)["message"].(string))
+	}
+	return out
+}
+
+func TestParseGraphQL(t *testing.T) {
+	doc, err := parseGraphQL(`
+		query Q($id: ID!, $ids: [ID!]! = ["1"]) {
+			a: user(id: $id) { ...F @include(if: true) }
+			users(limit: 2) { ... on User { id } }
+		}
+		fragment F on User { id email }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	op := doc.operations[0]
+	if op.kind != "query" || op.name != "Q" || len(op.vars) != 2 || op.vars[1].typ.String() != "[ID!]!" || !op.vars[1].hasDef {
+		t.Fatalf("operation = %+v", op)
+	}
+	user := op.sel[0]
+	if user.responseKey() != "a" || user.name != "user" || user.args[0].val != gqlVariable("id") {
+		t.Fatalf("aliased field = %+v", user)
+	}
+	if spread := user.sel[0]; spread.kind != selSpread || spread.name != "F" || spread.directives[0].name != "include" {
+		t.Fatalf("spread = %+v", spread)
+	}
+	if inline := op.sel[1].sel[0]; inline.kind != selInline || inline.typeCond != "User" {
+		t.Fatalf("inline fragment = %+v", inline)
+	}
+	if f := doc.fragments["F"]; f == nil || f.typeCond != "User" || len(f.sel) != 2 {
+		t.Fatalf("fragment = %+v", f)
+	}
+}
+
+func TestParseGraphQLSyntaxErrors(t *testing.T) {
+	for src, want := range map[string]string{
+		"":                              "Document contains no operations.",
+		"{ user(id: 1) { id }":          "Unexpected <EOF>.",
+		`{ user(id: "1 }`:               "Unterminated string.",
+		"subscription { users { id } }": "Subscriptions are not supported.",
+		"{ users(limit: 01) { id } }":   "Invalid number, unexpected digit after 0.",
+		"{ a } fragment F on User { id } fragment F on User { id }": `There can be only one fragment named "F".`,
+	} {
+		_, err := parseGraphQL(src)
+		var se *gqlSyntaxError
+		if !errors.As(err, &se) || se.msg != want {
+			t.Errorf("%q: %v, want %q", src, err, want)
+		}
+	}
+}
+
+func TestParseGraphQLDepthLimit(t *testing.T) {
+	nested := func(open, close string, n int) string {
+		return strings.Repeat(open, n) + strings.Repeat(close, n)
+	}
+	for name, src := range map[string]string{
+		"selections": "{" + strings.Repeat("a {", gqlMaxDepth) + "b" + strings.Repeat("}", gqlMaxDepth+1),
+		"lists":      "{ a(x: " + nested("[", "]", gqlMaxDepth+1) + ") }",
+		"objects":    "{ a(x: " + strings.Repeat("{a: ", gqlMaxDepth+1) + "1" + strings.Repeat("}", gqlMaxDepth+1) + ") }",
+		"types":      "query($v: " + strings.Repeat("[", gqlMaxDepth+1) + "ID" + strings.Repeat("]", gqlMaxDepth+1) + ") { a }",
+		// Unterminated, as an attacker would send it.
+		"huge list": "{ a(x: " + strings.Repeat("[", 1<<20),
+	} {
+		_, err := parseGraphQL(src)
+		if err == nil || !strings.Contains(err.Error(), "maximum depth") {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+	if _, err := parseGraphQL("{ a(x: " + nested("[", "]", gqlMaxDepth-2) + ") }"); err != nil {
+		t.Fatalf("nesting within the limit rejected: %v", err)
+	}
+}
+
+func TestGraphQLQueriesAndMutations(t *testing.T) {
+	ta := newTestApp(t, map[string]string{"ENABLE_GRAPHQL": "true"})
+	body := ta.gql(t, `mutation($u: String!, $e: String!) { createUser(username: $u, email: $e) { id username email } }`,
+		map[string]any{"u": "ann", "e": "ann@example.com"})
+	created := body["data"].(map[string]any)["createUser"].(map[string]any)
+	if created["id"] != "1" || created["email"] != "ann@example.com" || body["errors"] != nil {
+		t.Fatalf("createUser = %v", body)
+	}
+	ta.createUser(t, "bob", "bob@example.com")
+
+	body = ta.gql(t, `{ users(limit: 1, offset: 1) { id username } one: user(id: "1") { __typename email } none: user(id: "99") { id } }`, nil)
+	data := body["data"].(map[string]any)
+	if users := data["users"].([]any); len(users) != 1 || users[0].(map[string]any)["username"] != "bob" {
+		t.Fatalf("users = %v", data["users"])
+	}
+	if one := data["one"].(map[string]any); one["__typename"] != "User" || one["email"] != "ann@example.com" || data["none"] != nil {
+		t.Fatalf("user lookups = %v", data)
+	}
+
+	body = ta.gql(t, `mutation { updateUser(id: "1", username: "annie") { username email } deleteUser(id: "2") }`, nil)
+	data = body["data"].(map[string]any)
+	if data["updateUser"].(map[string]any)["username"] != "annie" || data["deleteUser"] != true {
+		t.Fatalf("mutations = %v", body)
+	}
+	if _, err := ta.Store.GetUser(context.Background(), 2); !errors.Is(err, errUserNotFound) {
+		t.Fatalf("deleted user still stored: %v", err)
+	}
+
+	body = ta.gql(t, `mutation { createUser(username: "cy", email: "not-an-email") { id } }`, nil)
+	errs := body["errors"].([]any)
+	if ext := errs[0].(map[string]any)["extensions"].(map[string]any); ext["code"] != "VALIDATION_FAILED" {
+		t.Fatalf("validation error = %v", body)
+	}
+}
+
+func TestGraphQLOverGET(t *testing.T) {
+	ta := newTestApp(t, map[string]string{"ENABLE_GRAPHQL": "true"})
+	ta.createUser(t, "ann", "ann@example.com")
+	q := url.Values{"query": {`query($id: ID!) { user(id: $id) { username } }`}, "variables": {`{"id":"1"}`}}
+	rec := ta.do(t, http.MethodGet, "/graphql?"+q.Encode(), "")
+	wantStatus(t, rec, http.StatusOK)
+	if !strings.Contains(rec.Body.String(), `"username":"ann"`) {
+		t.Fatalf("GET query = %s", rec.Body)
+	}
+
+	q = url.Values{"query": {`mutation { deleteUser(id: "1") }`}}
+	rec = ta.do(t, http.MethodGet, "/graphql?"+q.Encode(), "")
+	wantStatus(t, rec, http.StatusMethodNotAllowed)
+	if rec.Header().Get("Allow") != http.MethodPost {
+		t.Fatalf("Allow = %q", rec.Header().Get("Allow"))
+	}
+}
+
+func TestGraphQLValidationErrors(t *testing.T) {
+	ta := newTestApp(t, map[string]string{"ENABLE_GRAPHQL": "true"})
+	for query, want := range map[string]string{
+		`{ nope }`:                                  `Cannot query field "nope" on type "Query".`,
+		`{ user(id: "1") }`:                         `Field "user" of type "User" must have a selection of subfields.`,
+		`{ ...F } fragment F on Query { ...F }`:     `Cannot spread fragment "F" within itself.`,
+		`{ user(id: "1") { id } } { users { id } }`: "Must provide operation name if query contains multiple operations.",
+	} {
+		body := ta.gql(t, query, nil)
+		if msgs := gqlErrorMessages(body); len(msgs) == 0 || msgs[0] != want || body["data"] != nil {
+			t.Errorf("%s: %v, want %q", query, body, want)
+		}
+	}
+}
+
+func TestGraphQLDepthLimitAcrossFragments(t *testing.T) {
+	ta := newTestApp(t, map[string]string{"ENABLE_GRAPHQL": "true"})
+	// Each fragment nests only two levels, but chained they reach far past
+	// the limit.
+	var b strings.Builder
+	b.WriteString(`{ __type(name: "User") { ...F0 } }`)
+	for i := range gqlMaxDepth {
+		b.WriteString(" fragment F" + strconv.Itoa(i) + " on __Type { ofType { ...F" + strconv.Itoa(i+1) + " } }")
+	}
+	b.WriteString(" fragment F" + strconv.Itoa(gqlMaxDepth) + " on __Type { name }")
+	body := ta.gql(t, b.String(), nil)
+	if msgs := gqlErrorMessages(body); len(msgs) != 1 || !strings.Contains(msgs[0], "maximum depth") {
+		t.Fatalf("errors = %v", msgs)
+	}
+	if _, ok := body["data"]; ok {
+		t.Fatal("over-deep query executed")
+	}
+}
+
+func TestGraphQLRejectsHugeBodies(t *testing.T) {
+	ta := newTestApp(t, map[string]string{"ENABLE_GRAPHQL": "true", "MAX_BODY_BYTES": "4096"})
+	huge := `{"query":"{ users(limit: ` + strings.Repeat("[", 10000) + `) { id } }"}`
+	wantStatus(t, ta.do(t, http.MethodPost, "/graphql", huge), http.StatusRequestEntityTooLarge)
+
+	// Under the size cap, deep nesting is a syntax error, not a crash.
+	body := ta.gql(t, `{ users(limit: `+strings.Repeat("[", 2000)+`) { id } }`, nil)
+	if msgs := gqlErrorMessages(body); len(msgs) != 1 || !strings.Contains(msgs[0], "maximum depth") {
+		t.Fatalf("errors = %v", msgs)
+	}
+}
+
+func TestGraphQLIntrospection(t *testing.T) {
+	ta := newTestApp(t, map[string]string{"ENABLE_GRAPHQL": "true"})
+	body := ta.gql(t, `{
+		__schema { queryType { name } mutationType { name } types { name } }
+		__type(name: "User") { kind fields { name type { kind ofType { name } } } }
+	}`, nil)
+	if body["errors"] != nil {
+		t.Fatalf("errors = %v", body["errors"])
+	}
+	data := body["data"].(map[string]any)
+	schema := data["__schema"].(map[string]any)
+	if schema["queryType"].(map[string]any)["name"] != "Query" || schema["mutationType"].(map[string]any)["name"] != "Mutation" {
+		t.Fatalf("__schema = %v", schema)
+	}
+	names := map[string]bool{}
+	for _, typ := range schema["types"].([]any) {
+		names[typ.(map[string]any)["name"].(string)] = true
+	}
+	for _, want := range []string{"Query", "Mutation", "User", "ID", "String", "__Schema", "__Type"} {
+		if !names[want] {
+			t.Errorf("type %s missing from __schema", want)
+		}
+	}
+
+	user := data["__type"].(map[string]any)
+	var fields []string
+	for _, f := range user["fields"].([]any) {
+		fields = append(fields, f.(map[string]any)["name"].(string))
+	}
+	if user["kind"] != kindObject || strings.Join(fields, ",") != "id,username,email" {
+		t.Fatalf("__type(User) = %v", user)
+	}
+	id := user["fields"].([]any)[0].(map[string]any)["type"].(map[string]any)
+	if id["kind"] != kindNonNull || id["ofType"].(map[string]any)["name"] != "ID" {
+		t.Fatalf("id type = %v", id)
+	}
+}
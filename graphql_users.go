@@ -0,0 +1,263 @@
+// graphql_users.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// newUsersSchema exposes the users API over GraphQL (ENABLE_GRAPHQL). The
+// resolvers call the same UserService as the REST handlers.
+func (a *App) newUsersSchema() *gqlSchema {
+	optional := func(null bool, v string) any {
+		if null {
+			return nil
+		}
+		return v
+	}
+	user := &gqlType{kind: kindObject, name: "User", description: "A user account."}
+	user.fields = []*gqlField{
+		{name: "id", typ: gqlNonNull(gqlID), resolve: func(_ context.Context, src any, _ map[string]any) (any, error) {
+			return strconv.Itoa(int(src.(User).ID)), nil
+		}},
+		// Fields FIELD_SCOPES hides from the caller resolve to null.
+		{name: "username", typ: gqlString, resolve: func(ctx context.Context, src any, _ map[string]any) (any, error) {
+			u := src.(User)
+			return optional(u.NullUsername || !a.fieldAllowed(ctx, "username"), u.Username), nil
+		}},
+		{name: "email", typ: gqlString, resolve: func(ctx context.Context, src any, _ map[string]any) (any, error) {
+			u := src.(User)
+			return optional(u.NullEmail || !a.fieldAllowed(ctx, "email"), u.Email), nil
+		}},
+	}
+
+	idArg := &gqlArgDef{name: "id", typ: gqlNonNull(gqlID)}
+	query := &gqlType{kind: kindObject, name: "Query"}
+	query.fields = []*gqlField{
+		{name: "user", description: "The user with this id, or null.", args: []*gqlArgDef{idArg},
+			typ: user, resolve: a.gqlUser},
+		{name: "users", description: "Users in user_id order.",
+			args: []*gqlArgDef{
+				{name: "limit", description: "At most 100.", typ: gqlInt, def: defaultPageLimit, defLiteral: strconv.Itoa(defaultPageLimit)},
+				{name: "offset", typ: gqlInt, def: 0, defLiteral: "0"},
+			},
+			typ: gqlNonNull(gqlList(gqlNonNull(user))), resolve: a.gqlUsers},
+	}
+
+	mutation := &gqlType{kind: kindObject, name: "Mutation"}
+	mutation.fields = []*gqlField{
+		{name: "createUser", args: []*gqlArgDef{
+			{name: "username", typ: gqlNonNull(gqlString)},
+			{name: "email", typ: gqlNonNull(gqlString)},
+		}, typ: user, resolve: a.gqlCreateUser},
+		{name: "updateUser", description: "Changes the given fields; null or omitted ones are kept. Returns null when there is no such user.",
+			args: []*gqlArgDef{idArg, {name: "username", typ: gqlString}, {name: "email", typ: gqlString}},
+			typ:  user, resolve: a.gqlUpdateUser},
+		{name: "deleteUser", description: "Reports whether a user was deleted.", args: []*gqlArgDef{idArg},
+			typ: gqlNonNull(gqlBoolean), resolve: a.gqlDeleteUser},
+	}
+
+	return newGQLSchema(query, mutation, user)
+}
+
+func gqlUserID(args map[string]any) (int32, error) {
+	id, err := parseID(args["id"].(string))
+	if err != nil {
+		return 0, newGQLError("BAD_USER_INPUT", "Invalid id: "+err.Error())
+	}
+	return id, nil
+}
+
+func (a *App) gqlUser(ctx context.Context, _ any, args map[string]any) (any, error) {
+	id, err := gqlUserID(args)
+	if err != nil {
+		return nil, err
+	}
+	u, err := a.Users.Get(ctx, id)
+	if errors.Is(err, errUserNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, gqlStoreError(ctx, err)
+	}
+	return u, nil
+}
+
+func (a *App) gqlUsers(ctx context.Context, _ any, args map[string]any) (any, error) {
+	limit, offset := args["limit"].(int), args["offset"].(int)
+	if limit < 1 {
+		return nil, newGQLError("BAD_USER_INPUT", "Invalid limit")
+	}
+	if offset < 0 {
+		return nil, newGQLError("BAD_USER_INPUT", "Invalid offset")
+	}
+	users, err := a.Users.List(ctx, pageParams{Limit: min(limit, maxPageLimit), Offset: offset, Sort: "user_id"})
+	if err != nil {
+		return nil, gqlStoreError(ctx, err)
+	}
+	out := make([]any, len(users))
+	for i, u := range users {
+		out[i] = u
+	}
+	return out, nil
+}
+
+func (a *App) gqlCreateUser(ctx context.Context, _ any, args map[string]any) (any, error) {
+	req := createUserReq{Username: args["username"].(string), Email: args["email"].(string)}
+	u, _, err := a.Users.Create(ctx, req)
+	if err != nil {
+		return nil, gqlStoreError(ctx, err)
+	}
+	return u, nil
+}
+
+func (a *App) gqlUpdateUser(ctx context.Context, _ any, args map[string]any) (any, error) {
+	id, err := gqlUserID(args)
+	if err != nil {
+		return nil, err
+	}
+	item := userUpdate{ID: id}
+	if v, ok := args["username"].(string); ok {
+		item.Username = &v
+	}
+	if v, ok := args["email"].(string); ok {
+		item.Email = &v
+	}
+	u, err := a.Users.Update(ctx, item)
+	if errors.Is(err, errUserNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, gqlStoreError(ctx, err)
+	}
+	return u, nil
+}
+
+func (a *App) gqlDeleteUser(ctx context.Context, _ any, args map[string]any) (any, error) {
+	id, err := gqlUserID(args)
+	if err != nil {
+		return nil, err
+	}
+	err = a.Users.Delete(ctx, id)
+	if errors.Is(err, errUserNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return nil, gqlStoreError(ctx, err)
+	}
+	return true, nil
+}
+
+// gqlStoreError maps UserService errors the way writeUserError does,
+// without exposing unexpected database errors to the client.
+func gqlStoreError(ctx context.Context, err error) error {
+	var ve *validationError
+	var cv *checkViolationError
+	switch {
+	case errors.As(err, &ve):
+		e := newGQLError("VALIDATION_FAILED", "Validation failed")
+		e.extensions["fields"] = ve.fields
+		return e
+	case errors.Is(err, errEmailDomainUnresolvable):
+		return newGQLError("EMAIL_DOMAIN_UNRESOLVABLE", "Email domain does not accept mail")
+	case errors.Is(err, errDuplicateEmail):
+		return newGQLError("DUPLICATE_EMAIL", "Email already exists")
+	case errors.Is(err, errDuplicateUsername):
+		return newGQLError("DUPLICATE_USERNAME", "Username already exists")
+	case errors.Is(err, errValueTooLong):
+		return newGQLError("VALUE_TOO_LONG", "username or email is too long")
+	case errors.As(err, &cv):
+		code, ok := constraintCodes[cv.Constraint]
+		if !ok {
+			code = "CONSTRAINT_VIOLATION"
+		}
+		return newGQLError(code, "Value rejected by database constraint")
+	case errors.Is(err, errPoolExhausted):
+		return newGQLError("UNAVAILABLE", "Database busy, try again later")
+	case isConnectionLost(err):
+		return newGQLError("DB_CONNECTION_LOST", "Database connection lost, try again")
+	}
+	logger(ctx).Error("graphql: store error", "err", err)
+	return newGQLError("INTERNAL", "Database error")
+}
+
+// graphQL serves GraphQL over HTTP: POST with a JSON body, or GET with
+// query, operationName and variables parameters for queries only.
+func (a *App) graphQL(schema *gqlSchema) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req gqlRequest
+		switch r.Method {
+		case http.MethodGet:
+			q := r.URL.Query()
+			req.Query, req.OperationName = q.Get("query"), q.Get("operationName")
+			if v := q.Get("variables"); v != "" {
+				dec := json.NewDecoder(strings.NewReader(v))
+				dec.UseNumber()
+				if err := dec.Decode(&req.Variables); err != nil {
+					jsonWrite(w, http.StatusBadRequest, gqlErrorsBody("Variables are invalid JSON."))
+					return
+				}
+			}
+		case http.MethodPost:
+			r.Body = http.MaxBytesReader(w, r.Body, a.Config.MaxBodyBytes)
+			dec := json.NewDecoder(r.Body)
+			dec.UseNumber()
+			if err := dec.Decode(&req); err != nil {
+				writeDecodeError(w, err, "invalid JSON")
+				return
+			}
+		default:
+			writeMethodNotAllowed(w, http.MethodGet, http.MethodPost)
+			return
+		}
+		if strings.TrimSpace(req.Query) == "" {
+			jsonWrite(w, http.StatusBadRequest, gqlErrorsBody("Must provide query string."))
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), a.Config.QueryTimeout)
+		defer cancel()
+		body, err := schema.execute(ctx, req, r.Method == http.MethodPost)
+		if errors.Is(err, errGQLMutationNotAllowed) {
+			w.Header().Set("Allow", http.MethodPost)
+			jsonWrite(w, http.StatusMethodNotAllowed, gqlErrorsBody("Mutations can only be sent with POST."))
+			return
+		}
+		jsonWrite(w, http.StatusOK, body)
+	}
+}
+
+// isGraphQLMutation reports whether a POST /graphql body runs a mutation.
+// The bytes read are put back in front of the body. A body that doesn't
+// parse, or runs past max, counts as none and is left for the handler to
+// reject.
+func isGraphQLMutation(r *http.Request, max int64) bool {
+	buf, err := io.ReadAll(io.LimitReader(r.Body, max+1))
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(buf), r.Body), r.Body}
+	if err != nil || int64(len(buf)) > max {
+		return false
+	}
+	var req gqlRequest
+	if json.Unmarshal(buf, &req) != nil {
+		return false
+	}
+	doc, err := parseGraphQL(req.Query)
+	if err != nil {
+		return false
+	}
+	op, err := doc.operation(req.OperationName)
+	return err == nil && op.kind == "mutation"
+}
+
+func gqlErrorsBody(msg string) map[string]any {
+	return map[string]any{"errors": []gqlError{{Message: msg}}}
+}
@@ -0,0 +1,168 @@
+// health.go
+package main
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var readinessTransitions = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "readiness_transitions_total",
+	Help: "Changes of the /healthz readiness state, by the state entered.",
+}, []string{"to"})
+
+// componentDBPing holds the gate closed while the database doesn't answer
+// /healthz's ping.
+const componentDBPing = "db_ping"
+
+// readiness gates /healthz. It reports not-ready until the startup grace
+// period has passed, and while any component holds the gate closed. Each
+// flip between ready and not ready is kept in a bounded history
+// (READINESS_HISTORY_SIZE), for finding out why a pod left rotation.
+type readiness struct {
+	mu          sync.Mutex
+	startedAt   time.Time
+	grace       time.Duration
+	closed      map[string]string // component -> reason
+	ready       bool
+	reason      string
+	history     []readinessChange
+	historySize int
+}
+
+type readinessChange struct {
+	At     time.Time `json:"at"`
+	Ready  bool      `json:"ready"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+func newReadiness(grace time.Duration, historySize int) *readiness {
+	g := &readiness{startedAt: time.Now(), grace: grace, closed: make(map[string]string), historySize: historySize}
+	// A process starts out of rotation; without a grace period the first
+	// entry is it becoming ready.
+	g.reason = "starting"
+	g.observe(g.startedAt)
+	return g
+}
+
+func (g *readiness) setNotReady(component, reason string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.closed[component] = reason
+	g.observe(time.Now())
+}
+
+func (g *readiness) setReady(component string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.closed, component)
+	g.observe(time.Now())
+}
+
+func (g *readiness) closedBy(component string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	_, ok := g.closed[component]
+	return ok
+}
+
+// state reports whether the gate is open at now and, if not, why.
+func (g *readiness) state(now time.Time) (bool, string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.observe(now)
+}
+
+// observe evaluates the gate at now, recording a flip from the last state.
+// The end of the grace period is only noticed on the next evaluation, so it
+// is dated when it actually happened. g.mu must be held.
+func (g *readiness) observe(now time.Time) (bool, string) {
+	ok, reason := g.evaluate(now)
+	if ok != g.ready {
+		at := now
+		if ok && g.reason == "starting" {
+			at = g.startedAt.Add(g.grace)
+		}
+		change := readinessChange{At: at.UTC(), Ready: ok, Reason: reason}
+		if ok {
+			readinessTransitions.WithLabelValues("ready").Inc()
+		} else {
+			readinessTransitions.WithLabelValues("not_ready").Inc()
+		}
+		if g.historySize > 0 {
+			g.history = append(g.history, change)
+			if len(g.history) > g.historySize {
+				g.history = slices.Clone(g.history[len(g.history)-g.historySize:])
+			}
+		}
+		g.ready = ok
+	}
+	g.reason = reason
+	return ok, reason
+}
+
+func (g *readiness) evaluate(now time.Time) (bool, string) {
+	if now.Sub(g.startedAt) < g.grace {
+		return false, "starting"
+	}
+	if len(g.closed) > 0 {
+		reasons := make([]string, 0, len(g.closed))
+		for _, r := range g.closed {
+			reasons = append(reasons, r)
+		}
+		sort.Strings(reasons)
+		return false, strings.Join(reasons, "; ")
+	}
+	return true, ""
+}
+
+// changes returns the recorded flips, oldest first.
+func (g *readiness) changes() []readinessChange {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return slices.Clone(g.history)
+}
+
+// handleHealthz is the readiness probe: 200 only after STARTUP_GRACE and
+// while the database answers. Liveness probes should use /livez instead,
+// otherwise a slow warmup or a DB outage would get the pod restarted.
+func (a *App) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	// The ping result goes through the gate, so that an outage seen here
+	// shows up in the readiness history like any other reason.
+	if a.DB != nil {
+		ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+		defer cancel()
+		if err := a.DB.PingContext(ctx); err != nil {
+			a.Ready.setNotReady(componentDBPing, "database unreachable")
+		} else {
+			a.Ready.setReady(componentDBPing)
+		}
+	}
+	if ok, reason := a.Ready.state(time.Now()); !ok {
+		jsonWrite(w, http.StatusServiceUnavailable, map[string]string{"status": "unavailable", "reason": reason})
+		return
+	}
+	jsonWrite(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func (a *App) handleLivez(w http.ResponseWriter, r *http.Request) {
+	jsonWrite(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// readinessHistory reports the readiness state and its recent flips.
+func (a *App) readinessHistory(w http.ResponseWriter, r *http.Request) {
+	ok, reason := a.Ready.state(time.Now())
+	resp := map[string]any{"ready": ok, "transitions": a.Ready.changes()}
+	if !ok {
+		resp["reason"] = reason
+	}
+	jsonWrite(w, http.StatusOK, resp)
+}
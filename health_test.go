@@ -0,0 +1,126 @@
+// health_test.go
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestHealthzUnavailableDuringStartupGrace(t *testing.T) {
+	ta := newTestApp(t, map[string]string{"STARTUP_GRACE": "1m"})
+	rec := ta.do(t, http.MethodGet, "/healthz", "")
+	wantStatus(t, rec, http.StatusServiceUnavailable)
+	if got := jsonBody(t, rec)["reason"]; got != "starting" {
+		t.Fatalf("reason = %v, want starting", got)
+	}
+	// Liveness ignores the grace period.
+	wantStatus(t, ta.do(t, http.MethodGet, "/livez", ""), http.StatusOK)
+
+	ta.Ready.mu.Lock()
+	ta.Ready.startedAt = time.Now().Add(-2 * time.Minute)
+	ta.Ready.mu.Unlock()
+	wantStatus(t, ta.do(t, http.MethodGet, "/healthz", ""), http.StatusOK)
+}
+
+func TestReadinessComponentsCloseGate(t *testing.T) {
+	g := newReadiness(0, 10)
+	now := time.Now()
+	if ok, _ := g.state(now); !ok {
+		t.Fatal("not ready without grace period")
+	}
+	g.setNotReady(componentDBPing, "database unreachable")
+	if ok, reason := g.state(now); ok || reason != "database unreachable" {
+		t.Fatalf("state = %v, %q", ok, reason)
+	}
+	g.setReady(componentDBPing)
+	if ok, _ := g.state(now); !ok {
+		t.Fatal("still not ready after the component reopened the gate")
+	}
+}
+
+func TestReadinessHistory(t *testing.T) {
+	toReady, toNotReady := readinessTransitions.WithLabelValues("ready"), readinessTransitions.WithLabelValues("not_ready")
+	readyBefore, notReadyBefore := testutil.ToFloat64(toReady), testutil.ToFloat64(toNotReady)
+
+	g := newReadiness(0, 4)
+	g.setNotReady(componentMaintenance, "maintenance")
+	// A second reason while already out of rotation is not a flip.
+	g.setNotReady(componentDBPing, "database unreachable")
+	g.setReady(componentMaintenance)
+	g.setReady(componentDBPing)
+	g.setNotReady(componentDBPing, "database unreachable")
+	g.setReady(componentDBPing)
+
+	var got []string
+	for _, c := range g.changes() {
+		got = append(got, fmt.Sprintf("%v:%s", c.Ready, c.Reason))
+	}
+	// Bounded to the 4 latest of 5 flips.
+	want := []string{"false:maintenance", "true:", "false:database unreachable", "true:"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("history = %v, want %v", got, want)
+	}
+	if n := testutil.ToFloat64(toReady) - readyBefore; n != 3 {
+		t.Errorf("ready transitions = %v, want 3", n)
+	}
+	if n := testutil.ToFloat64(toNotReady) - notReadyBefore; n != 2 {
+		t.Errorf("not_ready transitions = %v, want 2", n)
+	}
+
+	if g := newReadiness(0, 0); len(g.changes()) != 0 {
+		t.Fatalf("READINESS_HISTORY_SIZE=0 kept %v", g.changes())
+	}
+}
+
+func TestReadinessHistoryDatesEndOfGrace(t *testing.T) {
+	g := newReadiness(time.Minute, 10)
+	if h := g.changes(); len(h) != 0 {
+		t.Fatalf("history = %v, want none while starting", h)
+	}
+	g.state(g.startedAt.Add(5 * time.Minute))
+	h := g.changes()
+	if len(h) != 1 || !h[0].Ready || !h[0].At.Equal(g.startedAt.Add(time.Minute)) {
+		t.Fatalf("history = %v, want ready at the end of the grace period", h)
+	}
+}
+
+func TestReadinessHistoryEndpoint(t *testing.T) {
+	ta := newTestApp(t, map[string]string{"ADMIN_TOKEN": "secret"})
+	ta.DB = sql.OpenDB(&scriptedPinger{steps: []string{"fail", "ok"}})
+	defer ta.DB.Close()
+	wantStatus(t, ta.do(t, http.MethodGet, "/admin/readiness/history", ""), http.StatusUnauthorized)
+
+	wantStatus(t, ta.do(t, http.MethodGet, "/healthz", ""), http.StatusServiceUnavailable)
+	wantStatus(t, ta.do(t, http.MethodGet, "/healthz", ""), http.StatusOK)
+	wantStatus(t, ta.do(t, http.MethodPut, "/maintenance", "", adminAuth...), http.StatusOK)
+
+	rec := ta.do(t, http.MethodGet, "/admin/readiness/history", "", adminAuth...)
+	wantStatus(t, rec, http.StatusOK)
+	body := jsonBody(t, rec)
+	if body["ready"] != false || body["reason"] != "maintenance" {
+		t.Fatalf("body = %v", body)
+	}
+	var reasons []any
+	for _, c := range body["transitions"].([]any) {
+		c := c.(map[string]any)
+		if _, err := time.Parse(time.RFC3339Nano, c["at"].(string)); err != nil {
+			t.Fatalf("at: %v", err)
+		}
+		reasons = append(reasons, c["ready"], c["reason"])
+	}
+	want := []any{true, nil, false, "database unreachable", true, nil, false, "maintenance"}
+	if !slices.Equal(reasons, want) {
+		t.Fatalf("transitions = %v, want %v", reasons, want)
+	}
+
+	wantStatus(t, ta.do(t, http.MethodDelete, "/maintenance", "", adminAuth...), http.StatusOK)
+	if body := jsonBody(t, ta.do(t, http.MethodGet, "/admin/readiness/history", "", adminAuth...)); body["ready"] != true || body["reason"] != nil {
+		t.Fatalf("body = %v", body)
+	}
+}
@@ -0,0 +1,172 @@
+// helpers_test.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// testApp is the App main would build for STORAGE=memory, with the public
+// and admin routes on one mux behind the public middleware chain.
+type testApp struct {
+	*App
+	mux     *http.ServeMux
+	handler http.Handler
+}
+
+// testConfig loads a Config from env. STORAGE defaults to memory, so tests
+// never need a database.
+func testConfig(t *testing.T, env map[string]string) Config {
+	t.Helper()
+	cfg, err := LoadConfig(func(key string) string {
+		if v, ok := env[key]; ok {
+			return v
+		}
+		if key == "STORAGE" {
+			return "memory"
+		}
+		return ""
+	})
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	return cfg
+}
+
+func newTestApp(t *testing.T, env map[string]string) *testApp {
+	t.Helper()
+	cfg := testConfig(t, env)
+	app := &App{
+		Config:      cfg,
+		Events:      newBroadcaster(cfg.SSEMaxSubscribers, cfg.SSEBufferSize, cfg.EventHubBuffer, cfg.EventHubOverflow),
+		Idempotency: newMemoryIdempotencyStore(cfg.IdempotencyTTL),
+		Notifier:    noopNotifier{},
+		Ready:       newReadiness(cfg.StartupGrace, cfg.ReadinessHistorySize),
+		Stats:       &statsCache{ttl: cfg.StatsCacheTTL},
+		Store:       newMemoryStore(cfg.UniqueUsernames),
+	}
+	t.Cleanup(app.Events.stop)
+	if cfg.Maintenance {
+		app.Ready.setNotReady(componentMaintenance, "maintenance")
+	}
+	if cfg.CoalesceReads {
+		app.Reads = &singleflight.Group{}
+	}
+	if cfg.CaptureSampleRate > 0 {
+		app.Captures = newCaptureRing(cfg.CaptureBufferSize)
+	}
+	app.Users = &UserService{
+		store:    app.Store,
+		events:   app.Events,
+		notifier: app.Notifier,
+		reads:    app.Reads,
+		cfg:      cfg,
+	}
+	if cfg.SeedEmail != "" {
+		if err := app.Users.Seed(context.Background(), createUserReq{Username: cfg.SeedUsername, Email: cfg.SeedEmail}); err != nil {
+			t.Fatalf("seed: %v", err)
+		}
+	}
+	return newTestServer(app)
+}
+
+// newTestServer mounts the routes of an App assembled by the test.
+func newTestServer(app *App) *testApp {
+	mux := http.NewServeMux()
+	app.registerPublicRoutes(mux)
+	app.registerAdminRoutes(mux)
+	return &testApp{App: app, mux: mux, handler: app.publicHandler(mux)}
+}
+
+// do serves one request; header holds name, value pairs.
+func (ta *testApp) do(t *testing.T, method, target, body string, header ...string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	if body != "" {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	rec := httptest.NewRecorder()
+	ta.handler.ServeHTTP(rec, r)
+	return rec
+}
+
+// createUser adds a user through POST /users and returns its id.
+func (ta *testApp) createUser(t *testing.T, username, email string) int32 {
+	t.Helper()
+	rec := ta.do(t, http.MethodPost, "/users", `{"username":`+strconv.Quote(username)+`,"email":`+strconv.Quote(email)+`}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create %s: status %d, body %s", email, rec.Code, rec.Body)
+	}
+	var body struct {
+		UserID int32 `json:"user_id"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("create %s: %v", email, err)
+	}
+	return body.UserID
+}
+
+// jsonBody decodes a JSON object response.
+func jsonBody(t *testing.T, rec *httptest.ResponseRecorder) map[string]any {
+	t.Helper()
+	var m map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &m); err != nil {
+		t.Fatalf("decode %q: %v", rec.Body, err)
+	}
+	return m
+}
+
+// wantStatus fails t unless rec has status.
+func wantStatus(t *testing.T, rec *httptest.ResponseRecorder, status int) {
+	t.Helper()
+	if rec.Code != status {
+		t.Fatalf("status = %d, want %d; body %s", rec.Code, status, rec.Body)
+	}
+}
+
+// testDB opens and migrates the database named by TEST_DATABASE_URL,
+// skipping the test when it isn't set.
+func testDB(t *testing.T) *sql.DB {
+	t.Helper()
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+	db, err := sql.Open("pgx", url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := runMigrations(context.Background(), db); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	return db
+}
+
+// adminAuth is the header pair for ADMIN_TOKEN=secret.
+var adminAuth = []string{"Authorization", "Bearer secret"}
+
+// waitFor polls cond until it holds, failing t after two seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
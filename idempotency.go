@@ -0,0 +1,255 @@
+// idempotency.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const maxIdempotencyKeyLen = 255
+
+var errIdempotencyInProgress = errors.New("idempotency key in progress")
+
+// idempotencyRecord is the stored outcome of the first request for a key.
+type idempotencyRecord struct {
+	BodyHash    string
+	Status      int
+	ContentType string
+	Location    string
+	Body        []byte
+}
+
+// idempotencyStore persists Idempotency-Key outcomes.
+type idempotencyStore interface {
+	// Claim reserves key for a request whose body hashes to bodyHash. It
+	// returns the finished record when the key was used before, or
+	// errIdempotencyInProgress while the first request is still running. A
+	// nil record and nil error mean the caller now owns the key.
+	Claim(ctx context.Context, key, bodyHash string) (*idempotencyRecord, error)
+	// Complete stores the outcome for a claimed key.
+	Complete(ctx context.Context, key string, rec idempotencyRecord) error
+	// Release gives up a claim so that the client may retry.
+	Release(ctx context.Context, key string) error
+}
+
+type memoryIdempotencyEntry struct {
+	rec     *idempotencyRecord // nil while in progress
+	hash    string
+	expires time.Time
+}
+
+type memoryIdempotencyStore struct {
+	mu        sync.Mutex
+	ttl       time.Duration
+	entries   map[string]memoryIdempotencyEntry
+	lastSweep time.Time
+}
+
+func newMemoryIdempotencyStore(ttl time.Duration) *memoryIdempotencyStore {
+	return &memoryIdempotencyStore{ttl: ttl, entries: make(map[string]memoryIdempotencyEntry)}
+}
+
+func (s *memoryIdempotencyStore) Claim(_ context.Context, key, bodyHash string) (*idempotencyRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.lastSweep) > time.Minute {
+		for k, e := range s.entries {
+			if now.After(e.expires) {
+				delete(s.entries, k)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	if e, ok := s.entries[key]; ok && now.Before(e.expires) {
+		if e.rec == nil {
+			if e.hash != bodyHash {
+				return &idempotencyRecord{BodyHash: e.hash}, nil
+			}
+			return nil, errIdempotencyInProgress
+		}
+		return e.rec, nil
+	}
+	s.entries[key] = memoryIdempotencyEntry{hash: bodyHash, expires: now.Add(s.ttl)}
+	return nil, nil
+}
+
+func (s *memoryIdempotencyStore) Complete(_ context.Context, key string, rec idempotencyRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries[key] = memoryIdempotencyEntry{rec: &rec, hash: rec.BodyHash, expires: time.Now().Add(s.ttl)}
+	return nil
+}
+
+func (s *memoryIdempotencyStore) Release(_ context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, key)
+	return nil
+}
+
+// hashRequestBody fingerprints a request for key-reuse detection. The query
+// and JSON bodies are canonicalized first (sorted keys, no insignificant
+// whitespace) so formatting differences don't count as a different request,
+// while a changed query parameter does.
+func hashRequestBody(method, path, rawQuery string, body []byte) string {
+	query := rawQuery
+	if q, err := url.ParseQuery(rawQuery); err == nil {
+		query = q.Encode()
+	}
+	canonical := body
+	var v any
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err == nil {
+		if b, err := json.Marshal(v); err == nil {
+			canonical = b
+		}
+	}
+	h := sha256.New()
+	io.WriteString(h, method+" "+path+"?"+query+"\n")
+	h.Write(canonical)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// recordingWriter tees a response so it can be stored for replay.
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+	buf    bytes.Buffer
+}
+
+func (rw *recordingWriter) WriteHeader(status int) {
+	if rw.status == 0 {
+		rw.status = status
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *recordingWriter) Unwrap() http.ResponseWriter { return rw.ResponseWriter }
+
+func (rw *recordingWriter) Write(b []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	rw.buf.Write(b)
+	return rw.ResponseWriter.Write(b)
+}
+
+// scopedIdempotencyKey is the stored form of a client's key: keys are unique
+// per scope, so one caller can neither replay another's response nor tie up
+// its key. Hashing keeps it within the 255 characters stored.
+func scopedIdempotencyKey(scope, key string) string {
+	sum := sha256.Sum256([]byte(scope + "\x00" + key))
+	return hex.EncodeToString(sum[:])
+}
+
+// idempotencyScope is the caller a key belongs to: its credential when it
+// sends one, else its client IP. A client retrying from a new address
+// without credentials starts afresh rather than risk another's replay.
+func (a *App) idempotencyScope(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		sum := sha256.Sum256([]byte(auth))
+		return "auth:" + hex.EncodeToString(sum[:])
+	}
+	if ip, ok := a.clientIP(r); ok {
+		return "ip:" + ip.String()
+	}
+	return ""
+}
+
+// idempotency replays the stored response for a repeated Idempotency-Key on
+// writes, and rejects reuse of a key with a different body (422). Keys are
+// kept per scope(r). Writes without a key are rejected when requireKey says
+// so for them (REQUIRE_IDEMPOTENCY_KEY); a nil requireKey requires none.
+func idempotency(store idempotencyStore, maxBody int64, scope func(*http.Request) string, requireKey func(*http.Request) bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" && requireKey != nil && requireKey(r) {
+			jsonWrite(w, http.StatusBadRequest, map[string]string{"error": "Writes require an Idempotency-Key header", "code": "IDEMPOTENCY_KEY_REQUIRED"})
+			return
+		}
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLen {
+			jsonWrite(w, http.StatusBadRequest, map[string]string{"error": "Idempotency-Key too long", "code": "IDEMPOTENCY_KEY_INVALID"})
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxBody+1))
+		if err != nil {
+			writeDecodeError(w, err, "unreadable request body")
+			return
+		}
+		if int64(len(body)) > maxBody {
+			writeDecodeError(w, errBodyTooLarge, "")
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		hash := hashRequestBody(r.Method, r.URL.Path, r.URL.RawQuery, body)
+		stored := scopedIdempotencyKey(scope(r), key)
+
+		rec, err := store.Claim(r.Context(), stored, hash)
+		switch {
+		case errors.Is(err, errIdempotencyInProgress):
+			jsonWrite(w, http.StatusConflict, map[string]string{"error": "A request with this Idempotency-Key is still in progress", "code": "IDEMPOTENCY_KEY_IN_PROGRESS"})
+			return
+		case err != nil:
+			writeDBError(w, err)
+			return
+		case rec != nil && rec.BodyHash != hash:
+			jsonWrite(w, http.StatusUnprocessableEntity, map[string]string{"error": "Idempotency-Key was already used with a different request body", "code": "IDEMPOTENCY_KEY_REUSE"})
+			return
+		case rec != nil:
+			if rec.ContentType != "" {
+				w.Header().Set("Content-Type", rec.ContentType)
+			}
+			if rec.Location != "" {
+				w.Header().Set("Location", rec.Location)
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(rec.Status)
+			w.Write(rec.Body)
+			return
+		}
+
+		rw := &recordingWriter{ResponseWriter: w}
+		next.ServeHTTP(rw, r)
+
+		// Server errors are not final: let the client retry with the same key.
+		ctx := context.WithoutCancel(r.Context())
+		if rw.status == 0 || rw.status >= 500 {
+			if err := store.Release(ctx, stored); err != nil {
+				logger(ctx).Error("idempotency: release key", "key", key, "err", err)
+			}
+			return
+		}
+		err = store.Complete(ctx, stored, idempotencyRecord{
+			BodyHash:    hash,
+			Status:      rw.status,
+			ContentType: w.Header().Get("Content-Type"),
+			Location:    w.Header().Get("Location"),
+			Body:        rw.buf.Bytes(),
+		})
+		if err != nil {
+			logger(ctx).Error("idempotency: store response", "key", key, "err", err)
+		}
+	})
+}
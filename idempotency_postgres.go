@@ -0,0 +1,92 @@
+// idempotency_postgres.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// pgIdempotencyStore keeps keys in the idempotency_keys table so replays
+// survive restarts and work across replicas. The primary key makes the
+// claim atomic: whichever replica inserts first owns the request.
+type pgIdempotencyStore struct {
+	db  *sql.DB
+	ttl time.Duration
+}
+
+func (s *pgIdempotencyStore) Claim(ctx context.Context, key, bodyHash string) (*idempotencyRecord, error) {
+	res, err := s.db.ExecContext(ctx,
+		"INSERT INTO idempotency_keys (idempotency_key, body_hash) VALUES ($1, $2) ON CONFLICT DO NOTHING",
+		key, bodyHash,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return nil, err
+	} else if n == 1 {
+		return nil, nil
+	}
+
+	// Take over an expired record in place; the WHERE clause keeps this
+	// atomic if two replicas race for it.
+	res, err = s.db.ExecContext(ctx,
+		`UPDATE idempotency_keys
+		    SET body_hash = $2, status = NULL, content_type = NULL, location = NULL, body = NULL, created_at = now()
+		  WHERE idempotency_key = $1 AND created_at < now() - make_interval(secs => $3)`,
+		key, bodyHash, s.ttl.Seconds(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return nil, err
+	} else if n == 1 {
+		return nil, nil
+	}
+
+	var (
+		rec         idempotencyRecord
+		status      sql.NullInt32
+		contentType sql.NullString
+		location    sql.NullString
+	)
+	err = s.db.QueryRowContext(ctx,
+		"SELECT body_hash, status, content_type, location, body FROM idempotency_keys WHERE idempotency_key = $1",
+		key,
+	).Scan(&rec.BodyHash, &status, &contentType, &location, &rec.Body)
+	if err == sql.ErrNoRows {
+		// Released between our INSERT and SELECT; let the client retry.
+		return nil, errIdempotencyInProgress
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !status.Valid {
+		if rec.BodyHash != bodyHash {
+			return &idempotencyRecord{BodyHash: rec.BodyHash}, nil
+		}
+		return nil, errIdempotencyInProgress
+	}
+	rec.Status = int(status.Int32)
+	rec.ContentType = contentType.String
+	rec.Location = location.String
+	return &rec, nil
+}
+
+func (s *pgIdempotencyStore) Complete(ctx context.Context, key string, rec idempotencyRecord) error {
+	_, err := s.db.ExecContext(ctx,
+		"UPDATE idempotency_keys SET status = $2, content_type = $3, location = $4, body = $5 WHERE idempotency_key = $1",
+		key, rec.Status, rec.ContentType, rec.Location, rec.Body,
+	)
+	return err
+}
+
+func (s *pgIdempotencyStore) Release(ctx context.Context, key string) error {
+	_, err := s.db.ExecContext(ctx,
+		"DELETE FROM idempotency_keys WHERE idempotency_key = $1 AND status IS NULL",
+		key,
+	)
+	return err
+}
@@ -0,0 +1,39 @@
+// idempotency_postgres_test.go
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// TestIdempotencyKeysSharedAcrossApps runs two Apps against one database,
+// as two replicas would.
+func TestIdempotencyKeysSharedAcrossApps(t *testing.T) {
+	db := testDB(t)
+	replica := func() *testApp {
+		ta := newTestApp(t, nil)
+		ta.Store = &pgStore{db: db}
+		ta.Users.store = ta.Store
+		ta.Idempotency = &pgIdempotencyStore{db: db, ttl: time.Hour}
+		return newTestServer(ta.App)
+	}
+	a, b := replica(), replica()
+
+	run := time.Now().UnixNano()
+	key := fmt.Sprintf("test-%d", run)
+	body := fmt.Sprintf(`{"username":"idem%d","email":"idem%d@example.com"}`, run, run)
+
+	first := a.do(t, http.MethodPost, "/users", body, "Idempotency-Key", key)
+	wantStatus(t, first, http.StatusCreated)
+
+	replay := b.do(t, http.MethodPost, "/users", body, "Idempotency-Key", key)
+	wantStatus(t, replay, http.StatusCreated)
+	if replay.Header().Get("Idempotent-Replayed") != "true" || replay.Body.String() != first.Body.String() {
+		t.Fatalf("replica b did not replay: %s", replay.Body)
+	}
+
+	other := fmt.Sprintf(`{"username":"idem%d","email":"other%d@example.com"}`, run, run)
+	wantStatus(t, b.do(t, http.MethodPost, "/users", other, "Idempotency-Key", key), http.StatusUnprocessableEntity)
+}
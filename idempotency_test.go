@@ -0,0 +1,172 @@
+// idempotency_test.go
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestIdempotencyKeyReplay(t *testing.T) {
+	ta := newTestApp(t, nil)
+	first := ta.do(t, http.MethodPost, "/users", `{"username":"ann","email":"ann@example.com"}`, "Idempotency-Key", "k1")
+	wantStatus(t, first, http.StatusCreated)
+
+	// Same document, different key order and whitespace.
+	again := ta.do(t, http.MethodPost, "/users", `{ "email": "ann@example.com", "username": "ann" }`, "Idempotency-Key", "k1")
+	wantStatus(t, again, http.StatusCreated)
+	if again.Header().Get("Idempotent-Replayed") != "true" {
+		t.Fatal("response not marked as replayed")
+	}
+	if again.Body.String() != first.Body.String() || again.Header().Get("Location") != first.Header().Get("Location") {
+		t.Fatalf("replay differs: %s vs %s", again.Body, first.Body)
+	}
+}
+
+func TestIdempotencyKeyReuse(t *testing.T) {
+	ta := newTestApp(t, nil)
+	wantStatus(t, ta.do(t, http.MethodPost, "/users", `{"username":"ann","email":"ann@example.com"}`, "Idempotency-Key", "k1"), http.StatusCreated)
+	rec := ta.do(t, http.MethodPost, "/users", `{"username":"bob","email":"bob@example.com"}`, "Idempotency-Key", "k1")
+	wantStatus(t, rec, http.StatusUnprocessableEntity)
+	if got := jsonBody(t, rec)["code"]; got != "IDEMPOTENCY_KEY_REUSE" {
+		t.Fatalf("code = %v", got)
+	}
+}
+
+func TestHashRequestBodyCanonical(t *testing.T) {
+	a := hashRequestBody(http.MethodPost, "/users", "", []byte(`{"a":1,"b":[1,2]}`))
+	if b := hashRequestBody(http.MethodPost, "/users", "", []byte("{\n \"b\": [1, 2],\n \"a\": 1\n}")); a != b {
+		t.Fatal("key order or whitespace changed the hash")
+	}
+	if b := hashRequestBody(http.MethodPost, "/users", "", []byte(`{"a":1.0,"b":[1,2]}`)); a == b {
+		t.Fatal("1 and 1.0 hash alike")
+	}
+	if b := hashRequestBody(http.MethodPut, "/users", "", []byte(`{"a":1,"b":[1,2]}`)); a == b {
+		t.Fatal("method not part of the hash")
+	}
+	q := hashRequestBody(http.MethodPost, "/users", "x=1&return_ids=true", nil)
+	if b := hashRequestBody(http.MethodPost, "/users", "return_ids=true&x=1", nil); q != b {
+		t.Fatal("query parameter order changed the hash")
+	}
+	if b := hashRequestBody(http.MethodPost, "/users", "x=1", nil); q == b {
+		t.Fatal("query not part of the hash")
+	}
+}
+
+func TestIdempotencyKeyCoversQuery(t *testing.T) {
+	ta := newTestApp(t, map[string]string{"ADMIN_TOKEN": "secret"})
+	csv := importCSV("ann", 2)
+	header := append([]string{"Idempotency-Key", "k1"}, adminAuth...)
+	wantStatus(t, ta.do(t, http.MethodPost, "/users/import", csv, header...), http.StatusCreated)
+	rec := ta.do(t, http.MethodPost, "/users/import?return_ids=true", csv, header...)
+	wantStatus(t, rec, http.StatusUnprocessableEntity)
+	if got := jsonBody(t, rec)["code"]; got != "IDEMPOTENCY_KEY_REUSE" {
+		t.Fatalf("code = %v", got)
+	}
+}
+
+func TestIdempotencyKeysScopedByCaller(t *testing.T) {
+	ta := newTestApp(t, nil)
+	post := func(body, remoteAddr string, header ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/users", strings.NewReader(body))
+		r.RemoteAddr = remoteAddr
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set("Idempotency-Key", "k1")
+		for i := 0; i < len(header); i += 2 {
+			r.Header.Set(header[i], header[i+1])
+		}
+		rec := httptest.NewRecorder()
+		ta.handler.ServeHTTP(rec, r)
+		return rec
+	}
+	ann, bob := `{"username":"ann","email":"ann@example.com"}`, `{"username":"bob","email":"bob@example.com"}`
+	wantStatus(t, post(ann, "192.0.2.1:1000"), http.StatusCreated)
+
+	// Another address, or a credential, is another caller: its k1 is its own.
+	for _, tt := range []struct {
+		name, remoteAddr string
+		header           []string
+	}{
+		{"other ip", "192.0.2.2:1000", nil},
+		{"credential", "192.0.2.1:1000", []string{"Authorization", "Bearer someone"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			body := strings.Replace(bob, "bob", "bob-"+strings.ReplaceAll(tt.name, " ", ""), 2)
+			rec := post(body, tt.remoteAddr, tt.header...)
+			wantStatus(t, rec, http.StatusCreated)
+			if rec.Header().Get("Idempotent-Replayed") != "" {
+				t.Fatal("replayed another caller's response")
+			}
+		})
+	}
+	if rec := post(ann, "192.0.2.1:2000"); rec.Header().Get("Idempotent-Replayed") != "true" {
+		t.Fatalf("same caller from a new port: status %d, not replayed", rec.Code)
+	}
+}
+
+func TestRequireIdempotencyKey(t *testing.T) {
+	ta := newTestApp(t, map[string]string{"REQUIRE_IDEMPOTENCY_KEY": "true", "ENABLE_GRAPHQL": "true", "ADMIN_TOKEN": "secret"})
+	wantStatus(t, ta.do(t, http.MethodPost, "/users", `{"username":"ann","email":"ann@example.com"}`, "Idempotency-Key", "k1"), http.StatusCreated)
+	for _, tt := range []struct{ method, target, body string }{
+		{http.MethodPost, "/users", `{"username":"bob","email":"bob@example.com"}`},
+		{http.MethodPut, "/users/1", `{"username":"ann2","email":"ann@example.com"}`},
+		{http.MethodPatch, "/users", `[{"user_id":1,"username":"ann2"}]`},
+		{http.MethodDelete, "/users/1", ""},
+		{http.MethodPost, "/graphql", `{"query":"mutation { deleteUser(id: \"1\") }"}`},
+		{http.MethodPost, "/graphql", `{"query":"query A { user(id: \"1\") { id } } mutation B { deleteUser(id: \"1\") }","operationName":"B"}`},
+	} {
+		t.Run(tt.method+" "+tt.target, func(t *testing.T) {
+			rec := ta.do(t, tt.method, tt.target, tt.body)
+			wantStatus(t, rec, http.StatusBadRequest)
+			if got := jsonBody(t, rec)["code"]; got != "IDEMPOTENCY_KEY_REQUIRED" {
+				t.Fatalf("code = %v", got)
+			}
+		})
+	}
+	if _, err := ta.Users.Get(context.Background(), 1); err != nil {
+		t.Fatalf("rejected write was applied: %v", err)
+	}
+
+	// Reads sent as POST, ops paths and admin routes need no key.
+	for _, tt := range []struct {
+		method, target, body string
+		want                 int
+	}{
+		{http.MethodGet, "/users/1", "", http.StatusOK},
+		{http.MethodPost, "/users/by-emails", `["ann@example.com"]`, http.StatusOK},
+		{http.MethodPost, "/graphql", `{"query":"{ user(id: \"1\") { username } }"}`, http.StatusOK},
+		{http.MethodPost, "/graphql", `{"query":"query A { user(id: \"1\") { id } } mutation B { deleteUser(id: \"1\") }","operationName":"A"}`, http.StatusOK},
+		{http.MethodPost, "/graphql", `{"query":"{ user("}`, http.StatusOK},
+		{http.MethodPut, "/maintenance", "", http.StatusOK},
+		{http.MethodDelete, "/maintenance", "", http.StatusOK},
+	} {
+		t.Run("exempt "+tt.method+" "+tt.target, func(t *testing.T) {
+			rec := ta.do(t, tt.method, tt.target, tt.body, adminAuth...)
+			wantStatus(t, rec, tt.want)
+			if strings.Contains(rec.Body.String(), "IDEMPOTENCY_KEY_REQUIRED") {
+				t.Fatalf("body = %s", rec.Body)
+			}
+		})
+	}
+	// The GraphQL handler still got the whole body it was peeked at for.
+	body := jsonBody(t, ta.do(t, http.MethodPost, "/graphql", `{"query":"{ user(id: \"1\") { username } }"}`))
+	if user := body["data"].(map[string]any)["user"].(map[string]any); user["username"] != "ann" {
+		t.Fatalf("body = %v", body)
+	}
+
+	// With a key, writes go through and replay as usual.
+	req := `{"username":"bob","email":"bob@example.com"}`
+	first := ta.do(t, http.MethodPost, "/users", req, "Idempotency-Key", "k2")
+	wantStatus(t, first, http.StatusCreated)
+	again := ta.do(t, http.MethodPost, "/users", req, "Idempotency-Key", "k2")
+	wantStatus(t, again, http.StatusCreated)
+	if again.Header().Get("Idempotent-Replayed") != "true" || again.Body.String() != first.Body.String() {
+		t.Fatalf("replay = %s %v", again.Body, again.Header())
+	}
+	wantStatus(t, ta.do(t, http.MethodPost, "/graphql", `{"query":"mutation { deleteUser(id: \"2\") }"}`, "Idempotency-Key", "k3"), http.StatusOK)
+
+	// Off by default.
+	wantStatus(t, newTestApp(t, nil).do(t, http.MethodPost, "/users", req), http.StatusCreated)
+}
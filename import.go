@@ -0,0 +1,151 @@
+// import.go
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// importUsers handles POST /users/import: a CSV body whose header row names
+// a username and an email column, loaded in one all-or-nothing write. With
+// return_ids=true the response lists the new ids in row order.
+func (a *App) importUsers(w http.ResponseWriter, r *http.Request) {
+	rows, err := readImportCSV(r.Body, a.Config.MaxImportRows)
+	if isBodyTooLarge(err) {
+		writeDecodeError(w, err, "")
+		return
+	}
+	if err != nil {
+		jsonWrite(w, http.StatusBadRequest, map[string]string{"error": err.Error(), "code": "INVALID_CSV"})
+		return
+	}
+	if len(rows) == 0 {
+		jsonWrite(w, http.StatusBadRequest, map[string]string{"error": "at least one row is required"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), a.Config.ImportTimeout)
+	defer cancel()
+
+	res, err := a.Users.Import(ctx, rows, r.URL.Query().Get("return_ids") == "true")
+	if bde := (*batchDuplicatesError)(nil); errors.As(err, &bde) {
+		jsonWrite(w, http.StatusBadRequest, map[string]any{
+			"error":      "Rows repeat an earlier row's email or username",
+			"code":       "DUPLICATE_IN_BATCH",
+			"duplicates": bde.dups,
+		})
+		return
+	}
+	if bve := (*batchValidationError)(nil); errors.As(err, &bve) {
+		jsonWrite(w, http.StatusBadRequest, map[string]any{
+			"error":  "Validation failed",
+			"index":  bve.index,
+			"fields": bve.fields,
+		})
+		return
+	}
+	if err != nil {
+		writeUserError(w, err)
+		return
+	}
+	jsonWrite(w, http.StatusCreated, res)
+}
+
+// readImportCSV parses the import body. Columns other than username and
+// email are ignored; more than maxRows data rows is an error.
+func readImportCSV(body io.Reader, maxRows int) ([]createUserReq, error) {
+	cr := csv.NewReader(body)
+	cr.ReuseRecord = true
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	userCol, emailCol := slices.Index(header, "username"), slices.Index(header, "email")
+	if userCol < 0 || emailCol < 0 {
+		return nil, errors.New("header row must name username and email columns")
+	}
+
+	var rows []createUserReq
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(rows) == maxRows {
+			return nil, fmt.Errorf("at most %d rows per import", maxRows)
+		}
+		rows = append(rows, createUserReq{Username: rec[userCol], Email: rec[emailCol]})
+	}
+}
+
+// batchDuplicate is a row that would violate a unique index already taken
+// by an earlier row of the same batch.
+type batchDuplicate struct {
+	Index       int    `json:"index"`
+	DuplicateOf int    `json:"duplicate_of"`
+	Field       string `json:"field"`
+}
+
+type batchDuplicatesError struct {
+	dups []batchDuplicate
+}
+
+func (e *batchDuplicatesError) Error() string {
+	return fmt.Sprintf("%d duplicate rows in batch", len(e.dups))
+}
+
+// batchDuplicates finds rows repeating an earlier row's email, or username
+// when byUsername, compared in lower case as the unique indexes do. Caught
+// up front, they don't roll the whole load back on a unique violation.
+func batchDuplicates(rows []createUserReq, byUsername bool) []batchDuplicate {
+	var dups []batchDuplicate
+	emails := make(map[string]int, len(rows))
+	usernames := make(map[string]int)
+	for i, row := range rows {
+		email := strings.ToLower(row.Email)
+		if first, ok := emails[email]; ok {
+			dups = append(dups, batchDuplicate{Index: i, DuplicateOf: first, Field: "email"})
+			continue
+		}
+		if byUsername {
+			username := strings.ToLower(row.Username)
+			if first, ok := usernames[username]; ok {
+				dups = append(dups, batchDuplicate{Index: i, DuplicateOf: first, Field: "username"})
+				continue
+			}
+			usernames[username] = i
+		}
+		emails[email] = i
+	}
+	return dups
+}
+
+// dropDuplicates returns rows without dups, and the indexes it dropped.
+func dropDuplicates(rows []createUserReq, dups []batchDuplicate) ([]createUserReq, []int) {
+	if len(dups) == 0 {
+		return rows, nil
+	}
+	skipped := make([]int, len(dups))
+	for i, d := range dups {
+		skipped[i] = d.Index
+	}
+	kept := make([]createUserReq, 0, len(rows)-len(dups))
+	for i, row := range rows {
+		if _, drop := slices.BinarySearch(skipped, i); !drop {
+			kept = append(kept, row)
+		}
+	}
+	return kept, skipped
+}
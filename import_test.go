@@ -0,0 +1,208 @@
+// import_test.go
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// importCSV is a CSV import body of n users named prefix1 onwards.
+func importCSV(prefix string, n int) string {
+	var b strings.Builder
+	b.WriteString("username,email\n")
+	for i := 1; i <= n; i++ {
+		fmt.Fprintf(&b, "%s%d,%s%d@example.com\n", prefix, i, prefix, i)
+	}
+	return b.String()
+}
+
+func TestImportUsersMethod(t *testing.T) {
+	ta := newTestApp(t, map[string]string{"ADMIN_TOKEN": "secret", "IMPORT_COPY_THRESHOLD": "10"})
+	wantStatus(t, ta.do(t, http.MethodPost, "/users/import", importCSV("user", 3)), http.StatusUnauthorized)
+
+	rec := ta.do(t, http.MethodPost, "/users/import", importCSV("user", 3), adminAuth...)
+	wantStatus(t, rec, http.StatusCreated)
+	if body := jsonBody(t, rec); body["imported"] != float64(3) || body["method"] != "insert" || body["user_ids"] != nil {
+		t.Fatalf("small import = %v", body)
+	}
+
+	rec = ta.do(t, http.MethodPost, "/users/import", importCSV("big", 10), adminAuth...)
+	wantStatus(t, rec, http.StatusCreated)
+	if body := jsonBody(t, rec); body["imported"] != float64(10) || body["method"] != "copy" {
+		t.Fatalf("import at the threshold = %v", body)
+	}
+
+	// Asking for ids takes the INSERT path whatever the size.
+	rec = ta.do(t, http.MethodPost, "/users/import?return_ids=true", importCSV("ids", 10), adminAuth...)
+	wantStatus(t, rec, http.StatusCreated)
+	body := jsonBody(t, rec)
+	ids, _ := body["user_ids"].([]any)
+	if body["method"] != "insert" || len(ids) != 10 || ids[0] != float64(14) || ids[9] != float64(23) {
+		t.Fatalf("import with ids = %v", body)
+	}
+
+	users, err := ta.Users.List(context.Background(), pageParams{Limit: 100, Sort: "user_id"})
+	if err != nil || len(users) != 23 {
+		t.Fatalf("%d users after imports, want 23 (%v)", len(users), err)
+	}
+}
+
+func TestImportUsersRejects(t *testing.T) {
+	ta := newTestApp(t, map[string]string{"ADMIN_TOKEN": "secret", "MAX_IMPORT_ROWS": "5"})
+	for name, tt := range map[string]struct {
+		body, code string
+	}{
+		"no header columns": {"name,mail\nann,ann@example.com\n", "INVALID_CSV"},
+		"ragged row":        {"username,email\nann\n", "INVALID_CSV"},
+		"too many rows":     {importCSV("user", 6), "INVALID_CSV"},
+		"header only":       {"username,email\n", ""},
+	} {
+		t.Run(name, func(t *testing.T) {
+			rec := ta.do(t, http.MethodPost, "/users/import", tt.body, adminAuth...)
+			wantStatus(t, rec, http.StatusBadRequest)
+			if got, _ := jsonBody(t, rec)["code"].(string); got != tt.code {
+				t.Fatalf("code = %q, want %q", got, tt.code)
+			}
+		})
+	}
+
+	rec := ta.do(t, http.MethodPost, "/users/import", "username,email\nann,ann@example.com\nbob,not-an-email\n", adminAuth...)
+	wantStatus(t, rec, http.StatusBadRequest)
+	if body := jsonBody(t, rec); body["index"] != float64(1) {
+		t.Fatalf("validation failure = %v", body)
+	}
+	// All or nothing: the valid first row was not written either.
+	users, _ := ta.Users.List(context.Background(), pageParams{Limit: 10, Sort: "user_id"})
+	if len(users) != 0 {
+		t.Fatalf("%d users written by a rejected import", len(users))
+	}
+
+	ta.createUser(t, "ann", "ann@example.com")
+	wantStatus(t, ta.do(t, http.MethodPost, "/users/import", "username,email\nann2,ann@example.com\n", adminAuth...), http.StatusConflict)
+}
+
+func TestReadImportCSVIgnoresExtraColumns(t *testing.T) {
+	rows, err := readImportCSV(strings.NewReader("email,notes,username\nann@example.com,vip,ann\n"), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 || rows[0] != (createUserReq{Username: "ann", Email: "ann@example.com"}) {
+		t.Fatalf("rows = %+v", rows)
+	}
+}
+
+// TestImportUsersPostgres imports into a session-local copy of the users
+// table, which the store's unqualified table name resolves to.
+func TestImportUsersPostgres(t *testing.T) {
+	db := testDB(t)
+	db.SetMaxOpenConns(1)
+	ctx := context.Background()
+	if _, err := db.ExecContext(ctx, "CREATE TEMP TABLE users (LIKE public.users INCLUDING ALL)"); err != nil {
+		t.Fatal(err)
+	}
+	ta := newTestApp(t, map[string]string{"ADMIN_TOKEN": "secret"})
+	ta.Users.store = &pgStore{db: db}
+
+	rec := ta.do(t, http.MethodPost, "/users/import", importCSV("user", 2500), adminAuth...)
+	wantStatus(t, rec, http.StatusCreated)
+	if body := jsonBody(t, rec); body["imported"] != float64(2500) || body["method"] != "copy" {
+		t.Fatalf("COPY import = %v", body)
+	}
+	rec = ta.do(t, http.MethodPost, "/users/import?return_ids=true", importCSV("ids", 1500), adminAuth...)
+	wantStatus(t, rec, http.StatusCreated)
+	if ids, _ := jsonBody(t, rec)["user_ids"].([]any); len(ids) != 1500 {
+		t.Fatalf("INSERT import returned %d ids", len(ids))
+	}
+
+	var n int
+	if err := db.QueryRowContext(ctx, "SELECT count(*) FROM users").Scan(&n); err != nil || n != 4000 {
+		t.Fatalf("users = %d, %v; want 4000", n, err)
+	}
+	// A duplicate aborts the whole COPY.
+	rec = ta.do(t, http.MethodPost, "/users/import", importCSV("user", 1000), adminAuth...)
+	wantStatus(t, rec, http.StatusConflict)
+	if err := db.QueryRowContext(ctx, "SELECT count(*) FROM users").Scan(&n); err != nil || n != 4000 {
+		t.Fatalf("users after failed COPY = %d, %v", n, err)
+	}
+}
+
+func TestImportDuplicates(t *testing.T) {
+	// Row 1 repeats row 0's email, row 2 repeats its username.
+	const csv = "username,email\nann,ann@example.com\nannie,ANN@example.com\nAnn,ann2@example.com\nbob,bob@example.com\n"
+	env := func(policy string) map[string]string {
+		return map[string]string{"ADMIN_TOKEN": "secret", "UNIQUE_USERNAMES": "true", "IMPORT_DUPLICATES": policy}
+	}
+
+	ta := newTestApp(t, env("reject"))
+	rec := ta.do(t, http.MethodPost, "/users/import", csv, adminAuth...)
+	wantStatus(t, rec, http.StatusBadRequest)
+	body := jsonBody(t, rec)
+	if body["code"] != "DUPLICATE_IN_BATCH" {
+		t.Fatalf("body = %v", body)
+	}
+	var got []string
+	for _, d := range body["duplicates"].([]any) {
+		d := d.(map[string]any)
+		got = append(got, fmt.Sprintf("%v->%v:%v", d["index"], d["duplicate_of"], d["field"]))
+	}
+	if want := []string{"1->0:email", "2->0:username"}; !slices.Equal(got, want) {
+		t.Fatalf("duplicates = %v, want %v", got, want)
+	}
+	if users, _ := ta.Users.List(context.Background(), pageParams{Limit: 10, Sort: "user_id"}); len(users) != 0 {
+		t.Fatalf("rejected import wrote %d users", len(users))
+	}
+
+	ta = newTestApp(t, env("dedupe"))
+	rec = ta.do(t, http.MethodPost, "/users/import", csv, adminAuth...)
+	wantStatus(t, rec, http.StatusCreated)
+	body = jsonBody(t, rec)
+	if skipped, _ := body["skipped_rows"].([]any); body["imported"] != float64(2) || !slices.Equal(skipped, []any{float64(1), float64(2)}) {
+		t.Fatalf("body = %v", body)
+	}
+	users, err := ta.Users.List(context.Background(), pageParams{Limit: 10, Sort: "user_id"})
+	if err != nil || len(users) != 2 || users[0].Username != "ann" || users[1].Username != "bob" {
+		t.Fatalf("users = %v, %v", users, err)
+	}
+	// A clean import reports no skipped rows.
+	if body := jsonBody(t, ta.do(t, http.MethodPost, "/users/import", importCSV("clean", 2), adminAuth...)); body["skipped_rows"] != nil {
+		t.Fatalf("clean import = %v", body)
+	}
+
+	// Off, the store's unique index rejects the whole import.
+	ta = newTestApp(t, env("off"))
+	wantStatus(t, ta.do(t, http.MethodPost, "/users/import", csv, adminAuth...), http.StatusConflict)
+
+	if err := loadConfigErr(t, map[string]string{"IMPORT_DUPLICATES": "merge"}); err == nil {
+		t.Fatal("unknown IMPORT_DUPLICATES accepted")
+	}
+}
+
+func TestBatchDuplicates(t *testing.T) {
+	rows := []createUserReq{
+		{"ann", "ann@example.com"},
+		{"ANN", "other@example.com"},
+		{"bob", "Ann@Example.com"},
+		{"cy", "cy@example.com"},
+		{"cy", "cy@example.com"},
+	}
+	// Without UNIQUE_USERNAMES only emails count.
+	if got := batchDuplicates(rows, false); !slices.Equal(got, []batchDuplicate{{2, 0, "email"}, {4, 3, "email"}}) {
+		t.Fatalf("by email = %v", got)
+	}
+	dups := batchDuplicates(rows, true)
+	if !slices.Equal(dups, []batchDuplicate{{1, 0, "username"}, {2, 0, "email"}, {4, 3, "email"}}) {
+		t.Fatalf("by email and username = %v", dups)
+	}
+
+	kept, skipped := dropDuplicates(rows, dups)
+	if !slices.Equal(skipped, []int{1, 2, 4}) || !slices.Equal(kept, []createUserReq{rows[0], rows[3]}) {
+		t.Fatalf("kept %v, skipped %v", kept, skipped)
+	}
+	if kept, skipped := dropDuplicates(rows, nil); len(kept) != len(rows) || skipped != nil {
+		t.Fatalf("no duplicates: kept %v, skipped %v", kept, skipped)
+	}
+}
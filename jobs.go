@@ -0,0 +1,57 @@
+// jobs.go
+package main
+
+import (
+	"context"
+	"net/http"
+)
+
+// listJobs reports the background delivery queue (webhook notifications).
+func (a *App) listJobs(w http.ResponseWriter, r *http.Request) {
+	if a.Jobs == nil {
+		jsonWrite(w, http.StatusOK, map[string]any{"enabled": false})
+		return
+	}
+	jsonWrite(w, http.StatusOK, a.jobsStatus())
+}
+
+func (a *App) jobsStatus() map[string]any {
+	pending, draining := a.Jobs.queue()
+	return map[string]any{
+		"enabled":         true,
+		"pending":         pending,
+		"in_flight":       a.Jobs.posting.Load(),
+		"draining":        draining,
+		"recent_failures": a.Jobs.recentFailures(),
+	}
+}
+
+// drainJobs (POST) stops accepting new deliveries and waits, up to
+// SHUTDOWN_STEP_TIMEOUT, for the queued ones to finish, e.g. ahead of
+// maintenance. DELETE accepts deliveries again.
+func (a *App) drainJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		writeMethodNotAllowed(w, http.MethodPost, http.MethodDelete)
+		return
+	}
+	if a.Jobs == nil {
+		jsonWrite(w, http.StatusConflict, map[string]string{"error": "No background jobs configured"})
+		return
+	}
+	if r.Method == http.MethodDelete {
+		a.Jobs.setDraining(false)
+		jsonWrite(w, http.StatusOK, a.jobsStatus())
+		return
+	}
+
+	a.Jobs.setDraining(true)
+	ctx, cancel := context.WithTimeout(r.Context(), a.Config.ShutdownStepTimeout)
+	defer cancel()
+	if err := a.Jobs.wait(ctx); err != nil {
+		body := a.jobsStatus()
+		body["error"], body["code"] = "Queue did not drain in time", "DRAIN_TIMEOUT"
+		jsonWrite(w, http.StatusGatewayTimeout, body)
+		return
+	}
+	jsonWrite(w, http.StatusOK, a.jobsStatus())
+}
@@ -0,0 +1,66 @@
+// jobs_test.go
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestJobsDisabledWithoutWebhook(t *testing.T) {
+	ta := newTestApp(t, map[string]string{"ADMIN_TOKEN": "secret"})
+	rec := ta.do(t, http.MethodGet, "/admin/jobs", "", adminAuth...)
+	wantStatus(t, rec, http.StatusOK)
+	if jsonBody(t, rec)["enabled"] != false {
+		t.Fatalf("jobs = %s", rec.Body)
+	}
+	wantStatus(t, ta.do(t, http.MethodPost, "/admin/jobs/drain", "", adminAuth...), http.StatusConflict)
+	wantStatus(t, ta.do(t, http.MethodGet, "/admin/jobs", ""), http.StatusUnauthorized)
+}
+
+func TestDrainEmptiesQueue(t *testing.T) {
+	release := make(chan struct{})
+	var received atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		received.Add(1)
+	}))
+	defer srv.Close()
+
+	ta, n := webhookApp(t, srv.URL, 0)
+	for _, name := range []string{"ann", "bob", "cy"} {
+		ta.createUser(t, name, name+"@example.com")
+	}
+	waitFor(t, "deliveries in flight", func() bool { return n.posting.Load() == 3 })
+	rec := ta.do(t, http.MethodGet, "/admin/jobs", "", adminAuth...)
+	if body := jsonBody(t, rec); body["pending"] != 3.0 || body["in_flight"] != 3.0 || body["draining"] != false {
+		t.Fatalf("jobs = %v", body)
+	}
+
+	close(release)
+	rec = ta.do(t, http.MethodPost, "/admin/jobs/drain", "", adminAuth...)
+	wantStatus(t, rec, http.StatusOK)
+	if body := jsonBody(t, rec); body["pending"] != 0.0 || body["in_flight"] != 0.0 || received.Load() != 3 {
+		t.Fatalf("after drain = %v, received %d", body, received.Load())
+	}
+}
+
+func TestDrainTimesOut(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) { <-release }))
+	defer srv.Close()
+	defer close(release)
+
+	ta, n := webhookApp(t, srv.URL, 0)
+	ta.Config.ShutdownStepTimeout = 20 * time.Millisecond
+	ta.createUser(t, "ann", "ann@example.com")
+	waitFor(t, "delivery in flight", func() bool { return n.posting.Load() == 1 })
+
+	rec := ta.do(t, http.MethodPost, "/admin/jobs/drain", "", adminAuth...)
+	wantStatus(t, rec, http.StatusGatewayTimeout)
+	if body := jsonBody(t, rec); body["code"] != "DRAIN_TIMEOUT" || body["pending"] != 1.0 || body["draining"] != true {
+		t.Fatalf("drain = %v", body)
+	}
+}
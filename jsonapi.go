@@ -0,0 +1,163 @@
+// jsonapi.go
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const jsonAPIMediaType = "application/vnd.api+json"
+
+// jsonAPIWriter marks a response as negotiated to JSON:API; jsonWrite finds
+// it by unwrapping and reshapes the body on the way out.
+type jsonAPIWriter struct {
+	http.ResponseWriter
+}
+
+func (j *jsonAPIWriter) Flush() {
+	if f, ok := j.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (j *jsonAPIWriter) Unwrap() http.ResponseWriter { return j.ResponseWriter }
+
+// negotiateJSONAPI switches a request to JSON:API documents when its Accept
+// header asks for application/vnd.api+json (JSON_API=true).
+func negotiateJSONAPI(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if acceptsJSONAPI(r.Header.Values("Accept")) {
+			w.Header().Add("Vary", "Accept")
+			w = &jsonAPIWriter{ResponseWriter: w}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func acceptsJSONAPI(accept []string) bool {
+	for _, h := range accept {
+		for _, part := range strings.Split(h, ",") {
+			mt, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+			// The spec reserves media type parameters other than ext/profile.
+			if err == nil && mt == jsonAPIMediaType && len(params) == 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isJSONAPI(w http.ResponseWriter) bool {
+	for {
+		switch v := w.(type) {
+		case *jsonAPIWriter:
+			return true
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = v.Unwrap()
+		default:
+			return false
+		}
+	}
+}
+
+// toJSONAPI converts a response body to a JSON:API document: users become
+// "users" resources under data, error bodies an errors array, and any other
+// fields move to meta.
+func toJSONAPI(status int, v any) any {
+	switch body := v.(type) {
+	case *object:
+		if _, ok := body.vals["user_id"]; ok {
+			return map[string]any{"data": userResource(body)}
+		}
+	case map[string]string:
+		m := make(map[string]any, len(body))
+		for k, s := range body {
+			m[k] = s
+		}
+		return toJSONAPI(status, m)
+	case map[string]any:
+		if fields, ok := body["fields"].([]fieldError); ok && status >= 400 {
+			return map[string]any{"errors": jsonAPIFieldErrors(status, fields)}
+		}
+		if status >= 400 {
+			return map[string]any{"errors": []map[string]any{jsonAPIError(status, body)}}
+		}
+		meta := make(map[string]any)
+		doc := map[string]any{}
+		for k, val := range body {
+			if users, ok := val.([]*object); ok && k == "users" {
+				data := make([]any, 0, len(users))
+				for _, u := range users {
+					data = append(data, userResource(u))
+				}
+				doc["data"] = data
+				continue
+			}
+			meta[k] = val
+		}
+		if len(meta) > 0 {
+			doc["meta"] = meta
+		}
+		return doc
+	}
+	if status >= 400 {
+		return map[string]any{"errors": []map[string]any{{"status": strconv.Itoa(status)}}}
+	}
+	return map[string]any{"meta": v}
+}
+
+func userResource(u *object) map[string]any {
+	attrs := newObject(u.sorted)
+	for _, k := range u.keys {
+		if k != "user_id" {
+			attrs.set(k, u.vals[k])
+		}
+	}
+	return map[string]any{
+		"type":       "users",
+		"id":         fmt.Sprint(u.vals["user_id"]),
+		"attributes": attrs,
+	}
+}
+
+// jsonAPIError maps the service's {"error", "code", ...} shape onto a
+// JSON:API error object; remaining fields go to its meta.
+func jsonAPIError(status int, body map[string]any) map[string]any {
+	e := map[string]any{"status": strconv.Itoa(status)}
+	meta := make(map[string]any)
+	for k, val := range body {
+		switch k {
+		case "error":
+			e["title"] = val
+		case "code":
+			e["code"] = val
+		case "detail":
+			e["detail"] = fmt.Sprint(val)
+		default:
+			meta[k] = val
+		}
+	}
+	if len(meta) > 0 {
+		e["meta"] = meta
+	}
+	return e
+}
+
+// jsonAPIFieldErrors reports each validation failure as its own error
+// object, pointing at the offending member of the request body.
+func jsonAPIFieldErrors(status int, fields []fieldError) []map[string]any {
+	errs := make([]map[string]any, 0, len(fields))
+	for _, fe := range fields {
+		errs = append(errs, map[string]any{
+			"status": strconv.Itoa(status),
+			"code":   fe.Code,
+			"title":  "Validation failed",
+			"detail": fe.Message,
+			"source": map[string]string{"pointer": "/" + fe.Field},
+		})
+	}
+	return errs
+}
@@ -0,0 +1,87 @@
+// jsonapi_test.go
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+var acceptJSONAPI = []string{"Accept", jsonAPIMediaType}
+
+func TestJSONAPIGetUser(t *testing.T) {
+	ta := newTestApp(t, map[string]string{"JSON_API": "true"})
+	ta.createUser(t, "ann", "ann@example.com")
+	rec := ta.do(t, http.MethodGet, "/users/1", "", acceptJSONAPI...)
+	wantStatus(t, rec, http.StatusOK)
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, jsonAPIMediaType) {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+	want := `{"data":{"attributes":{"username":"ann","email":"ann@example.com"},"id":"1","type":"users"}}`
+	if got := strings.TrimSpace(rec.Body.String()); got != want {
+		t.Fatalf("body = %s, want %s", got, want)
+	}
+
+	// Without the media type the plain shape is kept.
+	rec = ta.do(t, http.MethodGet, "/users/1", "")
+	if jsonBody(t, rec)["username"] != "ann" {
+		t.Fatalf("plain body = %s", rec.Body)
+	}
+}
+
+func TestJSONAPIListUsers(t *testing.T) {
+	ta := newTestApp(t, map[string]string{"JSON_API": "true"})
+	ta.createUser(t, "ann", "ann@example.com")
+	ta.createUser(t, "bob", "bob@example.com")
+	rec := ta.do(t, http.MethodGet, "/users?limit=1", "", acceptJSONAPI...)
+	wantStatus(t, rec, http.StatusOK)
+	body := jsonBody(t, rec)
+	data, _ := body["data"].([]any)
+	if len(data) != 1 {
+		t.Fatalf("data = %v", body)
+	}
+	res := data[0].(map[string]any)
+	if res["type"] != "users" || res["id"] != "1" || res["attributes"].(map[string]any)["username"] != "ann" {
+		t.Fatalf("resource = %v", res)
+	}
+	if meta, _ := body["meta"].(map[string]any); meta["next_cursor"] == nil {
+		t.Fatalf("pagination not under meta: %v", body)
+	}
+	if _, ok := body["users"]; ok {
+		t.Fatal("users left at the top level")
+	}
+}
+
+func TestJSONAPIErrors(t *testing.T) {
+	ta := newTestApp(t, map[string]string{"JSON_API": "true"})
+	rec := ta.do(t, http.MethodGet, "/users/42", "", acceptJSONAPI...)
+	wantStatus(t, rec, http.StatusNotFound)
+	errs, _ := jsonBody(t, rec)["errors"].([]any)
+	if len(errs) != 1 || errs[0].(map[string]any)["status"] != "404" || errs[0].(map[string]any)["title"] != "User not found" {
+		t.Fatalf("errors = %s", rec.Body)
+	}
+
+	rec = ta.do(t, http.MethodPost, "/users", `{"username":"","email":"nope"}`, acceptJSONAPI...)
+	wantStatus(t, rec, http.StatusBadRequest)
+	errs, _ = jsonBody(t, rec)["errors"].([]any)
+	var pointers []string
+	for _, e := range errs {
+		pointers = append(pointers, e.(map[string]any)["source"].(map[string]any)["pointer"].(string))
+	}
+	if strings.Join(pointers, ",") != "/username,/email" {
+		t.Fatalf("pointers = %v in %s", pointers, rec.Body)
+	}
+}
+
+func TestAcceptsJSONAPI(t *testing.T) {
+	for accept, want := range map[string]bool{
+		jsonAPIMediaType:                        true,
+		"application/json, " + jsonAPIMediaType: true,
+		jsonAPIMediaType + "; charset=utf-8":    false,
+		"application/json":                      false,
+	} {
+		if got := acceptsJSONAPI([]string{accept}); got != want {
+			t.Errorf("acceptsJSONAPI(%q) = %v", accept, got)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+// jsonobject.go
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// object is a JSON object that keeps its fields in insertion order, so a
+// user always renders as user_id, username, email followed by any extras.
+// Plain maps marshal with keys sorted alphabetically instead; sorted keeps
+// that order for clients pinned to it (JSON_FIELD_ORDER=sorted).
+type object struct {
+	keys   []string
+	vals   map[string]any
+	sorted bool
+}
+
+func newObject(sorted bool) *object {
+	return &object{vals: make(map[string]any), sorted: sorted}
+}
+
+// set adds or replaces a field; a replaced field keeps its position.
+func (o *object) set(key string, v any) {
+	if _, ok := o.vals[key]; !ok {
+		o.keys = append(o.keys, key)
+	}
+	o.vals[key] = v
+}
+
+func (o *object) MarshalJSON() ([]byte, error) {
+	if o.sorted {
+		return json.Marshal(o.vals)
+	}
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, k := range o.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, err := json.Marshal(k)
+		if err != nil {
+			return nil, err
+		}
+		val, err := json.Marshal(o.vals[k])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(val)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,56 @@
+// jsonobject_test.go
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"testing"
+)
+
+// wantFixture compares a response body byte for byte with testdata/name.
+func wantFixture(t *testing.T, got []byte, name string) {
+	t.Helper()
+	want, err := os.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("body = %q, want %q (testdata/%s)", got, want, name)
+	}
+}
+
+func TestUserResponseFixtures(t *testing.T) {
+	ta := newTestApp(t, nil)
+	rec := ta.do(t, http.MethodPost, "/users", `{"email":"ann@example.com","username":"ann"}`)
+	wantStatus(t, rec, http.StatusCreated)
+	wantFixture(t, rec.Body.Bytes(), "user_created.json")
+
+	// Repeated requests must not reorder fields.
+	for range 20 {
+		rec = ta.do(t, http.MethodGet, "/users/1", "")
+		wantStatus(t, rec, http.StatusOK)
+		wantFixture(t, rec.Body.Bytes(), "user_get.json")
+	}
+}
+
+func TestObjectFieldOrder(t *testing.T) {
+	o := newObject(false)
+	o.set("user_id", 1)
+	o.set("username", "ann")
+	o.set("avatar", "x")
+	o.set("username", "bob")
+	got, err := o.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != `{"user_id":1,"username":"bob","avatar":"x"}` {
+		t.Fatalf("canonical = %s", got)
+	}
+
+	o.sorted = true
+	got, _ = o.MarshalJSON()
+	if string(got) != `{"avatar":"x","user_id":1,"username":"bob"}` {
+		t.Fatalf("sorted = %s", got)
+	}
+}
@@ -0,0 +1,114 @@
+// loadshed.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	loadShedding = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "load_shedding",
+		Help: "1 while writes are shed because the DB pool is saturated (LOAD_SHED_WAIT), else 0.",
+	})
+	writesShed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "writes_shed_total",
+		Help: "Writes answered 503 OVERLOADED while the DB pool was saturated.",
+	})
+)
+
+// loadShedder watches how long requests wait for a pooled connection and,
+// while the average wait over the last window is at least maxWait, sheds
+// user-facing writes so the reads queued behind them get the connections.
+// minWaits keeps a handful of slow acquires from counting as saturation.
+type loadShedder struct {
+	stats    func() sql.DBStats
+	window   time.Duration
+	maxWait  time.Duration
+	minWaits int64
+
+	mu       sync.Mutex
+	samples  []poolWaitSample // oldest first, spanning window
+	shedding atomic.Bool
+}
+
+type poolWaitSample struct {
+	at    time.Time
+	count int64
+	wait  time.Duration
+}
+
+// loadShedSamples is how many samples a window is split into.
+const loadShedSamples = 10
+
+func (s *loadShedder) run(ctx context.Context) {
+	t := time.NewTicker(s.window / loadShedSamples)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			s.sample(now)
+		}
+	}
+}
+
+// sample records the pool's wait counters at now and re-evaluates the window
+// ending there.
+func (s *loadShedder) sample(now time.Time) {
+	st := s.stats()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.samples = append(s.samples, poolWaitSample{at: now, count: st.WaitCount, wait: st.WaitDuration})
+	// Keep the newest sample at or before the window start as its baseline.
+	for len(s.samples) > 1 && !s.samples[1].at.After(now.Add(-s.window)) {
+		s.samples = s.samples[1:]
+	}
+	first, last := s.samples[0], s.samples[len(s.samples)-1]
+	waits := last.count - first.count
+	var avg time.Duration
+	if waits > 0 {
+		avg = (last.wait - first.wait) / time.Duration(waits)
+	}
+
+	shed := waits >= s.minWaits && avg >= s.maxWait
+	if s.shedding.Swap(shed) != shed {
+		if shed {
+			slog.Warn("load shedding: pool saturated, rejecting writes", "waits", waits, "avg_wait", avg, "window", s.window)
+			loadShedding.Set(1)
+		} else {
+			slog.Info("load shedding: pool recovered, accepting writes", "waits", waits, "avg_wait", avg)
+			loadShedding.Set(0)
+		}
+	}
+}
+
+// shedWrites answers user-facing writes with 503 OVERLOADED while the
+// shedder is shedding. Reads, including those sent as POST, ops paths and
+// admin routes (matched against admin) pass; see isUserWrite.
+func (a *App) shedWrites(admin *http.ServeMux, next http.Handler) http.Handler {
+	s := a.Shedder
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.shedding.Load() || !a.isUserWrite(admin, r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		writesShed.Inc()
+		a.Config.RetryAfterFormat.set(w.Header(), s.window/loadShedSamples)
+		jsonWrite(w, http.StatusServiceUnavailable, map[string]string{
+			"error": "Database overloaded, writes are temporarily rejected",
+			"code":  "OVERLOADED",
+		})
+	})
+}
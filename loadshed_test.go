@@ -0,0 +1,123 @@
+// loadshed_test.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakePool stands in for db.Stats, with wait counters set by the test.
+type fakePool struct {
+	mu    sync.Mutex
+	stats sql.DBStats
+}
+
+func (p *fakePool) wait(n int64, each time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stats.WaitCount += n
+	p.stats.WaitDuration += time.Duration(n) * each
+}
+
+func (p *fakePool) Stats() sql.DBStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.stats
+}
+
+func newTestShedder(pool *fakePool) *loadShedder {
+	return &loadShedder{stats: pool.Stats, window: 10 * time.Second, maxWait: 100 * time.Millisecond, minWaits: 5}
+}
+
+func TestLoadShedderWindow(t *testing.T) {
+	pool := &fakePool{}
+	s := newTestShedder(pool)
+	t0 := time.Now()
+	s.sample(t0)
+
+	// Too few waits count for nothing, however slow.
+	pool.wait(3, time.Second)
+	s.sample(t0.Add(time.Second))
+	if s.shedding.Load() {
+		t.Fatal("shedding on 3 waits")
+	}
+
+	pool.wait(10, 200*time.Millisecond)
+	s.sample(t0.Add(2 * time.Second))
+	if !s.shedding.Load() || testutil.ToFloat64(loadShedding) != 1 {
+		t.Fatal("not shedding on a saturated window")
+	}
+
+	// Fast acquires pull the average under maxWait.
+	pool.wait(400, time.Millisecond)
+	s.sample(t0.Add(3 * time.Second))
+	if s.shedding.Load() {
+		t.Fatal("still shedding with a low average")
+	}
+
+	// A window with no waits in it sheds nothing.
+	s.sample(t0.Add(20 * time.Second))
+	if s.shedding.Load() || testutil.ToFloat64(loadShedding) != 0 {
+		t.Fatal("shedding on a quiet window")
+	}
+}
+
+func TestShedWritesPassesReads(t *testing.T) {
+	ta := newTestApp(t, map[string]string{"ENABLE_GRAPHQL": "true", "ADMIN_TOKEN": "secret"})
+	ta.createUser(t, "ann", "ann@example.com")
+	pool := &fakePool{}
+	ta.Shedder = newTestShedder(pool)
+	ta = newTestServer(ta.App)
+
+	t0 := time.Now()
+	ta.Shedder.sample(t0)
+	pool.wait(50, 500*time.Millisecond)
+	ta.Shedder.sample(t0.Add(time.Second))
+	shed := testutil.ToFloat64(writesShed)
+
+	writes := []struct{ method, target, body string }{
+		{http.MethodPost, "/users", `{"username":"bob","email":"bob@example.com"}`},
+		{http.MethodPut, "/users/1", `{"username":"ann2","email":"ann@example.com"}`},
+		{http.MethodPatch, "/users", `[{"user_id":1,"username":"ann2"}]`},
+		{http.MethodDelete, "/users/1", ""},
+		{http.MethodPost, "/graphql", `{"query":"mutation { deleteUser(id: \"1\") }"}`},
+	}
+	for _, tt := range writes {
+		rec := ta.do(t, tt.method, tt.target, tt.body)
+		wantStatus(t, rec, http.StatusServiceUnavailable)
+		if got := jsonBody(t, rec)["code"]; got != "OVERLOADED" || rec.Header().Get("Retry-After") != "1" {
+			t.Fatalf("%s %s: code %v, Retry-After %q", tt.method, tt.target, got, rec.Header().Get("Retry-After"))
+		}
+	}
+	if got := testutil.ToFloat64(writesShed) - shed; got != float64(len(writes)) {
+		t.Fatalf("writes shed counted %v, want %d", got, len(writes))
+	}
+
+	for _, tt := range []struct {
+		method, target, body string
+		want                 int
+	}{
+		{http.MethodGet, "/users/1", "", http.StatusOK},
+		{http.MethodGet, "/users", "", http.StatusOK},
+		{http.MethodPost, "/users/by-emails", `["ann@example.com"]`, http.StatusOK},
+		{http.MethodPost, "/graphql", `{"query":"{ user(id: \"1\") { username } }"}`, http.StatusOK},
+		{http.MethodGet, "/healthz", "", http.StatusOK},
+		{http.MethodPut, "/maintenance", "", http.StatusOK},
+		{http.MethodDelete, "/maintenance", "", http.StatusOK},
+	} {
+		wantStatus(t, ta.do(t, tt.method, tt.target, tt.body, adminAuth...), tt.want)
+	}
+	if _, err := ta.Users.Get(context.Background(), 1); err != nil {
+		t.Fatalf("shed delete was applied: %v", err)
+	}
+
+	// Writes resume once the waits age out of the window.
+	ta.Shedder.sample(t0.Add(20 * time.Second))
+	wantStatus(t, ta.do(t, writes[0].method, writes[0].target, writes[0].body), http.StatusCreated)
+}
@@ -0,0 +1,134 @@
+// logfile.go
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// rotatingFile is an io.Writer appending to path. The file is rotated,
+// renamed to path.<timestamp>, once a write would take it past maxBytes or
+// it is older than maxAge (0: never by age); only the newest maxBackups
+// rotated files are kept (0: all).
+type rotatingFile struct {
+	path       string
+	maxBytes   int64
+	maxAge     time.Duration
+	maxBackups int
+
+	mu     sync.Mutex
+	f      *os.File
+	size   int64
+	opened time.Time
+}
+
+// logOutput is where logs go: stdout, plus the LOG_FILE copy when set.
+// closeLog syncs and closes that file.
+func logOutput(cfg Config, stdout io.Writer) (out io.Writer, closeLog func() error, err error) {
+	if cfg.LogFile == "" {
+		return stdout, func() error { return nil }, nil
+	}
+	lf, err := openRotatingFile(cfg.LogFile, cfg.LogFileMaxBytes, cfg.LogFileMaxAge, cfg.LogFileMaxBackups)
+	if err != nil {
+		return nil, nil, err
+	}
+	return io.MultiWriter(stdout, lf), lf.Close, nil
+}
+
+func openRotatingFile(path string, maxBytes int64, maxAge time.Duration, maxBackups int) (*rotatingFile, error) {
+	rf := &rotatingFile{path: path, maxBytes: maxBytes, maxAge: maxAge, maxBackups: maxBackups}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.f, rf.size, rf.opened = f, info.Size(), time.Now()
+	return nil
+}
+
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.f == nil {
+		return 0, os.ErrClosed
+	}
+
+	full := rf.size > 0 && rf.size+int64(len(p)) > rf.maxBytes
+	old := rf.maxAge > 0 && time.Since(rf.opened) > rf.maxAge
+	if full || old {
+		if err := rf.rotate(); err != nil {
+			// Keep logging to the current file rather than dropping lines.
+			fmt.Fprintf(os.Stderr, "log file rotation failed: %v\n", err)
+		}
+		if rf.f == nil {
+			return 0, os.ErrClosed
+		}
+	}
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+func (rf *rotatingFile) rotate() error {
+	backup := rf.path + "." + time.Now().UTC().Format("20060102T150405.000000000")
+	if err := os.Rename(rf.path, backup); err != nil {
+		return err
+	}
+	rf.f.Close()
+	if err := rf.open(); err != nil {
+		// Nothing left to write to; Write reports os.ErrClosed from now on.
+		rf.f = nil
+		return err
+	}
+	return rf.prune()
+}
+
+// prune removes the oldest rotated files beyond maxBackups. The timestamp
+// suffix sorts chronologically.
+func (rf *rotatingFile) prune() error {
+	if rf.maxBackups == 0 {
+		return nil
+	}
+	backups, err := filepath.Glob(rf.path + ".[0-9]*")
+	if err != nil || len(backups) <= rf.maxBackups {
+		return err
+	}
+	slices.Sort(backups)
+	for _, b := range backups[:len(backups)-rf.maxBackups] {
+		if err := os.Remove(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close flushes and closes the current file.
+func (rf *rotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.f == nil {
+		return nil
+	}
+	err := rf.f.Sync()
+	if cerr := rf.f.Close(); err == nil {
+		err = cerr
+	}
+	rf.f = nil
+	return err
+}
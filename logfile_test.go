@@ -0,0 +1,94 @@
+// logfile_test.go
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogFileTeesOutput(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "api.log")
+	var stdout bytes.Buffer
+	out, closeLog, err := logOutput(testConfig(t, map[string]string{"LOG_FILE": path}), &stdout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newLogger(false, out).Info("user created", "user_id", 7)
+	if err := closeLog(); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(stdout.String(), `"msg":"user created"`) {
+		t.Fatalf("stdout = %q", stdout.String())
+	}
+	if string(file) != stdout.String() {
+		t.Fatalf("file = %q, want the stdout line %q", file, stdout.String())
+	}
+	if _, err := out.Write([]byte("late\n")); err == nil {
+		t.Fatal("write after close succeeded")
+	}
+}
+
+func TestLogOutputWithoutFile(t *testing.T) {
+	var stdout bytes.Buffer
+	out, closeLog, err := logOutput(testConfig(t, nil), &stdout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != &stdout {
+		t.Fatalf("output = %T, want stdout alone", out)
+	}
+	if err := closeLog(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRotatingFileRotatesBySize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "api.log")
+	rf, err := openRotatingFile(path, 10, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := rf.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, _ := os.ReadFile(path); string(got) != "fourth\n" {
+		t.Fatalf("current file = %q", got)
+	}
+	backups, _ := filepath.Glob(path + ".*")
+	if len(backups) != 2 {
+		t.Fatalf("backups = %v, want the newest 2", backups)
+	}
+	if got, _ := os.ReadFile(backups[1]); string(got) != "third\n" {
+		t.Fatalf("newest backup = %q", got)
+	}
+}
+
+func TestRotatingFileRotatesByAge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "api.log")
+	rf, err := openRotatingFile(path, 1<<20, time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+	rf.Write([]byte("old\n"))
+	rf.opened = time.Now().Add(-2 * time.Hour)
+	rf.Write([]byte("new\n"))
+	if got, _ := os.ReadFile(path); string(got) != "new\n" {
+		t.Fatalf("current file = %q", got)
+	}
+	if backups, _ := filepath.Glob(path + ".*"); len(backups) != 1 {
+		t.Fatalf("backups = %v", backups)
+	}
+}
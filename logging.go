@@ -0,0 +1,161 @@
+// logging.go
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+func newLogger(debug bool, out io.Writer) *slog.Logger {
+	level := slog.LevelInfo
+	if debug {
+		level = slog.LevelDebug
+	}
+	return slog.New(slog.NewJSONHandler(out, &slog.HandlerOptions{Level: level}))
+}
+
+// baseLogger is the process logger, tagged with the build when
+// LOG_BUILD_INFO is set.
+func baseLogger(cfg Config, out io.Writer) *slog.Logger {
+	logger := newLogger(cfg.Debug, out)
+	if cfg.LogBuildInfo {
+		// With encodes the attributes once, not per record.
+		version, commit := buildInfo()
+		logger = logger.With("version", version, "commit", commit)
+	}
+	return logger
+}
+
+// serverErrorLog routes net/http's own errors (TLS handshakes, malformed
+// requests, header timeouts) through slog instead of plain stderr.
+func serverErrorLog(l *slog.Logger, addr string) *log.Logger {
+	h := l.With("component", "http_server", "listen_addr", addr).Handler()
+	return slog.NewLogLogger(h, slog.LevelWarn)
+}
+
+// connStateLogger records connection transitions with the client address,
+// which is the only context available for failures before a handler runs.
+func connStateLogger(l *slog.Logger) func(net.Conn, http.ConnState) {
+	return func(c net.Conn, state http.ConnState) {
+		l.Debug("connection state", "component", "http_server",
+			"remote_addr", c.RemoteAddr().String(), "state", state.String())
+	}
+}
+
+// requestFields accumulates context for a request's summary log line.
+// Handlers add to it as they learn things (withField); the access log
+// middleware writes it out once the response is done.
+type requestFields struct {
+	mu    sync.Mutex
+	attrs []any
+}
+
+func withRequestFields(ctx context.Context) context.Context {
+	return context.WithValue(ctx, logFieldsKey, &requestFields{})
+}
+
+// withField attaches key=value to the request's summary line and to every
+// later logger(ctx) call. It is a no-op outside the access log.
+func withField(ctx context.Context, key string, value any) {
+	f, ok := ctx.Value(logFieldsKey).(*requestFields)
+	if !ok {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.attrs = append(f.attrs, slog.Any(key, value))
+}
+
+func fieldsFrom(ctx context.Context) []any {
+	f, ok := ctx.Value(logFieldsKey).(*requestFields)
+	if !ok {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]any(nil), f.attrs...)
+}
+
+// logger returns the default logger carrying the request ID and the
+// fields attached so far.
+func logger(ctx context.Context) *slog.Logger {
+	l := slog.Default()
+	if id := requestIDFrom(ctx); id != "" {
+		l = l.With("request_id", id)
+	}
+	if attrs := fieldsFrom(ctx); len(attrs) > 0 {
+		l = l.With(attrs...)
+	}
+	return l
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(b)
+	s.bytes += n
+	return n, err
+}
+
+func (s *statusRecorder) Flush() {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (s *statusRecorder) Unwrap() http.ResponseWriter { return s.ResponseWriter }
+
+// accessLog writes one summary line per request (ACCESS_LOG=true) with the
+// fields handlers attached along the way.
+func accessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ctx := withRequestFields(r.Context())
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		level := slog.LevelInfo
+		if rec.status >= 500 {
+			level = slog.LevelError
+		}
+		logger(ctx).Log(ctx, level, "request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.status,
+			"bytes", rec.bytes,
+			"duration_ms", float64(time.Since(start).Microseconds())/1000,
+		)
+	})
+}
+
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
@@ -0,0 +1,164 @@
+// logging_test.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// syncBuffer is a bytes.Buffer safe to write from server goroutines.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// captureDefaultLog sends slog's default logger, at debug level, to the
+// returned buffer for the rest of the test.
+func captureDefaultLog(t *testing.T) *syncBuffer {
+	var out syncBuffer
+	prev := slog.Default()
+	slog.SetDefault(newLogger(true, &out))
+	t.Cleanup(func() { slog.SetDefault(prev) })
+	return &out
+}
+
+// logLines decodes the JSON log lines written so far.
+func logLines(t *testing.T, out *syncBuffer) []map[string]any {
+	t.Helper()
+	var lines []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var m map[string]any
+		if err := json.Unmarshal([]byte(line), &m); err != nil {
+			t.Fatalf("log line %q: %v", line, err)
+		}
+		lines = append(lines, m)
+	}
+	return lines
+}
+
+func TestServerErrorsLoggedStructurally(t *testing.T) {
+	var out syncBuffer
+	srv := httptest.NewUnstartedServer(http.NotFoundHandler())
+	srv.Config.ErrorLog = serverErrorLog(newLogger(false, &out), ":3000")
+	srv.StartTLS()
+	defer srv.Close()
+
+	// Plain text at a TLS listener fails the handshake inside net/http.
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: x\r\n\r\n"))
+	conn.Close()
+
+	waitFor(t, "the handshake error log", func() bool { return strings.Contains(out.String(), "TLS handshake error") })
+	line := logLines(t, &out)[0]
+	if line["level"] != "WARN" || line["component"] != "http_server" || line["listen_addr"] != ":3000" {
+		t.Fatalf("log line = %v", line)
+	}
+}
+
+func TestConnStateLoggedWithClientAddress(t *testing.T) {
+	var out syncBuffer
+	srv := httptest.NewUnstartedServer(http.NotFoundHandler())
+	srv.Config.ConnState = connStateLogger(newLogger(true, &out))
+	srv.Start()
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	waitFor(t, "a connection state log", func() bool { return strings.Contains(out.String(), `"state":"active"`) })
+	for _, line := range logLines(t, &out) {
+		if addr, _ := line["remote_addr"].(string); !strings.HasPrefix(addr, "127.0.0.1:") {
+			t.Fatalf("remote_addr = %v", line["remote_addr"])
+		}
+	}
+}
+
+func TestAccessLogIncludesHandlerFields(t *testing.T) {
+	out := captureDefaultLog(t)
+	ta := newTestApp(t, map[string]string{"ACCESS_LOG": "true"})
+	ta.createUser(t, "ann", "ann@example.com")
+	ta.do(t, http.MethodGet, "/users/1", "", "X-Request-ID", "req-42")
+
+	var summary map[string]any
+	for _, line := range logLines(t, out) {
+		if line["msg"] == "request" && line["request_id"] == "req-42" {
+			summary = line
+		}
+	}
+	if summary == nil {
+		t.Fatalf("no summary line in %s", out)
+	}
+	// user_id is only known once the handler parsed the path.
+	if summary["user_id"] != 1.0 || summary["route"] != "/users/" || summary["status"] != 200.0 || summary["path"] != "/users/1" {
+		t.Fatalf("summary = %v", summary)
+	}
+}
+
+func TestLoggerCarriesAccumulatedFields(t *testing.T) {
+	out := captureDefaultLog(t)
+	ctx := withRequestFields(withRequestID(context.Background(), "req-1"))
+	withField(ctx, "user_id", 7)
+	logger(ctx).Info("lookup")
+	withField(context.Background(), "ignored", true) // outside the access log
+
+	lines := logLines(t, out)
+	if len(lines) != 1 || lines[0]["request_id"] != "req-1" || lines[0]["user_id"] != 7.0 {
+		t.Fatalf("lines = %v", lines)
+	}
+}
+
+func TestBaseLoggerBuildInfo(t *testing.T) {
+	prevVersion, prevCommit := buildVersion, buildCommit
+	buildVersion, buildCommit = "v1.4.0", "5e1f2a9"
+	t.Cleanup(func() { buildVersion, buildCommit = prevVersion, prevCommit })
+
+	var out syncBuffer
+	logger := baseLogger(testConfig(t, nil), &out)
+	logger.Info("first")
+	logger.With("component", "purge").Warn("second", "n", 3)
+	lines := logLines(t, &out)
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines", len(lines))
+	}
+	for _, line := range lines {
+		if line["version"] != "v1.4.0" || line["commit"] != "5e1f2a9" {
+			t.Errorf("line = %v", line)
+		}
+	}
+
+	var untagged syncBuffer
+	logger = baseLogger(testConfig(t, map[string]string{"LOG_BUILD_INFO": "false"}), &untagged)
+	logger.Info("untagged")
+	if line := logLines(t, &untagged)[0]; line["commit"] != nil || line["version"] != nil {
+		t.Fatalf("tagged while disabled: %v", line)
+	}
+}
@@ -2,22 +2,60 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"math"
+	"net"
 	"net/http"
+	"net/mail"
+	"net/url"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
-	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/stdlib"
+	"golang.org/x/sync/singleflight"
 )
 
 type App struct {
-	DB *sql.DB
+	Config Config
+	DB     *sql.DB
+	Store  userStore
+	Events *broadcaster
+	Ready  *readiness
+	Stats  *statsCache
+
+	Idempotency idempotencyStore
+	// Reads coalesces concurrent GetUser calls for the same id when
+	// COALESCE_READS is on; nil otherwise.
+	Reads *singleflight.Group
+	// Captures holds sampled requests when CAPTURE_SAMPLE_RATE > 0.
+	Captures *captureRing
+	Notifier Notifier
+	// Jobs is the webhook delivery queue behind /admin/jobs; nil when no
+	// webhook is configured.
+	Jobs *webhookNotifier
+	// Deliveries is the durable queue behind /admin/webhooks/deliveries
+	// with WEBHOOK_QUEUE=db; nil otherwise.
+	Deliveries *webhookQueue
+	// Shedder rejects writes while the pool is saturated when
+	// LOAD_SHED_WAIT is set; nil otherwise.
+	Shedder *loadShedder
+	// EmailDomains checks new users' email domains when VALIDATE_EMAIL_MX
+	// is on; nil otherwise.
+	EmailDomains *emailDomainChecker
+	// Users is what the handlers call to read and change users.
+	Users *UserService
 }
 
 type createUserReq struct {
@@ -25,159 +63,866 @@ type createUserReq struct {
 	Email    string `json:"email"`
 }
 
+// encodeFailureBody answers a response that failed to encode, so a client
+// never gets an empty or truncated body instead.
+var encodeFailureBody = []byte(`{"error":"Internal Server Error","code":"ENCODING_FAILED"}` + "\n")
+
+// jsonWrite encodes v into a buffer before anything is sent, so an encoding
+// failure can still be answered with a well-formed 500.
 func jsonWrite(w http.ResponseWriter, status int, v any) {
-	w.Header().Set("Content-Type", "application/json")
+	contentType := "application/json"
+	switch {
+	case isJSONAPI(w):
+		contentType, v = jsonAPIMediaType, toJSONAPI(status, v)
+	case status >= 400 && isProblemJSON(w):
+		contentType, v = problemMediaType, toProblem(status, v)
+	}
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(v); err != nil {
+		slog.Error("response encoding failed, sending fallback 500", "status", status, "type", fmt.Sprintf("%T", v), "err", err)
+		contentType, status = "application/json", http.StatusInternalServerError
+		buf.Reset()
+		buf.Write(encodeFailureBody)
+	}
+	w.Header().Set("Content-Type", contentType)
 	w.WriteHeader(status)
-	_ = json.NewEncoder(w).Encode(v)
+	_, _ = w.Write(buf.Bytes())
 }
 
 func (a *App) handleRoot(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet || r.URL.Path != "/" {
-		jsonWrite(w, http.StatusNotFound, map[string]string{"error": "Not Found"})
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, http.MethodGet)
 		return
 	}
-	jsonWrite(w, http.StatusOK, map[string]string{"message": "Hello World from Go (PostgreSQL)"})
+	switch a.Config.RootBehavior {
+	case "notfound":
+		writeNotFound(w)
+	case "redirect":
+		http.Redirect(w, r, a.Config.RootRedirectURL, http.StatusFound)
+	default:
+		jsonWrite(w, http.StatusOK, map[string]string{"message": "Hello World from Go (PostgreSQL)"})
+	}
 }
 
 func (a *App) handleUsers(w http.ResponseWriter, r *http.Request) {
 	switch {
 	case r.Method == http.MethodPost && r.URL.Path == "/users":
 		a.createUser(w, r)
+	case r.Method == http.MethodGet && (r.URL.Path == "/users" || r.URL.Path == "/users/"):
+		// "/users/" is the collection too, not a request for an empty id.
+		a.listUsers(w, r)
+	case r.Method == http.MethodPatch && r.URL.Path == "/users":
+		a.updateUsers(w, r)
+	case r.Method == http.MethodPost && r.URL.Path == "/users/by-emails":
+		a.listUsersByEmails(w, r)
+	case r.Method == http.MethodGet && r.URL.Path == "/users/lookup":
+		a.lookupUser(w, r)
+	case r.URL.Path == "/users/":
+		// Only reading the collection; it has no id to replace or delete.
+		writeMethodNotAllowed(w, http.MethodGet)
 	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/users/"):
 		a.getUser(w, r)
+	case r.Method == http.MethodHead && a.Config.UserETags && strings.HasPrefix(r.URL.Path, "/users/"):
+		a.headUser(w, r)
+	case r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, "/users/"):
+		a.replaceUser(w, r)
+	case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, "/users/"):
+		a.deleteUser(w, r)
+	case r.URL.Path == "/users":
+		writeMethodNotAllowed(w, http.MethodGet, http.MethodPost, http.MethodPatch)
+	case r.URL.Path == "/users/by-emails":
+		writeMethodNotAllowed(w, http.MethodPost)
+	case r.URL.Path == "/users/lookup":
+		writeMethodNotAllowed(w, http.MethodGet)
+	case a.Config.UserETags:
+		writeMethodNotAllowed(w, http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete)
 	default:
-		jsonWrite(w, http.StatusNotFound, map[string]string{"error": "Not Found"})
+		writeMethodNotAllowed(w, http.MethodGet, http.MethodPut, http.MethodDelete)
 	}
 }
 
 func (a *App) createUser(w http.ResponseWriter, r *http.Request) {
 	var req createUserReq
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		jsonWrite(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON"})
-		return
-	}
-	if strings.TrimSpace(req.Username) == "" || strings.TrimSpace(req.Email) == "" {
-		jsonWrite(w, http.StatusBadRequest, map[string]string{"error": "username and email are required"})
+	if err := a.decodeBody(r, &req); err != nil {
+		writeDecodeError(w, err, "invalid JSON")
 		return
 	}
 
-	ctx, cancel := context.WithTimeout(r.Context(), 60*time.Second)
+	ctx, cancel := context.WithTimeout(r.Context(), a.Config.QueryTimeout)
 	defer cancel()
 
-	var id int32
-	err := a.DB.QueryRowContext(
-		ctx,
-		"INSERT INTO users (username, email) VALUES ($1, $2) RETURNING user_id",
-		req.Username, req.Email,
-	).Scan(&id)
+	u, existed, err := a.Users.Create(ctx, req)
 	if err != nil {
-		jsonWrite(w, http.StatusInternalServerError, map[string]string{"error": "Database error", "detail": err.Error()})
+		writeUserError(w, err)
+		return
+	}
+	if existed {
+		// A retry of a create that already succeeded is not a conflict.
+		body := a.userBody(r.Context(), u)
+		body.set("message", "User already exists")
+		jsonWrite(w, http.StatusOK, body)
 		return
 	}
 
+	w.Header().Set("Location", "/users/"+strconv.Itoa(int(u.ID)))
+	if !a.Config.CreateReturnsBody {
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
 	jsonWrite(w, http.StatusCreated, map[string]any{
 		"message": "User created successfully",
-		"user_id": id,
+		"user_id": u.ID,
 	})
 }
 
 func (a *App) getUser(w http.ResponseWriter, r *http.Request) {
-	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/users/"), "/")
-	if len(parts) < 1 || parts[0] == "" {
-		jsonWrite(w, http.StatusBadRequest, map[string]string{"error": "Invalid user_id"})
+	id, err := parseUserID(r)
+	if err != nil {
+		a.writeInvalidID(w, err)
 		return
 	}
-	id, err := strconv.Atoi(parts[0])
+	expand, err := parseExpand(r)
 	if err != nil {
-		jsonWrite(w, http.StatusBadRequest, map[string]string{"error": "Invalid user_id"})
+		jsonWrite(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
 		return
 	}
 
-	ctx, cancel := context.WithTimeout(r.Context(), 60*time.Second)
+	ctx, cancel := context.WithTimeout(r.Context(), a.Config.QueryTimeout)
 	defer cancel()
 
-	var (
-		userID   int32
-		username string
-		email    string
-	)
-	err = a.DB.QueryRowContext(ctx,
-		"SELECT user_id, username, email FROM users WHERE user_id = $1",
-		id,
-	).Scan(&userID, &username, &email)
-
-	if err == sql.ErrNoRows {
-		jsonWrite(w, http.StatusNotFound, map[string]string{"error": "User not found"})
+	u, err := a.Users.Get(ctx, id)
+	if err != nil {
+		writeUserError(w, err)
 		return
 	}
+	a.writeUser(w, r, u, expand)
+}
+
+// lookupUser handles GET /users/lookup: a user by ?id= or by ?email=, for
+// clients holding either. Exactly one of them must be given.
+func (a *App) lookupUser(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Has("id") == q.Has("email") {
+		jsonWrite(w, http.StatusBadRequest, map[string]string{
+			"error": "exactly one of id or email is required",
+			"code":  "INVALID_LOOKUP",
+		})
+		return
+	}
+	expand, err := parseExpand(r)
 	if err != nil {
-		jsonWrite(w, http.StatusInternalServerError, map[string]string{"error": "Database error", "detail": err.Error()})
+		jsonWrite(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
 		return
 	}
 
-	jsonWrite(w, http.StatusOK, map[string]any{
-		"user_id":  userID,
-		"username": username,
-		"email":    email,
-	})
+	ctx, cancel := context.WithTimeout(r.Context(), a.Config.QueryTimeout)
+	defer cancel()
+
+	var u User
+	if q.Has("id") {
+		var id int32
+		if id, err = parseID(q.Get("id")); err != nil {
+			a.writeInvalidID(w, err)
+			return
+		}
+		withField(r.Context(), "user_id", id)
+		u, err = a.Users.Get(ctx, id)
+	} else {
+		email := q.Get("email")
+		if !isValidEmail(email) {
+			recordValidationFailure("invalid_email")
+			jsonWrite(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("invalid email %q", email)})
+			return
+		}
+		u, err = a.Users.GetByEmail(ctx, email)
+	}
+	if err != nil {
+		writeUserError(w, err)
+		return
+	}
+	a.writeUser(w, r, u, expand)
+}
+
+// writeUser answers a single-user read, honouring If-None-Match.
+func (a *App) writeUser(w http.ResponseWriter, r *http.Request, u User, expand []string) {
+	a.setCacheControl(w, "get_user")
+	body := a.userBody(r.Context(), u)
+	for _, f := range expand {
+		if a.fieldAllowed(r.Context(), f) {
+			body.set(f, expanders[f](u))
+		}
+	}
+	if a.Config.UserETags && notModified(w, r, body) {
+		return
+	}
+	jsonWrite(w, http.StatusOK, body)
+}
+
+func (a *App) listUsers(w http.ResponseWriter, r *http.Request) {
+	page, err := parsePagination(r)
+	if err != nil {
+		jsonWrite(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if a.Config.Debug && r.URL.Query().Get("explain") == "true" {
+		query, args := buildListQuery(page)
+		jsonWrite(w, http.StatusOK, map[string]any{"sql": query, "args": redactArgs(args)})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), a.Config.QueryTimeout)
+	defer cancel()
+
+	users, err := a.Users.List(ctx, page)
+	partial := false
+	if err != nil {
+		if !a.Config.PartialResults || len(users) == 0 || !errors.Is(err, context.DeadlineExceeded) {
+			writeDBError(w, err)
+			return
+		}
+		// Out of time mid-stream: hand back what we have and how to resume.
+		partial = true
+	}
+
+	out := make([]*object, 0, len(users))
+	for _, u := range users {
+		out = append(out, a.userBody(r.Context(), u))
+	}
+	n, ok := a.fitResponse(w, out)
+	if !ok {
+		return
+	}
+	truncated := n < len(out)
+	out, users = out[:n], users[:n]
+
+	resp := map[string]any{"users": a.usersField(out)}
+	switch {
+	case len(users) == 0:
+	case page.Sort == "user_id" && page.Offset == 0 && (partial || truncated || len(users) == page.Limit):
+		resp["next_cursor"] = encodeCursor(users[len(users)-1].ID)
+	case partial || truncated:
+		resp["next_offset"] = page.Offset + len(users)
+	}
+	if partial {
+		resp["partial"] = true
+	}
+	if truncated {
+		resp["truncated"] = true
+	}
+	a.setCacheControl(w, "list_users")
+	jsonWrite(w, http.StatusOK, resp)
 }
 
-func mustEnv(key, def string) string {
-	if v := os.Getenv(key); v != "" {
-		return v
+// usersField is the "users" value of a list response: out, which is never
+// nil so an empty page encodes as [], or a nil slice encoding as null when
+// EMPTY_LIST_AS_NULL asks for it. The nil stays typed so JSON:API still
+// renders an empty data array.
+func (a *App) usersField(out []*object) []*object {
+	if len(out) == 0 && a.Config.EmptyListAsNull {
+		return nil
+	}
+	return out
+}
+
+func (a *App) listUsersByEmails(w http.ResponseWriter, r *http.Request) {
+	var emails []string
+	if err := a.decodeBatchBody(r, &emails); err != nil {
+		writeDecodeError(w, err, "invalid JSON, expected an array of emails")
+		return
+	}
+	if len(emails) == 0 {
+		jsonWrite(w, http.StatusBadRequest, map[string]string{"error": "at least one email is required"})
+		return
+	}
+	if len(emails) > a.Config.MaxBatchSize {
+		jsonWrite(w, http.StatusBadRequest, map[string]string{
+			"error": fmt.Sprintf("at most %d emails per request", a.Config.MaxBatchSize),
+		})
+		return
+	}
+
+	wanted := make([]string, 0, len(emails))
+	seen := make(map[string]bool, len(emails))
+	for _, e := range emails {
+		if !isValidEmail(e) {
+			recordValidationFailure("invalid_email")
+			jsonWrite(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("invalid email %q", e)})
+			return
+		}
+		e = strings.ToLower(e)
+		if !seen[e] {
+			seen[e] = true
+			wanted = append(wanted, e)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), a.Config.QueryTimeout)
+	defer cancel()
+
+	users, err := a.Store.ListUsersByEmails(ctx, wanted)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+
+	out := make([]*object, 0, len(users))
+	for _, u := range users {
+		out = append(out, a.userBody(r.Context(), u))
+		delete(seen, strings.ToLower(u.Email))
+	}
+	notFound := make([]string, 0, len(seen))
+	for _, e := range wanted {
+		if seen[e] {
+			notFound = append(notFound, e)
+		}
+	}
+	n, ok := a.fitResponse(w, out)
+	if !ok {
+		return
+	}
+	resp := map[string]any{"users": a.usersField(out[:n]), "not_found": notFound}
+	if n < len(out) {
+		resp["truncated"] = true
+	}
+	jsonWrite(w, http.StatusOK, resp)
+}
+
+// replaceUser handles PUT /users/{id}: every field is replaced, so an
+// omitted field is cleared unless it is in PUT_PROTECTED_FIELDS.
+func (a *App) replaceUser(w http.ResponseWriter, r *http.Request) {
+	id, err := parseUserID(r)
+	if err != nil {
+		a.writeInvalidID(w, err)
+		return
+	}
+	var req createUserReq
+	if err := a.decodeBody(r, &req); err != nil {
+		writeDecodeError(w, err, "invalid JSON")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), a.Config.QueryTimeout)
+	defer cancel()
+
+	u, err := a.Users.Replace(ctx, id, req)
+	if err != nil {
+		writeUserError(w, err)
+		return
+	}
+	jsonWrite(w, http.StatusOK, a.userBody(r.Context(), u))
+}
+
+func (a *App) deleteUser(w http.ResponseWriter, r *http.Request) {
+	id, err := parseUserID(r)
+	if err != nil {
+		a.writeInvalidID(w, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), a.Config.QueryTimeout)
+	defer cancel()
+
+	if err := a.Users.Delete(ctx, id); err != nil {
+		writeUserError(w, err)
+		return
+	}
+
+	jsonWrite(w, http.StatusOK, map[string]string{"message": "User deleted successfully"})
+}
+
+// writeUserError answers a UserService error: rejected input and missing
+// users are client errors, anything else goes through writeDBError.
+func writeUserError(w http.ResponseWriter, err error) {
+	var ve *validationError
+	var cv *checkViolationError
+	switch {
+	case errors.As(err, &ve):
+		writeValidationErrors(w, ve.fields)
+	case errors.Is(err, errEmailDomainUnresolvable):
+		jsonWrite(w, http.StatusBadRequest, map[string]string{
+			"error": "Email domain does not accept mail",
+			"code":  "EMAIL_DOMAIN_UNRESOLVABLE",
+		})
+	case errors.Is(err, errUserNotFound):
+		jsonWrite(w, http.StatusNotFound, map[string]string{"error": "User not found"})
+	case errors.Is(err, errDuplicateEmail):
+		jsonWrite(w, http.StatusConflict, map[string]string{"error": "Email already exists"})
+	case errors.Is(err, errDuplicateUsername):
+		jsonWrite(w, http.StatusConflict, map[string]string{"error": "Username already exists", "code": "DUPLICATE_USERNAME"})
+	case errors.Is(err, errValueTooLong):
+		jsonWrite(w, http.StatusBadRequest, map[string]string{"error": "username or email is too long"})
+	case errors.As(err, &cv):
+		writeCheckViolation(w, cv)
+	default:
+		writeDBError(w, err)
+	}
+}
+
+// redactArgs hides string bind values, which may carry user data; numeric
+// paging arguments are kept so placeholders can be checked against them.
+func redactArgs(args []any) []any {
+	out := make([]any, len(args))
+	for i, v := range args {
+		if _, ok := v.(string); ok {
+			v = "[redacted]"
+		}
+		out[i] = v
+	}
+	return out
+}
+
+// writeDBError reports a store failure not handled by the caller.
+func writeDBError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errPoolExhausted) {
+		jsonWrite(w, http.StatusServiceUnavailable, map[string]string{"error": "Database busy, try again later"})
+		return
+	}
+	if isConnectionLost(err) {
+		// A write may or may not have committed; retrying is safe with an
+		// Idempotency-Key.
+		jsonWrite(w, http.StatusServiceUnavailable, map[string]string{
+			"error": "Database connection lost, try again",
+			"code":  "DB_CONNECTION_LOST",
+		})
+		return
+	}
+	// The driver's message can name tables, constraints or values, so it
+	// stays in the log.
+	slog.Error("database error", "err", err)
+	jsonWrite(w, http.StatusInternalServerError, map[string]string{"error": "Database error"})
+}
+
+// writeInvalidID answers a request whose path id isn't a valid user_id,
+// using 400 or 404 per MALFORMED_ID_STATUS.
+func (a *App) writeInvalidID(w http.ResponseWriter, err error) {
+	if a.Config.MalformedIDStatus == http.StatusNotFound {
+		jsonWrite(w, http.StatusNotFound, map[string]string{"error": "User not found"})
+		return
+	}
+	jsonWrite(w, http.StatusBadRequest, map[string]string{"error": "Invalid user_id: " + err.Error()})
+}
+
+// parseUserID reads the id from /users/{id}.
+func parseUserID(r *http.Request) (int32, error) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/users/"), "/")
+	id, err := parseID(parts[0])
+	if err != nil {
+		return 0, err
+	}
+	withField(r.Context(), "user_id", id)
+	return id, nil
+}
+
+// parseID parses a user_id given as text, e.g. in a path or a GraphQL ID.
+// It must fit user_id's SERIAL (int4) range, so nothing that can't name a
+// row reaches the database.
+func parseID(s string) (int32, error) {
+	if s == "" {
+		return 0, errors.New("missing")
+	}
+	id, err := strconv.ParseInt(s, 10, 64)
+	switch {
+	case errors.Is(err, strconv.ErrRange):
+		return 0, errors.New("out of range")
+	case err != nil:
+		return 0, errors.New("not an integer")
+	case id < 1:
+		return 0, errors.New("must be positive")
+	case id > math.MaxInt32:
+		return 0, errors.New("out of range")
+	}
+	return int32(id), nil
+}
+
+// isValidEmail accepts a bare addr-spec such as "a@example.com", rejecting
+// display-name forms like "A <a@example.com>".
+func isValidEmail(s string) bool {
+	addr, err := mail.ParseAddress(s)
+	return err == nil && addr.Address == s
+}
+
+// userBody renders u with the fields the principal in ctx may see.
+func (a *App) userBody(ctx context.Context, u User) *object {
+	body := newObject(a.Config.JSONFieldOrder == "sorted")
+	body.set("user_id", u.ID)
+	if a.fieldAllowed(ctx, "username") {
+		a.nullableField(body, "username", u.Username, u.NullUsername)
+	}
+	if a.fieldAllowed(ctx, "email") {
+		a.nullableField(body, "email", u.Email, u.NullEmail)
+	}
+	return body
+}
+
+// nullableField renders a possibly-NULL column per NULL_FIELDS.
+func (a *App) nullableField(body *object, key, v string, null bool) {
+	switch {
+	case !null:
+		body.set(key, v)
+	case a.Config.NullFields == "empty":
+		body.set(key, "")
+	case a.Config.NullFields == "null":
+		body.set(key, nil)
 	}
-	return def
 }
 
 func main() {
-	host := mustEnv("DB_HOST", "container_postgresql")
-	user := mustEnv("DB_USER", "testuser")
-	pass := mustEnv("DB_PASSWORD", "testpass")
-	name := mustEnv("DB_NAME", "testdb")
-	port := mustEnv("DB_PORT", "5432")
-	httpPort := mustEnv("PORT", "3000")
-
-	// Postgres DSN (pgx stdlib)
-	// NOTE: ใน Docker/local มักใช้ sslmode=disable
-	dsn := fmt.Sprintf("postgres://%s:%s@%s:%s/%s?sslmode=disable",
-		user, pass, host, port, name)
+	cfg, err := LoadConfig(os.Getenv)
+	if err != nil {
+		fatal("invalid config", "err", err)
+	}
+	logOut, closeLog, err := logOutput(cfg, os.Stdout)
+	if err != nil {
+		fatal("cannot open log file", "path", cfg.LogFile, "err", err)
+	}
+	// Closed last, after the shutdown steps have logged.
+	defer closeLog()
+	logger := baseLogger(cfg, logOut)
+	slog.SetDefault(logger)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	db, err := sql.Open("pgx", dsn)
+	app := &App{
+		Config: cfg,
+		Events: newBroadcaster(cfg.SSEMaxSubscribers, cfg.SSEBufferSize, cfg.EventHubBuffer, cfg.EventHubOverflow),
+		Ready:  newReadiness(cfg.StartupGrace, cfg.ReadinessHistorySize),
+		Stats:  &statsCache{ttl: cfg.StatsCacheTTL},
+	}
+
+	if cfg.Maintenance {
+		app.Ready.setNotReady(componentMaintenance, "maintenance")
+	}
+
+	var closers shutdownCoordinator
+
+	switch cfg.Storage {
+	case "memory":
+		slog.Warn("using in-memory storage; data is lost on restart")
+		app.Store = newMemoryStore(cfg.UniqueUsernames)
+	default:
+		db, err := openDB(ctx, cfg)
+		if err != nil {
+			fatal("database unavailable", "err", err)
+		}
+		if cfg.RunMigrations {
+			migrateCtx, cancel := context.WithTimeout(ctx, cfg.MigrationTimeout)
+			err := runMigrations(migrateCtx, db)
+			cancel()
+			if err != nil {
+				fatal("migrations failed", "err", err)
+			}
+		}
+		checkCtx, cancel := context.WithTimeout(ctx, cfg.QueryTimeout)
+		err = checkEmailIndex(checkCtx, db)
+		cancel()
+		if err != nil {
+			fatal("email index unavailable", "err", err)
+		}
+		if cfg.UniqueUsernames {
+			indexCtx, cancel := context.WithTimeout(ctx, cfg.MigrationTimeout)
+			err := ensureUsernameIndex(indexCtx, db)
+			cancel()
+			if err != nil {
+				fatal("username index unavailable", "err", err)
+			}
+		}
+		app.DB = db
+		closers.register("database", cfg.ShutdownStepTimeout, func(context.Context) error {
+			return db.Close()
+		})
+		app.Store = &pgStore{
+			db:               db,
+			acquireTimeout:   cfg.DBAcquireTimeout,
+			commentRequestID: cfg.SQLCommentReqID,
+			isolation:        cfg.DBIsolation,
+			audit:            cfg.AuditLog && cfg.AuditDBURL == "",
+		}
+		if cfg.DBReadRetry {
+			app.Store = readRetryStore{app.Store}
+		}
+	}
+
+	if cfg.CoalesceReads {
+		app.Reads = &singleflight.Group{}
+	}
+	if cfg.ValidateEmailMX {
+		app.EmailDomains = newEmailDomainChecker(net.DefaultResolver, cfg.EmailMXTimeout, cfg.EmailMXCacheTTL, cfg.EmailMXAllowlist)
+	}
+	if cfg.CaptureSampleRate > 0 {
+		app.Captures = newCaptureRing(cfg.CaptureBufferSize)
+	}
+	if cfg.IdempotencyStore == "db" {
+		app.Idempotency = &pgIdempotencyStore{db: app.DB, ttl: cfg.IdempotencyTTL}
+	} else {
+		app.Idempotency = newMemoryIdempotencyStore(cfg.IdempotencyTTL)
+	}
+
+	closers.register("event hub", cfg.ShutdownStepTimeout, func(context.Context) error {
+		app.Events.stop()
+		return nil
+	})
+
+	slots := newBackgroundSlots(cfg.MaxBackgroundConcurrency)
+	app.Notifier = noopNotifier{}
+	switch {
+	case cfg.UserCreatedWebhook != "" && cfg.WebhookQueue == "db":
+		queue := newWebhookQueue(app.DB, cfg.UserCreatedWebhook, cfg.WebhookTimeout, cfg.WebhookRetries, cfg.WebhookPollInterval, slots)
+		app.Notifier, app.Deliveries = queue, queue
+	case cfg.UserCreatedWebhook != "":
+		notifyCtx, cancelNotify := context.WithCancel(context.Background())
+		webhook := newWebhookNotifier(notifyCtx, cfg.UserCreatedWebhook, cfg.WebhookTimeout, cfg.WebhookRetries, slots)
+		app.Notifier, app.Jobs = webhook, webhook
+		closers.register("notifications", cfg.ShutdownStepTimeout, func(ctx context.Context) error {
+			defer cancelNotify()
+			webhook.setDraining(true)
+			return webhook.wait(ctx)
+		})
+	}
+	app.Users = &UserService{
+		store:    app.Store,
+		events:   app.Events,
+		notifier: app.Notifier,
+		domains:  app.EmailDomains,
+		reads:    app.Reads,
+		cfg:      cfg,
+	}
+	if cfg.AuditDBURL != "" {
+		auditDB, err := openAuditDB(ctx, cfg)
+		if err != nil {
+			fatal("audit database unavailable", "err", err)
+		}
+		// Registered before the background jobs so the writer has drained
+		// by the time this closes.
+		closers.register("audit database", cfg.ShutdownStepTimeout, func(context.Context) error {
+			return auditDB.Close()
+		})
+		app.Users.audit = newAuditWriter(auditDB, cfg.QueryTimeout)
+	}
+	if cfg.SeedEmail != "" {
+		seedCtx, cancel := context.WithTimeout(ctx, cfg.QueryTimeout)
+		err := app.Users.Seed(seedCtx, createUserReq{Username: cfg.SeedUsername, Email: cfg.SeedEmail})
+		cancel()
+		if err != nil {
+			fatal("seeding user failed", "err", err)
+		}
+	}
+
+	bgCtx, stopBackground := context.WithCancel(context.Background())
+	defer stopBackground()
+	var background sync.WaitGroup
+	if app.DB != nil && cfg.PoolHealthInterval > 0 {
+		checker := &poolHealthChecker{
+			db:       app.DB,
+			interval: cfg.PoolHealthInterval,
+			failures: cfg.PoolHealthFailures,
+			ready:    app.Ready,
+			slots:    slots,
+		}
+		background.Go(func() { checker.run(bgCtx) })
+	}
+	if app.Deliveries != nil {
+		background.Go(func() { app.Deliveries.run(bgCtx) })
+	}
+	if app.Users.audit != nil {
+		background.Go(func() { app.Users.audit.run(bgCtx) })
+	}
+	if app.DB != nil && cfg.LoadShedWait > 0 {
+		app.Shedder = &loadShedder{
+			stats:    app.DB.Stats,
+			window:   cfg.LoadShedWindow,
+			maxWait:  cfg.LoadShedWait,
+			minWaits: int64(cfg.LoadShedMinWaits),
+		}
+		background.Go(func() { app.Shedder.run(bgCtx) })
+	}
+	if cfg.IdempotencyStore == "db" && cfg.PurgeInterval > 0 {
+		p := &purger{
+			table:     "idempotency_keys",
+			query:     purgeIdempotencyKeys,
+			db:        app.DB,
+			retention: cfg.IdempotencyRetention,
+			interval:  cfg.PurgeInterval,
+			batch:     cfg.PurgeBatchSize,
+			slots:     slots,
+		}
+		background.Go(func() { p.run(bgCtx) })
+	}
+	if app.Deliveries != nil && cfg.WebhookRetention > 0 && cfg.PurgeInterval > 0 {
+		p := &purger{
+			table:     "webhook_deliveries",
+			query:     purgeWebhookDeliveries,
+			db:        app.DB,
+			retention: cfg.WebhookRetention,
+			interval:  cfg.PurgeInterval,
+			batch:     cfg.PurgeBatchSize,
+			slots:     slots,
+		}
+		background.Go(func() { p.run(bgCtx) })
+	}
+	closers.register("background jobs", cfg.ShutdownStepTimeout, func(context.Context) error {
+		stopBackground()
+		background.Wait()
+		return nil
+	})
+
+	public, admin := app.handlers()
+	servers := []*http.Server{{
+		Addr:              ":" + cfg.Port,
+		Handler:           public,
+		ReadHeaderTimeout: 10 * time.Second,
+	}}
+	if admin != nil {
+		servers = append(servers, &http.Server{
+			Addr:              net.JoinHostPort(cfg.AdminBind, cfg.AdminPort),
+			Handler:           admin,
+			ReadHeaderTimeout: 10 * time.Second,
+		})
+	}
+
+	// Servers drain together, as one step, before anything they use closes.
+	closers.register("http servers", cfg.ShutdownTimeout, func(ctx context.Context) error {
+		errs := make([]error, len(servers))
+		var wg sync.WaitGroup
+		for i, srv := range servers {
+			wg.Go(func() {
+				if err := srv.Shutdown(ctx); err != nil {
+					errs[i] = fmt.Errorf("%s: %w", srv.Addr, err)
+				}
+			})
+		}
+		wg.Wait()
+		return errors.Join(errs...)
+	})
+
+	serveErr := make(chan error, len(servers))
+	for _, srv := range servers {
+		srv.ErrorLog = serverErrorLog(logger, srv.Addr)
+		srv.ConnState = connStateLogger(logger)
+		// SSE streams never finish on their own; ending them lets the drain
+		// complete instead of running into SHUTDOWN_TIMEOUT.
+		srv.RegisterOnShutdown(app.Events.stop)
+		go func() {
+			slog.Info("server listening", "addr", srv.Addr)
+			serveErr <- srv.ListenAndServe()
+		}()
+	}
+
+	select {
+	case err := <-serveErr:
+		if err != nil && err != http.ErrServerClosed {
+			fatal("server failed", "err", err)
+		}
+	case <-ctx.Done():
+		slog.Info("shutting down")
+	}
+
+	if err := closers.run(); err != nil {
+		slog.Error("shutdown incomplete", "err", err)
+	}
+}
+
+func openDB(ctx context.Context, cfg Config) (*sql.DB, error) {
+	connCfg, err := pgx.ParseConfig(buildDSN(cfg))
 	if err != nil {
-		log.Fatalf("open db: %v", err)
+		return nil, fmt.Errorf("open: %w", err)
+	}
+	if cfg.LogQueries {
+		connCfg.Tracer = newQueryLogger(cfg.LogQueriesRedact)
+	}
+	if cfg.RouteTimingMetrics {
+		connCfg.Tracer = &queryTimer{next: connCfg.Tracer}
+	}
+	var opts []stdlib.OptionOpenDB
+	if cfg.PrepareWarmup {
+		opts = append(opts, stdlib.OptionAfterConnect(warmStatements))
 	}
+	db := stdlib.OpenDB(*connCfg, opts...)
 
 	// Connection pool
-	db.SetMaxOpenConns(10)
-	db.SetMaxIdleConns(10)
-	db.SetConnMaxLifetime(30 * time.Minute)
-	db.SetConnMaxIdleTime(10 * time.Minute)
+	db.SetMaxOpenConns(cfg.DBMaxOpenConns)
+	db.SetMaxIdleConns(cfg.DBMaxIdleConns)
+	db.SetConnMaxLifetime(cfg.DBConnMaxLifetime)
+	db.SetConnMaxIdleTime(cfg.DBConnMaxIdleTime)
 
-	if err := pingWithTimeout(db, 10*time.Second); err != nil {
-		log.Fatalf("db ping: %v", err)
+	if err := pingWithRetry(ctx, db, cfg.DBPingTimeout, cfg.DBConnectMaxRetries, cfg.DBConnectBackoff); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("ping: %w", err)
 	}
+	return db, nil
+}
+
+// openAuditDB connects to AUDIT_DB_URL and checks that audit_log exists
+// there. The pool is small: auditWriter inserts one batch at a time.
+func openAuditDB(ctx context.Context, cfg Config) (*sql.DB, error) {
+	connCfg, err := pgx.ParseConfig(cfg.AuditDBURL)
+	if err != nil {
+		return nil, fmt.Errorf("open: %w", err)
+	}
+	db := stdlib.OpenDB(*connCfg)
+	db.SetMaxOpenConns(2)
+	db.SetConnMaxIdleTime(cfg.DBConnMaxIdleTime)
 
-	app := &App{DB: db}
+	if err := pingWithRetry(ctx, db, cfg.DBPingTimeout, cfg.DBConnectMaxRetries, cfg.DBConnectBackoff); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("ping: %w", err)
+	}
+	checkCtx, cancel := context.WithTimeout(ctx, cfg.QueryTimeout)
+	defer cancel()
+	if _, err := db.ExecContext(checkCtx, "SELECT 1 FROM audit_log LIMIT 0"); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("audit_log: %w", err)
+	}
+	return db, nil
+}
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("/", app.handleRoot)
-	mux.HandleFunc("/users", app.handleUsers)
-	mux.HandleFunc("/users/", app.handleUsers)
+// maxConnectBackoff caps the doubling wait between startup pings.
+const maxConnectBackoff = 30 * time.Second
 
-	srv := &http.Server{
-		Addr:              ":" + httpPort,
-		Handler:           mux,
-		ReadHeaderTimeout: 10 * time.Second,
+// pingWithRetry pings up to retries+1 times, each attempt bounded by
+// timeout on its own, so one hung ping can't use up the budget for the rest.
+func pingWithRetry(ctx context.Context, db *sql.DB, timeout time.Duration, retries int, backoff time.Duration) error {
+	wait := backoff
+	for attempt := 1; ; attempt++ {
+		err := pingWithTimeout(ctx, db, timeout)
+		if err == nil {
+			return nil
+		}
+		if attempt > retries {
+			return fmt.Errorf("after %d attempts: %w", attempt, err)
+		}
+		slog.Warn("database ping failed, retrying", "attempt", attempt, "retry_in", wait.String(), "err", err)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return fmt.Errorf("interrupted after %d attempts: %w", attempt, err)
+		}
+		wait = min(wait*2, maxConnectBackoff)
 	}
+}
 
-	log.Printf("Server listening on :%s", httpPort)
-	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-		log.Fatalf("server: %v", err)
+// buildDSN renders the Postgres DSN (pgx stdlib). DB_PARAMS entries are
+// appended, but never override the parameters set here.
+func buildDSN(cfg Config) string {
+	// NOTE: ใน Docker/local มักใช้ sslmode=disable
+	q := url.Values{"sslmode": {"disable"}}
+	for k, vs := range cfg.DBParams {
+		if _, set := q[k]; !set {
+			q[k] = vs
+		}
+	}
+	u := url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(cfg.DBUser, cfg.DBPassword),
+		Host:     net.JoinHostPort(cfg.DBHost, cfg.DBPort),
+		Path:     "/" + cfg.DBName,
+		RawQuery: q.Encode(),
 	}
+	return u.String()
 }
 
-func pingWithTimeout(db *sql.DB, d time.Duration) error {
-	ctx, cancel := context.WithTimeout(context.Background(), d)
+func pingWithTimeout(ctx context.Context, db *sql.DB, d time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, d)
 	defer cancel()
 	return db.PingContext(ctx)
 }
@@ -0,0 +1,369 @@
+// main_test.go
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestListUsersByEmails(t *testing.T) {
+	ta := newTestApp(t, nil)
+	ta.createUser(t, "ann", "ann@example.com")
+	ta.createUser(t, "bob", "bob@example.com")
+
+	rec := ta.do(t, http.MethodPost, "/users/by-emails",
+		`["ANN@example.com","nobody@example.com","bob@example.com","ann@example.com"]`)
+	wantStatus(t, rec, http.StatusOK)
+	body := jsonBody(t, rec)
+
+	var got []string
+	for _, u := range body["users"].([]any) {
+		got = append(got, u.(map[string]any)["username"].(string))
+	}
+	slices.Sort(got)
+	if !slices.Equal(got, []string{"ann", "bob"}) {
+		t.Fatalf("users = %v", got)
+	}
+	if nf := body["not_found"].([]any); len(nf) != 1 || nf[0] != "nobody@example.com" {
+		t.Fatalf("not_found = %v", nf)
+	}
+}
+
+func TestListUsersByEmailsRejectsBadInput(t *testing.T) {
+	ta := newTestApp(t, map[string]string{"MAX_BATCH_SIZE": "2"})
+	for name, body := range map[string]string{
+		"empty":         `[]`,
+		"invalid email": `["not-an-email"]`,
+		"over batch":    `["a@example.com","b@example.com","c@example.com"]`,
+		"not an array":  `{"emails":[]}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			wantStatus(t, ta.do(t, http.MethodPost, "/users/by-emails", body), http.StatusBadRequest)
+		})
+	}
+}
+
+func TestPoolExhaustedIsServiceUnavailable(t *testing.T) {
+	rec := httptest.NewRecorder()
+	writeDBError(rec, fmt.Errorf("get user: %w", errPoolExhausted))
+	wantStatus(t, rec, http.StatusServiceUnavailable)
+}
+
+func TestMalformedIDStatus(t *testing.T) {
+	for _, status := range []int{http.StatusBadRequest, http.StatusNotFound} {
+		ta := newTestApp(t, map[string]string{"MALFORMED_ID_STATUS": strconv.Itoa(status)})
+		for _, method := range []string{http.MethodGet, http.MethodPut, http.MethodDelete} {
+			t.Run(fmt.Sprintf("%d %s", status, method), func(t *testing.T) {
+				body := ""
+				if method == http.MethodPut {
+					body = `{"username":"ann","email":"ann@example.com"}`
+				}
+				wantStatus(t, ta.do(t, method, "/users/abc", body), status)
+			})
+		}
+	}
+}
+
+func TestRootBehavior(t *testing.T) {
+	ta := newTestApp(t, nil)
+	rec := ta.do(t, http.MethodGet, "/", "")
+	wantStatus(t, rec, http.StatusOK)
+	if jsonBody(t, rec)["message"] == nil {
+		t.Fatalf("no hello message: %s", rec.Body)
+	}
+
+	ta = newTestApp(t, map[string]string{"ROOT_BEHAVIOR": "notfound"})
+	wantStatus(t, ta.do(t, http.MethodGet, "/", ""), http.StatusNotFound)
+
+	ta = newTestApp(t, map[string]string{"ROOT_BEHAVIOR": "redirect:https://docs.example.com/api"})
+	rec = ta.do(t, http.MethodGet, "/", "")
+	wantStatus(t, rec, http.StatusFound)
+	if loc := rec.Header().Get("Location"); loc != "https://docs.example.com/api" {
+		t.Fatalf("Location = %q", loc)
+	}
+}
+
+func TestListUsersExplain(t *testing.T) {
+	ta := newTestApp(t, map[string]string{"DEBUG": "true", "ADMIN_TOKEN": "secret"})
+	rec := ta.do(t, http.MethodGet, "/users?explain=true&sort=-email&limit=5&offset=10", "")
+	wantStatus(t, rec, http.StatusOK)
+	body := jsonBody(t, rec)
+	query, args := body["sql"].(string), body["args"].([]any)
+	want := "SELECT user_id, username, email FROM users ORDER BY email DESC, user_id DESC LIMIT $1 OFFSET $2"
+	if query != want {
+		t.Fatalf("sql = %q, want %q", query, want)
+	}
+	if len(args) != 2 || args[0] != float64(5) || args[1] != float64(10) {
+		t.Fatalf("args = %v", args)
+	}
+
+	rec = ta.do(t, http.MethodGet, "/users?explain=true&cursor="+encodeCursor(7), "")
+	body = jsonBody(t, rec)
+	if got := body["sql"]; got != "SELECT user_id, username, email FROM users WHERE user_id > $1 ORDER BY user_id ASC LIMIT $2" {
+		t.Fatalf("cursor sql = %q", got)
+	}
+	if args := body["args"].([]any); len(args) != 2 {
+		t.Fatalf("cursor args = %v", args)
+	}
+}
+
+func TestListUsersExplainNeedsDebug(t *testing.T) {
+	ta := newTestApp(t, nil)
+	rec := ta.do(t, http.MethodGet, "/users?explain=true", "")
+	wantStatus(t, rec, http.StatusOK)
+	if _, ok := jsonBody(t, rec)["sql"]; ok {
+		t.Fatal("SQL exposed outside debug mode")
+	}
+}
+
+func TestRedactArgs(t *testing.T) {
+	got := redactArgs([]any{"ann@example.com", int32(3), 20})
+	if !slices.Equal(got, []any{"[redacted]", int32(3), 20}) {
+		t.Fatalf("redactArgs = %v", got)
+	}
+}
+
+func TestUsersTrailingSlashIsCollection(t *testing.T) {
+	ta := newTestApp(t, nil)
+	ta.createUser(t, "ann", "ann@example.com")
+	rec := ta.do(t, http.MethodGet, "/users/", "")
+	wantStatus(t, rec, http.StatusOK)
+	if users, _ := jsonBody(t, rec)["users"].([]any); len(users) != 1 {
+		t.Fatalf("GET /users/ = %s", rec.Body)
+	}
+	rec = ta.do(t, http.MethodDelete, "/users/", "")
+	wantStatus(t, rec, http.StatusMethodNotAllowed)
+	if allow := rec.Header().Get("Allow"); allow != "GET" {
+		t.Fatalf("Allow = %q", allow)
+	}
+}
+
+func TestListUsersPartialResponse(t *testing.T) {
+	slow := func() driver.Rows { return &userRows{n: 1000, delay: 5 * time.Millisecond} }
+	for _, partial := range []bool{true, false} {
+		t.Run(fmt.Sprint("partial=", partial), func(t *testing.T) {
+			ta := newTestApp(t, map[string]string{"PARTIAL_RESULTS": strconv.FormatBool(partial), "QUERY_TIMEOUT": "100ms"})
+			ta.Users.store = newRowsStore(t, slow)
+			rec := ta.do(t, http.MethodGet, "/users?limit=100", "")
+			if !partial {
+				if rec.Code == http.StatusOK {
+					t.Fatalf("timed-out list answered 200 without PARTIAL_RESULTS: %s", rec.Body)
+				}
+				return
+			}
+			wantStatus(t, rec, http.StatusOK)
+			body := jsonBody(t, rec)
+			users := body["users"].([]any)
+			if body["partial"] != true || len(users) == 0 || len(users) == 100 {
+				t.Fatalf("partial = %v with %d users", body["partial"], len(users))
+			}
+			last := int32(users[len(users)-1].(map[string]any)["user_id"].(float64))
+			if body["next_cursor"] != encodeCursor(last) {
+				t.Fatalf("next_cursor = %v, want cursor after %d", body["next_cursor"], last)
+			}
+		})
+	}
+}
+
+func TestListUsersIterationErrorIsServerError(t *testing.T) {
+	ta := newTestApp(t, nil)
+	ta.Users.store = newRowsStore(t, func() driver.Rows {
+		return &userRows{n: 3, err: errors.New("stub: malformed DataRow")}
+	})
+	wantStatus(t, ta.do(t, http.MethodGet, "/users", ""), http.StatusInternalServerError)
+}
+
+func TestIdenticalCreateReturnsOK(t *testing.T) {
+	ta := newTestApp(t, map[string]string{"IDENTICAL_CREATE_RETURNS_OK": "true"})
+	id := ta.createUser(t, "ann", "ann@example.com")
+
+	rec := ta.do(t, http.MethodPost, "/users", `{"username":"ann","email":"ann@example.com"}`)
+	wantStatus(t, rec, http.StatusOK)
+	if got := int32(jsonBody(t, rec)["user_id"].(float64)); got != id {
+		t.Fatalf("user_id = %d, want existing %d", got, id)
+	}
+
+	wantStatus(t, ta.do(t, http.MethodPost, "/users", `{"username":"annie","email":"ann@example.com"}`), http.StatusConflict)
+
+	ta = newTestApp(t, nil)
+	ta.createUser(t, "ann", "ann@example.com")
+	wantStatus(t, ta.do(t, http.MethodPost, "/users", `{"username":"ann","email":"ann@example.com"}`), http.StatusConflict)
+}
+
+// createErrStore fails every CreateUser with err.
+type createErrStore struct {
+	userStore
+	err error
+}
+
+func (s createErrStore) CreateUser(context.Context, string, string) (int32, error) { return 0, s.err }
+
+func TestCheckViolationIsClientError(t *testing.T) {
+	tests := []struct{ constraint, code string }{
+		{"users_email_check", "INVALID_EMAIL"},
+		{"users_username_check", "INVALID_USERNAME"},
+		{"users_future_check", "CONSTRAINT_VIOLATION"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.constraint, func(t *testing.T) {
+			ta := newTestApp(t, nil)
+			ta.Users.store = createErrStore{ta.Users.store, &checkViolationError{Constraint: tt.constraint}}
+			rec := ta.do(t, http.MethodPost, "/users", `{"username":"ann","email":"ann@example.com"}`)
+			wantStatus(t, rec, http.StatusBadRequest)
+			if got := jsonBody(t, rec)["code"]; got != tt.code {
+				t.Fatalf("code = %v, want %s", got, tt.code)
+			}
+		})
+	}
+}
+
+func TestNullFieldsPolicy(t *testing.T) {
+	legacy := func() driver.Rows {
+		return &valueRows{[][]driver.Value{{int64(1), "ann", nil}}}
+	}
+	tests := []struct {
+		policy string
+		want   string
+	}{
+		{"null", `{"user_id":1,"username":"ann","email":null}`},
+		{"empty", `{"user_id":1,"username":"ann","email":""}`},
+		{"omit", `{"user_id":1,"username":"ann"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			ta := newTestApp(t, map[string]string{"NULL_FIELDS": tt.policy})
+			ta.Users.store = newRowsStore(t, legacy)
+			rec := ta.do(t, http.MethodGet, "/users/1", "")
+			wantStatus(t, rec, http.StatusOK)
+			if got := strings.TrimSpace(rec.Body.String()); got != tt.want {
+				t.Fatalf("get = %s, want %s", got, tt.want)
+			}
+			rec = ta.do(t, http.MethodGet, "/users", "")
+			wantStatus(t, rec, http.StatusOK)
+			if !strings.Contains(rec.Body.String(), `"users":[`+tt.want+`]`) {
+				t.Fatalf("list = %s", rec.Body)
+			}
+		})
+	}
+}
+
+func TestCreateReturnsBody(t *testing.T) {
+	ta := newTestApp(t, nil)
+	rec := ta.do(t, http.MethodPost, "/users", `{"username":"ann","email":"ann@example.com"}`)
+	wantStatus(t, rec, http.StatusCreated)
+	id := int32(jsonBody(t, rec)["user_id"].(float64))
+	if loc := rec.Header().Get("Location"); loc != "/users/"+strconv.Itoa(int(id)) {
+		t.Fatalf("Location = %q", loc)
+	}
+
+	ta = newTestApp(t, map[string]string{"CREATE_RETURNS_BODY": "false"})
+	rec = ta.do(t, http.MethodPost, "/users", `{"username":"ann","email":"ann@example.com"}`)
+	wantStatus(t, rec, http.StatusCreated)
+	if rec.Body.Len() != 0 {
+		t.Fatalf("body = %q, want empty", rec.Body)
+	}
+	if loc := rec.Header().Get("Location"); loc != "/users/1" {
+		t.Fatalf("Location = %q", loc)
+	}
+
+	// A replayed empty 201 still says where the user is.
+	first := ta.do(t, http.MethodPost, "/users", `{"username":"bob","email":"bob@example.com"}`, "Idempotency-Key", "k1")
+	again := ta.do(t, http.MethodPost, "/users", `{"username":"bob","email":"bob@example.com"}`, "Idempotency-Key", "k1")
+	wantStatus(t, again, http.StatusCreated)
+	if again.Header().Get("Idempotent-Replayed") != "true" || again.Body.Len() != 0 {
+		t.Fatalf("replay = %q, replayed %q", again.Body, again.Header().Get("Idempotent-Replayed"))
+	}
+	if loc := again.Header().Get("Location"); loc == "" || loc != first.Header().Get("Location") {
+		t.Fatalf("replayed Location = %q, want %q", loc, first.Header().Get("Location"))
+	}
+}
+
+func TestLookupUser(t *testing.T) {
+	ta := newTestApp(t, map[string]string{"USER_ETAGS": "true"})
+	id := ta.createUser(t, "ann", "Ann@Example.com")
+	tests := []struct {
+		name, query string
+		status      int
+		code        string
+	}{
+		{"id", "id=" + strconv.Itoa(int(id)), http.StatusOK, ""},
+		{"email", "email=ann@example.com", http.StatusOK, ""},
+		{"neither", "", http.StatusBadRequest, "INVALID_LOOKUP"},
+		{"both", "id=1&email=ann@example.com", http.StatusBadRequest, "INVALID_LOOKUP"},
+		{"empty email still counts", "id=1&email=", http.StatusBadRequest, "INVALID_LOOKUP"},
+		{"bad id", "id=abc", http.StatusBadRequest, ""},
+		{"bad email", "email=nope", http.StatusBadRequest, ""},
+		{"unknown id", "id=999", http.StatusNotFound, ""},
+		{"unknown email", "email=bob@example.com", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := ta.do(t, http.MethodGet, "/users/lookup?"+tt.query, "")
+			wantStatus(t, rec, tt.status)
+			body := jsonBody(t, rec)
+			if tt.status == http.StatusOK && body["user_id"] != float64(id) {
+				t.Fatalf("body = %v", body)
+			}
+			if tt.code != "" && body["code"] != tt.code {
+				t.Fatalf("code = %v, want %s", body["code"], tt.code)
+			}
+		})
+	}
+
+	// The lookup answers like GET /users/{id}, ETag included.
+	get := ta.do(t, http.MethodGet, "/users/"+strconv.Itoa(int(id)), "")
+	etag := get.Header().Get("ETag")
+	if rec := ta.do(t, http.MethodGet, "/users/lookup?email=ann@example.com", ""); rec.Header().Get("ETag") != etag || rec.Body.String() != get.Body.String() {
+		t.Fatalf("lookup = %s %q, GET = %s %q", rec.Body, rec.Header().Get("ETag"), get.Body, etag)
+	}
+	wantStatus(t, ta.do(t, http.MethodGet, "/users/lookup?email=ann@example.com", "", "If-None-Match", etag), http.StatusNotModified)
+	wantStatus(t, ta.do(t, http.MethodPost, "/users/lookup", "{}"), http.StatusMethodNotAllowed)
+}
+
+// failingMarshaler can't be encoded.
+type failingMarshaler struct{}
+
+func (failingMarshaler) MarshalJSON() ([]byte, error) { return nil, errors.New("stub: cannot marshal") }
+
+func TestJSONWriteEncodingFailure(t *testing.T) {
+	out := captureDefaultLog(t)
+	for name, v := range map[string]any{
+		"channel":   map[string]any{"c": make(chan int)},
+		"NaN":       map[string]float64{"score": math.NaN()},
+		"marshaler": []any{failingMarshaler{}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			jsonWrite(rec, http.StatusBadRequest, v)
+			wantStatus(t, rec, http.StatusInternalServerError)
+			if rec.Body.String() != string(encodeFailureBody) || rec.Header().Get("Content-Type") != "application/json" {
+				t.Fatalf("response = %q %q", rec.Header().Get("Content-Type"), rec.Body)
+			}
+		})
+	}
+	lines := logLines(t, out)
+	if len(lines) != 3 || lines[0]["level"] != "ERROR" || lines[0]["status"] != float64(http.StatusBadRequest) {
+		t.Fatalf("log = %v", lines)
+	}
+
+	// The fallback is plain JSON even when the response would have been a
+	// problem document.
+	h := negotiateProblems(true, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		jsonWrite(w, http.StatusNotFound, map[string]any{"error": "x", "c": make(chan int)})
+	}))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusInternalServerError || rec.Header().Get("Content-Type") != "application/json" || rec.Body.String() != string(encodeFailureBody) {
+		t.Fatalf("problem response = %d %q %q", rec.Code, rec.Header().Get("Content-Type"), rec.Body)
+	}
+}
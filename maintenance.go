@@ -0,0 +1,45 @@
+// maintenance.go
+package main
+
+import "net/http"
+
+const componentMaintenance = "maintenance"
+
+// maintenanceGate answers user-facing requests with 503 while maintenance
+// mode holds the readiness gate closed. Ops paths and admin routes (matched
+// against admin) stay reachable so operators can watch and end the window.
+func (a *App) maintenanceGate(admin *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !a.Ready.closedBy(componentMaintenance) || opsPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if _, pattern := admin.Handler(r); pattern != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		a.Config.RetryAfterFormat.set(w.Header(), a.Config.MaintenanceRetryAfter)
+		jsonWrite(w, http.StatusServiceUnavailable, map[string]any{
+			"error":       "Service under maintenance",
+			"code":        "MAINTENANCE",
+			"message":     a.Config.MaintenanceMessage,
+			"retry_after": int(a.Config.MaintenanceRetryAfter.Seconds()),
+		})
+	})
+}
+
+// maintenanceMode reports (GET), enters (PUT) or leaves (DELETE) maintenance
+// mode.
+func (a *App) maintenanceMode(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		a.Ready.setNotReady(componentMaintenance, "maintenance")
+	case http.MethodDelete:
+		a.Ready.setReady(componentMaintenance)
+	default:
+		writeMethodNotAllowed(w, http.MethodGet, http.MethodPut, http.MethodDelete)
+		return
+	}
+	jsonWrite(w, http.StatusOK, map[string]bool{"maintenance": a.Ready.closedBy(componentMaintenance)})
+}
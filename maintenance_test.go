@@ -0,0 +1,55 @@
+// maintenance_test.go
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestMaintenanceMode(t *testing.T) {
+	ta := newTestApp(t, map[string]string{
+		"MAINTENANCE_MODE":        "true",
+		"MAINTENANCE_MESSAGE":     "Back at 06:00 UTC",
+		"MAINTENANCE_RETRY_AFTER": "10m",
+		"ADMIN_TOKEN":             "secret",
+	})
+
+	rec := ta.do(t, http.MethodGet, "/users", "")
+	wantStatus(t, rec, http.StatusServiceUnavailable)
+	if got := rec.Header().Get("Retry-After"); got != "600" {
+		t.Errorf("Retry-After = %q", got)
+	}
+	body := jsonBody(t, rec)
+	if body["code"] != "MAINTENANCE" || body["message"] != "Back at 06:00 UTC" || body["retry_after"] != 600.0 {
+		t.Errorf("body = %v", body)
+	}
+
+	// Health and admin routes stay reachable.
+	wantStatus(t, ta.do(t, http.MethodGet, "/livez", ""), http.StatusOK)
+	wantStatus(t, ta.do(t, http.MethodGet, "/healthz", ""), http.StatusServiceUnavailable)
+	wantStatus(t, ta.do(t, http.MethodGet, "/users/stats", "", adminAuth...), http.StatusOK)
+
+	// Leaving maintenance reopens the user endpoints.
+	wantStatus(t, ta.do(t, http.MethodDelete, "/maintenance", "", adminAuth...), http.StatusOK)
+	wantStatus(t, ta.do(t, http.MethodGet, "/users", ""), http.StatusOK)
+	wantStatus(t, ta.do(t, http.MethodPut, "/maintenance", "", adminAuth...), http.StatusOK)
+	wantStatus(t, ta.do(t, http.MethodGet, "/users", ""), http.StatusServiceUnavailable)
+}
+
+func TestMaintenanceRetryAfterHTTPDate(t *testing.T) {
+	ta := newTestApp(t, map[string]string{
+		"MAINTENANCE_MODE":        "true",
+		"MAINTENANCE_RETRY_AFTER": "10m",
+		"RETRY_AFTER_FORMAT":      "http-date",
+	})
+	rec := ta.do(t, http.MethodGet, "/users", "")
+	wantStatus(t, rec, http.StatusServiceUnavailable)
+	at, err := http.ParseTime(rec.Header().Get("Retry-After"))
+	if err != nil {
+		t.Fatalf("Retry-After = %q: %v", rec.Header().Get("Retry-After"), err)
+	}
+	if wait := time.Until(at); wait < 9*time.Minute || wait > 11*time.Minute {
+		t.Fatalf("Retry-After is %v away, want 10m", wait)
+	}
+}
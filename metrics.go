@@ -0,0 +1,47 @@
+// metrics.go
+package main
+
+import (
+	"slices"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var eventsDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "events_dropped_total",
+	Help: "Events dropped by the in-process event hub, by reason.",
+}, []string{"reason"})
+
+var rateLimiterErrors = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "rate_limiter_errors_total",
+	Help: "Requests for which the rate limiter failed and RATE_LIMIT_FAIL_POLICY applied.",
+})
+
+// validationReasons is the closed label set for validationFailures; anything
+// else is recorded as "other" to keep cardinality bounded.
+var validationReasons = []string{
+	"empty_username", "username_too_short", "username_too_long",
+	"empty_email", "email_too_long", "invalid_email", "duplicate_email",
+	"duplicate_username", "unresolvable_email_domain", "username_equals_email",
+	"invalid_json", "corrupt_body", "body_too_large", "value_out_of_range",
+	"type_mismatch", "too_many_tokens", "other",
+}
+
+var validationFailures = func() *prometheus.CounterVec {
+	c := promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "validation_failures_total",
+		Help: "Client requests rejected by validation, by reason.",
+	}, []string{"reason"})
+	for _, r := range validationReasons {
+		c.WithLabelValues(r)
+	}
+	return c
+}()
+
+func recordValidationFailure(reason string) {
+	if !slices.Contains(validationReasons, reason) {
+		reason = "other"
+	}
+	validationFailures.WithLabelValues(reason).Inc()
+}
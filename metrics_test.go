@@ -0,0 +1,46 @@
+// metrics_test.go
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// failuresDelta runs f and reports how much validation_failures_total rose
+// for reason.
+func failuresDelta(reason string, f func()) float64 {
+	c := validationFailures.WithLabelValues(reason)
+	before := testutil.ToFloat64(c)
+	f()
+	return testutil.ToFloat64(c) - before
+}
+
+func TestValidationFailuresCounted(t *testing.T) {
+	ta := newTestApp(t, map[string]string{"MAX_BODY_BYTES": "256"})
+	ta.createUser(t, "ann", "ann@example.com")
+	tests := []struct {
+		reason, body string
+	}{
+		{"invalid_email", `{"username":"bob","email":"bob"}`},
+		{"empty_username", `{"username":"","email":"bob@example.com"}`},
+		{"duplicate_email", `{"username":"ann2","email":"ann@example.com"}`},
+		{"invalid_json", `{"username":`},
+		{"body_too_large", `{"username":"` + strings.Repeat("a", 256) + `"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.reason, func(t *testing.T) {
+			if n := failuresDelta(tt.reason, func() { ta.do(t, http.MethodPost, "/users", tt.body) }); n != 1 {
+				t.Fatalf("%s rose by %v, want 1", tt.reason, n)
+			}
+		})
+	}
+}
+
+func TestValidationFailureReasonsBounded(t *testing.T) {
+	if n := failuresDelta("other", func() { recordValidationFailure("password_in_username") }); n != 1 {
+		t.Fatalf("unknown reason not folded into other")
+	}
+}
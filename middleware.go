@@ -0,0 +1,209 @@
+// middleware.go
+package main
+
+import (
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// opsPaths are infrastructure endpoints that must keep working regardless of
+// user-facing policies (probes and scrapers don't follow redirects).
+var opsPaths = map[string]bool{
+	"/healthz": true,
+	"/livez":   true,
+	"/metrics": true,
+}
+
+type trustedProxies []netip.Prefix
+
+func (t trustedProxies) contains(addr netip.Addr) bool {
+	for _, p := range t {
+		if p.Contains(addr.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteAddr returns the IP of the direct peer, ignoring any forwarding headers.
+func remoteAddr(r *http.Request) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	return addr, err == nil
+}
+
+// clientIP returns the address of the client behind any trusted proxies.
+// The forwarding header (X-Forwarded-For unless configured otherwise) is
+// only read when the direct peer is trusted, and is scanned right to left:
+// each trusted proxy appends the address it received from, so the first
+// untrusted entry is the client, and anything further left is whatever that
+// client claimed and is ignored. If every hop is trusted, the leftmost one
+// wins; an unparsable entry stops the scan at the last good hop.
+func clientIP(r *http.Request, trusted trustedProxies, header string) (netip.Addr, bool) {
+	addr, ok := remoteAddr(r)
+	if !ok || !trusted.contains(addr) {
+		return addr, ok
+	}
+	var hops []string
+	for _, v := range r.Header.Values(header) {
+		hops = append(hops, strings.Split(v, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, ok := parseHop(strings.TrimSpace(hops[i]))
+		if !ok {
+			break
+		}
+		addr = hop
+		if !trusted.contains(hop) {
+			break
+		}
+	}
+	return addr, true
+}
+
+// parseHop accepts "ip", "ip:port" and "[ipv6]:port".
+func parseHop(s string) (netip.Addr, bool) {
+	if addr, err := netip.ParseAddr(s); err == nil {
+		return addr.Unmap(), true
+	}
+	if ap, err := netip.ParseAddrPort(s); err == nil {
+		return ap.Addr().Unmap(), true
+	}
+	return netip.Addr{}, false
+}
+
+// forceHTTPS redirects plain-HTTP requests to https://. X-Forwarded-Proto is
+// only honoured when the direct peer is a trusted proxy.
+func forceHTTPS(trusted trustedProxies, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if opsPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		if peer, ok := remoteAddr(r); ok && trusted.contains(peer) {
+			if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+				scheme = strings.ToLower(strings.TrimSpace(strings.Split(proto, ",")[0]))
+			}
+		}
+
+		if scheme == "http" {
+			http.Redirect(w, r, "https://"+r.Host+r.URL.RequestURI(), http.StatusMovedPermanently)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// duplicateSlashes collapses repeated slashes in the path (/users//1 is
+// served as /users/1) or, with reject set, answers them with 400. A
+// single trailing slash is kept, since /users/ and /users differ.
+func duplicateSlashes(reject bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.URL.Path, "//") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if reject {
+			jsonWrite(w, http.StatusBadRequest, map[string]string{
+				"error": "path must not contain repeated slashes",
+				"code":  "INVALID_PATH",
+			})
+			return
+		}
+		r2 := new(http.Request)
+		*r2 = *r
+		u := *r.URL
+		u.Path = collapseSlashes(u.Path)
+		if u.RawPath != "" {
+			u.RawPath = collapseSlashes(u.RawPath)
+		}
+		r2.URL = &u
+		next.ServeHTTP(w, r2)
+	})
+}
+
+func collapseSlashes(p string) string {
+	var b strings.Builder
+	b.Grow(len(p))
+	for i := 0; i < len(p); i++ {
+		if p[i] == '/' && i > 0 && p[i-1] == '/' {
+			continue
+		}
+		b.WriteByte(p[i])
+	}
+	return b.String()
+}
+
+// rejectGetBody answers 400 when a GET, HEAD or DELETE request carries a
+// body (REJECT_GET_BODY). A chunked body has no length up front, so a
+// one-byte read tells; an empty one loses nothing to it.
+func rejectGetBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodDelete:
+		default:
+			next.ServeHTTP(w, r)
+			return
+		}
+		hasBody := r.ContentLength > 0
+		if r.ContentLength < 0 {
+			var probe [1]byte
+			n, _ := io.ReadFull(r.Body, probe[:])
+			hasBody = n > 0
+		}
+		if hasBody {
+			jsonWrite(w, http.StatusBadRequest, map[string]string{
+				"error": r.Method + " requests must not have a body",
+				"code":  "UNEXPECTED_BODY",
+			})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// retryAfterFormat is how Retry-After values are written
+// (RETRY_AFTER_FORMAT): delta-seconds or an HTTP-date.
+type retryAfterFormat string
+
+const (
+	retryAfterSeconds  retryAfterFormat = "seconds"
+	retryAfterHTTPDate retryAfterFormat = "http-date"
+)
+
+// set writes Retry-After for a wait of d. Seconds round up and are at
+// least 1, so a client never retries immediately.
+func (f retryAfterFormat) set(h http.Header, d time.Duration) {
+	secs := max(1, int(math.Ceil(d.Seconds())))
+	if f == retryAfterHTTPDate {
+		h.Set("Retry-After", time.Now().Add(time.Duration(secs)*time.Second).UTC().Format(http.TimeFormat))
+		return
+	}
+	h.Set("Retry-After", strconv.Itoa(secs))
+}
+
+// limitQueryParams rejects requests carrying more than max distinct query
+// parameters, a cheap guard against parameter pollution.
+func limitQueryParams(max int, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.RawQuery != "" && len(r.URL.Query()) > max {
+			jsonWrite(w, http.StatusBadRequest, map[string]string{"error": "too many query parameters"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
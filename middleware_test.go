@@ -0,0 +1,175 @@
+// middleware_test.go
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// httptest requests come from 192.0.2.1.
+var forceHTTPSEnv = map[string]string{"FORCE_HTTPS": "true", "TRUSTED_PROXIES": "192.0.2.0/24"}
+
+func TestForceHTTPSRedirectsForwardedHTTP(t *testing.T) {
+	ta := newTestApp(t, forceHTTPSEnv)
+	rec := ta.do(t, http.MethodGet, "/users/1?x=1", "", "X-Forwarded-Proto", "http")
+	wantStatus(t, rec, http.StatusMovedPermanently)
+	if loc := rec.Header().Get("Location"); loc != "https://example.com/users/1?x=1" {
+		t.Fatalf("Location = %q", loc)
+	}
+}
+
+func TestForceHTTPSPassesForwardedHTTPS(t *testing.T) {
+	ta := newTestApp(t, forceHTTPSEnv)
+	id, err := ta.Store.CreateUser(context.Background(), "ann", "ann@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantStatus(t, ta.do(t, http.MethodGet, fmt.Sprintf("/users/%d", id), "", "X-Forwarded-Proto", "https"), http.StatusOK)
+}
+
+func TestForceHTTPSIgnoresUntrustedProxy(t *testing.T) {
+	ta := newTestApp(t, map[string]string{"FORCE_HTTPS": "true", "TRUSTED_PROXIES": "10.0.0.0/8"})
+	wantStatus(t, ta.do(t, http.MethodGet, "/users/1", "", "X-Forwarded-Proto", "https"), http.StatusMovedPermanently)
+}
+
+func TestForceHTTPSExemptsOpsPaths(t *testing.T) {
+	ta := newTestApp(t, forceHTTPSEnv)
+	for _, path := range []string{"/healthz", "/livez", "/metrics"} {
+		if rec := ta.do(t, http.MethodGet, path, "", "X-Forwarded-Proto", "http"); rec.Code == http.StatusMovedPermanently {
+			t.Errorf("%s redirected", path)
+		}
+	}
+}
+
+func TestMaxQueryParams(t *testing.T) {
+	ta := newTestApp(t, map[string]string{"MAX_QUERY_PARAMS": "3"})
+	wantStatus(t, ta.do(t, http.MethodGet, "/users?limit=1&offset=0&sort=email", ""), http.StatusOK)
+	// Repeats of one name count once.
+	wantStatus(t, ta.do(t, http.MethodGet, "/users?limit=1&limit=2&limit=3&limit=4", ""), http.StatusOK)
+	wantStatus(t, ta.do(t, http.MethodGet, "/users?a=1&b=2&c=3&d=4", ""), http.StatusBadRequest)
+}
+
+func TestClientIPWalksForwardedChain(t *testing.T) {
+	trusted := trustedProxies{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("192.0.2.0/24")}
+	tests := []struct {
+		name, remote string
+		xff          []string
+		want         string
+	}{
+		{"no header", "192.0.2.1:1234", nil, "192.0.2.1"},
+		{"one hop", "192.0.2.1:1234", []string{"203.0.113.7"}, "203.0.113.7"},
+		{"spoofed left entries", "192.0.2.1:1234", []string{"1.2.3.4, 5.6.7.8, 203.0.113.7, 10.0.0.5"}, "203.0.113.7"},
+		{"split across headers", "192.0.2.1:1234", []string{"1.2.3.4", "203.0.113.7, 10.0.0.5"}, "203.0.113.7"},
+		{"all trusted", "192.0.2.1:1234", []string{"10.0.0.9, 10.0.0.5"}, "10.0.0.9"},
+		{"garbage stops the scan", "192.0.2.1:1234", []string{"1.2.3.4, not-an-ip, 10.0.0.5"}, "10.0.0.5"},
+		{"with ports", "192.0.2.1:1234", []string{"[2001:db8::1]:443, 10.0.0.5:80"}, "2001:db8::1"},
+		{"untrusted peer", "198.51.100.9:1234", []string{"203.0.113.7"}, "198.51.100.9"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remote
+			for _, v := range tt.xff {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			got, ok := clientIP(r, trusted, "X-Forwarded-For")
+			if !ok || got.String() != tt.want {
+				t.Fatalf("clientIP = %v, %v; want %s", got, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestRateLimitKeysOnForwardedClient(t *testing.T) {
+	ta := newTestApp(t, map[string]string{"TRUSTED_PROXIES": "192.0.2.0/24", "RATE_LIMIT_RPS": "0.01", "RATE_LIMIT_BURST": "1"})
+	wantStatus(t, ta.do(t, http.MethodGet, "/users", "", "X-Forwarded-For", "203.0.113.7"), http.StatusOK)
+	// Spoofing a leftmost entry doesn't buy a fresh bucket.
+	wantStatus(t, ta.do(t, http.MethodGet, "/users", "", "X-Forwarded-For", "1.2.3.4, 203.0.113.7"), http.StatusTooManyRequests)
+	wantStatus(t, ta.do(t, http.MethodGet, "/users", "", "X-Forwarded-For", "203.0.113.8"), http.StatusOK)
+}
+
+func TestDuplicateSlashes(t *testing.T) {
+	ta := newTestApp(t, map[string]string{"DUPLICATE_SLASHES": "collapse"})
+	id := ta.createUser(t, "ann", "ann@example.com")
+	rec := ta.do(t, http.MethodGet, "/users//"+strconv.Itoa(int(id)), "")
+	wantStatus(t, rec, http.StatusOK)
+	if got := jsonBody(t, rec)["username"]; got != "ann" {
+		t.Fatalf("/users//id = %s", rec.Body)
+	}
+	rec = ta.do(t, http.MethodGet, "//users", "")
+	wantStatus(t, rec, http.StatusOK)
+	if _, ok := jsonBody(t, rec)["users"]; !ok {
+		t.Fatalf("//users = %s", rec.Body)
+	}
+	// The trailing slash survives, so //users// is still the collection.
+	wantStatus(t, ta.do(t, http.MethodDelete, "//users//", ""), http.StatusMethodNotAllowed)
+
+	ta = newTestApp(t, map[string]string{"DUPLICATE_SLASHES": "reject"})
+	for _, path := range []string{"/users//1", "//users"} {
+		rec := ta.do(t, http.MethodGet, path, "")
+		wantStatus(t, rec, http.StatusBadRequest)
+		if got := jsonBody(t, rec)["code"]; got != "INVALID_PATH" {
+			t.Fatalf("%s code = %v", path, got)
+		}
+	}
+	wantStatus(t, ta.do(t, http.MethodGet, "/users", ""), http.StatusOK)
+
+	// By default the mux redirects to the cleaned path.
+	ta = newTestApp(t, nil)
+	rec = ta.do(t, http.MethodGet, "/users//1", "")
+	wantStatus(t, rec, http.StatusTemporaryRedirect)
+	if loc := rec.Header().Get("Location"); loc != "/users/1" {
+		t.Fatalf("Location = %q", loc)
+	}
+}
+
+func TestCollapseSlashes(t *testing.T) {
+	for in, want := range map[string]string{
+		"//users":   "/users",
+		"/users//1": "/users/1",
+		"/users///": "/users/",
+		"/users/1":  "/users/1",
+		"///":       "/",
+	} {
+		if got := collapseSlashes(in); got != want {
+			t.Errorf("collapseSlashes(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestRejectGetBody(t *testing.T) {
+	ta := newTestApp(t, map[string]string{"REJECT_GET_BODY": "true"})
+	id := strconv.Itoa(int(ta.createUser(t, "ann", "ann@example.com")))
+	for _, method := range []string{http.MethodGet, http.MethodHead, http.MethodDelete} {
+		rec := ta.do(t, method, "/users/"+id, `{"username":"x"}`)
+		wantStatus(t, rec, http.StatusBadRequest)
+		if method != http.MethodHead {
+			if got := jsonBody(t, rec)["code"]; got != "UNEXPECTED_BODY" {
+				t.Fatalf("%s code = %v", method, got)
+			}
+		}
+	}
+
+	// Without a length, a probe read decides.
+	chunked := func(body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/users/"+id, strings.NewReader(body))
+		r.ContentLength = -1
+		rec := httptest.NewRecorder()
+		ta.handler.ServeHTTP(rec, r)
+		return rec
+	}
+	wantStatus(t, chunked(`{"username":"x"}`), http.StatusBadRequest)
+	wantStatus(t, chunked(""), http.StatusOK)
+
+	wantStatus(t, ta.do(t, http.MethodGet, "/users/"+id, ""), http.StatusOK)
+	wantStatus(t, ta.do(t, http.MethodPut, "/users/"+id, `{"username":"annie","email":"ann@example.com"}`), http.StatusOK)
+
+	ta = newTestApp(t, nil)
+	wantStatus(t, ta.do(t, http.MethodGet, "/users", `{"username":"x"}`), http.StatusOK)
+}
@@ -0,0 +1,109 @@
+// migrate.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"sort"
+	"strings"
+)
+
+// Migrations are applied in file name order; give them a zero-padded
+// numeric prefix (0003_add_x.sql). Never edit one that has shipped.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLockID is the advisory lock key serializing concurrent runners,
+// e.g. several replicas starting at once.
+const migrationLockID = 7305_2001
+
+// runMigrations applies pending migrations (RUN_MIGRATIONS=true). Each runs
+// in its own transaction together with its schema_migrations row, so a
+// failure leaves both the schema and the tracking table at the previous
+// version.
+func runMigrations(ctx context.Context, db *sql.DB) error {
+	c, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if _, err := c.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLockID); err != nil {
+		return fmt.Errorf("lock: %w", err)
+	}
+	defer c.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", migrationLockID)
+
+	if _, err := c.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS public.schema_migrations (
+		version TEXT PRIMARY KEY,
+		applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`); err != nil {
+		return fmt.Errorf("create schema_migrations: %w", err)
+	}
+
+	applied, err := appliedMigrations(ctx, c)
+	if err != nil {
+		return err
+	}
+	names, err := fs.Glob(migrationFiles, "migrations/*.sql")
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		version := strings.TrimSuffix(strings.TrimPrefix(name, "migrations/"), ".sql")
+		if applied[version] {
+			continue
+		}
+		body, err := migrationFiles.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		if err := applyMigration(ctx, c, version, string(body)); err != nil {
+			return fmt.Errorf("migration %s: %w", version, err)
+		}
+		slog.Info("applied migration", "version", version)
+	}
+	return nil
+}
+
+func appliedMigrations(ctx context.Context, c *sql.Conn) (applied map[string]bool, err error) {
+	rows, err := c.QueryContext(ctx, "SELECT version FROM public.schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer closeRows(rows, &err)
+
+	applied = make(map[string]bool)
+	for rows.Next() {
+		var v string
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		applied[v] = true
+	}
+	return applied, rows.Err()
+}
+
+func applyMigration(ctx context.Context, c *sql.Conn, version, body string) error {
+	tx, err := c.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// No bind arguments, so pgx sends the file as one simple-protocol
+	// query and multi-statement migrations work.
+	if _, err := tx.ExecContext(ctx, body); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO public.schema_migrations (version) VALUES ($1)", version); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,80 @@
+// migrate_test.go
+package main
+
+import (
+	"context"
+	"io/fs"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestMigrationFilesNamed(t *testing.T) {
+	names, err := fs.Glob(migrationFiles, "migrations/*.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) < 2 {
+		t.Fatalf("embedded migrations = %v", names)
+	}
+	valid := regexp.MustCompile(`^migrations/\d{4}_[a-z0-9_]+\.sql$`)
+	seen := map[string]bool{}
+	for _, name := range names {
+		if !valid.MatchString(name) {
+			t.Errorf("%s: want migrations/NNNN_name.sql", name)
+		}
+		prefix := strings.TrimPrefix(name, "migrations/")[:4]
+		if seen[prefix] {
+			t.Errorf("%s: duplicate version prefix %s", name, prefix)
+		}
+		seen[prefix] = true
+	}
+}
+
+func TestRunMigrationsRequiresPostgres(t *testing.T) {
+	if err := loadConfigErr(t, map[string]string{"STORAGE": "memory", "RUN_MIGRATIONS": "true"}); !strings.Contains(err.Error(), "RUN_MIGRATIONS") {
+		t.Fatal(err)
+	}
+}
+
+func TestRunMigrationsIdempotent(t *testing.T) {
+	db := testDB(t) // has applied every migration once
+	ctx := context.Background()
+	if err := runMigrations(ctx, db); err != nil {
+		t.Fatalf("re-run: %v", err)
+	}
+
+	rows, err := db.QueryContext(ctx, "SELECT version FROM public.schema_migrations ORDER BY version")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var applied []string
+	for rows.Next() {
+		var v string
+		if err := rows.Scan(&v); err != nil {
+			t.Fatal(err)
+		}
+		applied = append(applied, v)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	names, _ := fs.Glob(migrationFiles, "migrations/*.sql")
+	var want []string
+	for _, name := range names {
+		want = append(want, strings.TrimSuffix(strings.TrimPrefix(name, "migrations/"), ".sql"))
+	}
+	slices.Sort(want)
+	if !slices.Equal(applied, want) {
+		t.Fatalf("schema_migrations = %v, want each of %v once", applied, want)
+	}
+	for _, table := range []string{"users", "idempotency_keys"} {
+		var name *string
+		if err := db.QueryRowContext(ctx, "SELECT to_regclass($1)::text", "public."+table).Scan(&name); err != nil || name == nil {
+			t.Errorf("table %s missing: %v", table, err)
+		}
+	}
+}
@@ -0,0 +1,3 @@
+-- Emails are unique ignoring case; the API maps violations to 409. Fails
+-- if existing rows already collide, which have to be resolved by hand.
+CREATE UNIQUE INDEX IF NOT EXISTS users_email_key ON public.users (lower(email));
@@ -0,0 +1,9 @@
+-- Used when IDEMPOTENCY_STORE=db; status is NULL while the first request runs.
+CREATE TABLE IF NOT EXISTS public.idempotency_keys (
+  idempotency_key VARCHAR(255) PRIMARY KEY,
+  body_hash CHAR(64) NOT NULL,
+  status INT,
+  content_type TEXT,
+  body BYTEA,
+  created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,2 @@
+-- Replays restore the Location header of a create.
+ALTER TABLE public.idempotency_keys ADD COLUMN IF NOT EXISTS location TEXT;
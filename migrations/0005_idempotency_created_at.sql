@@ -0,0 +1,2 @@
+-- Lets the purger find old records without a full scan.
+CREATE INDEX IF NOT EXISTS idempotency_keys_created_at_idx ON public.idempotency_keys (created_at);
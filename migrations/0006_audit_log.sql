@@ -0,0 +1,12 @@
+-- Used when AUDIT_LOG=true: one row per user created, updated or deleted.
+-- With AUDIT_DB_URL the table must also exist in that database, which
+-- migrations don't touch. occurred_at is set by the API, not the insert.
+CREATE TABLE IF NOT EXISTS public.audit_log (
+  id BIGINT GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+  action TEXT NOT NULL,
+  user_id INT NOT NULL,
+  request_id TEXT,
+  occurred_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS audit_log_user_id_idx ON public.audit_log (user_id);
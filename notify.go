@@ -0,0 +1,222 @@
+// notify.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxJobFailures is how many recent failed deliveries GET /admin/jobs lists.
+const maxJobFailures = 20
+
+// Notifier is told about committed user changes, e.g. to send a welcome
+// email. Implementations must not block the request: failures are theirs to
+// log, never the caller's to handle.
+type Notifier interface {
+	UserCreated(u User)
+}
+
+type noopNotifier struct{}
+
+func (noopNotifier) UserCreated(User) {}
+
+// webhookNotifier POSTs events to a URL in the background, retrying with
+// exponential backoff.
+type webhookNotifier struct {
+	url     string
+	client  *http.Client
+	retries int
+	backoff time.Duration
+	slots   backgroundSlots
+
+	ctx context.Context // cancelled on shutdown to abandon retries
+
+	// mu guards the queue state, so that a delivery is either accepted before
+	// draining starts and waited for, or dropped. pending counts accepted
+	// deliveries not yet finished; idle is closed whenever it is zero.
+	mu       sync.Mutex
+	pending  int
+	idle     chan struct{}
+	draining bool
+
+	// Reported by GET /admin/jobs: deliveries holding a slot right now.
+	posting  atomic.Int64
+	failMu   sync.Mutex
+	failures []jobFailure
+}
+
+type jobFailure struct {
+	Time     time.Time `json:"time"`
+	Type     string    `json:"type"`
+	Attempts int       `json:"attempts"`
+	Error    string    `json:"error"`
+}
+
+func newWebhookNotifier(ctx context.Context, url string, timeout time.Duration, retries int, slots backgroundSlots) *webhookNotifier {
+	idle := make(chan struct{})
+	close(idle)
+	return &webhookNotifier{
+		url:     url,
+		client:  &http.Client{Timeout: timeout},
+		retries: retries,
+		backoff: time.Second,
+		slots:   slots,
+		ctx:     ctx,
+		idle:    idle,
+	}
+}
+
+func (n *webhookNotifier) UserCreated(u User) {
+	payload, err := userCreatedPayload(u)
+	if err != nil {
+		slog.Error("webhook: encode event", "err", err)
+		return
+	}
+	if !n.accept() {
+		slog.Warn("webhook: draining, dropping event", "type", "user.created", "user_id", u.ID)
+		n.recordFailure("user.created", 0, "dropped while draining")
+		return
+	}
+	go func() {
+		defer n.finish()
+		n.deliver("user.created", payload)
+	}()
+}
+
+// accept counts a new delivery unless the queue is draining.
+func (n *webhookNotifier) accept() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.draining {
+		return false
+	}
+	if n.pending == 0 {
+		n.idle = make(chan struct{})
+	}
+	n.pending++
+	return true
+}
+
+func (n *webhookNotifier) finish() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.pending--
+	if n.pending == 0 {
+		close(n.idle)
+	}
+}
+
+// setDraining stops (or resumes) accepting deliveries.
+func (n *webhookNotifier) setDraining(draining bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.draining = draining
+}
+
+// queue reports the pending deliveries and whether the queue is draining.
+func (n *webhookNotifier) queue() (pending int, draining bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.pending, n.draining
+}
+
+func userCreatedPayload(u User) ([]byte, error) {
+	return json.Marshal(event{Type: "user.created", Data: map[string]any{
+		"user_id":  u.ID,
+		"username": u.Username,
+		"email":    u.Email,
+	}})
+}
+
+func (n *webhookNotifier) deliver(typ string, payload []byte) {
+	wait := n.backoff
+	for attempt := 0; ; attempt++ {
+		err := n.post(payload)
+		if err == nil {
+			return
+		}
+		if attempt >= n.retries {
+			slog.Error("webhook: giving up", "url", n.url, "attempts", attempt+1, "err", err)
+			n.recordFailure(typ, attempt+1, err.Error())
+			return
+		}
+		slog.Warn("webhook: delivery failed, retrying", "url", n.url, "attempt", attempt+1, "err", err)
+		select {
+		case <-time.After(wait):
+			wait *= 2
+		case <-n.ctx.Done():
+			slog.Error("webhook: abandoned on shutdown", "url", n.url, "err", err)
+			n.recordFailure(typ, attempt+1, err.Error())
+			return
+		}
+	}
+}
+
+func (n *webhookNotifier) post(payload []byte) error {
+	if err := n.slots.acquire(n.ctx); err != nil {
+		return err
+	}
+	defer n.slots.release()
+	n.posting.Add(1)
+	defer n.posting.Add(-1)
+
+	return postWebhook(n.ctx, n.client, n.url, payload)
+}
+
+// postWebhook sends one event; any non-2xx answer is a failure.
+func postWebhook(ctx context.Context, client *http.Client, url string, payload []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (n *webhookNotifier) recordFailure(typ string, attempts int, msg string) {
+	n.failMu.Lock()
+	defer n.failMu.Unlock()
+	n.failures = append(n.failures, jobFailure{Time: time.Now().UTC(), Type: typ, Attempts: attempts, Error: msg})
+	if len(n.failures) > maxJobFailures {
+		n.failures = n.failures[len(n.failures)-maxJobFailures:]
+	}
+}
+
+func (n *webhookNotifier) recentFailures() []jobFailure {
+	n.failMu.Lock()
+	defer n.failMu.Unlock()
+	return append([]jobFailure{}, n.failures...)
+}
+
+// wait blocks until queued deliveries finish or give up. Deliveries
+// accepted meanwhile are waited for too; drain first to bound the wait.
+func (n *webhookNotifier) wait(ctx context.Context) error {
+	for {
+		n.mu.Lock()
+		idle, pending := n.idle, n.pending
+		n.mu.Unlock()
+		if pending == 0 {
+			return nil
+		}
+		select {
+		case <-idle:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,176 @@
+// notify_test.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// webhookApp is a test app whose creates notify a webhook at url.
+func webhookApp(t *testing.T, url string, retries int) (*testApp, *webhookNotifier) {
+	t.Helper()
+	ta := newTestApp(t, map[string]string{"ADMIN_TOKEN": "secret"})
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	n := newWebhookNotifier(ctx, url, time.Second, retries, newBackgroundSlots(4))
+	n.backoff = time.Millisecond
+	ta.Notifier, ta.Jobs, ta.Users.notifier = n, n, n
+	return ta, n
+}
+
+func TestWebhookReceivesUserCreated(t *testing.T) {
+	events := make(chan event, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e event
+		if r.Header.Get("Content-Type") != "application/json" || json.NewDecoder(r.Body).Decode(&e) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		events <- e
+	}))
+	defer srv.Close()
+
+	ta, n := webhookApp(t, srv.URL, 0)
+	id := ta.createUser(t, "ann", "ann@example.com")
+	select {
+	case e := <-events:
+		data := e.Data.(map[string]any)
+		if e.Type != "user.created" || data["user_id"] != float64(id) || data["email"] != "ann@example.com" {
+			t.Fatalf("event = %+v", e)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("webhook not called")
+	}
+	if err := n.wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if f := n.recentFailures(); len(f) != 0 {
+		t.Fatalf("failures = %+v", f)
+	}
+}
+
+func TestWebhookRetriesThenRecordsFailure(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		if calls.Add(1) < 3 {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer srv.Close()
+
+	_, n := webhookApp(t, srv.URL, 2)
+	n.UserCreated(User{ID: 1, Username: "ann", Email: "ann@example.com"})
+	n.wait(context.Background())
+	if calls.Load() != 3 || len(n.recentFailures()) != 0 {
+		t.Fatalf("calls = %d, failures %+v; want success on the third attempt", calls.Load(), n.recentFailures())
+	}
+
+	calls.Store(-10)
+	n.UserCreated(User{ID: 2})
+	n.wait(context.Background())
+	if f := n.recentFailures(); len(f) != 1 || f[0].Attempts != 3 || f[0].Error != "status 502" {
+		t.Fatalf("failures = %+v", f)
+	}
+}
+
+func TestDrainJobsWaitsThenDrops(t *testing.T) {
+	release := make(chan struct{})
+	var received atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		received.Add(1)
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	ta, n := webhookApp(t, srv.URL, 0)
+	ta.createUser(t, "ann", "ann@example.com")
+	waitFor(t, "delivery in flight", func() bool { return n.posting.Load() == 1 })
+
+	drained := make(chan *httptest.ResponseRecorder)
+	go func() { drained <- ta.do(t, http.MethodPost, "/admin/jobs/drain", "", adminAuth...) }()
+	waitFor(t, "draining", func() bool { _, d := n.queue(); return d })
+
+	// ann's delivery was accepted before the drain and is waited for;
+	// bob's arrives while draining and is dropped.
+	ta.createUser(t, "bob", "bob@example.com")
+	release <- struct{}{}
+	rec := <-drained
+	wantStatus(t, rec, http.StatusOK)
+	body := jsonBody(t, rec)
+	if body["pending"] != 0.0 || body["draining"] != true || received.Load() != 1 {
+		t.Fatalf("drain = %v, received %d", body, received.Load())
+	}
+	if f := n.recentFailures(); len(f) != 1 || f[0].Error != "dropped while draining" {
+		t.Fatalf("failures = %+v", f)
+	}
+
+	wantStatus(t, ta.do(t, http.MethodDelete, "/admin/jobs/drain", "", adminAuth...), http.StatusOK)
+	if !n.accept() {
+		t.Fatal("not accepting after DELETE")
+	}
+	n.finish()
+}
+
+// TestWebhookDrainRace interleaves deliveries with drains and waits; run
+// with -race. A WaitGroup here panicked on Add during Wait.
+func TestWebhookDrainRace(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer srv.Close()
+	_, n := webhookApp(t, srv.URL, 0)
+
+	var wg sync.WaitGroup
+	for i := range 4 {
+		wg.Go(func() {
+			for range 50 {
+				n.UserCreated(User{ID: int32(i)})
+			}
+		})
+	}
+	wg.Go(func() {
+		for range 20 {
+			n.setDraining(true)
+			ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+			n.wait(ctx)
+			cancel()
+			n.setDraining(false)
+		}
+	})
+	wg.Wait()
+	n.setDraining(true)
+	if err := n.wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if pending, _ := n.queue(); pending != 0 {
+		t.Fatalf("pending = %d after drain", pending)
+	}
+}
+
+func TestWebhookAbandonedOnShutdown(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	n := newWebhookNotifier(ctx, srv.URL, time.Second, 5, newBackgroundSlots(4))
+	n.backoff = time.Hour
+	n.UserCreated(User{ID: 1})
+	waitFor(t, "the first attempt", func() bool { return calls.Load() == 1 })
+	cancel()
+	waitCtx, done := context.WithTimeout(context.Background(), 2*time.Second)
+	defer done()
+	if err := n.wait(waitCtx); err != nil {
+		t.Fatalf("retry not abandoned: %v", err)
+	}
+}
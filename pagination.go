@@ -0,0 +1,93 @@
+// pagination.go
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultPageLimit = 20
+	maxPageLimit     = 100
+)
+
+// sortColumns maps accepted ?sort= fields to their column; a leading "-"
+// requests descending order.
+var sortColumns = map[string]string{
+	"user_id":  "user_id",
+	"username": "username",
+	"email":    "email",
+}
+
+type pageParams struct {
+	Limit  int
+	Offset int
+	// AfterID is the decoded cursor: only rows past this id are returned.
+	AfterID int32
+	Sort    string // column name from sortColumns
+	Desc    bool
+}
+
+// parsePagination reads limit, offset, cursor and sort from the query string.
+// limit is clamped to maxPageLimit; a cursor only applies to user_id order.
+func parsePagination(r *http.Request) (pageParams, error) {
+	q := r.URL.Query()
+	p := pageParams{Limit: defaultPageLimit, Sort: "user_id"}
+
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return p, errors.New("Invalid limit")
+		}
+		p.Limit = min(n, maxPageLimit)
+	}
+	if v := q.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return p, errors.New("Invalid offset")
+		}
+		p.Offset = n
+	}
+	if v := q.Get("sort"); v != "" {
+		field, desc := strings.CutPrefix(v, "-")
+		col, ok := sortColumns[field]
+		if !ok {
+			return p, fmt.Errorf("Invalid sort %q", v)
+		}
+		p.Sort, p.Desc = col, desc
+	}
+	if v := q.Get("cursor"); v != "" {
+		id, err := decodeCursor(v)
+		if err != nil {
+			return p, errors.New("Invalid cursor")
+		}
+		if p.Sort != "user_id" {
+			return p, errors.New("cursor requires sort=user_id")
+		}
+		if p.Offset != 0 {
+			return p, errors.New("cursor and offset are mutually exclusive")
+		}
+		p.AfterID = id
+	}
+	return p, nil
+}
+
+func encodeCursor(id int32) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(int64(id), 10)))
+}
+
+func decodeCursor(s string) (int32, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.ParseInt(string(b), 10, 32)
+	if err != nil || n < 1 {
+		return 0, errors.New("invalid cursor")
+	}
+	return int32(n), nil
+}
@@ -0,0 +1,107 @@
+// pagination_test.go
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParsePagination(t *testing.T) {
+	tests := []struct {
+		query string
+		want  pageParams
+	}{
+		{"", pageParams{Limit: defaultPageLimit, Sort: "user_id"}},
+		{"limit=5&offset=10", pageParams{Limit: 5, Offset: 10, Sort: "user_id"}},
+		{"limit=1000", pageParams{Limit: maxPageLimit, Sort: "user_id"}},
+		{"sort=-email", pageParams{Limit: defaultPageLimit, Sort: "email", Desc: true}},
+		{"cursor=" + encodeCursor(42), pageParams{Limit: defaultPageLimit, Sort: "user_id", AfterID: 42}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			got, err := parsePagination(httptest.NewRequest(http.MethodGet, "/users?"+tt.query, nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Fatalf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParsePaginationRejects(t *testing.T) {
+	for _, query := range []string{
+		"limit=0",
+		"limit=-1",
+		"limit=ten",
+		"offset=-1",
+		"sort=password",
+		"cursor=not*base64",
+		"cursor=" + encodeCursor(0),
+		"cursor=" + encodeCursor(5) + "&sort=email",
+		"cursor=" + encodeCursor(5) + "&offset=3",
+	} {
+		t.Run(query, func(t *testing.T) {
+			if _, err := parsePagination(httptest.NewRequest(http.MethodGet, "/users?"+query, nil)); err == nil {
+				t.Fatal("accepted")
+			}
+		})
+	}
+}
+
+func TestListUsersInvalidPaginationIsBadRequest(t *testing.T) {
+	ta := newTestApp(t, nil)
+	wantStatus(t, ta.do(t, http.MethodGet, "/users?sort=password", ""), http.StatusBadRequest)
+}
+
+func TestListUsersCursor(t *testing.T) {
+	ta := newTestApp(t, nil)
+	ta.createUser(t, "ann", "ann@example.com")
+	second := ta.createUser(t, "bob", "bob@example.com")
+	rec := ta.do(t, http.MethodGet, "/users?limit=1", "")
+	wantStatus(t, rec, http.StatusOK)
+	next, _ := jsonBody(t, rec)["next_cursor"].(string)
+	if next == "" {
+		t.Fatalf("no next_cursor in %s", rec.Body)
+	}
+	rec = ta.do(t, http.MethodGet, "/users?limit=1&cursor="+next, "")
+	wantStatus(t, rec, http.StatusOK)
+	users := jsonBody(t, rec)["users"].([]any)
+	if len(users) != 1 || int32(users[0].(map[string]any)["user_id"].(float64)) != second {
+		t.Fatalf("second page = %v", users)
+	}
+}
+
+func TestEmptyListEncoding(t *testing.T) {
+	for _, tt := range []struct {
+		env  map[string]string
+		want string
+	}{
+		{nil, `"users":[]`},
+		{map[string]string{"EMPTY_LIST_AS_NULL": "true"}, `"users":null`},
+	} {
+		ta := newTestApp(t, tt.env)
+		for _, rec := range []*httptest.ResponseRecorder{
+			ta.do(t, http.MethodGet, "/users", ""),
+			ta.do(t, http.MethodPost, "/users/by-emails", `["nobody@example.com"]`),
+		} {
+			wantStatus(t, rec, http.StatusOK)
+			if !strings.Contains(rec.Body.String(), tt.want) {
+				t.Errorf("%v: body = %s, want %s", tt.env, rec.Body, tt.want)
+			}
+		}
+	}
+
+	// A non-empty page is unaffected, and JSON:API keeps an empty data array.
+	ta := newTestApp(t, map[string]string{"EMPTY_LIST_AS_NULL": "true", "JSON_API": "true"})
+	if rec := ta.do(t, http.MethodGet, "/users", "", acceptJSONAPI...); !strings.Contains(rec.Body.String(), `"data":[]`) {
+		t.Errorf("JSON:API body = %s", rec.Body)
+	}
+	ta.createUser(t, "ann", "ann@example.com")
+	if users, _ := jsonBody(t, ta.do(t, http.MethodGet, "/users", ""))["users"].([]any); len(users) != 1 {
+		t.Errorf("users = %v", users)
+	}
+}
@@ -0,0 +1,98 @@
+// ping_test.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// scriptedPinger's connections answer Ping with the next step: "hang" waits
+// out the caller's deadline, "fail" errors and "ok" succeeds. Past the end
+// of the script every ping fails.
+type scriptedPinger struct {
+	steps []string
+	next  atomic.Int32
+}
+
+func (p *scriptedPinger) Connect(context.Context) (driver.Conn, error) { return pingerConn{p}, nil }
+func (*scriptedPinger) Driver() driver.Driver                          { return nil }
+
+type pingerConn struct{ p *scriptedPinger }
+
+func (pingerConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("stub: no statements") }
+func (pingerConn) Close() error                        { return nil }
+func (pingerConn) Begin() (driver.Tx, error)           { return nil, errors.New("stub: no transactions") }
+
+func (c pingerConn) Ping(ctx context.Context) error {
+	i := int(c.p.next.Add(1)) - 1
+	step := "fail"
+	if i < len(c.p.steps) {
+		step = c.p.steps[i]
+	}
+	switch step {
+	case "hang":
+		<-ctx.Done()
+		return ctx.Err()
+	case "ok":
+		return nil
+	}
+	return errors.New("stub: connection refused")
+}
+
+func TestPingWithRetryTimesOutEachAttempt(t *testing.T) {
+	p := &scriptedPinger{steps: []string{"hang", "fail", "ok"}}
+	db := sql.OpenDB(p)
+	defer db.Close()
+
+	start := time.Now()
+	if err := pingWithRetry(context.Background(), db, 50*time.Millisecond, 3, time.Millisecond); err != nil {
+		t.Fatalf("pingWithRetry = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("took %v; the hung ping was not cut off", elapsed)
+	}
+	if n := p.next.Load(); n != 3 {
+		t.Fatalf("pinged %d times, want 3", n)
+	}
+}
+
+func TestPingWithRetryGivesUp(t *testing.T) {
+	p := &scriptedPinger{steps: []string{"hang"}}
+	db := sql.OpenDB(p)
+	defer db.Close()
+
+	err := pingWithRetry(context.Background(), db, 20*time.Millisecond, 2, time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "after 3 attempts") {
+		t.Fatalf("err = %v", err)
+	}
+
+	// Cancelling the context stops the backoff wait.
+	p = &scriptedPinger{}
+	db2 := sql.OpenDB(p)
+	defer db2.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	start := time.Now()
+	err = pingWithRetry(ctx, db2, time.Second, 5, time.Hour)
+	if err == nil || !strings.Contains(err.Error(), "interrupted") || time.Since(start) > time.Second {
+		t.Fatalf("err = %v after %v", err, time.Since(start))
+	}
+}
+
+func TestPingConfigValidated(t *testing.T) {
+	for key, v := range map[string]string{
+		"DB_PING_TIMEOUT":        "0s",
+		"DB_CONNECT_MAX_RETRIES": "-1",
+		"DB_CONNECT_BACKOFF":     "0s",
+	} {
+		if err := loadConfigErr(t, map[string]string{key: v}); !strings.Contains(err.Error(), key) {
+			t.Errorf("%s=%s: %v", key, v, err)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+// poolhealth.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"time"
+)
+
+// poolHealthChecker periodically runs SELECT 1 on a pooled connection. This
+// keeps idle connections warm and closes the readiness gate after
+// `failures` consecutive errors, reopening it on the next success.
+type poolHealthChecker struct {
+	db       *sql.DB
+	interval time.Duration
+	failures int
+	ready    *readiness
+	slots    backgroundSlots
+}
+
+func (p *poolHealthChecker) run(ctx context.Context) {
+	t := time.NewTicker(p.interval)
+	defer t.Stop()
+
+	failed := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		if err := p.check(ctx); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			failed++
+			slog.Warn("pool health: check failed", "consecutive", failed, "threshold", p.failures, "err", err)
+			if failed == p.failures {
+				p.ready.setNotReady("pool_health", "database unreachable")
+			}
+			continue
+		}
+		if failed >= p.failures {
+			slog.Info("pool health: database reachable again")
+		}
+		failed = 0
+		p.ready.setReady("pool_health")
+	}
+}
+
+func (p *poolHealthChecker) check(ctx context.Context) error {
+	if err := p.slots.acquire(ctx); err != nil {
+		return err
+	}
+	defer p.slots.release()
+
+	ctx, cancel := context.WithTimeout(ctx, min(p.interval, 5*time.Second))
+	defer cancel()
+	var one int
+	return p.db.QueryRowContext(ctx, "SELECT 1").Scan(&one)
+}
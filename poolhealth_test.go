@@ -0,0 +1,93 @@
+// poolhealth_test.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// pingConnector's connections answer any query with a single 1, or fail
+// while down is set.
+type pingConnector struct{ down *atomic.Bool }
+
+func (c pingConnector) Connect(context.Context) (driver.Conn, error) { return pingConn(c), nil }
+func (pingConnector) Driver() driver.Driver                          { return nil }
+
+type pingConn struct{ down *atomic.Bool }
+
+func (pingConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("stub: no statements") }
+func (pingConn) Close() error                        { return nil }
+func (pingConn) Begin() (driver.Tx, error)           { return nil, errors.New("stub: no transactions") }
+
+func (c pingConn) QueryContext(context.Context, string, []driver.NamedValue) (driver.Rows, error) {
+	if c.down.Load() {
+		return nil, errors.New("stub: connection refused")
+	}
+	return &oneRow{}, nil
+}
+
+type oneRow struct{ done bool }
+
+func (*oneRow) Columns() []string { return []string{"?column?"} }
+func (*oneRow) Close() error      { return nil }
+
+func (r *oneRow) Next(dest []driver.Value) error {
+	if r.done {
+		return io.EOF
+	}
+	r.done = true
+	dest[0] = int64(1)
+	return nil
+}
+
+func TestPoolHealthFailuresFlipReadiness(t *testing.T) {
+	var down atomic.Bool
+	db := sql.OpenDB(pingConnector{&down})
+	defer db.Close()
+	ready := newReadiness(0, 10)
+	checker := &poolHealthChecker{
+		db:       db,
+		interval: 5 * time.Millisecond,
+		failures: 3,
+		ready:    ready,
+		slots:    newBackgroundSlots(1),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Go(func() { checker.run(ctx) })
+
+	down.Store(true)
+	waitFor(t, "readiness to close", func() bool { ok, _ := ready.state(time.Now()); return !ok })
+	if _, reason := ready.state(time.Now()); reason != "database unreachable" {
+		t.Fatalf("reason = %q", reason)
+	}
+
+	down.Store(false)
+	waitFor(t, "readiness to reopen", func() bool { ok, _ := ready.state(time.Now()); return ok })
+
+	cancel()
+	wg.Wait()
+}
+
+func TestPoolHealthCheck(t *testing.T) {
+	var down atomic.Bool
+	db := sql.OpenDB(pingConnector{&down})
+	defer db.Close()
+	checker := &poolHealthChecker{db: db, interval: time.Second, slots: newBackgroundSlots(1)}
+
+	down.Store(true)
+	if err := checker.check(context.Background()); err == nil {
+		t.Fatal("check passed while the database was down")
+	}
+	down.Store(false)
+	if err := checker.check(context.Background()); err != nil {
+		t.Fatalf("check: %v", err)
+	}
+}
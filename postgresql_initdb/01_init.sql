@@ -5,4 +5,46 @@ CREATE TABLE IF NOT EXISTS public.users (
   created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
 );
 
+CREATE UNIQUE INDEX IF NOT EXISTS users_email_key ON public.users (lower(email));
+
+-- Used when IDEMPOTENCY_STORE=db; status is NULL while the first request runs.
+CREATE TABLE IF NOT EXISTS public.idempotency_keys (
+  idempotency_key VARCHAR(255) PRIMARY KEY,
+  body_hash CHAR(64) NOT NULL,
+  status INT,
+  content_type TEXT,
+  location TEXT,
+  body BYTEA,
+  created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idempotency_keys_created_at_idx ON public.idempotency_keys (created_at);
+
+-- Used when AUDIT_LOG=true: one row per user created, updated or deleted.
+CREATE TABLE IF NOT EXISTS public.audit_log (
+  id BIGINT GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+  action TEXT NOT NULL,
+  user_id INT NOT NULL,
+  request_id TEXT,
+  occurred_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS audit_log_user_id_idx ON public.audit_log (user_id);
+
+-- Used when WEBHOOK_QUEUE=db; next_attempt_at doubles as the claim lease.
+CREATE TABLE IF NOT EXISTS public.webhook_deliveries (
+  id BIGINT GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+  event_type TEXT NOT NULL,
+  payload JSONB NOT NULL,
+  status TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'delivered', 'dead')),
+  attempts INT NOT NULL DEFAULT 0,
+  next_attempt_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  last_error TEXT,
+  created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  delivered_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS webhook_deliveries_due_idx ON public.webhook_deliveries (next_attempt_at) WHERE status = 'pending';
+CREATE INDEX IF NOT EXISTS webhook_deliveries_done_idx ON public.webhook_deliveries (created_at) WHERE status <> 'pending';
+
 INSERT INTO public.users (username, email) VALUES ('optest', 'opsnoopop@hotmail.com');
\ No newline at end of file
@@ -0,0 +1,107 @@
+// problemjson.go
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+const problemMediaType = "application/problem+json"
+
+// problemWriter marks a response whose errors are RFC 7807 problem
+// documents; like jsonAPIWriter, jsonWrite finds it by unwrapping.
+type problemWriter struct {
+	http.ResponseWriter
+}
+
+func (p *problemWriter) Flush() {
+	if f, ok := p.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (p *problemWriter) Unwrap() http.ResponseWriter { return p.ResponseWriter }
+
+// negotiateProblems formats error responses as problem+json (PROBLEM_JSON):
+// for every request with always, otherwise only when Accept asks for it.
+// Successful responses are untouched.
+func negotiateProblems(always bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !always {
+			w.Header().Add("Vary", "Accept")
+		}
+		if always || acceptsProblems(r.Header.Values("Accept")) {
+			w = &problemWriter{ResponseWriter: w}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func acceptsProblems(accept []string) bool {
+	for _, h := range accept {
+		for _, part := range strings.Split(h, ",") {
+			mt, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+			if err == nil && mt == problemMediaType && params["q"] != "0" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isProblemJSON(w http.ResponseWriter) bool {
+	for {
+		switch v := w.(type) {
+		case *problemWriter:
+			return true
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = v.Unwrap()
+		default:
+			return false
+		}
+	}
+}
+
+// toProblem converts an error body to a problem document. The service's
+// codes don't have their own documentation URIs, so type stays about:blank
+// with the status text as title; the message becomes detail, field
+// failures the errors extension, and every other member, code included, an
+// extension of the same name.
+func toProblem(status int, v any) map[string]any {
+	p := map[string]any{
+		"type":   "about:blank",
+		"title":  http.StatusText(status),
+		"status": status,
+	}
+	var body map[string]any
+	switch b := v.(type) {
+	case map[string]any:
+		body = b
+	case map[string]string:
+		body = make(map[string]any, len(b))
+		for k, s := range b {
+			body[k] = s
+		}
+	default:
+		return p
+	}
+
+	for k, val := range body {
+		switch k {
+		case "error":
+			p["detail"] = fmt.Sprint(val)
+			if d, ok := body["detail"]; ok {
+				p["detail"] = fmt.Sprintf("%v: %v", val, d)
+			}
+		case "fields":
+			p["errors"] = val
+		case "detail", "type", "title", "status", "instance":
+			// Consumed above or reserved by RFC 7807.
+		default:
+			p[k] = val
+		}
+	}
+	return p
+}
@@ -0,0 +1,112 @@
+// problemjson_test.go
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+var acceptProblems = []string{"Accept", problemMediaType}
+
+// wantProblem checks that rec, whose decoded body is body, is a problem
+// document for status.
+func wantProblem(t *testing.T, rec *httptest.ResponseRecorder, body map[string]any, status int) {
+	t.Helper()
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, problemMediaType) {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+	if body["type"] != "about:blank" || body["title"] != http.StatusText(status) || body["status"] != float64(status) {
+		t.Fatalf("problem = %v, want status %d", body, status)
+	}
+}
+
+func TestProblemJSONErrors(t *testing.T) {
+	ta := newTestApp(t, map[string]string{"PROBLEM_JSON": "negotiate"})
+	ta.createUser(t, "ann", "ann@example.com")
+
+	rec := ta.do(t, http.MethodPost, "/users", `{"username":"","email":"nope"}`, acceptProblems...)
+	wantStatus(t, rec, http.StatusBadRequest)
+	body := jsonBody(t, rec)
+	wantProblem(t, rec, body, http.StatusBadRequest)
+	errs, _ := body["errors"].([]any)
+	if len(errs) != 2 || errs[0].(map[string]any)["field"] != "username" || errs[1].(map[string]any)["field"] != "email" {
+		t.Fatalf("errors = %v", body["errors"])
+	}
+	if _, ok := body["fields"]; ok {
+		t.Fatalf("fields kept alongside errors: %v", body)
+	}
+
+	rec = ta.do(t, http.MethodGet, "/users/42", "", acceptProblems...)
+	wantStatus(t, rec, http.StatusNotFound)
+	body = jsonBody(t, rec)
+	wantProblem(t, rec, body, http.StatusNotFound)
+	if body["detail"] != "User not found" {
+		t.Fatalf("detail = %v", body["detail"])
+	}
+
+	rec = ta.do(t, http.MethodPost, "/users", `{"username":"annie","email":"ann@example.com"}`, acceptProblems...)
+	wantStatus(t, rec, http.StatusConflict)
+	body = jsonBody(t, rec)
+	wantProblem(t, rec, body, http.StatusConflict)
+	if body["detail"] != "Email already exists" {
+		t.Fatalf("conflict problem = %v", body)
+	}
+
+	// Without the media type errors keep the plain shape.
+	rec = ta.do(t, http.MethodGet, "/users/42", "")
+	if ct := rec.Header().Get("Content-Type"); strings.HasPrefix(ct, problemMediaType) {
+		t.Fatalf("Content-Type = %q without Accept", ct)
+	}
+	if body := jsonBody(t, rec); body["error"] != "User not found" || body["type"] != nil {
+		t.Fatalf("plain body = %v", body)
+	}
+	if vary := rec.Header().Values("Vary"); !strings.Contains(strings.Join(vary, ","), "Accept") {
+		t.Fatalf("Vary = %v", vary)
+	}
+
+	// Successful responses are untouched.
+	rec = ta.do(t, http.MethodGet, "/users/1", "", acceptProblems...)
+	wantStatus(t, rec, http.StatusOK)
+	if jsonBody(t, rec)["username"] != "ann" {
+		t.Fatalf("user = %s", rec.Body)
+	}
+}
+
+func TestProblemJSONModes(t *testing.T) {
+	ta := newTestApp(t, map[string]string{"PROBLEM_JSON": "always"})
+	rec := ta.do(t, http.MethodGet, "/users/42", "")
+	wantStatus(t, rec, http.StatusNotFound)
+	wantProblem(t, rec, jsonBody(t, rec), http.StatusNotFound)
+
+	ta = newTestApp(t, nil)
+	rec = ta.do(t, http.MethodGet, "/users/42", "", acceptProblems...)
+	if ct := rec.Header().Get("Content-Type"); strings.HasPrefix(ct, problemMediaType) {
+		t.Fatalf("Content-Type = %q with PROBLEM_JSON off", ct)
+	}
+}
+
+func TestToProblem(t *testing.T) {
+	p := toProblem(http.StatusServiceUnavailable, map[string]string{"error": "Database unavailable", "detail": "pool closed", "code": "DB_DOWN", "status": "x"})
+	if p["detail"] != "Database unavailable: pool closed" || p["code"] != "DB_DOWN" || p["status"] != http.StatusServiceUnavailable {
+		t.Fatalf("problem = %v", p)
+	}
+	if p := toProblem(http.StatusTeapot, "not an object"); len(p) != 3 {
+		t.Fatalf("problem from a non-object = %v", p)
+	}
+}
+
+func TestAcceptsProblems(t *testing.T) {
+	for header, want := range map[string]bool{
+		problemMediaType:                        true,
+		"application/json, " + problemMediaType: true,
+		problemMediaType + ";q=0.5":             true,
+		problemMediaType + ";q=0":               false,
+		"application/json":                      false,
+	} {
+		if got := acceptsProblems([]string{header}); got != want {
+			t.Errorf("acceptsProblems(%q) = %v, want %v", header, got, want)
+		}
+	}
+}
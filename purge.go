@@ -0,0 +1,85 @@
+// purge.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"time"
+)
+
+// Purge statements delete at most $2 rows older than $1 seconds.
+const (
+	// Claim only reuses an expired key when it is sent again, so without
+	// this the table grows by one row per key ever used.
+	purgeIdempotencyKeys = `DELETE FROM idempotency_keys WHERE idempotency_key IN (
+	   SELECT idempotency_key FROM idempotency_keys
+	    WHERE created_at < now() - make_interval(secs => $1)
+	    LIMIT $2 FOR UPDATE SKIP LOCKED)`
+	// Pending deliveries are kept however old: they are still owed.
+	purgeWebhookDeliveries = `DELETE FROM webhook_deliveries WHERE id IN (
+	   SELECT id FROM webhook_deliveries
+	    WHERE status IN ('delivered', 'dead') AND created_at < now() - make_interval(secs => $1)
+	    LIMIT $2 FOR UPDATE SKIP LOCKED)`
+)
+
+// purger deletes a table's rows older than retention every interval.
+type purger struct {
+	table     string // for logs
+	query     string // one of the purge statements
+	db        *sql.DB
+	retention time.Duration
+	interval  time.Duration
+	batch     int
+	slots     backgroundSlots
+}
+
+func (p *purger) run(ctx context.Context) {
+	t := time.NewTicker(p.interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		n, err := p.purge(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			slog.Warn("purge failed", "table", p.table, "deleted", n, "err", err)
+			continue
+		}
+		if n > 0 {
+			slog.Info("purge", "table", p.table, "deleted", n)
+		}
+	}
+}
+
+// purge deletes expired rows batch at a time, so no single statement holds
+// its locks for long, until a batch comes back short.
+func (p *purger) purge(ctx context.Context) (int64, error) {
+	if err := p.slots.acquire(ctx); err != nil {
+		return 0, err
+	}
+	defer p.slots.release()
+
+	var total int64
+	for {
+		res, err := p.db.ExecContext(ctx, p.query, p.retention.Seconds(), p.batch)
+		if err != nil {
+			return total, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return total, err
+		}
+		total += n
+		if n < int64(p.batch) {
+			return total, nil
+		}
+	}
+}
@@ -0,0 +1,186 @@
+// purge_test.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// execConnector's connections answer each Exec with the next of affected,
+// then 0, recording the args they were given.
+type execConnector struct {
+	mu       sync.Mutex
+	affected []int64
+	args     [][]driver.NamedValue
+}
+
+func (c *execConnector) Connect(context.Context) (driver.Conn, error) { return execConn{c}, nil }
+func (*execConnector) Driver() driver.Driver                          { return nil }
+
+type execConn struct{ c *execConnector }
+
+func (execConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("stub: no statements") }
+func (execConn) Close() error                        { return nil }
+func (execConn) Begin() (driver.Tx, error)           { return nil, errors.New("stub: no transactions") }
+
+func (e execConn) ExecContext(_ context.Context, _ string, args []driver.NamedValue) (driver.Result, error) {
+	e.c.mu.Lock()
+	defer e.c.mu.Unlock()
+	e.c.args = append(e.c.args, args)
+	var n int64
+	if len(e.c.affected) > 0 {
+		n, e.c.affected = e.c.affected[0], e.c.affected[1:]
+	}
+	return driver.RowsAffected(n), nil
+}
+
+func TestIdempotencyPurgeBatches(t *testing.T) {
+	c := &execConnector{affected: []int64{100, 100, 40}}
+	db := sql.OpenDB(c)
+	defer db.Close()
+	p := &purger{query: purgeIdempotencyKeys, db: db, retention: time.Hour, batch: 100, slots: newBackgroundSlots(1)}
+
+	n, err := p.purge(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 240 || len(c.args) != 3 {
+		t.Fatalf("purged %d rows in %d statements, want 240 in 3", n, len(c.args))
+	}
+	if secs, limit := c.args[0][0].Value, c.args[0][1].Value; secs != float64(3600) || limit != int64(100) {
+		t.Fatalf("args = %v, %v", secs, limit)
+	}
+}
+
+func TestIdempotencyPurgeWaitsForSlot(t *testing.T) {
+	db := sql.OpenDB(&execConnector{})
+	defer db.Close()
+	slots := newBackgroundSlots(1)
+	if err := slots.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	p := &purger{query: purgeIdempotencyKeys, db: db, retention: time.Hour, batch: 10, slots: slots}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := p.purge(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("purge with no free slot = %v", err)
+	}
+}
+
+func TestIdempotencyPurgeStopsOnShutdown(t *testing.T) {
+	db := sql.OpenDB(&execConnector{})
+	defer db.Close()
+	p := &purger{query: purgeIdempotencyKeys, db: db, retention: time.Hour, interval: time.Millisecond, batch: 10, slots: newBackgroundSlots(1)}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		p.run(ctx)
+		close(done)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("purger still running after cancel")
+	}
+}
+
+func TestIdempotencyPurgeDeletesOnlyOldRows(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+	run := time.Now().UnixNano()
+	oldKey, newKey := fmt.Sprintf("purge-old-%d", run), fmt.Sprintf("purge-new-%d", run)
+	for key, age := range map[string]time.Duration{oldKey: 48 * time.Hour, newKey: time.Minute} {
+		if _, err := db.ExecContext(ctx,
+			`INSERT INTO idempotency_keys (idempotency_key, body_hash, created_at)
+			 VALUES ($1, $2, now() - make_interval(secs => $3))`,
+			key, fmt.Sprintf("%064d", 0), age.Seconds()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Cleanup(func() {
+		db.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE idempotency_key = $1", newKey)
+	})
+
+	p := &purger{query: purgeIdempotencyKeys, db: db, retention: 24 * time.Hour, batch: 1, slots: newBackgroundSlots(1)}
+	if _, err := p.purge(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]bool{oldKey: false, newKey: true} {
+		var exists bool
+		if err := db.QueryRowContext(ctx,
+			"SELECT EXISTS (SELECT 1 FROM idempotency_keys WHERE idempotency_key = $1)", key).Scan(&exists); err != nil {
+			t.Fatal(err)
+		}
+		if exists != want {
+			t.Errorf("%s exists = %v, want %v", key, exists, want)
+		}
+	}
+}
+
+// TestWebhookPurgeKeepsPending runs against a session-local
+// webhook_deliveries table, which the unqualified name resolves to.
+func TestWebhookPurgeKeepsPending(t *testing.T) {
+	db := testDB(t)
+	db.SetMaxOpenConns(1)
+	ctx := context.Background()
+	if _, err := db.ExecContext(ctx, "CREATE TEMP TABLE webhook_deliveries (LIKE public.webhook_deliveries INCLUDING ALL)"); err != nil {
+		t.Fatal(err)
+	}
+	for _, row := range []struct {
+		status string
+		age    time.Duration
+	}{{"delivered", 48 * time.Hour}, {"dead", 48 * time.Hour}, {"pending", 48 * time.Hour}, {"delivered", time.Minute}} {
+		if _, err := db.ExecContext(ctx,
+			`INSERT INTO webhook_deliveries (event_type, payload, status, created_at)
+			 VALUES ('user.created', '{}', $1, now() - make_interval(secs => $2))`,
+			row.status, row.age.Seconds()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	p := &purger{query: purgeWebhookDeliveries, db: db, retention: 24 * time.Hour, batch: 10, slots: newBackgroundSlots(1)}
+	if n, err := p.purge(ctx); err != nil || n != 2 {
+		t.Fatalf("purge = %d, %v; want the old delivered and dead rows", n, err)
+	}
+	var left []string
+	rows, err := db.QueryContext(ctx, "SELECT status FROM webhook_deliveries ORDER BY id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			t.Fatal(err)
+		}
+		left = append(left, s)
+	}
+	if strings.Join(left, ",") != "pending,delivered" {
+		t.Fatalf("rows left = %v", left)
+	}
+}
+
+func TestPurgeConfigValidated(t *testing.T) {
+	for _, tt := range []struct {
+		env  map[string]string
+		want string
+	}{
+		{map[string]string{"IDEMPOTENCY_TTL": "48h", "IDEMPOTENCY_RETENTION": "24h"}, "IDEMPOTENCY_RETENTION"},
+		{map[string]string{"WEBHOOK_RETENTION": "-1s"}, "WEBHOOK_RETENTION"},
+		{map[string]string{"PURGE_INTERVAL": "-1s"}, "PURGE_INTERVAL"},
+		{map[string]string{"PURGE_BATCH_SIZE": "0"}, "PURGE_BATCH_SIZE"},
+	} {
+		if err := loadConfigErr(t, tt.env); !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%v: %v", tt.env, err)
+		}
+	}
+}
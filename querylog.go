@@ -0,0 +1,102 @@
+// querylog.go
+package main
+
+import (
+	"context"
+	"log/slog"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// queryLogger is a pgx tracer logging every statement with its bind
+// arguments, row count and error (LOG_QUERIES). Arguments bound to a column
+// in redact are masked; columns are matched from the SQL text, which covers
+// the INSERT column lists and "col = $n" comparisons this service uses.
+type queryLogger struct {
+	redact map[string]bool
+}
+
+type queryLogStart struct {
+	sql   string
+	args  []any
+	start time.Time
+}
+
+var (
+	insertColumnsRe = regexp.MustCompile(`(?is)INSERT\s+INTO\s+\S+\s*\(([^)]*)\)\s*VALUES\s*\(([^)]*)\)`)
+	// Matches "col = $1", "lower(col) = lower($1)" and "col = ANY($1)".
+	comparisonRe = regexp.MustCompile(`(\w+)\)?\s*=\s*(?:\w+\()?\$(\d+)`)
+)
+
+func newQueryLogger(redact []string) *queryLogger {
+	l := &queryLogger{redact: make(map[string]bool, len(redact))}
+	for _, col := range redact {
+		l.redact[strings.ToLower(col)] = true
+	}
+	return l
+}
+
+func withQueryLogStart(ctx context.Context, q queryLogStart) context.Context {
+	return context.WithValue(ctx, queryLogKey, q)
+}
+
+func queryLogStartFrom(ctx context.Context) (queryLogStart, bool) {
+	q, ok := ctx.Value(queryLogKey).(queryLogStart)
+	return q, ok
+}
+
+func (l *queryLogger) TraceQueryStart(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+	return withQueryLogStart(ctx, queryLogStart{sql: data.SQL, args: data.Args, start: time.Now()})
+}
+
+func (l *queryLogger) TraceQueryEnd(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryEndData) {
+	q, ok := queryLogStartFrom(ctx)
+	if !ok {
+		return
+	}
+	attrs := []any{
+		"sql", q.sql,
+		"args", l.redactArgs(q.sql, q.args),
+		"duration", time.Since(q.start),
+		"request_id", requestIDFrom(ctx),
+	}
+	if data.Err != nil {
+		slog.Debug("query", append(attrs, "err", data.Err)...)
+		return
+	}
+	slog.Debug("query", append(attrs, "rows", data.CommandTag.RowsAffected())...)
+}
+
+// redactArgs masks the arguments whose placeholder is bound to a redacted
+// column.
+func (l *queryLogger) redactArgs(sql string, args []any) []any {
+	masked := make(map[int]bool)
+	mark := func(col, param string) {
+		n, err := strconv.Atoi(strings.TrimPrefix(strings.TrimSpace(param), "$"))
+		if err == nil && l.redact[strings.ToLower(strings.TrimSpace(col))] {
+			masked[n-1] = true
+		}
+	}
+	if m := insertColumnsRe.FindStringSubmatch(sql); m != nil {
+		cols, params := strings.Split(m[1], ","), strings.Split(m[2], ",")
+		for i := 0; i < len(cols) && i < len(params); i++ {
+			mark(cols[i], params[i])
+		}
+	}
+	for _, m := range comparisonRe.FindAllStringSubmatch(sql, -1) {
+		mark(m[1], m[2])
+	}
+
+	out := make([]any, len(args))
+	for i, v := range args {
+		if masked[i] {
+			v = "[redacted]"
+		}
+		out[i] = v
+	}
+	return out
+}
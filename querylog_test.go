@@ -0,0 +1,54 @@
+// querylog_test.go
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+func TestQueryLogRedactsInsertedEmail(t *testing.T) {
+	out := captureDefaultLog(t)
+	l := newQueryLogger(testConfig(t, map[string]string{"DEBUG": "true", "LOG_QUERIES": "true"}).LogQueriesRedact)
+
+	ctx := withRequestID(context.Background(), "req-1")
+	ctx = l.TraceQueryStart(ctx, nil, pgx.TraceQueryStartData{SQL: sqlInsertUser, Args: []any{"ann", "ann@example.com"}})
+	l.TraceQueryEnd(ctx, nil, pgx.TraceQueryEndData{CommandTag: pgconn.NewCommandTag("INSERT 0 1")})
+
+	lines := logLines(t, out)
+	if len(lines) != 1 {
+		t.Fatalf("logged %d lines", len(lines))
+	}
+	line := lines[0]
+	if line["msg"] != "query" || line["sql"] != sqlInsertUser || line["rows"] != 1.0 || line["request_id"] != "req-1" {
+		t.Fatalf("log line = %v", line)
+	}
+	if args, _ := line["args"].([]any); !slices.Equal(args, []any{"ann", "[redacted]"}) {
+		t.Fatalf("args = %v", line["args"])
+	}
+}
+
+func TestQueryLogRedactsComparisons(t *testing.T) {
+	l := newQueryLogger([]string{"email"})
+	tests := []struct {
+		sql  string
+		args []any
+		want []any
+	}{
+		{sqlGetUserByEmail, []any{"ann@example.com"}, []any{"[redacted]"}},
+		{"SELECT user_id FROM users WHERE lower(email) = ANY($1) AND user_id = $2", []any{"x", int32(3)}, []any{"[redacted]", int32(3)}},
+		{sqlGetUser, []any{int32(3)}, []any{int32(3)}},
+	}
+	for _, tt := range tests {
+		if got := l.redactArgs(tt.sql, tt.args); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: %v, want %v", tt.sql, got, tt.want)
+		}
+	}
+}
+
+func TestLogQueriesRequiresDebug(t *testing.T) {
+	loadConfigErr(t, map[string]string{"LOG_QUERIES": "true"})
+}
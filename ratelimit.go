@@ -0,0 +1,147 @@
+// ratelimit.go
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxBuckets bounds the limiter's memory; past it, full (idle) buckets are
+// swept before a new client is added, and if none are idle the limiter
+// fails with errLimiterFull.
+const maxBuckets = 10000
+
+var errLimiterFull = errors.New("rate limiter: too many active clients")
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter is a per-client token bucket: rate tokens per second up to
+// burst. Clients are keyed by IP (see clientIP).
+type rateLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[netip.Addr]*bucket
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{rate: rate, burst: float64(burst), buckets: make(map[netip.Addr]*bucket)}
+}
+
+// limit is a client's bucket state after take: the tokens left, how long
+// until it is full again and, when refused, how long until the next token.
+type limit struct {
+	allowed   bool
+	remaining int
+	reset     time.Duration
+	retry     time.Duration
+}
+
+// take spends a token for client if one is available.
+func (l *rateLimiter) take(client netip.Addr, now time.Time) (limit, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[client]
+	if !ok {
+		if len(l.buckets) >= maxBuckets {
+			l.sweep(now)
+		}
+		if len(l.buckets) >= maxBuckets {
+			return limit{}, errLimiterFull
+		}
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	var lim limit
+	if b.tokens >= 1 {
+		b.tokens--
+		lim.allowed = true
+	} else {
+		lim.retry = l.refill(1 - b.tokens)
+	}
+	lim.remaining = int(b.tokens)
+	lim.reset = l.refill(l.burst - b.tokens)
+	return lim, nil
+}
+
+// safeTake is take with panics turned into errors, so a limiter bug is
+// handled by the fail policy rather than failing the request outright.
+func (l *rateLimiter) safeTake(client netip.Addr, now time.Time) (lim limit, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("rate limiter: panic: %v", p)
+		}
+	}()
+	return l.take(client, now)
+}
+
+func (l *rateLimiter) refill(tokens float64) time.Duration {
+	return time.Duration(tokens / l.rate * float64(time.Second))
+}
+
+func (l *rateLimiter) sweep(now time.Time) {
+	for client, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, client)
+		}
+	}
+}
+
+// rateLimit answers 429 once a client's bucket is empty. With headers set,
+// every response carries X-RateLimit-Limit/-Remaining/-Reset so clients can
+// pace themselves before hitting the limit. When the limiter itself fails,
+// failOpen lets the request through unlimited; otherwise it gets 503.
+func rateLimit(l *rateLimiter, clientIP func(*http.Request) (netip.Addr, bool), headers, failOpen bool, retryAfter retryAfterFormat, next http.Handler) http.Handler {
+	limit := strconv.Itoa(int(l.burst))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if opsPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		client, ok := clientIP(r)
+		if !ok {
+			// Unix sockets and the like: nothing to key on.
+			client = netip.IPv4Unspecified()
+		}
+
+		lim, err := l.safeTake(client, time.Now())
+		if err != nil {
+			rateLimiterErrors.Inc()
+			if failOpen {
+				slog.Warn("rate limiter failed, allowing request", "err", err)
+				next.ServeHTTP(w, r)
+				return
+			}
+			slog.Error("rate limiter failed, rejecting request", "err", err)
+			retryAfter.set(w.Header(), time.Second)
+			jsonWrite(w, http.StatusServiceUnavailable, map[string]string{"error": "Rate limiter unavailable", "code": "RATE_LIMITER_UNAVAILABLE"})
+			return
+		}
+		if headers {
+			h := w.Header()
+			h.Set("X-RateLimit-Limit", limit)
+			h.Set("X-RateLimit-Remaining", strconv.Itoa(lim.remaining))
+			h.Set("X-RateLimit-Reset", strconv.Itoa(int(math.Ceil(lim.reset.Seconds()))))
+		}
+		if !lim.allowed {
+			retryAfter.set(w.Header(), lim.retry)
+			jsonWrite(w, http.StatusTooManyRequests, map[string]string{"error": "Too many requests", "code": "RATE_LIMITED"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,166 @@
+// ratelimit_test.go
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRateLimitHeadersCountDown(t *testing.T) {
+	ta := newTestApp(t, map[string]string{"RATE_LIMIT_RPS": "0.01", "RATE_LIMIT_BURST": "3"})
+	for _, want := range []string{"2", "1", "0"} {
+		rec := ta.do(t, http.MethodGet, "/users", "")
+		wantStatus(t, rec, http.StatusOK)
+		h := rec.Header()
+		if h.Get("X-RateLimit-Limit") != "3" || h.Get("X-RateLimit-Remaining") != want || h.Get("X-RateLimit-Reset") == "" {
+			t.Fatalf("headers = %v, want remaining %s", h, want)
+		}
+	}
+	rec := ta.do(t, http.MethodGet, "/users", "")
+	wantStatus(t, rec, http.StatusTooManyRequests)
+	if rec.Header().Get("Retry-After") == "" || rec.Header().Get("X-RateLimit-Remaining") != "0" {
+		t.Fatalf("429 headers = %v", rec.Header())
+	}
+	// Probes are never limited.
+	wantStatus(t, ta.do(t, http.MethodGet, "/livez", ""), http.StatusOK)
+}
+
+func TestRateLimitHeadersDisabled(t *testing.T) {
+	ta := newTestApp(t, map[string]string{"RATE_LIMIT_RPS": "10", "RATE_LIMIT_HEADERS": "false"})
+	if h := ta.do(t, http.MethodGet, "/users", "").Header().Get("X-RateLimit-Limit"); h != "" {
+		t.Fatalf("X-RateLimit-Limit = %q with headers disabled", h)
+	}
+}
+
+func TestRateLimiterTake(t *testing.T) {
+	l := newRateLimiter(1, 2)
+	client := netip.MustParseAddr("192.0.2.1")
+	now := time.Now()
+	for i, want := range []bool{true, true, false} {
+		lim, err := l.take(client, now)
+		if err != nil || lim.allowed != want {
+			t.Fatalf("take %d = %+v, %v", i, lim, err)
+		}
+	}
+	lim, _ := l.take(client, now)
+	if lim.retry != time.Second || lim.reset != 2*time.Second {
+		t.Fatalf("empty bucket = %+v", lim)
+	}
+	// Another client has its own bucket.
+	if lim, _ := l.take(netip.MustParseAddr("192.0.2.2"), now); !lim.allowed || lim.remaining != 1 {
+		t.Fatalf("second client = %+v", lim)
+	}
+	if lim, _ := l.take(client, now.Add(1500*time.Millisecond)); !lim.allowed {
+		t.Fatalf("no refill after 1.5s: %+v", lim)
+	}
+}
+
+// saturatedLimiter has maxBuckets clients that have just spent their
+// tokens, so a new client can neither be added nor swept room for.
+func saturatedLimiter() *rateLimiter {
+	l := newRateLimiter(1, 1)
+	now := time.Now()
+	for i := range maxBuckets {
+		l.buckets[netip.AddrFrom4([4]byte{10, byte(i >> 16), byte(i >> 8), byte(i)})] = &bucket{last: now}
+	}
+	return l
+}
+
+func TestRateLimiterFailPolicy(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) })
+	broken := map[string]func() *rateLimiter{
+		"full":  saturatedLimiter,
+		"panic": func() *rateLimiter { return &rateLimiter{rate: 1, burst: 1} }, // nil map
+	}
+	for name, limiter := range broken {
+		for _, failOpen := range []bool{true, false} {
+			before := testutil.ToFloat64(rateLimiterErrors)
+			h := rateLimit(limiter(), remoteAddr, true, failOpen, retryAfterSeconds, ok)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/users", nil))
+
+			want := http.StatusServiceUnavailable
+			if failOpen {
+				want = http.StatusNoContent
+			}
+			if rec.Code != want {
+				t.Errorf("%s, failOpen=%v: status %d, want %d", name, failOpen, rec.Code, want)
+			}
+			if !failOpen && (jsonBody(t, rec)["code"] != "RATE_LIMITER_UNAVAILABLE" || rec.Header().Get("Retry-After") == "") {
+				t.Errorf("%s: fail-closed response = %v %s", name, rec.Header(), rec.Body)
+			}
+			if got := testutil.ToFloat64(rateLimiterErrors) - before; got != 1 {
+				t.Errorf("%s: limiter errors rose by %v", name, got)
+			}
+		}
+	}
+}
+
+func TestRateLimiterSweepsIdleClients(t *testing.T) {
+	l := saturatedLimiter()
+	if _, err := l.take(netip.MustParseAddr("192.0.2.1"), time.Now()); err != errLimiterFull {
+		t.Fatalf("take = %v, want errLimiterFull", err)
+	}
+	// Once the old buckets refill they are swept to make room.
+	if lim, err := l.take(netip.MustParseAddr("192.0.2.1"), time.Now().Add(2*time.Second)); err != nil || !lim.allowed {
+		t.Fatalf("take after refill = %+v, %v", lim, err)
+	}
+}
+
+func TestRetryAfterFormats(t *testing.T) {
+	// Burst 1 at 0.1 rps refills in 10s.
+	limited := func(format string) string {
+		ta := newTestApp(t, map[string]string{"RATE_LIMIT_RPS": "0.1", "RATE_LIMIT_BURST": "1", "RETRY_AFTER_FORMAT": format})
+		wantStatus(t, ta.do(t, http.MethodGet, "/users", ""), http.StatusOK)
+		rec := ta.do(t, http.MethodGet, "/users", "")
+		wantStatus(t, rec, http.StatusTooManyRequests)
+		return rec.Header().Get("Retry-After")
+	}
+	if got := limited("seconds"); got != "10" {
+		t.Fatalf("seconds Retry-After = %q, want 10", got)
+	}
+	before := time.Now()
+	got := limited("http-date")
+	at, err := http.ParseTime(got)
+	if err != nil {
+		t.Fatalf("http-date Retry-After = %q: %v", got, err)
+	}
+	if wait := at.Sub(before.Truncate(time.Second)); wait < 9*time.Second || wait > 12*time.Second {
+		t.Fatalf("Retry-After %s is %v away, want about 10s", got, wait)
+	}
+}
+
+func TestRetryAfterFormatSet(t *testing.T) {
+	for _, tt := range []struct {
+		d    time.Duration
+		want string
+	}{
+		{0, "1"},
+		{300 * time.Millisecond, "1"},
+		{1500 * time.Millisecond, "2"},
+		{time.Minute, "60"},
+	} {
+		h := http.Header{}
+		retryAfterSeconds.set(h, tt.d)
+		if got := h.Get("Retry-After"); got != tt.want {
+			t.Errorf("%v: Retry-After = %q, want %s", tt.d, got, tt.want)
+		}
+	}
+	h := http.Header{}
+	retryAfterHTTPDate.set(h, 0)
+	if at, err := http.ParseTime(h.Get("Retry-After")); err != nil || !at.After(time.Now().Add(-time.Second)) {
+		t.Fatalf("http-date for no wait = %q, %v", h.Get("Retry-After"), err)
+	}
+}
+
+func TestRetryAfterFormatValidated(t *testing.T) {
+	if err := loadConfigErr(t, map[string]string{"RETRY_AFTER_FORMAT": "minutes"}); !strings.Contains(err.Error(), "RETRY_AFTER_FORMAT") {
+		t.Fatal(err)
+	}
+}
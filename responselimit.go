@@ -0,0 +1,42 @@
+// responselimit.go
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// envelopeReserve is the space kept for the fields around a list of users
+// (cursor, flags, not_found) when fitting it under MAX_RESPONSE_BYTES.
+const envelopeReserve = 512
+
+// fitResponse returns how many of users fit in MAX_RESPONSE_BYTES. When they
+// don't all fit and the mode is "error" it answers 413 itself and returns
+// ok=false; in "truncate" mode the caller drops the rest and flags the
+// response as truncated.
+func (a *App) fitResponse(w http.ResponseWriter, users []*object) (n int, ok bool) {
+	limit := a.Config.MaxResponseBytes
+	if limit <= 0 {
+		return len(users), true
+	}
+	size := envelopeReserve
+	for i, u := range users {
+		b, err := json.Marshal(u)
+		if err != nil {
+			return len(users), true
+		}
+		size += len(b) + 1 // element plus separator
+		if size > limit {
+			if a.Config.ResponseLimitMode == "truncate" {
+				return i, true
+			}
+			jsonWrite(w, http.StatusRequestEntityTooLarge, map[string]string{
+				"error": fmt.Sprintf("response exceeds %d bytes, request a smaller page", limit),
+				"code":  "RESPONSE_TOO_LARGE",
+			})
+			return 0, false
+		}
+	}
+	return len(users), true
+}
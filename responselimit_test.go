@@ -0,0 +1,45 @@
+// responselimit_test.go
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func createUsers(t *testing.T, ta *testApp, n int) {
+	t.Helper()
+	for i := range n {
+		ta.createUser(t, fmt.Sprintf("user%02d", i), fmt.Sprintf("user%02d@example.com", i))
+	}
+}
+
+func TestMaxResponseBytesError(t *testing.T) {
+	ta := newTestApp(t, map[string]string{"MAX_RESPONSE_BYTES": "800"})
+	createUsers(t, ta, 10)
+	rec := ta.do(t, http.MethodGet, "/users", "")
+	wantStatus(t, rec, http.StatusRequestEntityTooLarge)
+	if got := jsonBody(t, rec)["code"]; got != "RESPONSE_TOO_LARGE" {
+		t.Fatalf("code = %v", got)
+	}
+	// A page that fits is unaffected.
+	wantStatus(t, ta.do(t, http.MethodGet, "/users?limit=2", ""), http.StatusOK)
+}
+
+func TestMaxResponseBytesTruncate(t *testing.T) {
+	ta := newTestApp(t, map[string]string{"MAX_RESPONSE_BYTES": "800", "RESPONSE_LIMIT_MODE": "truncate"})
+	createUsers(t, ta, 10)
+	rec := ta.do(t, http.MethodGet, "/users", "")
+	wantStatus(t, rec, http.StatusOK)
+	if rec.Body.Len() > 800 {
+		t.Fatalf("response is %d bytes", rec.Body.Len())
+	}
+	body := jsonBody(t, rec)
+	users := body["users"].([]any)
+	if body["truncated"] != true || len(users) == 0 || len(users) == 10 {
+		t.Fatalf("truncated = %v with %d users", body["truncated"], len(users))
+	}
+	if body["next_cursor"] == nil {
+		t.Fatal("truncated page has no next_cursor")
+	}
+}
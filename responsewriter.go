@@ -0,0 +1,55 @@
+// responsewriter.go
+package main
+
+import (
+	"log/slog"
+	"net/http"
+)
+
+// guardedWriter makes WriteHeader idempotent: the first status wins and
+// later calls (e.g. a handler and a timeout/recovery middleware both
+// responding) are dropped instead of triggering net/http's "superfluous
+// response.WriteHeader call" warning.
+type guardedWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (g *guardedWriter) WriteHeader(status int) {
+	if g.status != 0 {
+		slog.Debug("ignored superfluous WriteHeader", "status", status, "sent", g.status)
+		return
+	}
+	g.status = status
+	g.ResponseWriter.WriteHeader(status)
+}
+
+func (g *guardedWriter) Write(b []byte) (int, error) {
+	if g.status == 0 {
+		g.WriteHeader(http.StatusOK)
+	}
+	return g.ResponseWriter.Write(b)
+}
+
+func (g *guardedWriter) Flush() {
+	if f, ok := g.ResponseWriter.(http.Flusher); ok {
+		if g.status == 0 {
+			g.WriteHeader(http.StatusOK)
+		}
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (g *guardedWriter) Unwrap() http.ResponseWriter { return g.ResponseWriter }
+
+// guardResponses installs a guardedWriter; it belongs outermost so every
+// middleware and handler below shares it.
+func guardResponses(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := w.(*guardedWriter); !ok {
+			w = &guardedWriter{ResponseWriter: w}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,43 @@
+// responsewriter_test.go
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGuardedWriterFirstStatusWins(t *testing.T) {
+	rec := httptest.NewRecorder()
+	guardResponses(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("ok"))
+	})).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	wantStatus(t, rec, http.StatusCreated)
+	if rec.Body.String() != "ok" {
+		t.Fatalf("body = %q", rec.Body)
+	}
+}
+
+func TestGuardedWriterImplicitStatus(t *testing.T) {
+	rec := httptest.NewRecorder()
+	guardResponses(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+		w.WriteHeader(http.StatusNotFound)
+	})).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	wantStatus(t, rec, http.StatusOK)
+}
+
+func TestGuardResponsesWrapsOnce(t *testing.T) {
+	var inner http.ResponseWriter
+	h := guardResponses(guardResponses(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { inner = w })))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	g, ok := inner.(*guardedWriter)
+	if !ok {
+		t.Fatalf("handler got %T", inner)
+	}
+	if _, nested := g.ResponseWriter.(*guardedWriter); nested {
+		t.Fatal("guardedWriter wrapped twice")
+	}
+}
@@ -0,0 +1,209 @@
+// routes.go
+package main
+
+import (
+	"net/http"
+	"net/http/pprof"
+	"net/netip"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// registerPublicRoutes mounts the user-facing API.
+func (a *App) registerPublicRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/{$}", a.handleRoot)
+	mux.HandleFunc("/users", a.handleUsers)
+	mux.HandleFunc("/users/", a.handleUsers)
+	mux.HandleFunc("/events", a.handleEvents)
+	mux.HandleFunc("/healthz", a.handleHealthz)
+	mux.HandleFunc("/livez", a.handleLivez)
+	if a.Config.EnableGraphQL {
+		mux.HandleFunc("/graphql", a.graphQL(a.newUsersSchema()))
+	}
+	if a.Config.EnableTimeEndpoint {
+		mux.HandleFunc("/time", a.handleTime)
+	}
+}
+
+// registerAdminRoutes mounts metrics, debug and admin endpoints. They share
+// the public mux unless ADMIN_PORT gives them a server of their own.
+func (a *App) registerAdminRoutes(mux *http.ServeMux) {
+	if a.Config.MetricsExemplars {
+		// Exemplars exist only in the OpenMetrics format, served to scrapers
+		// that ask for it.
+		mux.Handle("/metrics", promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer,
+			promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{EnableOpenMetrics: true})))
+	} else {
+		mux.Handle("/metrics", promhttp.Handler())
+	}
+	mux.HandleFunc("/users/stats", a.requireAdmin(a.userStats))
+	mux.HandleFunc("GET /users/domains", a.requireAdmin(a.emailDomains))
+	mux.HandleFunc("POST /users/import", a.requireAdmin(a.importUsers))
+	mux.HandleFunc("/maintenance", a.requireAdmin(a.maintenanceMode))
+	mux.HandleFunc("/admin/db/reconnect", a.requireAdmin(a.dbReconnect))
+	mux.HandleFunc("GET /admin/db/info", a.requireAdmin(a.dbInfo))
+	mux.HandleFunc("GET /admin/db/ping-bench", a.requireAdmin(a.dbPingBench))
+	mux.HandleFunc("GET /admin/captures", a.requireAdmin(a.listCaptures))
+	mux.HandleFunc("GET /admin/config", a.requireAdmin(a.showConfig))
+	mux.HandleFunc("/admin/config/validate", a.requireAdmin(a.validateConfig))
+	mux.HandleFunc("GET /admin/readiness/history", a.requireAdmin(a.readinessHistory))
+	mux.HandleFunc("GET /admin/jobs", a.requireAdmin(a.listJobs))
+	mux.HandleFunc("/admin/jobs/drain", a.requireAdmin(a.drainJobs))
+	mux.HandleFunc("GET /admin/webhooks/deliveries", a.requireAdmin(a.listWebhookDeliveries))
+	if a.Config.Debug {
+		mux.HandleFunc("GET /users/random", a.requireAdmin(a.randomUser))
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+}
+
+// handlers builds the public server's handler and, with ADMIN_PORT, the
+// admin server's. Without ADMIN_PORT the admin routes share the public mux
+// and admin is nil.
+func (a *App) handlers() (public, admin http.Handler) {
+	mux := http.NewServeMux()
+	a.registerPublicRoutes(mux)
+	if a.Config.AdminPort == "" {
+		a.registerAdminRoutes(mux)
+		return a.publicHandler(mux), nil
+	}
+	adminMux := http.NewServeMux()
+	a.registerAdminRoutes(adminMux)
+	return a.publicHandler(mux), a.adminHandler(adminMux)
+}
+
+// jsonNotFound answers paths no route matches with the standard JSON error
+// shape instead of ServeMux's plain-text 404.
+func jsonNotFound(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, pattern := mux.Handler(r)
+		if pattern == "" {
+			writeNotFound(w)
+			return
+		}
+		withField(r.Context(), "route", pattern)
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func writeNotFound(w http.ResponseWriter) {
+	jsonWrite(w, http.StatusNotFound, map[string]string{"error": "Not Found", "code": "NOT_FOUND"})
+}
+
+func writeMethodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	jsonWrite(w, http.StatusMethodNotAllowed, map[string]string{"error": "Method Not Allowed", "code": "METHOD_NOT_ALLOWED"})
+}
+
+// isUserWrite reports whether r may change user data through the public
+// API, which REQUIRE_IDEMPOTENCY_KEY and load shedding apply to. Reads
+// sent as POST (/users/by-emails, GraphQL queries), ops paths and admin
+// routes (matched against admin) are not writes in this sense.
+func (a *App) isUserWrite(admin *http.ServeMux, r *http.Request) bool {
+	switch {
+	case r.Method == http.MethodGet, r.Method == http.MethodHead, r.Method == http.MethodOptions:
+		return false
+	case opsPaths[r.URL.Path]:
+		return false
+	case r.Method == http.MethodPost && r.URL.Path == "/users/by-emails":
+		return false
+	case r.Method == http.MethodPost && r.URL.Path == "/graphql" && a.Config.EnableGraphQL:
+		return isGraphQLMutation(r, a.Config.MaxBodyBytes)
+	}
+	_, pattern := admin.Handler(r)
+	return pattern == ""
+}
+
+func (a *App) clientIP(r *http.Request) (netip.Addr, bool) {
+	return clientIP(r, a.Config.TrustedProxies, a.Config.ClientIPHeader)
+}
+
+func (a *App) publicHandler(mux *http.ServeMux) http.Handler {
+	cfg := a.Config
+	handler := jsonNotFound(mux)
+	// A private copy of the admin routes tells the maintenance gate which
+	// requests to let through when they share this mux.
+	admin := http.NewServeMux()
+	a.registerAdminRoutes(admin)
+	handler = a.maintenanceGate(admin, handler)
+	if a.Shedder != nil {
+		handler = a.shedWrites(admin, handler)
+	}
+	if len(cfg.FieldScopes) > 0 {
+		handler = a.identify(handler)
+	}
+	var requireKey func(*http.Request) bool
+	if cfg.RequireIdempotencyKey {
+		requireKey = func(r *http.Request) bool { return a.isUserWrite(admin, r) }
+	}
+	handler = idempotency(a.Idempotency, cfg.MaxDecompressedBytes, a.idempotencyScope, requireKey, handler)
+	if a.Captures != nil {
+		handler = captureRequests(a.Captures, cfg.CaptureSampleRate, cfg.CaptureMaxBytes, a.clientIP, handler)
+	}
+	handler = decompressRequest(cfg.MaxDecompressedBytes, cfg.MaxImportBodyBytes, handler)
+	handler = limitBodies(cfg.MaxBodyBytes, cfg.MaxImportBodyBytes, handler)
+	if cfg.MaxQueryParams > 0 {
+		handler = limitQueryParams(cfg.MaxQueryParams, handler)
+	}
+	if cfg.RejectGetBody {
+		handler = rejectGetBody(handler)
+	}
+	if cfg.DuplicateSlashes != "redirect" {
+		handler = duplicateSlashes(cfg.DuplicateSlashes == "reject", handler)
+	}
+	if cfg.RateLimitRPS > 0 {
+		limiter := newRateLimiter(cfg.RateLimitRPS, cfg.RateLimitBurst)
+		handler = rateLimit(limiter, a.clientIP, cfg.RateLimitHeaders, cfg.RateLimitFailOpen, cfg.RetryAfterFormat, handler)
+	}
+	if cfg.ForceHTTPS {
+		handler = forceHTTPS(cfg.TrustedProxies, handler)
+	}
+	if cfg.RouteTimingMetrics {
+		handler = timeRoutes(mux, cfg.MetricsExemplars, handler)
+	}
+	if cfg.AccessLog {
+		handler = accessLog(handler)
+	}
+	handler = requestIDMiddleware(handler)
+	if cfg.CompressResponses {
+		handler = compressResponses(cfg.CompressMinBytes, handler)
+	}
+	if cfg.JSONAPI {
+		handler = negotiateJSONAPI(handler)
+	}
+	if cfg.ProblemJSON != "off" {
+		handler = negotiateProblems(cfg.ProblemJSON == "always", handler)
+	}
+	handler = cacheControl(cfg.CacheControl, handler)
+	handler = guardResponses(handler)
+	return handler
+}
+
+func (a *App) adminHandler(mux *http.ServeMux) http.Handler {
+	handler := jsonNotFound(mux)
+	if len(a.Config.FieldScopes) > 0 {
+		handler = a.identify(handler)
+	}
+	handler = limitBodies(a.Config.MaxBodyBytes, a.Config.MaxImportBodyBytes, handler)
+	if a.Config.DuplicateSlashes != "redirect" {
+		handler = duplicateSlashes(a.Config.DuplicateSlashes == "reject", handler)
+	}
+	if a.Config.RouteTimingMetrics {
+		handler = timeRoutes(mux, a.Config.MetricsExemplars, handler)
+	}
+	if a.Config.AccessLog {
+		handler = accessLog(handler)
+	}
+	handler = requestIDMiddleware(handler)
+	if a.Config.ProblemJSON != "off" {
+		handler = negotiateProblems(a.Config.ProblemJSON == "always", handler)
+	}
+	handler = cacheControl(a.Config.CacheControl, handler)
+	handler = guardResponses(handler)
+	return handler
+}
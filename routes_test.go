@@ -0,0 +1,76 @@
+// routes_test.go
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func serve(h http.Handler, method, target string, header ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	return rec
+}
+
+func TestAdminPortSplitsRoutes(t *testing.T) {
+	ta := newTestApp(t, map[string]string{"ADMIN_PORT": "9091", "ADMIN_TOKEN": "secret"})
+	public, admin := ta.handlers()
+	if admin == nil {
+		t.Fatal("no admin handler with ADMIN_PORT set")
+	}
+	for _, path := range []string{"/metrics", "/users/stats", "/admin/config"} {
+		if rec := serve(public, http.MethodGet, path, adminAuth...); rec.Code == http.StatusOK {
+			t.Errorf("public %s = 200", path)
+		}
+		if rec := serve(admin, http.MethodGet, path, adminAuth...); rec.Code != http.StatusOK {
+			t.Errorf("admin %s = %d", path, rec.Code)
+		}
+	}
+	if rec := serve(admin, http.MethodGet, "/users"); rec.Code != http.StatusNotFound {
+		t.Errorf("admin /users = %d, want 404", rec.Code)
+	}
+	if rec := serve(public, http.MethodGet, "/users"); rec.Code != http.StatusOK {
+		t.Errorf("public /users = %d", rec.Code)
+	}
+}
+
+func TestAdminRoutesSharePublicMuxByDefault(t *testing.T) {
+	ta := newTestApp(t, nil)
+	public, admin := ta.handlers()
+	if admin != nil {
+		t.Fatal("admin handler without ADMIN_PORT")
+	}
+	wantStatus(t, serve(public, http.MethodGet, "/metrics"), http.StatusOK)
+}
+
+func TestUnknownPathsUniformJSON(t *testing.T) {
+	ta := newTestApp(t, nil)
+	tests := []struct {
+		method, path string
+		status       int
+		code         string
+	}{
+		{http.MethodGet, "/unknown", http.StatusNotFound, "NOT_FOUND"},
+		{http.MethodPost, "/nope/deeper", http.StatusNotFound, "NOT_FOUND"},
+		{http.MethodPost, "/", http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED"},
+		{http.MethodDelete, "/users", http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			rec := ta.do(t, tt.method, tt.path, "")
+			wantStatus(t, rec, tt.status)
+			if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+				t.Errorf("Content-Type = %q", ct)
+			}
+			body := jsonBody(t, rec)
+			if body["code"] != tt.code || body["error"] == nil {
+				t.Errorf("body = %v", body)
+			}
+		})
+	}
+}
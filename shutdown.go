@@ -0,0 +1,58 @@
+// shutdown.go
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// shutdownStep closes one component within its own timeout.
+type shutdownStep struct {
+	name    string
+	timeout time.Duration
+	close   func(context.Context) error
+}
+
+// shutdownCoordinator closes components in reverse registration order.
+// Register each component right after starting it, so whatever depends on
+// it (registered later) is closed first: servers stop accepting and drain,
+// then background jobs and the event hub stop, and the DB pool goes last.
+type shutdownCoordinator struct {
+	steps []shutdownStep
+}
+
+func (s *shutdownCoordinator) register(name string, timeout time.Duration, close func(context.Context) error) {
+	s.steps = append(s.steps, shutdownStep{name: name, timeout: timeout, close: close})
+}
+
+// run executes every step, even after failures, and joins their errors. A
+// step that ignores its context is abandoned once its timeout passes.
+func (s *shutdownCoordinator) run() error {
+	var errs []error
+	for i := len(s.steps) - 1; i >= 0; i-- {
+		step := s.steps[i]
+		start := time.Now()
+		if err := step.run(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", step.name, err))
+			continue
+		}
+		slog.Debug("shutdown step done", "step", step.name, "duration", time.Since(start))
+	}
+	return errors.Join(errs...)
+}
+
+func (step shutdownStep) run() error {
+	ctx, cancel := context.WithTimeout(context.Background(), step.timeout)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- step.close(ctx) }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,56 @@
+// shutdown_test.go
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestShutdownRunsInReverseOrder(t *testing.T) {
+	var order []string
+	var s shutdownCoordinator
+	for _, name := range []string{"database", "event hub", "background jobs", "http servers"} {
+		s.register(name, time.Second, func(context.Context) error {
+			order = append(order, name)
+			return nil
+		})
+	}
+	if err := s.run(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"http servers", "background jobs", "event hub", "database"}; !slices.Equal(order, want) {
+		t.Fatalf("order = %v, want %v", order, want)
+	}
+}
+
+func TestShutdownJoinsErrorsAndTimeouts(t *testing.T) {
+	boom := errors.New("boom")
+	release := make(chan struct{})
+	t.Cleanup(func() { close(release) })
+	var ran []string
+	var s shutdownCoordinator
+	s.register("database", time.Second, func(context.Context) error {
+		ran = append(ran, "database")
+		return nil
+	})
+	s.register("stuck", 20*time.Millisecond, func(context.Context) error {
+		<-release // ignores its context
+		return nil
+	})
+	s.register("failing", time.Second, func(context.Context) error { return boom })
+
+	start := time.Now()
+	err := s.run()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("run took %v; the stuck step was not abandoned", elapsed)
+	}
+	if !errors.Is(err, boom) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want both step errors", err)
+	}
+	if !slices.Equal(ran, []string{"database"}) {
+		t.Fatal("steps after a failure were skipped")
+	}
+}
@@ -0,0 +1,192 @@
+// sse.go
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+)
+
+var errTooManySubscribers = errors.New("too many subscribers")
+
+type event struct {
+	Type string `json:"type"`
+	Data any    `json:"data"`
+}
+
+type subscriber struct {
+	ch chan []byte
+}
+
+// Overflow policies for the hub's central queue.
+const (
+	overflowDropOldest = "drop_oldest"
+	overflowDropNew    = "drop_new"
+	overflowBlock      = "block"
+)
+
+// broadcaster fans events out to SSE subscribers. publish enqueues onto a
+// bounded central queue handled per the overflow policy; a dispatcher
+// goroutine delivers to subscribers without blocking, dropping any subscriber
+// whose buffer is full so one slow client cannot stall everyone else.
+type broadcaster struct {
+	mu      sync.Mutex
+	subs    map[*subscriber]struct{}
+	max     int
+	bufSize int
+
+	queue    chan []byte
+	overflow string
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+func newBroadcaster(max, bufSize, queueSize int, overflow string) *broadcaster {
+	b := &broadcaster{
+		subs:     make(map[*subscriber]struct{}),
+		max:      max,
+		bufSize:  bufSize,
+		queue:    make(chan []byte, queueSize),
+		overflow: overflow,
+		done:     make(chan struct{}),
+	}
+	go b.run()
+	return b
+}
+
+func (b *broadcaster) subscribe() (*subscriber, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.subs) >= b.max {
+		return nil, errTooManySubscribers
+	}
+	s := &subscriber{ch: make(chan []byte, b.bufSize)}
+	b.subs[s] = struct{}{}
+	return s, nil
+}
+
+func (b *broadcaster) unsubscribe(s *subscriber) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.subs[s]; ok {
+		delete(b.subs, s)
+		close(s.ch)
+	}
+}
+
+func (b *broadcaster) publish(ev event) {
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		slog.Error("sse: encode event", "type", ev.Type, "err", err)
+		return
+	}
+
+	switch b.overflow {
+	case overflowBlock:
+		select {
+		case b.queue <- payload:
+		case <-b.done:
+		}
+	case overflowDropNew:
+		select {
+		case b.queue <- payload:
+		default:
+			eventsDropped.WithLabelValues("hub_overflow").Inc()
+		}
+	default: // overflowDropOldest
+		for {
+			select {
+			case b.queue <- payload:
+				return
+			default:
+			}
+			select {
+			case <-b.queue:
+				eventsDropped.WithLabelValues("hub_overflow").Inc()
+			default:
+			}
+		}
+	}
+}
+
+func (b *broadcaster) run() {
+	for {
+		select {
+		case <-b.done:
+			return
+		case payload := <-b.queue:
+			b.dispatch(payload)
+		}
+	}
+}
+
+func (b *broadcaster) dispatch(payload []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for s := range b.subs {
+		select {
+		case s.ch <- payload:
+		default:
+			slog.Warn("sse: dropping slow subscriber", "buffer", b.bufSize)
+			eventsDropped.WithLabelValues("slow_subscriber").Inc()
+			delete(b.subs, s)
+			close(s.ch)
+		}
+	}
+}
+
+// stop halts the dispatcher and disconnects all subscribers.
+func (b *broadcaster) stop() {
+	b.stopOnce.Do(func() {
+		close(b.done)
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		for s := range b.subs {
+			delete(b.subs, s)
+			close(s.ch)
+		}
+	})
+}
+
+func (a *App) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		jsonWrite(w, http.StatusInternalServerError, map[string]string{"error": "streaming unsupported"})
+		return
+	}
+
+	sub, err := a.Events.subscribe()
+	if err != nil {
+		jsonWrite(w, http.StatusServiceUnavailable, map[string]string{"error": "Too many subscribers"})
+		return
+	}
+	defer a.Events.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case payload, ok := <-sub.ch:
+			if !ok {
+				return
+			}
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", payload); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
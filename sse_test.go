@@ -0,0 +1,159 @@
+// sse_test.go
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func receive(t *testing.T, s *subscriber) ([]byte, bool) {
+	t.Helper()
+	select {
+	case payload, ok := <-s.ch:
+		return payload, ok
+	case <-time.After(2 * time.Second):
+		t.Fatal("no event within 2s")
+		return nil, false
+	}
+}
+
+func TestBroadcasterDropsSlowSubscriber(t *testing.T) {
+	b := newBroadcaster(10, 1, 16, overflowDropOldest)
+	defer b.stop()
+	slow, _ := b.subscribe()
+	fast, _ := b.subscribe()
+
+	// One event at a time, so only the subscriber that never reads falls
+	// behind.
+	for i := range 3 {
+		b.publish(event{Type: "tick", Data: i})
+		if _, ok := receive(t, fast); !ok {
+			t.Fatalf("fast subscriber dropped at event %d", i)
+		}
+	}
+
+	if _, ok := receive(t, slow); !ok {
+		t.Fatal("slow subscriber lost its buffered event")
+	}
+	if _, ok := receive(t, slow); ok {
+		t.Fatal("slow subscriber still subscribed after its buffer filled")
+	}
+}
+
+func TestBroadcasterSubscriberLimit(t *testing.T) {
+	b := newBroadcaster(2, 1, 16, overflowDropOldest)
+	defer b.stop()
+	first, _ := b.subscribe()
+	if _, err := b.subscribe(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.subscribe(); !errors.Is(err, errTooManySubscribers) {
+		t.Fatalf("third subscribe: %v, want errTooManySubscribers", err)
+	}
+	b.unsubscribe(first)
+	if _, err := b.subscribe(); err != nil {
+		t.Fatalf("subscribe after unsubscribe: %v", err)
+	}
+}
+
+func TestEventsAtSubscriberLimit(t *testing.T) {
+	ta := newTestApp(t, map[string]string{"SSE_MAX_SUBSCRIBERS": "1"})
+	if _, err := ta.Events.subscribe(); err != nil {
+		t.Fatal(err)
+	}
+	wantStatus(t, ta.do(t, http.MethodGet, "/events", ""), http.StatusServiceUnavailable)
+}
+
+func TestUserCreatedEventCarriesOnlyID(t *testing.T) {
+	ta := newTestApp(t, nil)
+	sub, err := ta.Events.subscribe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := ta.createUser(t, "ann", "ann@example.com")
+
+	payload, ok := receive(t, sub)
+	if !ok {
+		t.Fatal("subscriber closed")
+	}
+	if want := fmt.Sprintf(`{"type":"user.created","data":{"user_id":%d}}`, id); string(payload) != want {
+		t.Fatalf("event = %s, want %s", payload, want)
+	}
+}
+
+// hubWithoutDispatcher is a broadcaster whose queue nothing drains, so a
+// test can fill it.
+func hubWithoutDispatcher(queueSize int, overflow string) *broadcaster {
+	return &broadcaster{
+		subs:     make(map[*subscriber]struct{}),
+		queue:    make(chan []byte, queueSize),
+		overflow: overflow,
+		done:     make(chan struct{}),
+	}
+}
+
+func queued(b *broadcaster) []string {
+	var out []string
+	for len(b.queue) > 0 {
+		var ev event
+		json.Unmarshal(<-b.queue, &ev)
+		out = append(out, fmt.Sprint(ev.Data))
+	}
+	return out
+}
+
+func TestHubOverflowPolicies(t *testing.T) {
+	tests := []struct {
+		overflow string
+		want     []string
+	}{
+		{overflowDropOldest, []string{"3", "4"}},
+		{overflowDropNew, []string{"0", "1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.overflow, func(t *testing.T) {
+			dropped := testutil.ToFloat64(eventsDropped.WithLabelValues("hub_overflow"))
+			b := hubWithoutDispatcher(2, tt.overflow)
+			for i := range 5 {
+				b.publish(event{Type: "tick", Data: i})
+			}
+			if got := queued(b); !slices.Equal(got, tt.want) {
+				t.Fatalf("queue = %v, want %v", got, tt.want)
+			}
+			if n := testutil.ToFloat64(eventsDropped.WithLabelValues("hub_overflow")) - dropped; n != 3 {
+				t.Fatalf("dropped counter rose by %v, want 3", n)
+			}
+		})
+	}
+}
+
+func TestHubOverflowBlock(t *testing.T) {
+	b := hubWithoutDispatcher(1, overflowBlock)
+	b.publish(event{Type: "tick", Data: 0})
+	published := make(chan struct{})
+	go func() {
+		b.publish(event{Type: "tick", Data: 1})
+		close(published)
+	}()
+	select {
+	case <-published:
+		t.Fatal("publish into a full queue did not block")
+	case <-time.After(50 * time.Millisecond):
+	}
+	<-b.queue
+	select {
+	case <-published:
+	case <-time.After(2 * time.Second):
+		t.Fatal("publish still blocked after the queue drained")
+	}
+	if got := queued(b); !slices.Equal(got, []string{"1"}) {
+		t.Fatalf("queue = %v", got)
+	}
+}
@@ -0,0 +1,130 @@
+// stats.go
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type userStats struct {
+	Total   int64 `json:"total"`
+	Last24h int64 `json:"created_last_24h"`
+	Last7d  int64 `json:"created_last_7d"`
+	Last30d int64 `json:"created_last_30d"`
+}
+
+// userStatsStrings is userStats with the counts as JSON strings
+// (LARGE_NUMBERS_AS_STRING), exact in JavaScript clients past 2^53.
+type userStatsStrings struct {
+	Total   int64 `json:"total,string"`
+	Last24h int64 `json:"created_last_24h,string"`
+	Last7d  int64 `json:"created_last_7d,string"`
+	Last30d int64 `json:"created_last_30d,string"`
+}
+
+// statsCache holds the last computed userStats for ttl, so dashboards
+// polling /users/stats don't each run the aggregate.
+type statsCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	value   userStats
+	expires time.Time
+}
+
+func (c *statsCache) get(ctx context.Context, load func(context.Context) (userStats, error)) (userStats, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Now().Before(c.expires) {
+		return c.value, nil
+	}
+	v, err := load(ctx)
+	if err != nil {
+		return userStats{}, err
+	}
+	c.value, c.expires = v, time.Now().Add(c.ttl)
+	return v, nil
+}
+
+func (a *App) userStats(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), a.Config.QueryTimeout)
+	defer cancel()
+
+	stats, err := a.Stats.get(ctx, a.Store.UserStats)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if a.Config.LargeNumbersAsString {
+		jsonWrite(w, http.StatusOK, userStatsStrings(stats))
+		return
+	}
+	jsonWrite(w, http.StatusOK, stats)
+}
+
+// domainCount is one row of /users/domains. Domain is nil for emails with
+// no "@" (and NULL legacy emails), grouped together.
+type domainCount struct {
+	Domain *string `json:"domain"`
+	Users  int64   `json:"users"`
+}
+
+// domainCountString is domainCount with Users as a JSON string
+// (LARGE_NUMBERS_AS_STRING).
+type domainCountString struct {
+	Domain *string `json:"domain"`
+	Users  int64   `json:"users,string"`
+}
+
+// emailDomains lists the most common email domains with their user counts,
+// largest first. limit defaults to 20 and is capped at DOMAINS_MAX_LIMIT.
+func (a *App) emailDomains(w http.ResponseWriter, r *http.Request) {
+	limit := 20
+	if v := r.URL.Query().Get("limit"); v != "" {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 {
+			jsonWrite(w, http.StatusBadRequest, map[string]string{"error": "limit must be a positive integer"})
+			return
+		}
+	}
+	limit = min(limit, a.Config.DomainsMaxLimit)
+
+	ctx, cancel := context.WithTimeout(r.Context(), a.Config.QueryTimeout)
+	defer cancel()
+
+	domains, err := a.Store.EmailDomains(ctx, limit)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if a.Config.LargeNumbersAsString {
+		out := make([]domainCountString, len(domains))
+		for i, d := range domains {
+			out[i] = domainCountString(d)
+		}
+		jsonWrite(w, http.StatusOK, map[string]any{"domains": out})
+		return
+	}
+	jsonWrite(w, http.StatusOK, map[string]any{"domains": domains})
+}
+
+// randomUser serves a random existing user, for generating realistic
+// load-test traffic.
+func (a *App) randomUser(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), a.Config.QueryTimeout)
+	defer cancel()
+
+	u, err := a.Store.RandomUser(ctx)
+	if errors.Is(err, errUserNotFound) {
+		jsonWrite(w, http.StatusNotFound, map[string]string{"error": "No users"})
+		return
+	}
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	jsonWrite(w, http.StatusOK, a.userBody(r.Context(), u))
+}
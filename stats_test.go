@@ -0,0 +1,188 @@
+// stats_test.go
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestUserStatsBuckets(t *testing.T) {
+	ta := newTestApp(t, map[string]string{"ADMIN_TOKEN": "secret"})
+	ages := map[string]time.Duration{
+		"new":   time.Hour,
+		"week":  3 * 24 * time.Hour,
+		"month": 20 * 24 * time.Hour,
+		"old":   90 * 24 * time.Hour,
+	}
+	store := ta.Store.(*memoryStore)
+	for name, age := range ages {
+		id := ta.createUser(t, name, name+"@example.com")
+		store.mu.Lock()
+		store.created[id] = time.Now().Add(-age)
+		store.mu.Unlock()
+	}
+
+	wantStatus(t, ta.do(t, http.MethodGet, "/users/stats", ""), http.StatusUnauthorized)
+	rec := ta.do(t, http.MethodGet, "/users/stats", "", adminAuth...)
+	wantStatus(t, rec, http.StatusOK)
+	want := map[string]any{"total": 4.0, "created_last_24h": 1.0, "created_last_7d": 2.0, "created_last_30d": 3.0}
+	for k, v := range want {
+		if got := jsonBody(t, rec)[k]; got != v {
+			t.Errorf("%s = %v, want %v", k, got, v)
+		}
+	}
+}
+
+func TestUserStatsCached(t *testing.T) {
+	ta := newTestApp(t, map[string]string{"ADMIN_TOKEN": "secret", "STATS_CACHE_TTL": "1h"})
+	ta.createUser(t, "ann", "ann@example.com")
+	jsonBody(t, ta.do(t, http.MethodGet, "/users/stats", "", adminAuth...))
+	ta.createUser(t, "bob", "bob@example.com")
+	if got := jsonBody(t, ta.do(t, http.MethodGet, "/users/stats", "", adminAuth...))["total"]; got != 1.0 {
+		t.Fatalf("total = %v, want the cached 1", got)
+	}
+}
+
+func TestRandomUser(t *testing.T) {
+	ta := newTestApp(t, map[string]string{"DEBUG": "true", "ADMIN_TOKEN": "secret"})
+	wantStatus(t, ta.do(t, http.MethodGet, "/users/random", "", adminAuth...), http.StatusNotFound)
+
+	ids := map[float64]bool{}
+	for _, name := range []string{"ann", "bob", "cy"} {
+		ids[float64(ta.createUser(t, name, name+"@example.com"))] = true
+	}
+	for range 10 {
+		rec := ta.do(t, http.MethodGet, "/users/random", "", adminAuth...)
+		wantStatus(t, rec, http.StatusOK)
+		if id := jsonBody(t, rec)["user_id"].(float64); !ids[id] {
+			t.Fatalf("random user %v does not exist", id)
+		}
+	}
+}
+
+func TestRandomUserNeedsDebug(t *testing.T) {
+	ta := newTestApp(t, map[string]string{"ADMIN_TOKEN": "secret"})
+	ta.createUser(t, "ann", "ann@example.com")
+	if rec := ta.do(t, http.MethodGet, "/users/random", "", adminAuth...); rec.Code == http.StatusOK {
+		t.Fatalf("served without DEBUG: %s", rec.Body)
+	}
+}
+
+func TestLargeNumbersAsString(t *testing.T) {
+	for _, asString := range []bool{false, true} {
+		t.Run(fmt.Sprint("as_string=", asString), func(t *testing.T) {
+			ta := newTestApp(t, map[string]string{"ADMIN_TOKEN": "secret", "LARGE_NUMBERS_AS_STRING": strconv.FormatBool(asString)})
+			ta.createUser(t, "ann", "ann@example.com")
+			ta.createUser(t, "bob", "bob@example.com")
+			want := func(n int) any {
+				if asString {
+					return strconv.Itoa(n)
+				}
+				return float64(n)
+			}
+
+			rec := ta.do(t, http.MethodGet, "/users/stats", "", adminAuth...)
+			wantStatus(t, rec, http.StatusOK)
+			body := jsonBody(t, rec)
+			for _, k := range []string{"total", "created_last_24h", "created_last_7d", "created_last_30d"} {
+				if got := body[k]; got != want(2) {
+					t.Errorf("%s = %#v, want %#v", k, got, want(2))
+				}
+			}
+
+			rec = ta.do(t, http.MethodGet, "/users/domains", "", adminAuth...)
+			wantStatus(t, rec, http.StatusOK)
+			domains := jsonBody(t, rec)["domains"].([]any)
+			if len(domains) != 1 {
+				t.Fatalf("domains = %v", domains)
+			}
+			if d := domains[0].(map[string]any); d["domain"] != "example.com" || d["users"] != want(2) {
+				t.Errorf("domain = %#v, want users %#v", d, want(2))
+			}
+		})
+	}
+}
+
+// domainsOf renders a /users/domains response as "domain=count" strings,
+// with "null" for the addresses without a domain.
+func domainsOf(t *testing.T, rec *httptest.ResponseRecorder) []string {
+	t.Helper()
+	wantStatus(t, rec, http.StatusOK)
+	var got []string
+	for _, d := range jsonBody(t, rec)["domains"].([]any) {
+		d := d.(map[string]any)
+		got = append(got, fmt.Sprintf("%v=%v", cmp.Or(d["domain"], any("null")), d["users"]))
+	}
+	return got
+}
+
+func TestEmailDomains(t *testing.T) {
+	ta := newTestApp(t, map[string]string{"ADMIN_TOKEN": "secret", "DOMAINS_MAX_LIMIT": "3"})
+	for i, email := range []string{
+		"a@example.com", "b@Example.COM", "c@example.com",
+		"d@corp.io", "e@corp.io",
+		"f@b.org", "g@a.org",
+	} {
+		ta.createUser(t, fmt.Sprintf("user%d", i), email)
+	}
+	// Legacy rows predating validation.
+	store := ta.Store.(*memoryStore)
+	store.mu.Lock()
+	store.users[100] = User{ID: 100, Username: "legacy", Email: "no-domain"}
+	store.users[101] = User{ID: 101, Username: "legacy2", NullEmail: true}
+	store.mu.Unlock()
+
+	wantStatus(t, ta.do(t, http.MethodGet, "/users/domains", ""), http.StatusUnauthorized)
+	rec := ta.do(t, http.MethodGet, "/users/domains?limit=10", "", adminAuth...)
+	if got := domainsOf(t, rec); !slices.Equal(got, []string{"example.com=3", "corp.io=2", "null=2"}) {
+		t.Fatalf("domains = %v, want the largest 3 with null after corp.io", got)
+	}
+
+	ta.Config.DomainsMaxLimit = 100
+	got := domainsOf(t, ta.do(t, http.MethodGet, "/users/domains", "", adminAuth...))
+	if !slices.Equal(got, []string{"example.com=3", "corp.io=2", "null=2", "a.org=1", "b.org=1"}) {
+		t.Fatalf("domains = %v", got)
+	}
+	if got := domainsOf(t, ta.do(t, http.MethodGet, "/users/domains?limit=1", "", adminAuth...)); !slices.Equal(got, []string{"example.com=3"}) {
+		t.Fatalf("limit=1 domains = %v", got)
+	}
+	for _, limit := range []string{"0", "-1", "x"} {
+		wantStatus(t, ta.do(t, http.MethodGet, "/users/domains?limit="+limit, "", adminAuth...), http.StatusBadRequest)
+	}
+}
+
+// TestEmailDomainsPostgres groups a session-local copy of the users table,
+// which the store's unqualified table name resolves to.
+func TestEmailDomainsPostgres(t *testing.T) {
+	db := testDB(t)
+	db.SetMaxOpenConns(1)
+	ctx := context.Background()
+	if _, err := db.ExecContext(ctx, `CREATE TEMP TABLE users (LIKE public.users INCLUDING ALL);
+		INSERT INTO users (username, email) VALUES
+		  ('a', 'a@example.com'), ('b', 'b@EXAMPLE.com'), ('c', 'c@x@corp.io'),
+		  ('d', 'd@corp.io'), ('e', 'no-domain'), ('f', 'f@b.org')`); err != nil {
+		t.Fatal(err)
+	}
+	domains, err := (&pgStore{db: db}).EmailDomains(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, d := range domains {
+		domain := "null"
+		if d.Domain != nil {
+			domain = *d.Domain
+		}
+		got = append(got, fmt.Sprintf("%s=%d", domain, d.Users))
+	}
+	if !slices.Equal(got, []string{"corp.io=2", "example.com=2", "b.org=1", "null=1"}) {
+		t.Fatalf("domains = %v", got)
+	}
+}
@@ -0,0 +1,107 @@
+// store.go
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+var (
+	errUserNotFound   = errors.New("user not found")
+	errDuplicateEmail = errors.New("email already exists")
+	// errDuplicateUsername is only returned with UNIQUE_USERNAMES.
+	errDuplicateUsername = errors.New("username already exists")
+	errValueTooLong      = errors.New("value too long for column")
+	errPoolExhausted     = errors.New("timed out acquiring a database connection")
+)
+
+// checkViolationError reports a failed CHECK constraint (SQLSTATE 23514).
+type checkViolationError struct {
+	Constraint string
+}
+
+func (e *checkViolationError) Error() string {
+	return "check constraint violated: " + e.Constraint
+}
+
+type User struct {
+	ID       int32
+	Username string
+	Email    string
+	// NullUsername and NullEmail mark NULL columns in legacy rows; the
+	// matching string is empty.
+	NullUsername bool
+	NullEmail    bool
+}
+
+// userUpdate changes the non-nil fields of one user.
+type userUpdate struct {
+	ID       int32
+	Username *string
+	Email    *string
+}
+
+// Per-item outcomes of a batch update.
+const (
+	updateUpdated    = "updated"
+	updateNotFound   = "not_found"
+	updateError      = "error"
+	updateRolledBack = "rolled_back"
+)
+
+type updateResult struct {
+	UserID int32  `json:"user_id"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	err    error
+}
+
+// isClientWriteError reports whether err is caused by the submitted data
+// rather than by the database.
+func isClientWriteError(err error) bool {
+	var cv *checkViolationError
+	return errors.Is(err, errDuplicateEmail) || errors.Is(err, errDuplicateUsername) ||
+		errors.Is(err, errValueTooLong) || errors.As(err, &cv)
+}
+
+func markRolledBack(results []updateResult) {
+	for i := range results {
+		if results[i].Status == updateUpdated {
+			results[i].Status = updateRolledBack
+		}
+	}
+}
+
+// userStore is the persistence boundary for users. pgStore is the default;
+// memoryStore backs STORAGE=memory for demos and handler tests.
+type userStore interface {
+	CreateUser(ctx context.Context, username, email string) (int32, error)
+	GetUser(ctx context.Context, id int32) (User, error)
+	// GetUserByEmail matches case-insensitively.
+	GetUserByEmail(ctx context.Context, email string) (User, error)
+	// ListUsers returns the rows read so far alongside the context error
+	// when ctx expires mid-iteration.
+	ListUsers(ctx context.Context, p pageParams) ([]User, error)
+	// ListUsersByEmails expects lowercased emails.
+	ListUsersByEmails(ctx context.Context, emails []string) ([]User, error)
+	// UpdateUsers applies items in one transaction. An item failing on a
+	// client-level error (duplicate email, constraint) is reported in its
+	// result; with atomic set it also rolls back the whole batch, reported
+	// as committed=false. not_found never aborts the batch.
+	UpdateUsers(ctx context.Context, items []userUpdate, atomic bool) (results []updateResult, committed bool, err error)
+	DeleteUser(ctx context.Context, id int32) error
+	UserStats(ctx context.Context) (userStats, error)
+	// EmailDomains returns the limit most common lowercased email domains,
+	// by count descending, then domain.
+	EmailDomains(ctx context.Context, limit int) ([]domainCount, error)
+	// RandomUser returns errUserNotFound when there are no users.
+	RandomUser(ctx context.Context) (User, error)
+	// InsertUsers adds all rows or, on any error, none, and returns their
+	// ids in row order. CopyUsers does the same without the ids, faster
+	// for large batches.
+	InsertUsers(ctx context.Context, rows []createUserReq) ([]int32, error)
+	CopyUsers(ctx context.Context, rows []createUserReq) (int64, error)
+	// SeedUser creates the user only while there are no users at all, and
+	// reports whether it did.
+	SeedUser(ctx context.Context, username, email string) (bool, error)
+}
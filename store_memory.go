@@ -0,0 +1,339 @@
+// store_memory.go
+package main
+
+import (
+	"context"
+	"math/rand/v2"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memoryStore keeps users in process memory. Email uniqueness is enforced
+// case-insensitively, matching the users_email_key index, and so is
+// username uniqueness with uniqueUsernames (UNIQUE_USERNAMES).
+type memoryStore struct {
+	mu      sync.RWMutex
+	nextID  int32
+	users   map[int32]User
+	byEmail map[string]int32
+	created map[int32]time.Time
+
+	uniqueUsernames bool
+}
+
+func newMemoryStore(uniqueUsernames bool) *memoryStore {
+	return &memoryStore{
+		users:           make(map[int32]User),
+		byEmail:         make(map[string]int32),
+		created:         make(map[int32]time.Time),
+		uniqueUsernames: uniqueUsernames,
+	}
+}
+
+// usernameTaken reports whether a user other than except has username,
+// ignoring case. A scan is fine at the sizes this store is meant for.
+func (s *memoryStore) usernameTaken(username string, except int32) bool {
+	if !s.uniqueUsernames {
+		return false
+	}
+	for id, u := range s.users {
+		if id != except && strings.EqualFold(u.Username, username) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *memoryStore) CreateUser(_ context.Context, username, email string) (int32, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := strings.ToLower(email)
+	if _, ok := s.byEmail[key]; ok {
+		return 0, errDuplicateEmail
+	}
+	if s.usernameTaken(username, 0) {
+		return 0, errDuplicateUsername
+	}
+	s.nextID++
+	s.users[s.nextID] = User{ID: s.nextID, Username: username, Email: email}
+	s.byEmail[key] = s.nextID
+	s.created[s.nextID] = time.Now()
+	return s.nextID, nil
+}
+
+func (s *memoryStore) GetUser(_ context.Context, id int32) (User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	u, ok := s.users[id]
+	if !ok {
+		return User{}, errUserNotFound
+	}
+	return u, nil
+}
+
+func (s *memoryStore) GetUserByEmail(_ context.Context, email string) (User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	id, ok := s.byEmail[strings.ToLower(email)]
+	if !ok {
+		return User{}, errUserNotFound
+	}
+	return s.users[id], nil
+}
+
+func (s *memoryStore) ListUsers(ctx context.Context, p pageParams) ([]User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	all := make([]User, 0, len(s.users))
+	for _, u := range s.users {
+		if p.AfterID > 0 && ((!p.Desc && u.ID <= p.AfterID) || (p.Desc && u.ID >= p.AfterID)) {
+			continue
+		}
+		all = append(all, u)
+	}
+	s.mu.RUnlock()
+
+	key := func(u User) string {
+		switch p.Sort {
+		case "username":
+			return u.Username
+		case "email":
+			return u.Email
+		}
+		return ""
+	}
+	sort.Slice(all, func(i, j int) bool {
+		a, b := all[i], all[j]
+		if p.Desc {
+			a, b = b, a
+		}
+		if ka, kb := key(a), key(b); ka != kb {
+			return ka < kb
+		}
+		return a.ID < b.ID
+	})
+
+	if p.Offset >= len(all) {
+		return nil, nil
+	}
+	all = all[p.Offset:]
+	return all[:min(p.Limit, len(all))], nil
+}
+
+func (s *memoryStore) ListUsersByEmails(_ context.Context, emails []string) ([]User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var users []User
+	for _, e := range emails {
+		if id, ok := s.byEmail[e]; ok {
+			users = append(users, s.users[id])
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	return users, nil
+}
+
+func (s *memoryStore) UpdateUsers(_ context.Context, items []userUpdate, atomic bool) ([]updateResult, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// undo restores the pre-batch rows if an atomic batch fails.
+	undo := make(map[int32]User)
+	rollback := func() {
+		for id, u := range undo {
+			delete(s.byEmail, strings.ToLower(s.users[id].Email))
+			s.users[id] = u
+		}
+		for id, u := range undo {
+			s.byEmail[strings.ToLower(u.Email)] = id
+		}
+	}
+
+	results := make([]updateResult, len(items))
+	for i, it := range items {
+		results[i].UserID = it.ID
+		u, ok := s.users[it.ID]
+		if !ok {
+			results[i].Status = updateNotFound
+			continue
+		}
+		next := u
+		if it.Username != nil {
+			next.Username = *it.Username
+		}
+		if it.Email != nil {
+			next.Email = *it.Email
+		}
+		oldKey, newKey := strings.ToLower(u.Email), strings.ToLower(next.Email)
+		var err error
+		if owner, taken := s.byEmail[newKey]; taken && owner != it.ID {
+			err = errDuplicateEmail
+		} else if it.Username != nil && s.usernameTaken(next.Username, it.ID) {
+			err = errDuplicateUsername
+		}
+		if err != nil {
+			results[i].Status, results[i].err = updateError, err
+			if atomic {
+				rollback()
+				markRolledBack(results[:i])
+				return results, false, nil
+			}
+			continue
+		}
+		if _, saved := undo[it.ID]; !saved {
+			undo[it.ID] = u
+		}
+		delete(s.byEmail, oldKey)
+		s.byEmail[newKey] = it.ID
+		s.users[it.ID] = next
+		results[i].Status = updateUpdated
+	}
+	return results, true, nil
+}
+
+func (s *memoryStore) DeleteUser(_ context.Context, id int32) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[id]
+	if !ok {
+		return errUserNotFound
+	}
+	delete(s.users, id)
+	delete(s.byEmail, strings.ToLower(u.Email))
+	delete(s.created, id)
+	return nil
+}
+
+func (s *memoryStore) UserStats(_ context.Context) (userStats, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := time.Now()
+	st := userStats{Total: int64(len(s.users))}
+	for _, t := range s.created {
+		age := now.Sub(t)
+		if age <= 24*time.Hour {
+			st.Last24h++
+		}
+		if age <= 7*24*time.Hour {
+			st.Last7d++
+		}
+		if age <= 30*24*time.Hour {
+			st.Last30d++
+		}
+	}
+	return st, nil
+}
+
+func (s *memoryStore) EmailDomains(_ context.Context, limit int) ([]domainCount, error) {
+	s.mu.RLock()
+	counts := make(map[string]int64)
+	none := int64(0)
+	for _, u := range s.users {
+		i := strings.LastIndexByte(u.Email, '@')
+		if u.NullEmail || i < 0 {
+			none++
+			continue
+		}
+		counts[strings.ToLower(u.Email[i+1:])]++
+	}
+	s.mu.RUnlock()
+
+	domains := make([]domainCount, 0, len(counts)+1)
+	for d, n := range counts {
+		domains = append(domains, domainCount{Domain: &d, Users: n})
+	}
+	if none > 0 {
+		domains = append(domains, domainCount{Users: none})
+	}
+	// Postgres sorts NULL last in ascending order; match it.
+	sort.Slice(domains, func(i, j int) bool {
+		a, b := domains[i], domains[j]
+		switch {
+		case a.Users != b.Users:
+			return a.Users > b.Users
+		case a.Domain == nil || b.Domain == nil:
+			return b.Domain == nil && a.Domain != nil
+		}
+		return *a.Domain < *b.Domain
+	})
+	return domains[:min(limit, len(domains))], nil
+}
+
+func (s *memoryStore) RandomUser(_ context.Context) (User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if len(s.users) == 0 {
+		return User{}, errUserNotFound
+	}
+	n := rand.IntN(len(s.users))
+	for _, u := range s.users {
+		if n == 0 {
+			return u, nil
+		}
+		n--
+	}
+	return User{}, errUserNotFound
+}
+
+func (s *memoryStore) SeedUser(_ context.Context, username, email string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.users) > 0 {
+		return false, nil
+	}
+	s.nextID++
+	s.users[s.nextID] = User{ID: s.nextID, Username: username, Email: email}
+	s.byEmail[strings.ToLower(email)] = s.nextID
+	s.created[s.nextID] = time.Now()
+	return true, nil
+}
+
+func (s *memoryStore) InsertUsers(_ context.Context, rows []createUserReq) ([]int32, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Check everything first so a duplicate leaves nothing behind.
+	seen := make(map[string]bool, len(rows))
+	seenNames := make(map[string]bool)
+	for _, row := range rows {
+		key := strings.ToLower(row.Email)
+		if _, ok := s.byEmail[key]; ok || seen[key] {
+			return nil, errDuplicateEmail
+		}
+		seen[key] = true
+		if s.uniqueUsernames {
+			name := strings.ToLower(row.Username)
+			if seenNames[name] || s.usernameTaken(row.Username, 0) {
+				return nil, errDuplicateUsername
+			}
+			seenNames[name] = true
+		}
+	}
+	ids := make([]int32, len(rows))
+	now := time.Now()
+	for i, row := range rows {
+		s.nextID++
+		s.users[s.nextID] = User{ID: s.nextID, Username: row.Username, Email: row.Email}
+		s.byEmail[strings.ToLower(row.Email)] = s.nextID
+		s.created[s.nextID] = now
+		ids[i] = s.nextID
+	}
+	return ids, nil
+}
+
+func (s *memoryStore) CopyUsers(ctx context.Context, rows []createUserReq) (int64, error) {
+	ids, err := s.InsertUsers(ctx, rows)
+	return int64(len(ids)), err
+}
@@ -0,0 +1,182 @@
+// store_memory_test.go
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+func TestMemoryStoreEmailUniqueIgnoresCase(t *testing.T) {
+	s := newMemoryStore(false)
+	ctx := context.Background()
+	if _, err := s.CreateUser(ctx, "ann", "Ann@Example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.CreateUser(ctx, "ann2", "ann@example.COM"); !errors.Is(err, errDuplicateEmail) {
+		t.Fatalf("err = %v, want errDuplicateEmail", err)
+	}
+}
+
+func TestMemoryStoreDeleteFreesEmail(t *testing.T) {
+	s := newMemoryStore(false)
+	ctx := context.Background()
+	id, _ := s.CreateUser(ctx, "ann", "ann@example.com")
+	if err := s.DeleteUser(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetUser(ctx, id); !errors.Is(err, errUserNotFound) {
+		t.Fatalf("GetUser after delete: %v", err)
+	}
+	if err := s.DeleteUser(ctx, id); !errors.Is(err, errUserNotFound) {
+		t.Fatalf("second delete: %v", err)
+	}
+	if _, err := s.CreateUser(ctx, "ann", "ann@example.com"); err != nil {
+		t.Fatalf("email not freed: %v", err)
+	}
+}
+
+func TestMemoryStoreConcurrentCreates(t *testing.T) {
+	s := newMemoryStore(false)
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	created := 0
+	for i := range 50 {
+		wg.Go(func() {
+			// Every pair of goroutines races for the same email.
+			if _, err := s.CreateUser(ctx, "u", fmt.Sprintf("u%d@example.com", i/2)); err == nil {
+				mu.Lock()
+				created++
+				mu.Unlock()
+			}
+		})
+	}
+	wg.Wait()
+	if created != 25 {
+		t.Fatalf("created %d users, want 25", created)
+	}
+}
+
+func TestMemoryStoreThroughHandlers(t *testing.T) {
+	ta := newTestApp(t, nil)
+	id := ta.createUser(t, "ann", "ann@example.com")
+
+	rec := ta.do(t, http.MethodGet, fmt.Sprintf("/users/%d", id), "")
+	wantStatus(t, rec, http.StatusOK)
+	if got := jsonBody(t, rec)["email"]; got != "ann@example.com" {
+		t.Fatalf("email = %v", got)
+	}
+
+	rec = ta.do(t, http.MethodPost, "/users", `{"username":"ann2","email":"ANN@example.com"}`)
+	wantStatus(t, rec, http.StatusConflict)
+
+	ta.createUser(t, "bob", "bob@example.com")
+	rec = ta.do(t, http.MethodGet, "/users?limit=1", "")
+	wantStatus(t, rec, http.StatusOK)
+	if users := jsonBody(t, rec)["users"].([]any); len(users) != 1 {
+		t.Fatalf("limit=1 returned %d users", len(users))
+	}
+
+	wantStatus(t, ta.do(t, http.MethodDelete, fmt.Sprintf("/users/%d", id), ""), http.StatusOK)
+	wantStatus(t, ta.do(t, http.MethodGet, fmt.Sprintf("/users/%d", id), ""), http.StatusNotFound)
+}
+
+func TestStorageDefaultsToPostgres(t *testing.T) {
+	cfg, err := LoadConfig(func(string) string { return "" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Storage != "postgres" {
+		t.Fatalf("Storage = %q, want postgres", cfg.Storage)
+	}
+}
+
+func TestMemoryStoreUsernameUniqueIgnoresCase(t *testing.T) {
+	s := newMemoryStore(true)
+	ctx := context.Background()
+	alice, err := s.CreateUser(ctx, "Alice", "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.CreateUser(ctx, "alice", "other@example.com"); !errors.Is(err, errDuplicateUsername) {
+		t.Fatalf("err = %v, want errDuplicateUsername", err)
+	}
+	if u, _ := s.GetUser(ctx, alice); u.Username != "Alice" {
+		t.Fatalf("username = %q, want the casing sent", u.Username)
+	}
+	if _, err := s.InsertUsers(ctx, []createUserReq{{Username: "ALICE", Email: "a3@example.com"}}); !errors.Is(err, errDuplicateUsername) {
+		t.Fatalf("InsertUsers = %v, want errDuplicateUsername", err)
+	}
+	if err := s.DeleteUser(ctx, alice); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.CreateUser(ctx, "alice", "other@example.com"); err != nil {
+		t.Fatalf("username not freed: %v", err)
+	}
+
+	// Without the option only emails are unique.
+	s = newMemoryStore(false)
+	s.CreateUser(ctx, "Alice", "alice@example.com")
+	if _, err := s.CreateUser(ctx, "alice", "other@example.com"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUniqueUsernamesThroughHandlers(t *testing.T) {
+	ta := newTestApp(t, map[string]string{"UNIQUE_USERNAMES": "true"})
+	alice := ta.createUser(t, "Alice", "alice@example.com")
+	bob := ta.createUser(t, "bob", "bob@example.com")
+
+	for name, tt := range map[string]struct{ method, target, body string }{
+		"create":  {http.MethodPost, "/users", `{"username":"ALICE","email":"a2@example.com"}`},
+		"replace": {http.MethodPut, fmt.Sprintf("/users/%d", bob), `{"username":"alice","email":"bob@example.com"}`},
+	} {
+		t.Run(name, func(t *testing.T) {
+			rec := ta.do(t, tt.method, tt.target, tt.body)
+			wantStatus(t, rec, http.StatusConflict)
+			if got := jsonBody(t, rec)["code"]; got != "DUPLICATE_USERNAME" {
+				t.Fatalf("code = %v", got)
+			}
+		})
+	}
+	rec := ta.do(t, http.MethodPatch, "/users", fmt.Sprintf(`[{"user_id":%d,"username":"aLiCe"}]`, bob))
+	wantStatus(t, rec, http.StatusConflict)
+
+	rec = ta.do(t, http.MethodGet, fmt.Sprintf("/users/%d", alice), "")
+	if got := jsonBody(t, rec)["username"]; got != "Alice" {
+		t.Fatalf("username = %v", got)
+	}
+	// Renaming a user to another casing of its own name is allowed.
+	wantStatus(t, ta.do(t, http.MethodPut, fmt.Sprintf("/users/%d", alice), `{"username":"alice","email":"alice@example.com"}`), http.StatusOK)
+}
+
+// TestUniqueUsernamesPostgres runs against a session-local users table
+// carrying the same unique indexes as public.users.
+func TestUniqueUsernamesPostgres(t *testing.T) {
+	db := testDB(t)
+	db.SetMaxOpenConns(1)
+	ctx := context.Background()
+	if _, err := db.ExecContext(ctx, `CREATE TEMP TABLE users (LIKE public.users INCLUDING DEFAULTS INCLUDING IDENTITY);
+		CREATE UNIQUE INDEX users_email_key ON users (lower(email));
+		CREATE UNIQUE INDEX `+usernameIndex+` ON users (lower(username))`); err != nil {
+		t.Fatal(err)
+	}
+	s := &pgStore{db: db}
+	if _, err := s.CreateUser(ctx, "Alice", "alice@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.CreateUser(ctx, "alice", "other@example.com"); !errors.Is(err, errDuplicateUsername) {
+		t.Fatalf("second casing = %v, want errDuplicateUsername", err)
+	}
+	if _, err := s.CreateUser(ctx, "bob", "ALICE@example.com"); !errors.Is(err, errDuplicateEmail) {
+		t.Fatalf("duplicate email = %v, want errDuplicateEmail", err)
+	}
+	u, err := s.GetUserByEmail(ctx, "alice@example.com")
+	if err != nil || u.Username != "Alice" {
+		t.Fatalf("stored user = %+v, %v", u, err)
+	}
+}
@@ -0,0 +1,652 @@
+// store_postgres.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/stdlib"
+)
+
+type pgStore struct {
+	db *sql.DB
+	// acquireTimeout bounds how long a query waits for a pooled connection,
+	// so pool saturation fails fast instead of eating the query timeout.
+	acquireTimeout time.Duration
+	// commentRequestID prefixes queries with /* req_id=... */ so they can be
+	// matched to requests in pg_stat_statements and the server log.
+	commentRequestID bool
+	// isolation applies to write transactions (DB_ISOLATION_LEVEL).
+	isolation sql.IsolationLevel
+	// audit writes audit_log rows in each write's transaction (AUDIT_LOG
+	// without AUDIT_DB_URL).
+	audit bool
+}
+
+// maxTxAttempts bounds how often a transaction rolled back by a
+// serialization failure or deadlock is run again.
+const maxTxAttempts = 3
+
+// isRetryableTxError reports whether Postgres aborted a transaction only
+// because of concurrent ones, so running it again can succeed.
+func isRetryableTxError(err error) bool {
+	switch pgErrorCode(err) {
+	case "40001", "40P01": // serialization_failure, deadlock_detected
+		return true
+	}
+	return false
+}
+
+// Statements on the hot path, shared with the connection warmup.
+const (
+	sqlInsertUser     = "INSERT INTO users (username, email) VALUES ($1, $2) RETURNING user_id"
+	sqlGetUser        = "SELECT user_id, username, email FROM users WHERE user_id = $1"
+	sqlGetUserByEmail = "SELECT user_id, username, email FROM users WHERE lower(email) = lower($1)"
+)
+
+// warmStatements prepares the hot statements on a new connection. They are
+// named after their SQL, which is how pgx finds an explicitly prepared
+// statement, so first use skips the parse round trip. Statements prefixed
+// with a request-ID comment don't match and are prepared as usual.
+func warmStatements(ctx context.Context, conn *pgx.Conn) error {
+	for _, q := range []string{sqlInsertUser, sqlGetUser, sqlGetUserByEmail} {
+		if _, err := conn.Prepare(ctx, q, q); err != nil {
+			return fmt.Errorf("prepare %q: %w", q, err)
+		}
+	}
+	return nil
+}
+
+func (s *pgStore) sql(ctx context.Context, query string) string {
+	if !s.commentRequestID {
+		return query
+	}
+	id := sanitizeRequestID(requestIDFrom(ctx))
+	if id == "" {
+		return query
+	}
+	return "/* req_id=" + id + " */ " + query
+}
+
+func (s *pgStore) conn(ctx context.Context) (*sql.Conn, error) {
+	if s.acquireTimeout <= 0 {
+		return s.db.Conn(ctx)
+	}
+	actx, cancel := context.WithTimeout(ctx, s.acquireTimeout)
+	defer cancel()
+	c, err := s.db.Conn(actx)
+	if err != nil && ctx.Err() == nil && errors.Is(actx.Err(), context.DeadlineExceeded) {
+		return nil, errPoolExhausted
+	}
+	return c, err
+}
+
+// querier is what a single-statement write runs on: the connection or,
+// with audit, a transaction on it.
+type querier interface {
+	execer
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// withAudit runs write on c and, with audit, inserts the entries it returns
+// in the same transaction, so a write and its audit rows commit together
+// or not at all.
+func (s *pgStore) withAudit(ctx context.Context, c *sql.Conn, write func(querier) ([]auditEntry, error)) error {
+	if !s.audit {
+		_, err := write(c)
+		return err
+	}
+	tx, err := c.BeginTx(ctx, &sql.TxOptions{Isolation: s.isolation})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	entries, err := write(tx)
+	if err != nil {
+		return err
+	}
+	if err := insertAudit(ctx, tx, entries); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *pgStore) CreateUser(ctx context.Context, username, email string) (int32, error) {
+	c, err := s.conn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+
+	var id int32
+	err = s.withAudit(ctx, c, func(q querier) ([]auditEntry, error) {
+		err := q.QueryRowContext(
+			ctx,
+			s.sql(ctx, sqlInsertUser),
+			username, email,
+		).Scan(&id)
+		if err != nil {
+			return nil, mapWriteError(err)
+		}
+		return auditEntries(ctx, auditUserCreated, id), nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+func (s *pgStore) GetUser(ctx context.Context, id int32) (User, error) {
+	c, err := s.conn(ctx)
+	if err != nil {
+		return User{}, err
+	}
+	defer c.Close()
+
+	u, err := scanUser(c.QueryRowContext(ctx,
+		s.sql(ctx, sqlGetUser),
+		id,
+	))
+	if err == sql.ErrNoRows {
+		return User{}, errUserNotFound
+	}
+	return u, err
+}
+
+func (s *pgStore) GetUserByEmail(ctx context.Context, email string) (User, error) {
+	c, err := s.conn(ctx)
+	if err != nil {
+		return User{}, err
+	}
+	defer c.Close()
+
+	u, err := scanUser(c.QueryRowContext(ctx,
+		s.sql(ctx, sqlGetUserByEmail),
+		email,
+	))
+	if err == sql.ErrNoRows {
+		return User{}, errUserNotFound
+	}
+	return u, err
+}
+
+func (s *pgStore) ListUsers(ctx context.Context, p pageParams) (users []User, err error) {
+	c, err := s.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	query, args := buildListQuery(p)
+	rows, err := c.QueryContext(ctx, s.sql(ctx, query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer closeRows(rows, &err)
+
+	for rows.Next() {
+		if err := ctx.Err(); err != nil {
+			return users, err
+		}
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	if err := rows.Err(); err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return users, ctxErr
+		}
+		return nil, err
+	}
+	return users, nil
+}
+
+// buildListQuery renders the list SELECT for p. Column names only ever come
+// from sortColumns; every value is a bind parameter.
+func buildListQuery(p pageParams) (string, []any) {
+	var (
+		sb   strings.Builder
+		args []any
+	)
+	sb.WriteString("SELECT user_id, username, email FROM users")
+	if p.AfterID > 0 {
+		args = append(args, p.AfterID)
+		if p.Desc {
+			fmt.Fprintf(&sb, " WHERE user_id < $%d", len(args))
+		} else {
+			fmt.Fprintf(&sb, " WHERE user_id > $%d", len(args))
+		}
+	}
+	dir := "ASC"
+	if p.Desc {
+		dir = "DESC"
+	}
+	fmt.Fprintf(&sb, " ORDER BY %s %s", p.Sort, dir)
+	if p.Sort != "user_id" {
+		fmt.Fprintf(&sb, ", user_id %s", dir)
+	}
+	args = append(args, p.Limit)
+	fmt.Fprintf(&sb, " LIMIT $%d", len(args))
+	if p.Offset > 0 {
+		args = append(args, p.Offset)
+		fmt.Fprintf(&sb, " OFFSET $%d", len(args))
+	}
+	return sb.String(), args
+}
+
+func (s *pgStore) ListUsersByEmails(ctx context.Context, emails []string) (users []User, err error) {
+	c, err := s.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	rows, err := c.QueryContext(ctx,
+		s.sql(ctx, "SELECT user_id, username, email FROM users WHERE lower(email) = ANY($1) ORDER BY user_id"),
+		emails,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer closeRows(rows, &err)
+
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func (s *pgStore) UpdateUsers(ctx context.Context, items []userUpdate, atomic bool) (results []updateResult, committed bool, err error) {
+	for attempt := 1; ; attempt++ {
+		results, committed, err = s.updateUsers(ctx, items, atomic)
+		if err == nil || attempt == maxTxAttempts || !isRetryableTxError(err) || ctx.Err() != nil {
+			return results, committed, err
+		}
+		slog.Debug("retrying update transaction", "attempt", attempt, "err", err)
+	}
+}
+
+func (s *pgStore) updateUsers(ctx context.Context, items []userUpdate, atomic bool) (results []updateResult, committed bool, err error) {
+	c, err := s.conn(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	defer c.Close()
+
+	tx, err := c.BeginTx(ctx, &sql.TxOptions{Isolation: s.isolation})
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback()
+
+	update := s.sql(ctx, `UPDATE users
+		SET username = COALESCE($2, username), email = COALESCE($3, email)
+		WHERE user_id = $1`)
+	results = make([]updateResult, len(items))
+	var updated []int32
+	for i, it := range items {
+		results[i].UserID = it.ID
+		// In best-effort mode a savepoint per item lets a failed statement be
+		// undone without aborting the transaction.
+		if !atomic {
+			if _, err := tx.ExecContext(ctx, "SAVEPOINT batch_item"); err != nil {
+				return nil, false, err
+			}
+		}
+
+		res, err := tx.ExecContext(ctx, update, it.ID, it.Username, it.Email)
+		if err == nil {
+			var n int64
+			if n, err = res.RowsAffected(); err == nil {
+				results[i].Status = updateUpdated
+				if n == 0 {
+					results[i].Status = updateNotFound
+				} else {
+					updated = append(updated, it.ID)
+				}
+			}
+		}
+		if err != nil {
+			err = mapWriteError(err)
+			if !isClientWriteError(err) {
+				return nil, false, err
+			}
+			results[i].Status, results[i].err = updateError, err
+			if atomic {
+				markRolledBack(results[:i])
+				return results, false, nil
+			}
+			if _, err := tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT batch_item"); err != nil {
+				return nil, false, err
+			}
+			continue
+		}
+		if !atomic {
+			if _, err := tx.ExecContext(ctx, "RELEASE SAVEPOINT batch_item"); err != nil {
+				return nil, false, err
+			}
+		}
+	}
+
+	if s.audit {
+		if err := insertAudit(ctx, tx, auditEntries(ctx, auditUserUpdated, updated...)); err != nil {
+			return nil, false, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, false, err
+	}
+	return results, true, nil
+}
+
+func (s *pgStore) DeleteUser(ctx context.Context, id int32) error {
+	c, err := s.conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	return s.withAudit(ctx, c, func(q querier) ([]auditEntry, error) {
+		res, err := q.ExecContext(ctx, s.sql(ctx, "DELETE FROM users WHERE user_id = $1"), id)
+		if err != nil {
+			return nil, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			return nil, errUserNotFound
+		}
+		return auditEntries(ctx, auditUserDeleted, id), nil
+	})
+}
+
+func (s *pgStore) UserStats(ctx context.Context) (userStats, error) {
+	c, err := s.conn(ctx)
+	if err != nil {
+		return userStats{}, err
+	}
+	defer c.Close()
+
+	var st userStats
+	err = c.QueryRowContext(ctx, s.sql(ctx, `SELECT
+		COUNT(*),
+		COUNT(*) FILTER (WHERE created_at >= now() - interval '24 hours'),
+		COUNT(*) FILTER (WHERE created_at >= now() - interval '7 days'),
+		COUNT(*) FILTER (WHERE created_at >= now() - interval '30 days')
+		FROM users`),
+	).Scan(&st.Total, &st.Last24h, &st.Last7d, &st.Last30d)
+	return st, err
+}
+
+func (s *pgStore) EmailDomains(ctx context.Context, limit int) (domains []domainCount, err error) {
+	c, err := s.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	// The text after the last "@", so a malformed address with several
+	// doesn't yield a middle part; NULL when there is none.
+	rows, err := c.QueryContext(ctx, s.sql(ctx, `SELECT lower(substring(email from '@([^@]*)$')) AS domain, COUNT(*)
+		FROM users GROUP BY domain ORDER BY COUNT(*) DESC, domain LIMIT $1`), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer closeRows(rows, &err)
+
+	domains = make([]domainCount, 0, limit)
+	for rows.Next() {
+		var d domainCount
+		if err := rows.Scan(&d.Domain, &d.Users); err != nil {
+			return nil, err
+		}
+		domains = append(domains, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return domains, nil
+}
+
+func (s *pgStore) RandomUser(ctx context.Context) (User, error) {
+	c, err := s.conn(ctx)
+	if err != nil {
+		return User{}, err
+	}
+	defer c.Close()
+
+	// ORDER BY random() scans the table; fine for the demo-sized tables
+	// this endpoint is meant for.
+	u, err := scanUser(c.QueryRowContext(ctx,
+		s.sql(ctx, "SELECT user_id, username, email FROM users ORDER BY random() LIMIT 1"),
+	))
+	if err == sql.ErrNoRows {
+		return User{}, errUserNotFound
+	}
+	return u, err
+}
+
+func (s *pgStore) SeedUser(ctx context.Context, username, email string) (bool, error) {
+	c, err := s.conn(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer c.Close()
+
+	// Replicas booting together may all see an empty table; the unique
+	// email index lets only one insert land.
+	res, err := c.ExecContext(ctx, s.sql(ctx, `INSERT INTO users (username, email)
+		SELECT $1, $2 WHERE NOT EXISTS (SELECT 1 FROM users)
+		ON CONFLICT DO NOTHING`), username, email)
+	if err != nil {
+		return false, mapWriteError(err)
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// importInsertChunk is the rows per INSERT of InsertUsers, well inside the
+// 65535 bind parameters a statement may carry.
+const importInsertChunk = 1000
+
+func (s *pgStore) InsertUsers(ctx context.Context, rows []createUserReq) (ids []int32, err error) {
+	c, err := s.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	tx, err := c.BeginTx(ctx, &sql.TxOptions{Isolation: s.isolation})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	ids = make([]int32, 0, len(rows))
+	for chunk := range slices.Chunk(rows, importInsertChunk) {
+		var values strings.Builder
+		args := make([]any, 0, 2*len(chunk))
+		for i, row := range chunk {
+			if i > 0 {
+				values.WriteString(", ")
+			}
+			fmt.Fprintf(&values, "($%d, $%d)", 2*i+1, 2*i+2)
+			args = append(args, row.Username, row.Email)
+		}
+		// RETURNING has no defined order; identity values rise in row order
+		// within one statement, so sorting them restores it.
+		rs, err := tx.QueryContext(ctx, s.sql(ctx, `WITH ins AS (
+			INSERT INTO users (username, email) VALUES `+values.String()+` RETURNING user_id)
+			SELECT user_id FROM ins ORDER BY user_id`), args...)
+		if err != nil {
+			return nil, mapWriteError(err)
+		}
+		for rs.Next() {
+			var id int32
+			if err := rs.Scan(&id); err != nil {
+				rs.Close()
+				return nil, err
+			}
+			ids = append(ids, id)
+		}
+		rs.Close()
+		if err := rs.Err(); err != nil {
+			return nil, mapWriteError(err)
+		}
+	}
+	if s.audit {
+		if err := insertAudit(ctx, tx, auditEntries(ctx, auditUserCreated, ids...)); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, mapWriteError(err)
+	}
+	return ids, nil
+}
+
+// CopyUsers loads rows with COPY FROM STDIN, one statement and so all or
+// nothing. COPY has no RETURNING, hence no ids, and so no audit rows:
+// UserService imports with InsertUsers while AUDIT_LOG is on.
+func (s *pgStore) CopyUsers(ctx context.Context, rows []createUserReq) (n int64, err error) {
+	if s.audit {
+		return 0, errors.New("copy users: COPY can't be audited")
+	}
+	c, err := s.conn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+
+	err = c.Raw(func(driverConn any) error {
+		conn := driverConn.(*stdlib.Conn).Conn()
+		n, err = conn.CopyFrom(ctx, pgx.Identifier{"users"}, []string{"username", "email"},
+			pgx.CopyFromSlice(len(rows), func(i int) ([]any, error) {
+				return []any{rows[i].Username, rows[i].Email}, nil
+			}))
+		return err
+	})
+	if err != nil {
+		return 0, mapWriteError(err)
+	}
+	return n, nil
+}
+
+// closeRows closes rows, surfacing a close error through errp unless the
+// caller is already returning one. Use with a named error result:
+//
+//	defer closeRows(rows, &err)
+//
+// Callers must still check rows.Err() after iterating; a loop that ends
+// early on an error is otherwise indistinguishable from the last row.
+func closeRows(rows *sql.Rows, errp *error) {
+	if err := rows.Close(); err != nil && *errp == nil {
+		*errp = err
+	}
+}
+
+// emailIndex is the unique index on lower(email) that CreateUser relies on
+// to reject duplicate emails.
+const emailIndex = "users_email_key"
+
+// checkEmailIndex fails when emailIndex is missing, as it is from tables
+// created before it was added: without it duplicate emails are stored
+// silently instead of answering 409.
+func checkEmailIndex(ctx context.Context, db *sql.DB) error {
+	var exists bool
+	err := db.QueryRowContext(ctx,
+		`SELECT EXISTS (SELECT 1 FROM pg_indexes
+		   WHERE schemaname = 'public' AND tablename = 'users' AND indexname = $1)`,
+		emailIndex).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("unique index %s on public.users (lower(email)) is missing; run migration 0002 or RUN_MIGRATIONS=true", emailIndex)
+	}
+	return nil
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// scanUser reads a (user_id, username, email) row. Legacy rows may hold
+// NULLs, which are flagged on the User rather than failing the scan.
+func scanUser(row rowScanner) (User, error) {
+	var (
+		u               User
+		username, email sql.NullString
+	)
+	if err := row.Scan(&u.ID, &username, &email); err != nil {
+		return User{}, err
+	}
+	u.Username, u.NullUsername = username.String, !username.Valid
+	u.Email, u.NullEmail = email.String, !email.Valid
+	return u, nil
+}
+
+// usernameIndex enforces UNIQUE_USERNAMES. It isn't a migration because
+// existing tables may hold usernames differing only in case; see
+// ensureUsernameIndex.
+const usernameIndex = "users_username_key"
+
+// ensureUsernameIndex creates usernameIndex when it is missing. Building it
+// locks out writes to users for the duration, and fails when existing
+// usernames already collide; those have to be resolved by hand first.
+func ensureUsernameIndex(ctx context.Context, db *sql.DB) error {
+	_, err := db.ExecContext(ctx,
+		"CREATE UNIQUE INDEX IF NOT EXISTS "+usernameIndex+" ON public.users (lower(username))")
+	if pgErrorCode(err) == "23505" {
+		return fmt.Errorf("usernames differing only in case already exist: %w", err)
+	}
+	return err
+}
+
+// mapWriteError translates constraint failures on INSERT/UPDATE into the
+// store's sentinel errors.
+func mapWriteError(err error) error {
+	switch pgErrorCode(err) {
+	case "23505":
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.ConstraintName == usernameIndex {
+			return errDuplicateUsername
+		}
+		return errDuplicateEmail
+	case "22001":
+		return errValueTooLong
+	case "23514":
+		var pgErr *pgconn.PgError
+		errors.As(err, &pgErr)
+		return &checkViolationError{Constraint: pgErr.ConstraintName}
+	}
+	return err
+}
+
+// pgErrorCode returns the SQLSTATE of a Postgres error, or "" otherwise.
+func pgErrorCode(err error) string {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code
+	}
+	return ""
+}
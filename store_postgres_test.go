@@ -0,0 +1,287 @@
+// store_postgres_test.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/stdlib"
+)
+
+func TestCheckEmailIndex(t *testing.T) {
+	for exists, wantErr := range map[string]bool{"true": false, "false": true} {
+		db := sql.OpenDB(textConnector{"pg_indexes": {exists}})
+		err := checkEmailIndex(context.Background(), db)
+		db.Close()
+		if (err != nil) != wantErr || (err != nil && !strings.Contains(err.Error(), emailIndex)) {
+			t.Errorf("index exists=%s: %v", exists, err)
+		}
+	}
+}
+
+func TestCheckEmailIndexPostgres(t *testing.T) {
+	if err := checkEmailIndex(context.Background(), testDB(t)); err != nil {
+		t.Fatalf("migrated database: %v", err)
+	}
+}
+
+func TestPgErrorCode(t *testing.T) {
+	if got := pgErrorCode(fmt.Errorf("insert: %w", &pgconn.PgError{Code: "22001"})); got != "22001" {
+		t.Fatalf("wrapped truncation = %q", got)
+	}
+	if got := pgErrorCode(errors.New("boom")); got != "" {
+		t.Fatalf("non-Postgres error = %q", got)
+	}
+}
+
+func TestMapWriteError(t *testing.T) {
+	wrap := func(pgErr *pgconn.PgError) error { return fmt.Errorf("insert: %w", pgErr) }
+	tests := []struct {
+		name string
+		err  error
+		want error
+	}{
+		{"truncation", wrap(&pgconn.PgError{Code: "22001"}), errValueTooLong},
+		{"duplicate email", wrap(&pgconn.PgError{Code: "23505", ConstraintName: "users_email_key"}), errDuplicateEmail},
+		{"duplicate username", wrap(&pgconn.PgError{Code: "23505", ConstraintName: usernameIndex}), errDuplicateUsername},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mapWriteError(tt.err); !errors.Is(got, tt.want) {
+				t.Fatalf("mapWriteError = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	var cv *checkViolationError
+	if !errors.As(mapWriteError(wrap(&pgconn.PgError{Code: "23514", ConstraintName: "users_email_check"})), &cv) ||
+		cv.Constraint != "users_email_check" {
+		t.Fatalf("check violation not mapped: %v", cv)
+	}
+	other := errors.New("boom")
+	if got := mapWriteError(other); got != other {
+		t.Fatalf("unrelated error changed: %v", got)
+	}
+}
+
+// stubConnector hands database/sql connections that can't run queries, for
+// exercising pool behaviour without a server.
+type stubConnector struct{}
+
+func (stubConnector) Connect(context.Context) (driver.Conn, error) { return stubConn{}, nil }
+func (stubConnector) Driver() driver.Driver                        { return nil }
+
+type stubConn struct{}
+
+func (stubConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("stub: no queries") }
+func (stubConn) Close() error                        { return nil }
+func (stubConn) Begin() (driver.Tx, error)           { return nil, errors.New("stub: no transactions") }
+
+func TestAcquireTimeoutOnSaturatedPool(t *testing.T) {
+	db := sql.OpenDB(stubConnector{})
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	held, err := db.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer held.Close()
+
+	s := &pgStore{db: db, acquireTimeout: 20 * time.Millisecond}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	if _, err := s.conn(ctx); !errors.Is(err, errPoolExhausted) {
+		t.Fatalf("conn = %v, want errPoolExhausted", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("acquire took %v, want about the acquire timeout", elapsed)
+	}
+
+	// A caller's own deadline is not reported as saturation.
+	short, cancelShort := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancelShort()
+	s.acquireTimeout = time.Second
+	if _, err := s.conn(short); errors.Is(err, errPoolExhausted) {
+		t.Fatal("caller deadline reported as pool exhaustion")
+	}
+
+	held.Close()
+	c, err := s.conn(ctx)
+	if err != nil {
+		t.Fatalf("conn after release: %v", err)
+	}
+	c.Close()
+}
+
+func TestSQLCommentsRequestID(t *testing.T) {
+	const q = "SELECT user_id, username, email FROM users WHERE user_id = $1"
+	s := &pgStore{commentRequestID: true}
+	tests := []struct{ id, want string }{
+		{"abc123", "/* req_id=abc123 */ " + q},
+		{"x*/ DROP TABLE users; /*", "/* req_id=xDROPTABLEusers */ " + q},
+		{"", q},
+	}
+	for _, tt := range tests {
+		if got := s.sql(withRequestID(context.Background(), tt.id), q); got != tt.want {
+			t.Errorf("id %q: got %q, want %q", tt.id, got, tt.want)
+		}
+	}
+
+	s.commentRequestID = false
+	if got := s.sql(withRequestID(context.Background(), "abc123"), q); got != q {
+		t.Errorf("comment added while disabled: %q", got)
+	}
+}
+
+// rowsConnector's connections answer every query with the rows made by
+// rows, for driving the store's iteration code without a server.
+type rowsConnector struct{ rows func() driver.Rows }
+
+func (c rowsConnector) Connect(context.Context) (driver.Conn, error) { return rowsConn(c), nil }
+func (rowsConnector) Driver() driver.Driver                          { return nil }
+
+type rowsConn struct{ rows func() driver.Rows }
+
+func (rowsConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("stub: no statements") }
+func (rowsConn) Close() error                        { return nil }
+func (rowsConn) Begin() (driver.Tx, error)           { return nil, errors.New("stub: no transactions") }
+
+func (c rowsConn) QueryContext(context.Context, string, []driver.NamedValue) (driver.Rows, error) {
+	return c.rows(), nil
+}
+
+// userRows yields n (user_id, username, email) rows, each after delay, then
+// ends with err, or io.EOF if err is nil.
+type userRows struct {
+	n, next int
+	delay   time.Duration
+	err     error
+}
+
+func (*userRows) Columns() []string { return []string{"user_id", "username", "email"} }
+func (*userRows) Close() error      { return nil }
+
+func (r *userRows) Next(dest []driver.Value) error {
+	if r.next == r.n {
+		if r.err != nil {
+			return r.err
+		}
+		return io.EOF
+	}
+	time.Sleep(r.delay)
+	r.next++
+	dest[0], dest[1], dest[2] = int64(r.next), fmt.Sprintf("user%d", r.next), fmt.Sprintf("user%d@example.com", r.next)
+	return nil
+}
+
+// newRowsStore is a pgStore over rowsConnector.
+func newRowsStore(t *testing.T, rows func() driver.Rows) *pgStore {
+	db := sql.OpenDB(rowsConnector{rows})
+	t.Cleanup(func() { db.Close() })
+	return &pgStore{db: db}
+}
+
+func TestListUsersPartialResults(t *testing.T) {
+	s := newRowsStore(t, func() driver.Rows { return &userRows{n: 1000, delay: 5 * time.Millisecond} })
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	users, err := s.ListUsers(ctx, pageParams{Limit: 1000, Sort: "user_id"})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want DeadlineExceeded", err)
+	}
+	if len(users) == 0 || len(users) == 1000 {
+		t.Fatalf("got %d users, want a partial page", len(users))
+	}
+}
+
+func TestListUsersIterationError(t *testing.T) {
+	failing := errors.New("stub: malformed DataRow")
+	s := newRowsStore(t, func() driver.Rows { return &userRows{n: 3, err: failing} })
+	users, err := s.ListUsers(context.Background(), pageParams{Limit: 10, Sort: "user_id"})
+	if !errors.Is(err, failing) {
+		t.Fatalf("err = %v, want the iteration error", err)
+	}
+	if users != nil {
+		t.Fatalf("returned %d users alongside the error", len(users))
+	}
+}
+
+func TestWarmStatementsOnFreshConnection(t *testing.T) {
+	testDB(t) // skips without a database; migrates otherwise
+	connCfg, err := pgx.ParseConfig(os.Getenv("TEST_DATABASE_URL"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := stdlib.OpenDB(*connCfg, stdlib.OptionAfterConnect(warmStatements))
+	defer db.Close()
+
+	ctx := context.Background()
+	c, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	rows, err := c.QueryContext(ctx, "SELECT name FROM pg_prepared_statements")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prepared := map[string]bool{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			t.Fatal(err)
+		}
+		prepared[name] = true
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range []string{sqlInsertUser, sqlGetUser, sqlGetUserByEmail} {
+		if !prepared[q] {
+			t.Errorf("not prepared on connect: %s", q)
+		}
+	}
+
+	var id int32
+	if err := c.QueryRowContext(ctx, sqlGetUser, int32(-1)).Scan(&id, new(string), new(string)); err != sql.ErrNoRows {
+		t.Fatalf("warm statement unusable: %v", err)
+	}
+}
+
+// valueRows yields fixed rows of (user_id, username, email) values.
+type valueRows struct{ rows [][]driver.Value }
+
+func (*valueRows) Columns() []string { return []string{"user_id", "username", "email"} }
+func (*valueRows) Close() error      { return nil }
+
+func (r *valueRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+func TestScanUserNulls(t *testing.T) {
+	s := newRowsStore(t, func() driver.Rows { return &valueRows{[][]driver.Value{{int64(1), nil, nil}}} })
+	u, err := s.GetUser(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !u.NullUsername || !u.NullEmail || u.Username != "" || u.Email != "" {
+		t.Fatalf("user = %+v", u)
+	}
+}
@@ -0,0 +1,171 @@
+// txretry_test.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// txConnector's connections record the isolation level of each transaction
+// they begin and fail the first failUpdates UPDATEs with a serialization
+// failure.
+type txConnector struct {
+	mu          sync.Mutex
+	isolations  []sql.IsolationLevel
+	failUpdates int
+	commits     int
+}
+
+func (c *txConnector) Connect(context.Context) (driver.Conn, error) { return &txConn{c}, nil }
+func (*txConnector) Driver() driver.Driver                          { return nil }
+
+type txConn struct{ c *txConnector }
+
+func (*txConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("stub: no statements") }
+func (*txConn) Close() error                        { return nil }
+func (*txConn) Begin() (driver.Tx, error)           { return nil, errors.New("stub: use BeginTx") }
+
+func (t *txConn) BeginTx(_ context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+	t.c.isolations = append(t.c.isolations, sql.IsolationLevel(opts.Isolation))
+	return t, nil
+}
+
+func (t *txConn) Commit() error {
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+	t.c.commits++
+	return nil
+}
+
+func (*txConn) Rollback() error { return nil }
+
+func (t *txConn) ExecContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Result, error) {
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+	if strings.HasPrefix(query, "UPDATE") && t.c.failUpdates > 0 {
+		t.c.failUpdates--
+		return nil, &pgconn.PgError{Code: "40001", Message: "could not serialize access due to concurrent update"}
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func TestUpdateUsersRetriesSerializationFailures(t *testing.T) {
+	name := "renamed"
+	items := []userUpdate{{ID: 1, Username: &name}}
+	for _, tt := range []struct {
+		fail      int
+		wantErr   bool
+		wantBegun int
+	}{
+		{fail: 0, wantBegun: 1},
+		{fail: 2, wantBegun: 3},
+		{fail: maxTxAttempts, wantErr: true, wantBegun: maxTxAttempts},
+	} {
+		t.Run(fmt.Sprint("fail=", tt.fail), func(t *testing.T) {
+			stub := &txConnector{failUpdates: tt.fail}
+			db := sql.OpenDB(stub)
+			defer db.Close()
+			s := &pgStore{db: db, isolation: sql.LevelSerializable}
+
+			results, committed, err := s.UpdateUsers(context.Background(), items, true)
+			if tt.wantErr {
+				if !isRetryableTxError(err) || committed {
+					t.Fatalf("err = %v, committed %v", err, committed)
+				}
+			} else if err != nil || !committed || results[0].Status != updateUpdated {
+				t.Fatalf("results = %+v, %v, %v", results, committed, err)
+			}
+			if len(stub.isolations) != tt.wantBegun {
+				t.Fatalf("began %d transactions, want %d", len(stub.isolations), tt.wantBegun)
+			}
+			for _, lvl := range stub.isolations {
+				if lvl != sql.LevelSerializable {
+					t.Fatalf("transaction began at %v", lvl)
+				}
+			}
+		})
+	}
+}
+
+func TestIsRetryableTxError(t *testing.T) {
+	if isRetryableTxError(&pgconn.PgError{Code: "23505"}) || isRetryableTxError(errors.New("boom")) {
+		t.Fatal("non-concurrency error treated as retryable")
+	}
+	if !isRetryableTxError(fmt.Errorf("update: %w", &pgconn.PgError{Code: "40P01"})) {
+		t.Fatal("deadlock not retryable")
+	}
+}
+
+func TestIsolationLevelConfig(t *testing.T) {
+	for v, want := range map[string]sql.IsolationLevel{
+		"":                sql.LevelReadCommitted,
+		"repeatable read": sql.LevelRepeatableRead,
+		"serializable":    sql.LevelSerializable,
+	} {
+		if got := testConfig(t, map[string]string{"DB_ISOLATION_LEVEL": v}).DBIsolation; got != want {
+			t.Errorf("%q: %v, want %v", v, got, want)
+		}
+	}
+	if err := loadConfigErr(t, map[string]string{"DB_ISOLATION_LEVEL": "snapshot"}); !strings.Contains(err.Error(), "DB_ISOLATION_LEVEL") {
+		t.Fatal(err)
+	}
+}
+
+func TestSerializableUpdateRetriesOnConflict(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+	s := &pgStore{db: db, isolation: sql.LevelSerializable}
+	suffix := fmt.Sprint(time.Now().UnixNano())
+	id, err := s.CreateUser(ctx, "iso"+suffix, "iso"+suffix+"@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.DeleteUser(ctx, id) })
+
+	// A concurrent transaction holds the row while the store's update
+	// starts, then commits, so the store's first attempt can't serialize.
+	other, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Rollback()
+	if _, err := other.ExecContext(ctx, "UPDATE users SET username = $2 WHERE user_id = $1", id, "other"+suffix); err != nil {
+		t.Fatal(err)
+	}
+
+	name := "store" + suffix
+	done := make(chan error, 1)
+	go func() {
+		_, committed, err := s.UpdateUsers(ctx, []userUpdate{{ID: id, Username: &name}}, true)
+		if err == nil && !committed {
+			err = errors.New("not committed")
+		}
+		done <- err
+	}()
+	waitFor(t, "update blocked on the row lock", func() bool {
+		var waiting bool
+		db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM pg_locks WHERE NOT granted)").Scan(&waiting)
+		return waiting
+	})
+	if err := other.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("update not retried past the conflict: %v", err)
+	}
+	u, err := s.GetUser(ctx, id)
+	if err != nil || u.Username != name {
+		t.Fatalf("user = %+v, %v", u, err)
+	}
+}
@@ -0,0 +1,51 @@
+// userid_test.go
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestParseID(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int32
+		wantErr string
+	}{
+		{"1", 1, ""},
+		{"2147483647", 2147483647, ""},
+		{"", 0, "missing"},
+		{"abc", 0, "not an integer"},
+		{"0", 0, "must be positive"},
+		{"-5", 0, "must be positive"},
+		{"2147483648", 0, "out of range"},
+		{"99999999999999999999999", 0, "out of range"},
+	}
+	for _, tt := range tests {
+		id, err := parseID(tt.in)
+		if tt.wantErr == "" && (err != nil || id != tt.want) {
+			t.Errorf("parseID(%q) = %d, %v", tt.in, id, err)
+		}
+		if tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr) {
+			t.Errorf("parseID(%q) error = %v, want %q", tt.in, err, tt.wantErr)
+		}
+	}
+}
+
+func TestOutOfRangeIDIsBadRequest(t *testing.T) {
+	ta := newTestApp(t, nil)
+	for id, reason := range map[string]string{
+		"99999999999999999999999": "out of range",
+		"2147483648":              "out of range",
+		"-1":                      "must be positive",
+		"0":                       "must be positive",
+	} {
+		t.Run(id, func(t *testing.T) {
+			rec := ta.do(t, http.MethodGet, "/users/"+id, "")
+			wantStatus(t, rec, http.StatusBadRequest)
+			if got := jsonBody(t, rec)["error"]; got != "Invalid user_id: "+reason {
+				t.Fatalf("error = %v", got)
+			}
+		})
+	}
+}
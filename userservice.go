@@ -0,0 +1,334 @@
+// userservice.go
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// errEmailDomainUnresolvable rejects a new user whose email domain doesn't
+// accept mail (VALIDATE_EMAIL_MX).
+var errEmailDomainUnresolvable = errors.New("email domain does not accept mail")
+
+// validationError carries every field problem found in one input.
+type validationError struct {
+	fields []fieldError
+}
+
+func (e *validationError) Error() string {
+	return "validation failed"
+}
+
+// UserService holds the rules for changing and reading users: validation,
+// the email domain check, read coalescing and change events. The REST and
+// GraphQL handlers only translate their requests and its errors.
+type UserService struct {
+	store    userStore
+	events   *broadcaster
+	notifier Notifier
+	// domains and reads are nil when their features are off.
+	domains *emailDomainChecker
+	reads   *singleflight.Group
+	// audit is set with AUDIT_DB_URL; without it pgStore writes audit_log
+	// itself.
+	audit *auditWriter
+	cfg   Config
+}
+
+// Create adds a user. With IDENTICAL_CREATE_OK a repeat of a create that
+// already succeeded returns the stored user and existed=true instead of
+// errDuplicateEmail.
+func (s *UserService) Create(ctx context.Context, p createUserReq) (u User, existed bool, err error) {
+	if errs := s.validateCreateUser(p); len(errs) > 0 {
+		return User{}, false, s.invalid(errs)
+	}
+	if s.domains != nil && !s.domains.resolvable(ctx, p.Email) {
+		recordValidationFailure("unresolvable_email_domain")
+		return User{}, false, errEmailDomainUnresolvable
+	}
+
+	id, err := s.store.CreateUser(ctx, p.Username, p.Email)
+	// With UNIQUE_USERNAMES an identical repeat may trip either index first.
+	duplicate := errors.Is(err, errDuplicateEmail) || errors.Is(err, errDuplicateUsername)
+	if duplicate && s.cfg.IdenticalCreateOK {
+		existing, lookupErr := s.store.GetUserByEmail(ctx, p.Email)
+		if lookupErr == nil && existing.Username == p.Username {
+			return existing, true, nil
+		}
+	}
+	if err != nil {
+		return User{}, false, countDuplicate(err)
+	}
+
+	u = User{ID: id, Username: p.Username, Email: p.Email}
+	s.recordAudit(ctx, auditUserCreated, u.ID)
+	// /events is public, so events name the user and nothing else;
+	// subscribers fetch the fields they may see from /users/{id}.
+	s.events.publish(event{Type: "user.created", Data: map[string]any{"user_id": u.ID}})
+	s.notifier.UserCreated(u)
+	withField(ctx, "user_id", u.ID)
+	return u, false, nil
+}
+
+// Seed creates the SEED_USER account when there are no users yet. Unlike
+// Create it announces nothing: nobody can be subscribed before startup. Nor
+// is it audited, since no client made the write.
+func (s *UserService) Seed(ctx context.Context, p createUserReq) error {
+	if errs := s.validateCreateUser(p); len(errs) > 0 {
+		msgs := make([]string, len(errs))
+		for i, fe := range errs {
+			msgs[i] = fe.Message
+		}
+		return errors.New(strings.Join(msgs, "; "))
+	}
+	created, err := s.store.SeedUser(ctx, p.Username, p.Email)
+	if err != nil {
+		return err
+	}
+	if created {
+		slog.Info("seed user created", "username", p.Username)
+	} else {
+		slog.Info("seed user skipped, users already exist")
+	}
+	return nil
+}
+
+// Get reads a user, sharing one store call among concurrent requests for
+// the same id when coalescing is enabled. The shared call is detached from
+// any single caller's cancellation so one client going away doesn't fail the
+// others; every waiter receives the same result or error.
+func (s *UserService) Get(ctx context.Context, id int32) (User, error) {
+	if s.reads == nil {
+		return s.store.GetUser(ctx, id)
+	}
+	ch := s.reads.DoChan(strconv.FormatInt(int64(id), 10), func() (any, error) {
+		sctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), s.cfg.QueryTimeout)
+		defer cancel()
+		return s.store.GetUser(sctx, id)
+	})
+	select {
+	case <-ctx.Done():
+		return User{}, ctx.Err()
+	case res := <-ch:
+		u, _ := res.Val.(User)
+		return u, res.Err
+	}
+}
+
+// GetByEmail reads the user with email, matched case-insensitively.
+func (s *UserService) GetByEmail(ctx context.Context, email string) (User, error) {
+	return s.store.GetUserByEmail(ctx, email)
+}
+
+// List returns one page of users. Like the store, it returns the rows read
+// so far alongside the context error when ctx expires mid-iteration.
+func (s *UserService) List(ctx context.Context, p pageParams) ([]User, error) {
+	return s.store.ListUsers(ctx, p)
+}
+
+// Update changes the fields set in u and returns the stored user. Unlike
+// Replace, a set field must be valid; it is never cleared.
+func (s *UserService) Update(ctx context.Context, u userUpdate) (User, error) {
+	if errs := s.validateUpdate(u); len(errs) > 0 {
+		return User{}, s.invalid(errs)
+	}
+	if err := s.updateOne(ctx, u); err != nil {
+		return User{}, err
+	}
+	updated, err := s.store.GetUser(ctx, u.ID)
+	if err != nil {
+		// errUserNotFound here means it was deleted since the update.
+		return User{}, err
+	}
+	return updated, nil
+}
+
+// Replace overwrites every field of user id, so an empty one is cleared.
+// Fields in PUT_PROTECTED_FIELDS can't be cleared this way, which guards
+// against clients that drop them by mistake.
+func (s *UserService) Replace(ctx context.Context, id int32, p createUserReq) (User, error) {
+	var errs []fieldError
+	for _, f := range []struct {
+		name  string
+		value string
+		check func([]fieldError, string) []fieldError
+	}{
+		{"username", p.Username, s.validateUsername},
+		{"email", p.Email, s.validateEmail},
+	} {
+		switch {
+		case strings.TrimSpace(f.value) != "":
+			errs = f.check(errs, f.value)
+		case slices.Contains(s.cfg.PutProtectedFields, f.name):
+			errs = append(errs, fieldError{f.name, codeClearNotAllowed,
+				f.name + " cannot be cleared with PUT"})
+		}
+	}
+	errs = s.validateDistinct(errs, p.Username, p.Email)
+	if len(errs) > 0 {
+		return User{}, s.invalid(errs)
+	}
+	if err := s.updateOne(ctx, userUpdate{ID: id, Username: &p.Username, Email: &p.Email}); err != nil {
+		return User{}, err
+	}
+	return User{ID: id, Username: p.Username, Email: p.Email}, nil
+}
+
+// UpdateBatch applies items in one transaction per BATCH_UPDATE_POLICY. A
+// validation failure rejects the whole batch before anything is written
+// and is reported as a *batchValidationError naming the item.
+func (s *UserService) UpdateBatch(ctx context.Context, items []userUpdate) (results []updateResult, committed bool, err error) {
+	for i, it := range items {
+		if errs := s.validateUpdate(it); len(errs) > 0 {
+			return nil, false, &batchValidationError{index: i, validationError: s.invalid(errs)}
+		}
+	}
+
+	results, committed, err = s.store.UpdateUsers(ctx, items, s.cfg.BatchUpdateAtomic)
+	if err != nil {
+		return nil, false, err
+	}
+	if committed {
+		var updated []int32
+		for i, res := range results {
+			if res.Status == updateUpdated {
+				updated = append(updated, items[i].ID)
+				s.events.publish(event{Type: "user.updated", Data: map[string]any{"user_id": items[i].ID}})
+			}
+		}
+		s.recordAudit(ctx, auditUserUpdated, updated...)
+	}
+	for i := range results {
+		if results[i].err != nil {
+			results[i].err = countDuplicate(results[i].err)
+		}
+	}
+	return results, committed, nil
+}
+
+// importResult reports a bulk import. IDs is set only when the caller asked
+// for them, which always takes the INSERT path.
+type importResult struct {
+	Imported int64   `json:"imported"`
+	Method   string  `json:"method"`
+	IDs      []int32 `json:"user_ids,omitempty"`
+	// Skipped are the indexes of the rows IMPORT_DUPLICATES=dedupe dropped.
+	Skipped []int `json:"skipped_rows,omitempty"`
+}
+
+// Import adds rows in one all-or-nothing write: COPY for batches of at
+// least IMPORT_COPY_THRESHOLD rows, a multi-row INSERT otherwise or when
+// wantIDs or AUDIT_LOG is set, since COPY can't return the generated ids.
+// A validation failure is a *batchValidationError naming the row. Imports
+// are bulk loads: no per-user events or webhooks are sent.
+func (s *UserService) Import(ctx context.Context, rows []createUserReq, wantIDs bool) (importResult, error) {
+	for i, row := range rows {
+		if errs := s.validateCreateUser(row); len(errs) > 0 {
+			return importResult{}, &batchValidationError{index: i, validationError: s.invalid(errs)}
+		}
+	}
+	var skipped []int
+	if s.cfg.ImportDuplicates != "off" {
+		dups := batchDuplicates(rows, s.cfg.UniqueUsernames)
+		if len(dups) > 0 && s.cfg.ImportDuplicates == "reject" {
+			for _, d := range dups {
+				recordValidationFailure("duplicate_" + d.Field)
+			}
+			return importResult{}, &batchDuplicatesError{dups}
+		}
+		rows, skipped = dropDuplicates(rows, dups)
+	}
+
+	if !wantIDs && !s.cfg.AuditLog && s.cfg.ImportCopyThreshold > 0 && len(rows) >= s.cfg.ImportCopyThreshold {
+		n, err := s.store.CopyUsers(ctx, rows)
+		if err != nil {
+			return importResult{}, countDuplicate(err)
+		}
+		return importResult{Imported: n, Method: "copy", Skipped: skipped}, nil
+	}
+	ids, err := s.store.InsertUsers(ctx, rows)
+	if err != nil {
+		return importResult{}, countDuplicate(err)
+	}
+	s.recordAudit(ctx, auditUserCreated, ids...)
+	res := importResult{Imported: int64(len(ids)), Method: "insert", Skipped: skipped}
+	if wantIDs {
+		res.IDs = ids
+	}
+	return res, nil
+}
+
+// Delete removes user id, or returns errUserNotFound.
+func (s *UserService) Delete(ctx context.Context, id int32) error {
+	if err := s.store.DeleteUser(ctx, id); err != nil {
+		return err
+	}
+	s.recordAudit(ctx, auditUserDeleted, id)
+	return nil
+}
+
+// recordAudit hands entries for a committed write to the audit writer, if
+// AUDIT_DB_URL configured one.
+func (s *UserService) recordAudit(ctx context.Context, action string, ids ...int32) {
+	if s.audit != nil {
+		s.audit.record(auditEntries(ctx, action, ids...))
+	}
+}
+
+// batchValidationError is a validationError for one item of a batch.
+type batchValidationError struct {
+	index int
+	*validationError
+}
+
+// updateOne writes a single update, returning errUserNotFound or the
+// item's client-level error.
+func (s *UserService) updateOne(ctx context.Context, u userUpdate) error {
+	results, _, err := s.store.UpdateUsers(ctx, []userUpdate{u}, true)
+	if err != nil {
+		return err
+	}
+	switch res := results[0]; {
+	case res.Status == updateNotFound:
+		return errUserNotFound
+	case res.err != nil:
+		return countDuplicate(res.err)
+	}
+	s.recordAudit(ctx, auditUserUpdated, u.ID)
+	s.events.publish(event{Type: "user.updated", Data: map[string]any{"user_id": u.ID}})
+	return nil
+}
+
+func (s *UserService) validateUpdate(u userUpdate) []fieldError {
+	var errs []fieldError
+	if u.Username != nil {
+		errs = s.validateUsername(errs, *u.Username)
+	}
+	if u.Email != nil {
+		errs = s.validateEmail(errs, *u.Email)
+	}
+	return errs
+}
+
+func (s *UserService) invalid(errs []fieldError) *validationError {
+	recordFieldErrors(errs)
+	return &validationError{fields: errs}
+}
+
+// countDuplicate records a write rejected for a duplicate email or username
+// and returns err unchanged.
+func countDuplicate(err error) error {
+	switch {
+	case errors.Is(err, errDuplicateEmail):
+		recordValidationFailure("duplicate_email")
+	case errors.Is(err, errDuplicateUsername):
+		recordValidationFailure("duplicate_username")
+	}
+	return err
+}
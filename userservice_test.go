@@ -0,0 +1,335 @@
+// userservice_test.go
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// gatedGetStore counts GetUser calls and holds each until release closes.
+type gatedGetStore struct {
+	userStore
+	calls   atomic.Int32
+	release chan struct{}
+	err     error
+}
+
+func (s *gatedGetStore) GetUser(ctx context.Context, id int32) (User, error) {
+	s.calls.Add(1)
+	<-s.release
+	if s.err != nil {
+		return User{}, s.err
+	}
+	return User{ID: id, Username: "ann", Email: "ann@example.com"}, nil
+}
+
+// concurrentGets runs n simultaneous Gets of one id through a service over
+// store and returns their errors once store is released.
+func concurrentGets(t *testing.T, store *gatedGetStore, n int) []error {
+	ta := newTestApp(t, map[string]string{"COALESCE_READS": "true"})
+	ta.Users.store = store
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Go(func() {
+			_, errs[i] = ta.Users.Get(context.Background(), 7)
+		})
+	}
+	waitFor(t, "the first read", func() bool { return store.calls.Load() > 0 })
+	// Give the rest time to join the read in flight.
+	time.Sleep(50 * time.Millisecond)
+	close(store.release)
+	wg.Wait()
+	return errs
+}
+
+func TestCoalescedReadsShareOneQuery(t *testing.T) {
+	store := &gatedGetStore{release: make(chan struct{})}
+	for i, err := range concurrentGets(t, store, 20) {
+		if err != nil {
+			t.Fatalf("read %d: %v", i, err)
+		}
+	}
+	if n := store.calls.Load(); n != 1 {
+		t.Fatalf("%d store reads, want 1", n)
+	}
+}
+
+func TestCoalescedReadErrorReachesEveryWaiter(t *testing.T) {
+	store := &gatedGetStore{release: make(chan struct{}), err: errUserNotFound}
+	for i, err := range concurrentGets(t, store, 20) {
+		if !errors.Is(err, errUserNotFound) {
+			t.Fatalf("read %d: %v, want errUserNotFound", i, err)
+		}
+	}
+}
+
+func TestCoalescedReadsThroughHandler(t *testing.T) {
+	ta := newTestApp(t, map[string]string{"COALESCE_READS": "true"})
+	id := ta.createUser(t, "ann", "ann@example.com")
+	wantStatus(t, ta.do(t, http.MethodGet, fmt.Sprintf("/users/%d", id), ""), http.StatusOK)
+	wantStatus(t, ta.do(t, http.MethodGet, "/users/999", ""), http.StatusNotFound)
+}
+
+// createdRecorder is a Notifier remembering every user it was told about.
+type createdRecorder struct {
+	mu    sync.Mutex
+	users []User
+}
+
+func (n *createdRecorder) UserCreated(u User) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.users = append(n.users, u)
+}
+
+// newTestService is a UserService over a memory store, with no HTTP in
+// front of it.
+func newTestService(t *testing.T, env map[string]string) (*UserService, *createdRecorder) {
+	t.Helper()
+	cfg := testConfig(t, env)
+	events := newBroadcaster(cfg.SSEMaxSubscribers, cfg.SSEBufferSize, cfg.EventHubBuffer, cfg.EventHubOverflow)
+	t.Cleanup(events.stop)
+	notifier := &createdRecorder{}
+	return &UserService{
+		store:    newMemoryStore(cfg.UniqueUsernames),
+		events:   events,
+		notifier: notifier,
+		cfg:      cfg,
+	}, notifier
+}
+
+func TestServiceCreateAndGet(t *testing.T) {
+	s, notifier := newTestService(t, nil)
+	ctx := context.Background()
+	u, existed, err := s.Create(ctx, createUserReq{Username: "ann", Email: "ann@example.com"})
+	if err != nil || existed {
+		t.Fatalf("Create = %v, existed %v", err, existed)
+	}
+	if len(notifier.users) != 1 || notifier.users[0] != u {
+		t.Fatalf("notified %v, want %v", notifier.users, u)
+	}
+	got, err := s.Get(ctx, u.ID)
+	if err != nil || got != u {
+		t.Fatalf("Get = %+v, %v; want %+v", got, err, u)
+	}
+	if got, err := s.GetByEmail(ctx, "ANN@example.com"); err != nil || got.ID != u.ID {
+		t.Fatalf("GetByEmail = %+v, %v", got, err)
+	}
+	if _, err := s.Get(ctx, u.ID+1); !errors.Is(err, errUserNotFound) {
+		t.Fatalf("Get missing = %v, want errUserNotFound", err)
+	}
+}
+
+func TestServiceCreateRejects(t *testing.T) {
+	s, notifier := newTestService(t, nil)
+	ctx := context.Background()
+	_, _, err := s.Create(ctx, createUserReq{Username: "", Email: "not-an-email"})
+	var ve *validationError
+	if !errors.As(err, &ve) || len(ve.fields) != 2 {
+		t.Fatalf("Create invalid = %v, want two field errors", err)
+	}
+
+	if _, _, err := s.Create(ctx, createUserReq{Username: "ann", Email: "ann@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.Create(ctx, createUserReq{Username: "annie", Email: "ann@example.com"}); !errors.Is(err, errDuplicateEmail) {
+		t.Fatalf("Create duplicate = %v, want errDuplicateEmail", err)
+	}
+	if len(notifier.users) != 1 {
+		t.Fatalf("notified %d times, want only for the created user", len(notifier.users))
+	}
+}
+
+func TestServiceIdenticalCreate(t *testing.T) {
+	s, notifier := newTestService(t, map[string]string{"IDENTICAL_CREATE_RETURNS_OK": "true"})
+	ctx := context.Background()
+	first, _, err := s.Create(ctx, createUserReq{Username: "ann", Email: "ann@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, existed, err := s.Create(ctx, createUserReq{Username: "ann", Email: "ann@example.com"})
+	if err != nil || !existed || again.ID != first.ID {
+		t.Fatalf("repeat = %+v, existed %v, %v", again, existed, err)
+	}
+	if len(notifier.users) != 1 {
+		t.Fatalf("repeat notified again: %v", notifier.users)
+	}
+}
+
+func TestServiceList(t *testing.T) {
+	s, _ := newTestService(t, nil)
+	ctx := context.Background()
+	for _, name := range []string{"ann", "bob", "cy"} {
+		if _, _, err := s.Create(ctx, createUserReq{Username: name, Email: name + "@example.com"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	users, err := s.List(ctx, pageParams{Limit: 2, Sort: "user_id"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 || users[0].Username != "ann" || users[1].Username != "bob" {
+		t.Fatalf("first page = %+v", users)
+	}
+	users, err = s.List(ctx, pageParams{Limit: 2, AfterID: users[1].ID, Sort: "user_id"})
+	if err != nil || len(users) != 1 || users[0].Username != "cy" {
+		t.Fatalf("second page = %+v, %v", users, err)
+	}
+}
+
+func TestServiceUpdate(t *testing.T) {
+	s, _ := newTestService(t, nil)
+	ctx := context.Background()
+	ann, _, err := s.Create(ctx, createUserReq{Username: "ann", Email: "ann@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, _, err := s.Create(ctx, createUserReq{Username: "bob", Email: "bob@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name := "annie"
+	got, err := s.Update(ctx, userUpdate{ID: ann.ID, Username: &name})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Username != "annie" || got.Email != "ann@example.com" {
+		t.Fatalf("Update = %+v, want only the username changed", got)
+	}
+
+	bad := "not-an-email"
+	var ve *validationError
+	if _, err := s.Update(ctx, userUpdate{ID: ann.ID, Email: &bad}); !errors.As(err, &ve) {
+		t.Fatalf("Update invalid = %v, want a validationError", err)
+	}
+	taken := bob.Email
+	if _, err := s.Update(ctx, userUpdate{ID: ann.ID, Email: &taken}); !errors.Is(err, errDuplicateEmail) {
+		t.Fatalf("Update duplicate = %v, want errDuplicateEmail", err)
+	}
+	if _, err := s.Update(ctx, userUpdate{ID: bob.ID + 100, Username: &name}); !errors.Is(err, errUserNotFound) {
+		t.Fatalf("Update missing = %v, want errUserNotFound", err)
+	}
+}
+
+func TestServiceReplace(t *testing.T) {
+	s, _ := newTestService(t, map[string]string{"PUT_PROTECTED_FIELDS": "email"})
+	ctx := context.Background()
+	ann, _, err := s.Create(ctx, createUserReq{Username: "ann", Email: "ann@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.Replace(ctx, ann.ID, createUserReq{Username: "annie", Email: "annie@example.com"})
+	if err != nil || got != (User{ID: ann.ID, Username: "annie", Email: "annie@example.com"}) {
+		t.Fatalf("Replace = %+v, %v", got, err)
+	}
+	var ve *validationError
+	if _, err := s.Replace(ctx, ann.ID, createUserReq{Username: "annie"}); !errors.As(err, &ve) ||
+		ve.fields[0].Code != codeClearNotAllowed {
+		t.Fatalf("Replace clearing a protected field = %v", err)
+	}
+	if _, err := s.Replace(ctx, ann.ID+1, createUserReq{Username: "bob", Email: "bob@example.com"}); !errors.Is(err, errUserNotFound) {
+		t.Fatalf("Replace missing = %v, want errUserNotFound", err)
+	}
+}
+
+func TestServiceDelete(t *testing.T) {
+	s, _ := newTestService(t, nil)
+	ctx := context.Background()
+	ann, _, err := s.Create(ctx, createUserReq{Username: "ann", Email: "ann@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(ctx, ann.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get(ctx, ann.ID); !errors.Is(err, errUserNotFound) {
+		t.Fatalf("Get after Delete = %v", err)
+	}
+	if err := s.Delete(ctx, ann.ID); !errors.Is(err, errUserNotFound) {
+		t.Fatalf("second Delete = %v, want errUserNotFound", err)
+	}
+}
+
+func TestServiceErrorsThroughHandler(t *testing.T) {
+	ta := newTestApp(t, nil)
+	ta.createUser(t, "ann", "ann@example.com")
+	rec := ta.do(t, http.MethodPost, "/users", `{"username":"annie","email":"ann@example.com"}`)
+	wantStatus(t, rec, http.StatusConflict)
+	rec = ta.do(t, http.MethodPost, "/users", `{"username":"","email":"bad"}`)
+	wantStatus(t, rec, http.StatusBadRequest)
+	wantStatus(t, ta.do(t, http.MethodDelete, "/users/999", ""), http.StatusNotFound)
+}
+
+func TestSeedUserOnFirstBoot(t *testing.T) {
+	out := captureDefaultLog(t)
+	ta := newTestApp(t, map[string]string{"SEED_USER": "admin:admin@example.com"})
+	rec := ta.do(t, http.MethodGet, "/users/1", "")
+	wantStatus(t, rec, http.StatusOK)
+	if body := jsonBody(t, rec); body["username"] != "admin" || body["email"] != "admin@example.com" {
+		t.Fatalf("seed user = %v", body)
+	}
+	if !strings.Contains(out.String(), "seed user created") {
+		t.Fatalf("log = %s", out)
+	}
+}
+
+func TestSeedSkipsWhenUsersExist(t *testing.T) {
+	s, notifier := newTestService(t, nil)
+	ctx := context.Background()
+	if err := s.Seed(ctx, createUserReq{Username: "admin", Email: "admin@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	// A second replica booting later finds the table no longer empty.
+	if err := s.Seed(ctx, createUserReq{Username: "root", Email: "root@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetByEmail(ctx, "root@example.com"); !errors.Is(err, errUserNotFound) {
+		t.Fatalf("second seed inserted: %v", err)
+	}
+	if len(notifier.users) != 0 {
+		t.Fatalf("seeding notified %v", notifier.users)
+	}
+}
+
+func TestSeedValidatesUser(t *testing.T) {
+	s, _ := newTestService(t, nil)
+	err := s.Seed(context.Background(), createUserReq{Username: strings.Repeat("a", 51), Email: "admin@example.com"})
+	if err == nil {
+		t.Fatal("seeded an invalid username")
+	}
+	if _, err := s.GetByEmail(context.Background(), "admin@example.com"); !errors.Is(err, errUserNotFound) {
+		t.Fatalf("invalid seed inserted: %v", err)
+	}
+}
+
+// TestSeedUserPostgres seeds a session-local copy of the users table, which
+// the store's unqualified table name resolves to ahead of public.users.
+func TestSeedUserPostgres(t *testing.T) {
+	db := testDB(t)
+	db.SetMaxOpenConns(1)
+	ctx := context.Background()
+	if _, err := db.ExecContext(ctx, "CREATE TEMP TABLE users (LIKE public.users INCLUDING ALL)"); err != nil {
+		t.Fatal(err)
+	}
+	store := &pgStore{db: db}
+	created, err := store.SeedUser(ctx, "admin", "admin@example.com")
+	if err != nil || !created {
+		t.Fatalf("SeedUser on empty table = %v, %v", created, err)
+	}
+	if created, err := store.SeedUser(ctx, "root", "root@example.com"); err != nil || created {
+		t.Fatalf("SeedUser on seeded table = %v, %v", created, err)
+	}
+	var n int
+	if err := db.QueryRowContext(ctx, "SELECT count(*) FROM users WHERE email = 'admin@example.com'").Scan(&n); err != nil || n != 1 {
+		t.Fatalf("seed rows = %d, %v", n, err)
+	}
+}
@@ -0,0 +1,133 @@
+// validation.go
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+// Field-level validation codes. Clients match on these, so they are stable.
+const (
+	codeRequired      = "REQUIRED"
+	codeTooShort      = "TOO_SHORT"
+	codeTooLong       = "TOO_LONG"
+	codeInvalidFormat = "INVALID_FORMAT"
+	// codeClearNotAllowed rejects emptying a PUT_PROTECTED_FIELDS field.
+	codeClearNotAllowed = "CLEAR_NOT_ALLOWED"
+	// codeUsernameEqualsEmail is DISALLOW_USERNAME_EQUALS_EMAIL's rule.
+	codeUsernameEqualsEmail = "USERNAME_EQUALS_EMAIL"
+)
+
+// constraintCodes maps DB CHECK constraint names to client error codes.
+var constraintCodes = map[string]string{
+	"users_email_check":    "INVALID_EMAIL",
+	"users_username_check": "INVALID_USERNAME",
+}
+
+type fieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// validateCreateUser reports every problem with req at once.
+func (s *UserService) validateCreateUser(req createUserReq) []fieldError {
+	errs := s.validateUsername(nil, req.Username)
+	errs = s.validateEmail(errs, req.Email)
+	return s.validateDistinct(errs, req.Username, req.Email)
+}
+
+// validateDistinct applies DISALLOW_USERNAME_EQUALS_EMAIL: a username that
+// reads as the email, whole or its local part, is confusing in login flows.
+func (s *UserService) validateDistinct(errs []fieldError, username, email string) []fieldError {
+	if !s.cfg.DisallowUsernameEqualsEmail {
+		return errs
+	}
+	username, email = strings.TrimSpace(username), strings.TrimSpace(email)
+	if username == "" {
+		return errs
+	}
+	local := email
+	if i := strings.LastIndexByte(email, '@'); i >= 0 {
+		local = email[:i]
+	}
+	if strings.EqualFold(username, email) || strings.EqualFold(username, local) {
+		errs = append(errs, fieldError{"username", codeUsernameEqualsEmail,
+			"username must differ from the email and its local part"})
+	}
+	return errs
+}
+
+func (s *UserService) validateUsername(errs []fieldError, username string) []fieldError {
+	// VARCHAR(n) limits characters, not bytes, so count runes.
+	trimmed := strings.TrimSpace(username)
+	switch n := utf8.RuneCountInString(username); {
+	case trimmed == "":
+		errs = append(errs, fieldError{"username", codeRequired, "username is required"})
+	case utf8.RuneCountInString(trimmed) < s.cfg.UsernameMinLen:
+		errs = append(errs, fieldError{"username", codeTooShort,
+			fmt.Sprintf("username must be at least %d characters", s.cfg.UsernameMinLen)})
+	case n > s.cfg.UsernameMaxLen:
+		errs = append(errs, fieldError{"username", codeTooLong,
+			fmt.Sprintf("username must be at most %d characters", s.cfg.UsernameMaxLen)})
+	}
+	return errs
+}
+
+func (s *UserService) validateEmail(errs []fieldError, email string) []fieldError {
+	switch {
+	case strings.TrimSpace(email) == "":
+		errs = append(errs, fieldError{"email", codeRequired, "email is required"})
+	case utf8.RuneCountInString(email) > s.cfg.EmailMaxLen:
+		errs = append(errs, fieldError{"email", codeTooLong,
+			fmt.Sprintf("email must be at most %d characters", s.cfg.EmailMaxLen)})
+	case !isValidEmail(email):
+		errs = append(errs, fieldError{"email", codeInvalidFormat, "email is not a valid address"})
+	}
+	return errs
+}
+
+// metricReason maps a field error onto the validation_failures_total label.
+func (fe fieldError) metricReason() string {
+	switch fe.Code {
+	case codeRequired, codeClearNotAllowed:
+		return "empty_" + fe.Field
+	case codeTooShort:
+		return fe.Field + "_too_short"
+	case codeTooLong:
+		return fe.Field + "_too_long"
+	case codeInvalidFormat:
+		return "invalid_" + fe.Field
+	case codeUsernameEqualsEmail:
+		return "username_equals_email"
+	}
+	return "other"
+}
+
+func recordFieldErrors(errs []fieldError) {
+	for _, fe := range errs {
+		recordValidationFailure(fe.metricReason())
+	}
+}
+
+func writeValidationErrors(w http.ResponseWriter, errs []fieldError) {
+	jsonWrite(w, http.StatusBadRequest, map[string]any{
+		"error":  "Validation failed",
+		"fields": errs,
+	})
+}
+
+// writeCheckViolation answers a DB-enforced rule failure as a client error
+// rather than leaking it as a 500.
+func writeCheckViolation(w http.ResponseWriter, cv *checkViolationError) {
+	code, ok := constraintCodes[cv.Constraint]
+	if !ok {
+		code = "CONSTRAINT_VIOLATION"
+	}
+	jsonWrite(w, http.StatusBadRequest, map[string]string{
+		"error": "Value rejected by database constraint",
+		"code":  code,
+	})
+}
@@ -0,0 +1,165 @@
+// validation_test.go
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fieldCodes lists a validation response's fields as "field:code".
+func fieldCodes(t *testing.T, rec *httptest.ResponseRecorder) []string {
+	t.Helper()
+	fields, _ := jsonBody(t, rec)["fields"].([]any)
+	var out []string
+	for _, f := range fields {
+		fe := f.(map[string]any)
+		out = append(out, fe["field"].(string)+":"+fe["code"].(string))
+	}
+	return out
+}
+
+func TestLengthLimitsCountCharacters(t *testing.T) {
+	ta := newTestApp(t, map[string]string{"USERNAME_MAX_LEN": "5", "EMAIL_MAX_LEN": "12"})
+	tests := []struct {
+		name, username, email string
+		want                  []string
+	}{
+		{"at limits", "abcde", "abc@exam.com", nil},
+		// "héllo" is 5 characters in 6 bytes.
+		{"multibyte at limit", "héllo", "d@example.io", nil},
+		{"username over", "abcdef", "e@example.io", []string{"username:TOO_LONG"}},
+		{"multibyte over", "héllo!", "f@example.io", []string{"username:TOO_LONG"}},
+		{"email over", "abc", "gh@example.io", []string{"email:TOO_LONG"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := ta.do(t, http.MethodPost, "/users", `{"username":"`+tt.username+`","email":"`+tt.email+`"}`)
+			if tt.want == nil {
+				wantStatus(t, rec, http.StatusCreated)
+				return
+			}
+			wantStatus(t, rec, http.StatusBadRequest)
+			if got := fieldCodes(t, rec); !slices.Equal(got, tt.want) {
+				t.Fatalf("fields = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// truncatingStore fails every create as a column shorter than the
+// configured limit would.
+type truncatingStore struct{ userStore }
+
+func (truncatingStore) CreateUser(context.Context, string, string) (int32, error) {
+	return 0, errValueTooLong
+}
+
+func TestValueTooLongIsClientError(t *testing.T) {
+	ta := newTestApp(t, nil)
+	ta.Users.store = truncatingStore{ta.Users.store}
+	rec := ta.do(t, http.MethodPost, "/users", `{"username":"ann","email":"ann@example.com"}`)
+	wantStatus(t, rec, http.StatusBadRequest)
+	if !strings.Contains(rec.Body.String(), "too long") {
+		t.Fatalf("body = %s", rec.Body)
+	}
+}
+
+func TestValidationReportsEveryField(t *testing.T) {
+	ta := newTestApp(t, map[string]string{"USERNAME_MIN_LEN": "3"})
+	tests := []struct {
+		body string
+		want []string
+	}{
+		{`{"username":"ab","email":"not-an-email"}`, []string{"username:" + codeTooShort, "email:" + codeInvalidFormat}},
+		{`{}`, []string{"username:" + codeRequired, "email:" + codeRequired}},
+	}
+	for _, tt := range tests {
+		rec := ta.do(t, http.MethodPost, "/users", tt.body)
+		wantStatus(t, rec, http.StatusBadRequest)
+		if got := jsonBody(t, rec)["error"]; got != "Validation failed" {
+			t.Errorf("%s: summary = %v", tt.body, got)
+		}
+		if got := fieldCodes(t, rec); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: fields = %v, want %v", tt.body, got, tt.want)
+		}
+	}
+}
+
+func TestPutProtectedFields(t *testing.T) {
+	ta := newTestApp(t, nil)
+	id := ta.createUser(t, "ann", "ann@example.com")
+	path := "/users/" + strconv.Itoa(int(id))
+
+	rec := ta.do(t, http.MethodPut, path, `{"username":"ann","email":""}`)
+	wantStatus(t, rec, http.StatusBadRequest)
+	if got := fieldCodes(t, rec); !slices.Equal(got, []string{"email:CLEAR_NOT_ALLOWED"}) {
+		t.Fatalf("codes = %v", got)
+	}
+	rec = ta.do(t, http.MethodPut, path, `{"username":"annie"}`)
+	wantStatus(t, rec, http.StatusBadRequest)
+
+	rec = ta.do(t, http.MethodPut, path, `{"username":"annie","email":"annie@example.com"}`)
+	wantStatus(t, rec, http.StatusOK)
+	if body := jsonBody(t, rec); body["username"] != "annie" || body["email"] != "annie@example.com" {
+		t.Fatalf("replaced = %v", body)
+	}
+	// Unprotected fields may still be cleared.
+	rec = ta.do(t, http.MethodPut, path, `{"username":"","email":"annie@example.com"}`)
+	wantStatus(t, rec, http.StatusOK)
+	if body := jsonBody(t, rec); body["username"] != "" {
+		t.Fatalf("username not cleared: %v", body)
+	}
+}
+
+func TestPutProtectedFieldsConfig(t *testing.T) {
+	ta := newTestApp(t, map[string]string{"PUT_PROTECTED_FIELDS": "username,email"})
+	ta.createUser(t, "ann", "ann@example.com")
+	rec := ta.do(t, http.MethodPut, "/users/1", `{"username":"","email":""}`)
+	wantStatus(t, rec, http.StatusBadRequest)
+	if got := fieldCodes(t, rec); !slices.Equal(got, []string{"username:CLEAR_NOT_ALLOWED", "email:CLEAR_NOT_ALLOWED"}) {
+		t.Fatalf("codes = %v", got)
+	}
+	if err := loadConfigErr(t, map[string]string{"PUT_PROTECTED_FIELDS": "password"}); !strings.Contains(err.Error(), "PUT_PROTECTED_FIELDS") {
+		t.Fatal(err)
+	}
+}
+
+func TestDisallowUsernameEqualsEmail(t *testing.T) {
+	ta := newTestApp(t, map[string]string{"DISALLOW_USERNAME_EQUALS_EMAIL": "true"})
+	counter := validationFailures.WithLabelValues("username_equals_email")
+	before := testutil.ToFloat64(counter)
+	for _, tt := range []struct{ name, username, email string }{
+		{"whole email", "Bob@X.io", "bob@x.io"},
+		{"local part", "BOB", "bob@x.io"},
+		{"padded", " bob ", "bob@x.io"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := ta.do(t, http.MethodPost, "/users", `{"username":"`+tt.username+`","email":"`+tt.email+`"}`)
+			wantStatus(t, rec, http.StatusBadRequest)
+			if got := fieldCodes(t, rec); !slices.Equal(got, []string{"username:" + codeUsernameEqualsEmail}) {
+				t.Fatalf("fields = %v", got)
+			}
+		})
+	}
+	if got := testutil.ToFloat64(counter) - before; got != 3 {
+		t.Fatalf("username_equals_email counted %v times", got)
+	}
+
+	id := ta.createUser(t, "bobby", "bob@x.io")
+	// PUT is held to the same rule.
+	rec := ta.do(t, http.MethodPut, "/users/"+strconv.Itoa(int(id)), `{"username":"bob","email":"bob@x.io"}`)
+	wantStatus(t, rec, http.StatusBadRequest)
+	if got := fieldCodes(t, rec); !slices.Equal(got, []string{"username:" + codeUsernameEqualsEmail}) {
+		t.Fatalf("PUT fields = %v", got)
+	}
+
+	// Off by default.
+	newTestApp(t, nil).createUser(t, "bob", "bob@x.io")
+}
@@ -0,0 +1,314 @@
+// webhookqueue.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Retry delays of the durable queue start at webhookBackoffBase and double
+// per failed attempt, up to webhookBackoffMax.
+const (
+	webhookBackoffBase = time.Second
+	webhookBackoffMax  = time.Hour
+)
+
+// webhookEnqueueBuffer is how many events wait for their insert before
+// UserCreated starts dropping them.
+const webhookEnqueueBuffer = 1000
+
+// webhookQueue is the Notifier for WEBHOOK_QUEUE=db: events are rows in
+// webhook_deliveries, so pending retries survive restarts and are shared by
+// replicas. Delivery is at least once; a crash between the receiver
+// accepting an event and the row being marked delivered sends it again.
+type webhookQueue struct {
+	db          *sql.DB
+	url         string
+	client      *http.Client
+	maxAttempts int
+	interval    time.Duration
+	slots       backgroundSlots
+	// enqueued holds events for the worker to insert; wake starts a
+	// delivery round early once one is stored.
+	enqueued chan queuedEvent
+	wake     chan struct{}
+}
+
+type queuedEvent struct {
+	typ     string
+	userID  int32
+	payload []byte
+}
+
+func newWebhookQueue(db *sql.DB, url string, timeout time.Duration, retries int, interval time.Duration, slots backgroundSlots) *webhookQueue {
+	return &webhookQueue{
+		db:          db,
+		url:         url,
+		client:      &http.Client{Timeout: timeout},
+		maxAttempts: retries + 1,
+		interval:    interval,
+		slots:       slots,
+		enqueued:    make(chan queuedEvent, webhookEnqueueBuffer),
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+// UserCreated hands the event to the worker, which inserts it, so the
+// request never waits on the database. After the user's own commit an event
+// is lost only if the buffer is full or the insert fails, both logged.
+func (q *webhookQueue) UserCreated(u User) {
+	payload, err := userCreatedPayload(u)
+	if err != nil {
+		slog.Error("webhook: encode event", "err", err)
+		return
+	}
+	select {
+	case q.enqueued <- queuedEvent{"user.created", u.ID, payload}:
+	default:
+		slog.Error("webhook: enqueue buffer full, dropping event", "type", "user.created", "user_id", u.ID)
+	}
+}
+
+// store inserts buffered events until ctx is done, then those still
+// buffered, which were accepted before shutdown. Inserts aren't cancelled
+// by ctx: each is bounded by the webhook timeout instead.
+func (q *webhookQueue) store(ctx context.Context) {
+	insertCtx := context.WithoutCancel(ctx)
+	for {
+		select {
+		case ev := <-q.enqueued:
+			q.insert(insertCtx, ev)
+		case <-ctx.Done():
+			for {
+				select {
+				case ev := <-q.enqueued:
+					q.insert(insertCtx, ev)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (q *webhookQueue) insert(ctx context.Context, ev queuedEvent) {
+	ctx, cancel := context.WithTimeout(ctx, q.client.Timeout)
+	defer cancel()
+	if _, err := q.db.ExecContext(ctx,
+		"INSERT INTO webhook_deliveries (event_type, payload) VALUES ($1, $2)",
+		ev.typ, ev.payload,
+	); err != nil {
+		slog.Error("webhook: enqueue failed", "type", ev.typ, "user_id", ev.userID, "err", err)
+		return
+	}
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *webhookQueue) run(ctx context.Context) {
+	var storing sync.WaitGroup
+	storing.Go(func() { q.store(ctx) })
+	defer storing.Wait()
+
+	t := time.NewTicker(q.interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		case <-q.wake:
+		}
+		for {
+			delivered, err := q.deliverOne(ctx)
+			if err != nil {
+				if ctx.Err() == nil {
+					slog.Warn("webhook: queue round failed", "err", err)
+				}
+				break
+			}
+			if !delivered {
+				break
+			}
+		}
+	}
+}
+
+// deliverOne claims the oldest due delivery and posts it, reporting whether
+// there was one. The claim pushes next_attempt_at past the attempt's
+// timeout, so other replicas skip the row while it is being posted and
+// pick it up again if this one dies mid-attempt.
+func (q *webhookQueue) deliverOne(ctx context.Context) (bool, error) {
+	if err := q.slots.acquire(ctx); err != nil {
+		return false, err
+	}
+	defer q.slots.release()
+
+	var (
+		id       int64
+		typ      string
+		payload  []byte
+		attempts int
+	)
+	lease := 2 * q.client.Timeout
+	err := q.db.QueryRowContext(ctx,
+		`UPDATE webhook_deliveries SET next_attempt_at = now() + make_interval(secs => $1)
+		  WHERE id = (SELECT id FROM webhook_deliveries
+		               WHERE status = 'pending' AND next_attempt_at <= now()
+		               ORDER BY next_attempt_at LIMIT 1 FOR UPDATE SKIP LOCKED)
+		  RETURNING id, event_type, payload, attempts`,
+		lease.Seconds(),
+	).Scan(&id, &typ, &payload, &attempts)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	postErr := postWebhook(ctx, q.client, q.url, payload)
+	if postErr != nil && ctx.Err() != nil {
+		// Shutting down: not the receiver's fault, so not an attempt. The
+		// lease runs out and the delivery is retried.
+		return false, ctx.Err()
+	}
+	attempts++
+
+	// Record the outcome even if shutdown begins now.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), q.client.Timeout)
+	defer cancel()
+	switch {
+	case postErr == nil:
+		_, err = q.db.ExecContext(ctx,
+			`UPDATE webhook_deliveries SET status = 'delivered', attempts = $2, delivered_at = now(), last_error = NULL
+			  WHERE id = $1`, id, attempts)
+	case attempts >= q.maxAttempts:
+		slog.Error("webhook: giving up", "url", q.url, "id", id, "type", typ, "attempts", attempts, "err", postErr)
+		_, err = q.db.ExecContext(ctx,
+			`UPDATE webhook_deliveries SET status = 'dead', attempts = $2, last_error = $3 WHERE id = $1`,
+			id, attempts, postErr.Error())
+	default:
+		wait := webhookBackoffMax
+		if attempts < 32 { // the shift would overflow long before that
+			wait = min(webhookBackoffBase<<(attempts-1), webhookBackoffMax)
+		}
+		slog.Warn("webhook: delivery failed, retrying", "url", q.url, "id", id, "attempt", attempts, "retry_in", wait, "err", postErr)
+		_, err = q.db.ExecContext(ctx,
+			`UPDATE webhook_deliveries SET attempts = $2, last_error = $3, next_attempt_at = now() + make_interval(secs => $4)
+			  WHERE id = $1`, id, attempts, postErr.Error(), wait.Seconds())
+	}
+	return true, err
+}
+
+type webhookDelivery struct {
+	ID            int64      `json:"id"`
+	Type          string     `json:"type"`
+	Status        string     `json:"status"`
+	Attempts      int        `json:"attempts"`
+	NextAttemptAt *time.Time `json:"next_attempt_at,omitempty"`
+	LastError     *string    `json:"last_error,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	DeliveredAt   *time.Time `json:"delivered_at,omitempty"`
+}
+
+// maxDeliveriesListed caps limit for /admin/webhooks/deliveries.
+const maxDeliveriesListed = 500
+
+// listWebhookDeliveries reports the durable queue: counts by status and the
+// newest deliveries, optionally only those with ?status=.
+func (a *App) listWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	if a.Deliveries == nil {
+		jsonWrite(w, http.StatusOK, map[string]any{"enabled": false})
+		return
+	}
+	status := r.URL.Query().Get("status")
+	switch status {
+	case "", "pending", "delivered", "dead":
+	default:
+		jsonWrite(w, http.StatusBadRequest, map[string]string{"error": "status must be pending, delivered or dead"})
+		return
+	}
+	limit := 50
+	if v := r.URL.Query().Get("limit"); v != "" {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 {
+			jsonWrite(w, http.StatusBadRequest, map[string]string{"error": "limit must be a positive integer"})
+			return
+		}
+	}
+	limit = min(limit, maxDeliveriesListed)
+
+	ctx, cancel := context.WithTimeout(r.Context(), a.Config.QueryTimeout)
+	defer cancel()
+
+	counts, err := a.Deliveries.counts(ctx)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	deliveries, err := a.Deliveries.list(ctx, status, limit)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	jsonWrite(w, http.StatusOK, map[string]any{"enabled": true, "counts": counts, "deliveries": deliveries})
+}
+
+func (q *webhookQueue) counts(ctx context.Context) (counts map[string]int64, err error) {
+	rows, err := q.db.QueryContext(ctx, "SELECT status, COUNT(*) FROM webhook_deliveries GROUP BY status")
+	if err != nil {
+		return nil, err
+	}
+	defer closeRows(rows, &err)
+
+	counts = map[string]int64{"pending": 0, "delivered": 0, "dead": 0}
+	for rows.Next() {
+		var status string
+		var n int64
+		if err := rows.Scan(&status, &n); err != nil {
+			return nil, err
+		}
+		counts[status] = n
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+func (q *webhookQueue) list(ctx context.Context, status string, limit int) (deliveries []webhookDelivery, err error) {
+	rows, err := q.db.QueryContext(ctx,
+		`SELECT id, event_type, status, attempts, next_attempt_at, last_error, created_at, delivered_at
+		   FROM webhook_deliveries WHERE $1 = '' OR status = $1
+		  ORDER BY id DESC LIMIT $2`, status, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer closeRows(rows, &err)
+
+	deliveries = make([]webhookDelivery, 0, limit)
+	for rows.Next() {
+		var d webhookDelivery
+		var next time.Time
+		if err := rows.Scan(&d.ID, &d.Type, &d.Status, &d.Attempts, &next, &d.LastError, &d.CreatedAt, &d.DeliveredAt); err != nil {
+			return nil, err
+		}
+		if d.Status == "pending" {
+			d.NextAttemptAt = &next
+		}
+		deliveries = append(deliveries, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
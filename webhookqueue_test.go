@@ -0,0 +1,244 @@
+// webhookqueue_test.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// queueConnector's connections hold one pending delivery, handed out by
+// the claim query with its attempts so far, and record every Exec.
+type queueConnector struct {
+	mu       sync.Mutex
+	pending  bool
+	attempts int64
+	execs    []string
+	args     [][]driver.NamedValue
+}
+
+func (c *queueConnector) Connect(context.Context) (driver.Conn, error) { return queueConn{c}, nil }
+func (*queueConnector) Driver() driver.Driver                          { return nil }
+
+type queueConn struct{ c *queueConnector }
+
+func (queueConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("stub: no statements") }
+func (queueConn) Close() error                        { return nil }
+func (queueConn) Begin() (driver.Tx, error)           { return nil, errors.New("stub: no transactions") }
+
+func (q queueConn) QueryContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Rows, error) {
+	q.c.mu.Lock()
+	defer q.c.mu.Unlock()
+	if !strings.Contains(query, "FOR UPDATE SKIP LOCKED") {
+		return nil, errors.New("stub: unexpected query")
+	}
+	rows := &claimRows{}
+	if q.c.pending {
+		q.c.pending = false
+		rows.row = []driver.Value{int64(7), "user.created", []byte(`{"type":"user.created"}`), q.c.attempts}
+	}
+	return rows, nil
+}
+
+func (q queueConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	q.c.mu.Lock()
+	defer q.c.mu.Unlock()
+	q.c.execs = append(q.c.execs, query)
+	q.c.args = append(q.c.args, args)
+	return driver.RowsAffected(1), nil
+}
+
+// claimRows is the claim query's result: row, or no rows when nil.
+type claimRows struct{ row []driver.Value }
+
+func (*claimRows) Columns() []string { return []string{"id", "event_type", "payload", "attempts"} }
+func (*claimRows) Close() error      { return nil }
+
+func (r *claimRows) Next(dest []driver.Value) error {
+	if r.row == nil {
+		return io.EOF
+	}
+	copy(dest, r.row)
+	r.row = nil
+	return nil
+}
+
+// statusServer is a webhook receiver answering status, counting posts.
+func statusServer(t *testing.T, status int) (*httptest.Server, *atomic.Int32) {
+	var posts atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		posts.Add(1)
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &posts
+}
+
+func TestWebhookQueueOutcomes(t *testing.T) {
+	failing, _ := statusServer(t, http.StatusBadGateway)
+	ok, _ := statusServer(t, http.StatusNoContent)
+	tests := []struct {
+		name     string
+		url      string
+		attempts int64
+		want     string
+		args     []any
+	}{
+		{"retried", failing.URL, 0, "next_attempt_at = now()", []any{int64(7), int64(1), "status 502", float64(1)}},
+		{"backs off", failing.URL, 2, "next_attempt_at = now()", []any{int64(7), int64(3), "status 502", float64(4)}},
+		{"dead-lettered", failing.URL, 3, "status = 'dead'", []any{int64(7), int64(4), "status 502"}},
+		{"delivered", ok.URL, 1, "status = 'delivered'", []any{int64(7), int64(2)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &queueConnector{pending: true, attempts: tt.attempts}
+			db := sql.OpenDB(c)
+			defer db.Close()
+			q := newWebhookQueue(db, tt.url, time.Second, 3, time.Hour, newBackgroundSlots(1))
+
+			delivered, err := q.deliverOne(context.Background())
+			if err != nil || !delivered {
+				t.Fatalf("deliverOne = %v, %v", delivered, err)
+			}
+			if len(c.execs) != 1 || !strings.Contains(c.execs[0], tt.want) {
+				t.Fatalf("execs = %q, want one containing %q", c.execs, tt.want)
+			}
+			var got []any
+			for _, a := range c.args[0] {
+				got = append(got, a.Value)
+			}
+			if len(got) != len(tt.args) {
+				t.Fatalf("args = %v, want %v", got, tt.args)
+			}
+			for i := range got {
+				if got[i] != tt.args[i] {
+					t.Fatalf("args = %v, want %v", got, tt.args)
+				}
+			}
+
+			if delivered, err := q.deliverOne(context.Background()); err != nil || delivered {
+				t.Fatalf("empty queue: deliverOne = %v, %v", delivered, err)
+			}
+		})
+	}
+}
+
+func TestWebhookQueueShutdownIsNotAnAttempt(t *testing.T) {
+	block := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-block
+	}))
+	t.Cleanup(srv.Close)
+	t.Cleanup(func() { close(block) })
+
+	c := &queueConnector{pending: true}
+	db := sql.OpenDB(c)
+	defer db.Close()
+	q := newWebhookQueue(db, srv.URL, 5*time.Second, 3, time.Hour, newBackgroundSlots(1))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := q.deliverOne(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("deliverOne = %v", err)
+	}
+	if len(c.execs) != 0 {
+		t.Fatalf("recorded an outcome on shutdown: %q", c.execs)
+	}
+}
+
+func TestWebhookQueueEnqueueDoesNotWait(t *testing.T) {
+	out := captureDefaultLog(t)
+	c := &queueConnector{}
+	db := sql.OpenDB(c)
+	defer db.Close()
+	q := newWebhookQueue(db, "http://127.0.0.1:1", time.Second, 3, time.Hour, newBackgroundSlots(1))
+
+	// No worker is running: UserCreated only buffers, and drops the event
+	// once the buffer is full.
+	for i := range webhookEnqueueBuffer + 1 {
+		q.UserCreated(User{ID: int32(i + 1), Username: "ann", Email: "ann@example.com"})
+	}
+	if len(c.execs) != 0 {
+		t.Fatalf("UserCreated wrote to the database: %q", c.execs)
+	}
+	if !strings.Contains(out.String(), "enqueue buffer full") {
+		t.Fatalf("log = %s", out)
+	}
+
+	// A worker stopped by shutdown still stores what was buffered.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	q.store(ctx)
+	if len(c.execs) != webhookEnqueueBuffer || !strings.Contains(c.execs[0], "INSERT INTO webhook_deliveries") {
+		t.Fatalf("stored %d events, want %d", len(c.execs), webhookEnqueueBuffer)
+	}
+	if typ := c.args[0][0].Value; typ != "user.created" {
+		t.Fatalf("event_type = %v", typ)
+	}
+}
+
+func TestWebhookDeliveriesDisabled(t *testing.T) {
+	ta := newTestApp(t, map[string]string{"ADMIN_TOKEN": "secret"})
+	wantStatus(t, ta.do(t, http.MethodGet, "/admin/webhooks/deliveries", ""), http.StatusUnauthorized)
+	rec := ta.do(t, http.MethodGet, "/admin/webhooks/deliveries", "", adminAuth...)
+	wantStatus(t, rec, http.StatusOK)
+	if jsonBody(t, rec)["enabled"] != false {
+		t.Fatalf("body = %s", rec.Body)
+	}
+}
+
+// TestWebhookQueuePostgres runs the queue against a session-local
+// webhook_deliveries table, which its unqualified table name resolves to.
+func TestWebhookQueuePostgres(t *testing.T) {
+	db := testDB(t)
+	db.SetMaxOpenConns(1)
+	ctx := context.Background()
+	if _, err := db.ExecContext(ctx, "CREATE TEMP TABLE webhook_deliveries (LIKE public.webhook_deliveries INCLUDING ALL)"); err != nil {
+		t.Fatal(err)
+	}
+	srv, posts := statusServer(t, http.StatusInternalServerError)
+	q := newWebhookQueue(db, srv.URL, time.Second, 2, time.Hour, newBackgroundSlots(1))
+	ta := newTestApp(t, map[string]string{"ADMIN_TOKEN": "secret"})
+	ta.Deliveries, ta.Users.notifier = q, q
+
+	ta.createUser(t, "ann", "ann@example.com")
+	q.insert(ctx, <-q.enqueued)
+	for range 3 {
+		// Skip the backoff: make the row due again.
+		if _, err := db.ExecContext(ctx, "UPDATE webhook_deliveries SET next_attempt_at = now()"); err != nil {
+			t.Fatal(err)
+		}
+		if delivered, err := q.deliverOne(ctx); err != nil || !delivered {
+			t.Fatalf("deliverOne = %v, %v", delivered, err)
+		}
+	}
+	if n := posts.Load(); n != 3 {
+		t.Fatalf("receiver got %d posts, want 3", n)
+	}
+	if delivered, err := q.deliverOne(ctx); err != nil || delivered {
+		t.Fatalf("dead delivery claimed again: %v, %v", delivered, err)
+	}
+
+	rec := ta.do(t, http.MethodGet, "/admin/webhooks/deliveries?status=dead", "", adminAuth...)
+	wantStatus(t, rec, http.StatusOK)
+	body := jsonBody(t, rec)
+	if counts := body["counts"].(map[string]any); counts["dead"] != float64(1) || counts["pending"] != float64(0) {
+		t.Fatalf("counts = %v", counts)
+	}
+	deliveries := body["deliveries"].([]any)
+	if len(deliveries) != 1 {
+		t.Fatalf("deliveries = %v", deliveries)
+	}
+	if d := deliveries[0].(map[string]any); d["attempts"] != float64(3) || d["last_error"] != "status 500" {
+		t.Fatalf("delivery = %v", d)
+	}
+	wantStatus(t, ta.do(t, http.MethodGet, "/admin/webhooks/deliveries?status=lost", "", adminAuth...), http.StatusBadRequest)
+}